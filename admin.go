@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"simplehttproulette/roulette"
+)
+
+const adminUsage = `usage: %[1]s admin password
+       %[1]s admin token create [flags] NAME
+       %[1]s admin token list [flags]
+       %[1]s admin token revoke [flags] ID
+       %[1]s admin apikey create [flags] [--quota N] NAME
+       %[1]s admin apikey list [flags]
+       %[1]s admin apikey revoke [flags] ID`
+
+// runAdmin manages credentials: the web UI password hash, the admin API
+// tokens and the public API keys.
+func runAdmin(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf(adminUsage, os.Args[0])
+	}
+	switch args[0] {
+	case "password":
+		return runAdminPassword()
+	case "token":
+		if len(args) < 2 {
+			return fmt.Errorf(adminUsage, os.Args[0])
+		}
+		return runAdminToken(args[1], args[2:])
+	case "apikey":
+		if len(args) < 2 {
+			return fmt.Errorf(adminUsage, os.Args[0])
+		}
+		return runAdminAPIKey(args[1], args[2:])
+	}
+	return fmt.Errorf(adminUsage, os.Args[0])
+}
+
+// runAdminPassword reads a password from stdin and prints its hash for
+// admin_password_hash.
+func runAdminPassword() error {
+	fmt.Fprint(os.Stderr, "New admin password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("failed to read password: %v", err)
+	}
+	hash, err := roulette.HashPassword(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "Add this to the config file as admin_password_hash:")
+	fmt.Println(hash)
+	return nil
+}
+
+func runAdminToken(action string, args []string) error {
+	fs := flag.NewFlagSet("admin token "+action, flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	fs.Parse(args)
+
+	c, err := storage.config()
+	if err != nil {
+		return err
+	}
+	path := c.DataPath(c.TokensFile)
+
+	switch action {
+	case "create":
+		if fs.NArg() != 1 {
+			return fmt.Errorf(adminUsage, os.Args[0])
+		}
+		secret, token, err := roulette.CreateAPIToken(path, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created token %s (%s). It won't be shown again:\n", token.ID, token.Name)
+		fmt.Println(secret)
+		return nil
+	case "list":
+		tokens, err := roulette.ReadAPITokens(path)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tCREATED")
+		for _, t := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", t.ID, t.Name, t.Created.Format("2006-01-02 15:04"))
+		}
+		return w.Flush()
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf(adminUsage, os.Args[0])
+		}
+		if err := roulette.RevokeAPIToken(path, fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked token %s\n", fs.Arg(0))
+		return nil
+	}
+	return fmt.Errorf(adminUsage, os.Args[0])
+}
+
+// runAdminAPIKey manages public API keys. They live in the database, next
+// to their usage counters.
+func runAdminAPIKey(action string, args []string) error {
+	fs := flag.NewFlagSet("admin apikey "+action, flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	quota := fs.Int("quota", roulette.DefaultAPIQuota, "requests allowed per UTC day")
+	fs.Parse(args)
+
+	rl, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	switch action {
+	case "create":
+		if fs.NArg() != 1 {
+			return fmt.Errorf(adminUsage, os.Args[0])
+		}
+		secret, key, err := rl.CreateAPIKey(fs.Arg(0), *quota)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created API key %s (%s, %d requests a day). It won't be shown again:\n", key.ID, key.Name, key.DailyQuota)
+		fmt.Println(secret)
+		return nil
+	case "list":
+		keys, err := rl.APIKeys()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tQUOTA\tUSED TODAY\tCREATED\tSTATUS")
+		for _, k := range keys {
+			used, err := rl.APIKeyUse(k.ID)
+			if err != nil {
+				return err
+			}
+			status := "active"
+			if k.Revoked {
+				status = "revoked"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", k.ID, k.Name, k.DailyQuota, used, k.Created.Format("2006-01-02 15:04"), status)
+		}
+		return w.Flush()
+	case "revoke":
+		if fs.NArg() != 1 {
+			return fmt.Errorf(adminUsage, os.Args[0])
+		}
+		if err := rl.RevokeAPIKey(fs.Arg(0)); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %s\n", fs.Arg(0))
+		return nil
+	}
+	return fmt.Errorf(adminUsage, os.Args[0])
+}
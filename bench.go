@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// benchResult is the outcome of one request made by bench.
+type benchResult struct {
+	latency time.Duration
+	status  int // 0 when the request failed
+}
+
+// runBench loads a running instance with requests at a steady rate and
+// reports latency percentiles, so a slower build shows up before release.
+// Redirects aren't followed, the sites they lead to aren't being measured.
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("url", "http://localhost:8080/shuffle", "URL to load")
+	rps := fs.Int("rps", 100, "requests per second to send")
+	duration := fs.Duration("duration", 10*time.Second, "how long to send for")
+	concurrency := fs.Int("concurrency", 64, "most requests in flight at once")
+	timeout := fs.Duration("timeout", 5*time.Second, "per-request timeout")
+	consent := fs.Bool("consent", true, "send the consent cookie, so the warning page is skipped")
+	fs.Parse(args)
+	if *rps <= 0 || *concurrency <= 0 || *duration <= 0 {
+		return fmt.Errorf("-rps, -concurrency and -duration must be positive")
+	}
+
+	client := &http.Client{
+		Timeout: *timeout,
+		Transport: &http.Transport{
+			MaxIdleConns:        *concurrency,
+			MaxIdleConnsPerHost: *concurrency,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest(http.MethodGet, *target, nil)
+	if err != nil {
+		return fmt.Errorf("invalid -url: %v", err)
+	}
+	if *consent {
+		req.AddCookie(&http.Cookie{Name: "roulette_consent", Value: "1"})
+	}
+
+	var mu sync.Mutex
+	var results []benchResult
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, *concurrency)
+	skipped := 0
+	fmt.Fprintf(os.Stderr, "Sending %d requests/s to %s for %s\n", *rps, *target, *duration)
+
+	tick := time.NewTicker(time.Second / time.Duration(*rps))
+	defer tick.Stop()
+	deadline := time.Now().Add(*duration)
+	for now := range tick.C {
+		if now.After(deadline) {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			// Every slot is busy: the server can't keep up with the rate
+			skipped++
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			start := time.Now()
+			r := benchResult{}
+			if resp, err := client.Do(req.Clone(req.Context())); err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				r.status = resp.StatusCode
+			}
+			r.latency = time.Since(start)
+			mu.Lock()
+			results = append(results, r)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	printBench(os.Stdout, results, skipped, *duration)
+	return nil
+}
+
+// printBench writes the summary of a bench run to w.
+func printBench(w io.Writer, results []benchResult, skipped int, duration time.Duration) {
+	if len(results) == 0 {
+		fmt.Fprintln(w, "No requests were sent")
+		return
+	}
+	statuses := make(map[int]int)
+	latencies := make([]time.Duration, len(results))
+	for i, r := range results {
+		statuses[r.status]++
+		latencies[i] = r.latency
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	fmt.Fprintf(w, "Requests:  %d (%.1f/s)", len(results), float64(len(results))/duration.Seconds())
+	if skipped > 0 {
+		fmt.Fprintf(w, ", %d not sent, too many in flight", skipped)
+	}
+	fmt.Fprintln(w)
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		if code == 0 {
+			fmt.Fprintf(w, "  failed:  %d\n", statuses[code])
+		} else {
+			fmt.Fprintf(w, "  %d:     %d\n", code, statuses[code])
+		}
+	}
+	fmt.Fprintf(w, "Latency:   p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(0.50).Round(time.Microsecond), percentile(0.90).Round(time.Microsecond),
+		percentile(0.99).Round(time.Microsecond), latencies[len(latencies)-1].Round(time.Microsecond))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"simplehttproulette/roulette"
+)
+
+// command is a subcommand of the roulette binary.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "start the web server (default)", runServe},
+		{"refresh", "fetch fresh URLs from Shodan once and sync the database", runRefresh},
+		{"import", "merge URLs from files (or - for stdin) into the URL list", runImport},
+		{"probe", "check every site and record whether it is up", runProbe},
+		{"export", "write the site list as text or JSON", runExport},
+		{"spin", "print or open random sites, from a running server or the local database", runSpin},
+		{"db", "database maintenance (db migrate)", runDB},
+		{"admin", "manage admin credentials (admin password, admin token create|list|revoke)", runAdmin},
+		{"healthcheck", "exit non-zero unless a running server reports healthy", runHealthcheck},
+		{"bench", "load a running server and report latency percentiles", runBench},
+		{"mock-shodan", "serve a fake Shodan API to refresh from", runMockShodan},
+		{"seed", "fill the pool with fake sites for development (seed --fake N)", runSeed},
+		{"service", "manage the Windows service (service install|uninstall|run)", runService},
+		{"version", "print version information", runVersion},
+		{"help", "show this help", runHelp},
+	}
+}
+
+// run dispatches to the subcommand named by args[0].
+func run(args []string) error {
+	// Keep the old flag-only invocation working by treating it as serve
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	printUsage(os.Stderr)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+func runVersion(args []string) error {
+	fmt.Printf("Simple HTTP Roulette %s\n", roulette.GetBuildInfo())
+	return nil
+}
+
+func runHelp(args []string) error {
+	printUsage(os.Stdout)
+	return nil
+}
+
+// storageOptions are the flags every command uses to find its data.
+type storageOptions struct {
+	ConfigPath   string
+	DataDir      string
+	DBPath       string
+	URLsFile     string
+	TemplatesDir string
+	Demo         bool
+	Profile      string
+
+	fs *flag.FlagSet
+}
+
+func (o *storageOptions) register(fs *flag.FlagSet) {
+	defaults := roulette.DefaultConfig()
+	o.fs = fs
+	o.TemplatesDir = defaults.TemplatesDir
+	fs.StringVar(&o.ConfigPath, "config", "", "JSON config file (reloaded on SIGHUP)")
+	fs.StringVar(&o.DataDir, "data-dir", "", "directory relative data paths are resolved against (default the working directory)")
+	fs.StringVar(&o.DBPath, "db", defaults.DBPath, "SQLite database path, or "+roulette.MemoryStorePath+" for storage without SQLite")
+	fs.StringVar(&o.URLsFile, "urls", defaults.URLsFile, "URL list file")
+	fs.BoolVar(&o.Demo, "demo", false, "serve the built-in sample list offline, without Shodan or probes")
+	fs.StringVar(&o.Profile, "profile", "", "settings profile: "+strings.Join(roulette.Profiles(), ", ")+" (default the config's profile, else "+roulette.DefaultProfile+")")
+}
+
+// config loads the config file and overrides it with any flags given on
+// the command line.
+func (o *storageOptions) config() (*roulette.Config, error) {
+	c, err := roulette.LoadConfigProfile(o.ConfigPath, o.Profile)
+	if err != nil {
+		return nil, err
+	}
+	o.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "data-dir":
+			c.DataDir = o.DataDir
+		case "urls":
+			c.URLsFile = o.URLsFile
+		case "db":
+			c.DBPath = o.DBPath
+		case "templates":
+			c.TemplatesDir = o.TemplatesDir
+		case "demo":
+			c.Demo = o.Demo
+		}
+	})
+	return c, nil
+}
+
+// open builds the roulette from the config and flags, syncing the pool
+// from the URL list.
+func (o *storageOptions) open() (*roulette.Roulette, error) {
+	c, err := o.config()
+	if err != nil {
+		return nil, err
+	}
+	return roulette.New(c)
+}
+
+// dataPath resolves name against the data directory. Before the config
+// file exists (during first-run setup) only --data-dir is considered.
+func (o *storageOptions) dataPath(name string) string {
+	if c, err := o.config(); err == nil {
+		return c.DataPath(name)
+	}
+	return (&roulette.Config{DataDir: o.DataDir}).DataPath(name)
+}
+
+// needsSetup reports whether this looks like a first run: no config file,
+// URL list, or database on disk.
+func (o *storageOptions) needsSetup() bool {
+	if o.Demo {
+		return false
+	}
+	if o.ConfigPath != "" && fileExists(o.ConfigPath) {
+		return false
+	}
+	if fileExists(o.dataPath(o.URLsFile)) {
+		return false
+	}
+	return o.DBPath == roulette.MemoryDB || o.DBPath == roulette.MemoryStorePath || !fileExists(o.dataPath(o.DBPath))
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// commandContext returns a context cancelled on SIGINT/SIGTERM.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+func runRefresh(args []string) error {
+	fs := flag.NewFlagSet("refresh", flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	fs.Parse(args)
+
+	rl, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	if !rl.HasShodanAPIKey() {
+		return fmt.Errorf("no Shodan API key: set SHODAN_API_KEY or SHODAN_API_KEY_FILE, or shodan_api_key or shodan_api_key_file in the config")
+	}
+
+	ctx, stop := commandContext()
+	defer stop()
+	return rl.Refresh(ctx)
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import [flags] FILE... (use - for stdin)\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no input files given")
+	}
+
+	var urls []string
+	for _, name := range fs.Args() {
+		var found []string
+		var err error
+		if name == "-" {
+			found, err = roulette.ReadURLs(os.Stdin)
+		} else {
+			found, err = roulette.ReadURLsFile(name)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		urls = append(urls, found...)
+	}
+
+	rl, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	added, err := rl.Import(urls)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d new URLs into %s\n", added, rl.Config().URLsFile)
+	return nil
+}
+
+func runProbe(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	workers := fs.Int("workers", 0, "number of concurrent probes (default from the profile)")
+	prune := fs.Bool("prune", false, "remove sites that are down from the URL list")
+	fs.Parse(args)
+
+	rl, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	ctx, stop := commandContext()
+	defer stop()
+	up, down, err := rl.Probe(ctx, *workers)
+	if err != nil {
+		return fmt.Errorf("probe failed: %v", err)
+	}
+	fmt.Printf("Probed %d sites: %d up, %d down\n", up+down, up, down)
+
+	if !*prune {
+		return nil
+	}
+	pruned, err := rl.PruneDown()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pruned %d dead sites from %s\n", pruned, rl.Config().URLsFile)
+	return nil
+}
+
+// exportedSite is the JSON shape written by the export command.
+type exportedSite struct {
+	URL         string `json:"url"`
+	Status      string `json:"status"`
+	LastChecked string `json:"last_checked,omitempty"`
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	format := fs.String("format", "text", "output format: text or json")
+	status := fs.String("status", "", "only export sites with this status (up, down, unknown)")
+	out := fs.String("out", "-", "output file, relative to the data directory, or - for stdout")
+	fs.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	rl, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	list, err := rl.Store().List(roulette.SiteFilter{Status: *status})
+	if err != nil {
+		return err
+	}
+	sites := []exportedSite{}
+	for _, site := range list {
+		exported := exportedSite{URL: site.URL, Status: site.Status}
+		if !site.LastChecked.IsZero() {
+			exported.LastChecked = site.LastChecked.UTC().Format(time.RFC3339)
+		}
+		sites = append(sites, exported)
+	}
+
+	w := os.Stdout
+	if *out != "-" {
+		path := rl.Config().DataPath(*out)
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", path, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	buf := bufio.NewWriter(w)
+	if *format == "json" {
+		enc := json.NewEncoder(buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(sites); err != nil {
+			return fmt.Errorf("failed to encode JSON: %v", err)
+		}
+	} else {
+		for _, site := range sites {
+			fmt.Fprintln(buf, site.URL)
+		}
+	}
+	return buf.Flush()
+}
+
+func runDB(args []string) error {
+	if len(args) == 0 || args[0] != "migrate" {
+		return fmt.Errorf("usage: %s db migrate [--db path]", os.Args[0])
+	}
+	fs := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	dbPath := fs.String("db", roulette.MemoryDB, "SQLite database path")
+	fs.Parse(args[1:])
+
+	version, err := roulette.MigrateSQLite(*dbPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Database schema is at version %d\n", version)
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+
+	"simplehttproulette/roulette"
+)
+
+// serveDebug serves the runtime diagnostics on their own listener at addr,
+// away from the public site: pprof under /debug/pprof/ and the expvar
+// variables under /debug/vars, both for admins only.
+func serveDebug(addr string, rl *roulette.Roulette) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", rl.DebugVars())
+
+	ln, err := listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: rl.RequireAdmin(mux), MaxHeaderBytes: roulette.MaxHeaderBytes}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			slog.Error("Debug listener stopped", "err", err)
+		}
+	}()
+	slog.Info("Serving diagnostics", "url", displayAddr(ln, false)+"/debug/")
+	return server, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// runHealthcheck asks a running server for its health, exiting non-zero
+// when it's unhealthy. It is meant for Docker's HEALTHCHECK.
+func runHealthcheck(args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	listenAddr := fs.String("listen", "", "address the server listens on, as given to serve (default $PORT or "+defaultListenAddr+")")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for an answer")
+	fs.Parse(args)
+
+	addr := resolveListenAddr(*listenAddr)
+	client := &http.Client{Timeout: *timeout}
+	target := "http://localhost/healthz"
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	} else {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid listen address %q: %v", addr, err)
+		}
+		if host == "" || net.ParseIP(host) != nil && net.ParseIP(host).IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		target = "http://" + net.JoinHostPort(host, port) + "/healthz"
+	}
+
+	start := time.Now()
+	resp, err := client.Get(target)
+	if err != nil {
+		return fmt.Errorf("health check failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unhealthy (%s): %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("healthy (%s)\n", time.Since(start).Round(time.Millisecond))
+	return nil
+}
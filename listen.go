@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultListenAddr is used when neither --listen nor PORT is set.
+const defaultListenAddr = ":8080"
+
+// unixPrefix marks a listen address as a unix domain socket path.
+const unixPrefix = "unix:"
+
+// systemdPrefix marks a listen address as a socket inherited through
+// systemd socket activation, optionally followed by the socket's
+// FileDescriptorName= to pick one of several.
+const systemdPrefix = "systemd:"
+
+// resolveListenAddr picks the listen address: the --listen flag wins, then
+// a socket passed in by systemd, then the PORT environment variable, then
+// the default.
+func resolveListenAddr(flagValue string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if socketActivated() {
+		return systemdPrefix
+	}
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return defaultListenAddr
+}
+
+// listen opens a listener for addr. Addresses of the form "unix:/path" bind a
+// unix domain socket, "systemd:" and "systemd:NAME" use an inherited socket,
+// anything else is treated as a TCP host:port.
+func listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, systemdPrefix) {
+		return activatedListener(strings.TrimPrefix(addr, systemdPrefix))
+	}
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		// Remove a stale socket left behind by a previous run
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on unix socket %s: %v", path, err)
+		}
+		return ln, nil
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return ln, nil
+}
+
+// displayAddr describes the effective address of ln for the startup message.
+func displayAddr(ln net.Listener, https bool) string {
+	if ln.Addr().Network() == "unix" {
+		return unixPrefix + ln.Addr().String()
+	}
+
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		return ln.Addr().String()
+	}
+	// Wildcard binds are reachable on localhost, so show that like before
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+	scheme := "http://"
+	if https {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, port)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"simplehttproulette/roulette"
+)
+
+// runMockShodan serves a fake Shodan API to point shodan_api_url at.
+func runMockShodan(args []string) error {
+	fs := flag.NewFlagSet("mock-shodan", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8090", "address to serve the mock on")
+	results := fs.Int("results", 1000, "number of results the mock returns")
+	rps := fs.Float64("rps", 1, "requests per second it takes before answering 429, 0 for no limit")
+	fs.Parse(args)
+
+	m := roulette.NewMockShodan(*results)
+	m.RPS = *rps
+	fmt.Fprintf(os.Stderr, "Serving a mock Shodan API with %d results on http://%s, set shodan_api_url to it\n", *results, *listen)
+	return http.ListenAndServe(*listen, m)
+}
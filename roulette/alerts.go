@@ -0,0 +1,310 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const alertJob = "alerts"
+const alertSendTimeout = 10 * time.Second // Per notification sent
+
+// Alert metrics. A pool or probe success rule fires while the value is
+// below its threshold, a job failures rule once it reaches it.
+const (
+	AlertPoolSize     = "pool_size"     // Sites in the pool
+	AlertJobFailures  = "job_failures"  // Failed runs in a row of the rule's job, as seen by this instance
+	AlertProbeSuccess = "probe_success" // Percentage of probed sites found up
+)
+
+// AlertsConfig checks alert rules on a schedule and notifies the operator
+// when one starts or stops firing, so problems surface without watching
+// the logs. Notifications go to every channel configured.
+type AlertsConfig struct {
+	// Interval is how often the rules are checked
+	Interval Duration `json:"interval"`
+	// Rules are the conditions to alert on, none turns alerting off
+	Rules []AlertRule `json:"rules"`
+	// Webhook is POSTed a JSON Notification
+	Webhook string `json:"webhook,omitempty"`
+	// Discord is a Discord channel's webhook URL
+	Discord string `json:"discord,omitempty"`
+	// Email sends notifications over SMTP
+	Email AlertEmail `json:"email"`
+}
+
+// AlertRule is one condition to alert on.
+type AlertRule struct {
+	// Name identifies the rule in notifications, by default its condition
+	Name string `json:"name,omitempty"`
+	// Metric is AlertPoolSize, AlertJobFailures or AlertProbeSuccess
+	Metric string `json:"metric"`
+	// Job is the job AlertJobFailures counts, by default refresh
+	Job string `json:"job,omitempty"`
+	// Threshold is the value the rule fires at, see the metrics
+	Threshold float64 `json:"threshold"`
+}
+
+func (r AlertRule) job() string {
+	if r.Job == "" {
+		return refreshLease
+	}
+	return r.Job
+}
+
+func (r AlertRule) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	switch r.Metric {
+	case AlertPoolSize:
+		return fmt.Sprintf("pool size below %g", r.Threshold)
+	case AlertJobFailures:
+		return fmt.Sprintf("%s failed %g times in a row", r.job(), r.Threshold)
+	default:
+		return fmt.Sprintf("probe success below %g%%", r.Threshold)
+	}
+}
+
+// firing reports whether value trips r.
+func (r AlertRule) firing(value float64) bool {
+	if r.Metric == AlertJobFailures {
+		return value >= r.Threshold
+	}
+	return value < r.Threshold
+}
+
+// AlertEmail is the SMTP server and addresses alert mails use.
+type AlertEmail struct {
+	// SMTP is the server's host:port, empty turns email off
+	SMTP string `json:"smtp,omitempty"`
+	// Username and Password log in to the server, if it wants that
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to"`
+}
+
+func (a AlertsConfig) validate() error {
+	if a.Interval <= 0 {
+		return fmt.Errorf("alerts.interval must be positive")
+	}
+	for _, r := range a.Rules {
+		switch r.Metric {
+		case AlertPoolSize, AlertProbeSuccess:
+		case AlertJobFailures:
+			if r.Threshold < 1 {
+				return fmt.Errorf("alerts rule %q: threshold must be at least 1", r.name())
+			}
+		default:
+			return fmt.Errorf("alerts rule metric must be %q, %q or %q", AlertPoolSize, AlertJobFailures, AlertProbeSuccess)
+		}
+	}
+	return a.Email.validate("alerts.email")
+}
+
+// validate checks e, which is configured as name.
+func (e AlertEmail) validate(name string) error {
+	if e.SMTP == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(e.SMTP); err != nil {
+		return fmt.Errorf("%s.smtp must be host:port", name)
+	}
+	if e.From == "" || len(e.To) == 0 {
+		return fmt.Errorf("%s needs from and to addresses", name)
+	}
+	return nil
+}
+
+// Notification is what the webhook is sent when a rule starts or stops
+// firing.
+type Notification struct {
+	Rule      string    `json:"rule"`
+	Metric    string    `json:"metric"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Firing    bool      `json:"firing"` // False once it's resolved
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// alertState remembers which rules are firing, so each change is notified
+// once.
+type alertState struct {
+	mu     sync.Mutex
+	firing map[string]bool // By rule name
+}
+
+// startAlerts checks the alert rules every Interval until ctx is
+// cancelled.
+func (rl *Roulette) startAlerts(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(rl.Config().Alerts.Interval)):
+			}
+			if len(rl.Config().Alerts.Rules) > 0 {
+				rl.timed(alertJob, rl.checkAlerts)(ctx)
+			}
+		}
+	}()
+}
+
+// checkAlerts evaluates every rule and notifies the ones that changed.
+func (rl *Roulette) checkAlerts(ctx context.Context) error {
+	c := rl.Config().Alerts
+	var errs []string
+	for _, rule := range c.Rules {
+		value, ok, err := rl.alertValue(rule)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", rule.name(), err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		firing := rule.firing(value)
+		if !rl.alerts.change(rule.name(), firing) {
+			continue
+		}
+		n := Notification{Rule: rule.name(), Metric: rule.Metric, Value: value, Threshold: rule.Threshold, Firing: firing, Time: time.Now().UTC()}
+		if firing {
+			n.Message = fmt.Sprintf("Alert: %s (%s is %g)", n.Rule, rule.Metric, value)
+			appLog.Warn(n.Message)
+		} else {
+			n.Message = fmt.Sprintf("Resolved: %s (%s is %g)", n.Rule, rule.Metric, value)
+			appLog.Info(n.Message)
+		}
+		if err := rl.notify(ctx, c, n); err != nil {
+			errs = append(errs, err.Error())
+			// Try again on the next check
+			rl.alerts.change(rule.name(), !firing)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// change records whether the rule called name is firing and reports
+// whether that's news. Rules start out not firing.
+func (a *alertState) change(name string, firing bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.firing == nil {
+		a.firing = make(map[string]bool)
+	}
+	if a.firing[name] == firing {
+		return false
+	}
+	a.firing[name] = firing
+	return true
+}
+
+// alertValue returns the current value of rule's metric, or false if
+// there's nothing to go by yet.
+func (rl *Roulette) alertValue(rule AlertRule) (float64, bool, error) {
+	switch rule.Metric {
+	case AlertPoolSize:
+		sites, err := rl.store.List(SiteFilter{})
+		if err != nil {
+			return 0, false, err
+		}
+		return float64(len(sites)), true, nil
+	case AlertJobFailures:
+		recent := rl.JobStatus(rule.job()).Recent
+		if len(recent) == 0 {
+			return 0, false, nil
+		}
+		failed := 0
+		for i := len(recent) - 1; i >= 0 && recent[i].Error != ""; i-- {
+			failed++
+		}
+		return float64(failed), true, nil
+	default:
+		sites, err := rl.store.List(SiteFilter{})
+		if err != nil {
+			return 0, false, err
+		}
+		up, checked := 0, 0
+		for _, s := range sites {
+			if s.LastChecked.IsZero() {
+				continue
+			}
+			checked++
+			if s.Status == StatusUp {
+				up++
+			}
+		}
+		if checked == 0 {
+			return 0, false, nil
+		}
+		return 100 * float64(up) / float64(checked), true, nil
+	}
+}
+
+// notify sends n to every channel in c, returning the failures.
+func (rl *Roulette) notify(ctx context.Context, c AlertsConfig, n Notification) error {
+	ctx, cancel := context.WithTimeout(ctx, alertSendTimeout)
+	defer cancel()
+	var errs []string
+	if c.Webhook != "" {
+		if err := postJSON(ctx, c.Webhook, n); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook: %v", err))
+		}
+	}
+	if c.Discord != "" {
+		if err := postJSON(ctx, c.Discord, map[string]string{"content": n.Message}); err != nil {
+			errs = append(errs, fmt.Sprintf("discord: %v", err))
+		}
+	}
+	if c.Email.SMTP != "" {
+		if err := sendMail(c.Email, n.Message, "text/plain", n.Message); err != nil {
+			errs = append(errs, fmt.Sprintf("email: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to send notification: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func postJSON(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	var uerr *neturl.Error
+	if errors.As(err, &uerr) {
+		// Webhook URLs are secrets, keep them out of the error
+		return uerr.Err
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
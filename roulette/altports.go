@@ -0,0 +1,132 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	neturl "net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const derivedListFile = "derived.txt" // Under DataDir, the listings alt ports found
+const derivedTag = "derived"          // Tags the sites found on alt ports
+
+// AltPortsConfig looks for more listings on the hosts Shodan finds, on
+// ports it didn't report, after each refresh. They're kept in their own
+// list under DataDir and tagged derived.
+type AltPortsConfig struct {
+	// Enabled probes the ports of every host a refresh finds
+	Enabled bool `json:"enabled"`
+	// Ports are the ports tried on each host
+	Ports []int `json:"ports"`
+	// Timeout bounds each port's probe
+	Timeout Duration `json:"timeout"`
+}
+
+func (c AltPortsConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Ports) == 0 {
+		return fmt.Errorf("alt_ports.ports must not be empty")
+	}
+	for _, p := range c.Ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("alt_ports port %d is out of range", p)
+		}
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("alt_ports.timeout must be positive")
+	}
+	return nil
+}
+
+// derivedListPath is where the listings alt ports found are kept.
+func (c *Config) derivedListPath() string {
+	return c.DataPath(derivedListFile)
+}
+
+// probeAltPorts tries the alt ports on every host of urls, the result of a
+// refresh, and returns the URLs of the further listings found, in order.
+// Ports urls already has for a host aren't tried again.
+func (rl *Roulette) probeAltPorts(ctx context.Context, urls []string) []string {
+	c := rl.Config()
+	known := make(map[string]bool, len(urls))
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, url := range urls {
+		known[url] = true
+		u, err := neturl.Parse(url)
+		if err != nil {
+			continue
+		}
+		if host := u.Hostname(); !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	var candidates []string
+	for _, host := range hosts {
+		for _, port := range c.AltPorts.Ports {
+			url := "http://" + net.JoinHostPort(host, strconv.Itoa(port))
+			if !known[url] {
+				known[url] = true
+				candidates = append(candidates, url)
+			}
+		}
+	}
+	shodanLog.Info("Probing alt ports", "hosts", len(hosts), "urls", len(candidates))
+
+	client := rl.siteClient(time.Duration(c.AltPorts.Timeout))
+	agent := c.Outbound.robotsName()
+	found := make([]bool, len(candidates))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < c.Probe.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				// Only listings count, not whatever else answers on the port
+				result := probeSite(ctx, client, candidates[j], agent)
+				found[j] = result.Status == StatusUp && bytes.Contains(result.Body, []byte("Directory listing for"))
+			}
+		}()
+	}
+	for j := range candidates {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- j
+	}
+	close(queue)
+	wg.Wait()
+	var derived []string
+	for j, ok := range found {
+		if ok {
+			derived = append(derived, candidates[j])
+		}
+	}
+	shodanLog.Info("Found listings on alt ports", "urls", len(derived))
+	return derived
+}
+
+// updateDerivedList replaces the derived list with the listings found on
+// the alt ports of urls, the URL list a refresh wrote, if alt ports are on.
+func (rl *Roulette) updateDerivedList(ctx context.Context, urls []string) error {
+	c := rl.Config()
+	if !c.AltPorts.Enabled {
+		return nil
+	}
+	derived := rl.probeAltPorts(ctx, urls)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := WriteURLsFile(c.derivedListPath(), derived); err != nil {
+		return fmt.Errorf("error writing derived URLs to file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package roulette
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const analyticsHourFormat = "2006-01-02T15" // UTC hour spins are counted in
+const analyticsHours = 48                   // Hours of spins shown on /stats
+const analyticsDays = 30                    // Days the country distribution covers
+
+// AnalyticsConfig publishes aggregate usage on /stats. Only counters are
+// stored, spins per hour and country of the site served, never anything
+// about the visitor.
+type AnalyticsConfig struct {
+	// Enabled counts spins and serves /stats
+	Enabled bool `json:"enabled"`
+}
+
+// SpinCount is how many spins served a site in one country in one hour.
+type SpinCount struct {
+	Hour    string // UTC, as analyticsHourFormat
+	Country string // Empty if unknown
+	Count   int
+}
+
+// AnalyticsStore is implemented by stores that keep spin counters.
+type AnalyticsStore interface {
+	// AddSpins adds each count to its hour and country's total.
+	AddSpins(counts []SpinCount) error
+	// Spins returns the counts from fromHour on, oldest first.
+	Spins(fromHour string) ([]SpinCount, error)
+}
+
+// HourlySpins is the total spins in one hour.
+type HourlySpins struct {
+	Hour  time.Time `json:"hour"`
+	Spins int       `json:"spins"`
+}
+
+// CountrySpins is the spins that served sites in one country.
+type CountrySpins struct {
+	Country string  `json:"country"` // Empty if unknown
+	Spins   int     `json:"spins"`
+	Percent float64 `json:"percent"`
+}
+
+// Analytics is what /stats shows.
+type Analytics struct {
+	Hourly    []HourlySpins  `json:"hourly"` // Oldest first, hours without spins included
+	Countries []CountrySpins `json:"countries"`
+	Total     int            `json:"total"` // Spins the countries add up to
+}
+
+// buildAnalytics adds up store's spin counters for /stats.
+func buildAnalytics(store AnalyticsStore) (Analytics, error) {
+	now := time.Now().UTC().Truncate(time.Hour)
+	counts, err := store.Spins(now.Add(-analyticsDays * 24 * time.Hour).Format(analyticsHourFormat))
+	if err != nil {
+		return Analytics{}, err
+	}
+	var a Analytics
+	from := now.Add(-(analyticsHours - 1) * time.Hour)
+	hourly := make(map[string]int)
+	countries := make(map[string]int)
+	for _, c := range counts {
+		countries[c.Country] += c.Count
+		a.Total += c.Count
+		if c.Hour >= from.Format(analyticsHourFormat) {
+			hourly[c.Hour] += c.Count
+		}
+	}
+	for h := from; !h.After(now); h = h.Add(time.Hour) {
+		a.Hourly = append(a.Hourly, HourlySpins{Hour: h, Spins: hourly[h.Format(analyticsHourFormat)]})
+	}
+	for country, n := range countries {
+		a.Countries = append(a.Countries, CountrySpins{Country: country, Spins: n, Percent: 100 * float64(n) / float64(a.Total)})
+	}
+	sort.Slice(a.Countries, func(i, j int) bool {
+		if a.Countries[i].Spins != a.Countries[j].Spins {
+			return a.Countries[i].Spins > a.Countries[j].Spins
+		}
+		return a.Countries[i].Country < a.Countries[j].Country
+	})
+	return a, nil
+}
+
+// statsPage is the data the stats template is rendered with.
+type statsPage struct {
+	basePage
+	Analytics
+	Days int
+}
+
+// statsHandler shows the spin counters, as JSON with format=json.
+func (rl *Roulette) statsHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := rl.store.(AnalyticsStore)
+	if !rl.Config().Analytics.Enabled || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	a, err := buildAnalytics(store)
+	if err != nil {
+		httpLog.Error("Failed to read analytics", "err", err)
+		http.Error(w, "Failed to read analytics", http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+		return
+	}
+	rl.render(w, "stats.html", statsPage{basePage: rl.pageBase(w, r), Analytics: a, Days: analyticsDays})
+}
@@ -0,0 +1,269 @@
+package roulette
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const apiKeyPrefix = "rlk_"      // Marks API keys, as tokenPrefix does admin tokens
+const apiKeyHeader = "X-API-Key" // Header API keys are sent in
+const DefaultAPIQuota = 1000     // Requests per UTC day for keys created without a quota
+
+// APIConfig controls access to the public JSON API.
+type APIConfig struct {
+	// RequireKey turns away requests without a valid API key. Otherwise
+	// anonymous requests are only rate limited.
+	RequireKey bool `json:"require_key"`
+}
+
+// APIKey is a consumer key for the public JSON API with a daily quota.
+// Only a hash of the key is stored.
+type APIKey struct {
+	ID         string
+	Name       string
+	Hash       string
+	DailyQuota int
+	Created    time.Time
+	Revoked    bool
+}
+
+// APIKeyStore is implemented by stores that keep API keys and count their
+// use per day.
+type APIKeyStore interface {
+	// AddAPIKey stores a new key.
+	AddAPIKey(k APIKey) error
+	// APIKeyByHash finds a key by the hash of its secret.
+	APIKeyByHash(hash string) (k APIKey, ok bool, err error)
+	// APIKeys lists every key, revoked ones included.
+	APIKeys() ([]APIKey, error)
+	// RevokeAPIKey disables a key for good.
+	RevokeAPIKey(id string) error
+	// CountAPIUse adds one to the key's count for day and returns the new count.
+	CountAPIUse(id, day string) (int, error)
+	// APIUse returns the key's count for day.
+	APIUse(id, day string) (int, error)
+}
+
+// apiKeyStore returns the store as an APIKeyStore.
+func (rl *Roulette) apiKeyStore() (APIKeyStore, error) {
+	keys, ok := rl.store.(APIKeyStore)
+	if !ok {
+		return nil, fmt.Errorf("API keys aren't supported by this store")
+	}
+	return keys, nil
+}
+
+// CreateAPIKey adds a key with the given daily quota and returns its
+// secret, which can't be recovered later.
+func (rl *Roulette) CreateAPIKey(name string, quota int) (string, APIKey, error) {
+	keys, err := rl.apiKeyStore()
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	if quota <= 0 {
+		return "", APIKey{}, fmt.Errorf("the quota must be positive")
+	}
+	secret := make([]byte, 24)
+	id := make([]byte, 4)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKey{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", APIKey{}, err
+	}
+	raw := apiKeyPrefix + hex.EncodeToString(secret)
+	k := APIKey{
+		ID:         hex.EncodeToString(id),
+		Name:       name,
+		Hash:       hashToken(raw),
+		DailyQuota: quota,
+		Created:    time.Now().UTC(),
+	}
+	if err := keys.AddAPIKey(k); err != nil {
+		return "", APIKey{}, err
+	}
+	return raw, k, nil
+}
+
+// APIKeys lists the stored keys.
+func (rl *Roulette) APIKeys() ([]APIKey, error) {
+	keys, err := rl.apiKeyStore()
+	if err != nil {
+		return nil, err
+	}
+	return keys.APIKeys()
+}
+
+// RevokeAPIKey disables the key with the given ID.
+func (rl *Roulette) RevokeAPIKey(id string) error {
+	keys, err := rl.apiKeyStore()
+	if err != nil {
+		return err
+	}
+	return keys.RevokeAPIKey(id)
+}
+
+// APIKeyUse returns how many requests the key has made today.
+func (rl *Roulette) APIKeyUse(id string) (int, error) {
+	keys, err := rl.apiKeyStore()
+	if err != nil {
+		return 0, err
+	}
+	day, _ := usageDay(time.Now())
+	return keys.APIUse(id, day)
+}
+
+// usageDay is the UTC day quotas are counted in, and when it ends.
+func usageDay(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	day := now.Format("2006-01-02")
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return day, midnight
+}
+
+// requestAPIKey returns the key r was sent with. ok is false if there was
+// none; err is set if it was given but isn't valid.
+func (rl *Roulette) requestAPIKey(r *http.Request) (APIKey, bool, error) {
+	raw := r.Header.Get(apiKeyHeader)
+	if raw == "" {
+		raw = r.URL.Query().Get("api_key")
+	}
+	if raw == "" {
+		return APIKey{}, false, nil
+	}
+	keys, err := rl.apiKeyStore()
+	if err != nil {
+		return APIKey{}, true, err
+	}
+	k, found, err := keys.APIKeyByHash(hashToken(raw))
+	if err != nil {
+		httpLog.Error("Failed to look up API key", "err", err)
+		return APIKey{}, true, fmt.Errorf("failed to check the API key")
+	}
+	if !found || k.Revoked {
+		return APIKey{}, true, fmt.Errorf("invalid API key")
+	}
+	return k, true, nil
+}
+
+// apiQuota enforces API keys and their daily quotas on h. Requests over
+// quota get 429 with a Retry-After header pointing at the next UTC day.
+func (rl *Roulette) apiQuota(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k, given, err := rl.requestAPIKey(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !given {
+			if rl.Config().API.RequireKey {
+				http.Error(w, "An API key is required, send it in the "+apiKeyHeader+" header", http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+			return
+		}
+
+		keys, _ := rl.apiKeyStore()
+		day, resets := usageDay(time.Now())
+		used, err := keys.CountAPIUse(k.ID, day)
+		if err != nil {
+			httpLog.Error("Failed to count API use", "err", err)
+			http.Error(w, "Failed to count API use", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(k.DailyQuota))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(max(k.DailyQuota-used, 0)))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(resets.Unix(), 10))
+		if used > k.DailyQuota {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(resets).Seconds())+1))
+			http.Error(w, "Daily API quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// apiUsage is the response of /api/v1/usage.
+type apiUsage struct {
+	KeyID      string    `json:"key_id"`
+	Name       string    `json:"name"`
+	DailyQuota int       `json:"daily_quota"`
+	UsedToday  int       `json:"used_today"`
+	Remaining  int       `json:"remaining"`
+	ResetsAt   time.Time `json:"resets_at"`
+}
+
+// usageHandler reports the calling key's quota and use today. Checking
+// usage doesn't count against the quota.
+func (rl *Roulette) usageHandler(w http.ResponseWriter, r *http.Request) {
+	k, given, err := rl.requestAPIKey(r)
+	if !given {
+		err = fmt.Errorf("send your API key in the %s header", apiKeyHeader)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	keys, _ := rl.apiKeyStore()
+	day, resets := usageDay(time.Now())
+	used, err := keys.APIUse(k.ID, day)
+	if err != nil {
+		httpLog.Error("Failed to read API use", "err", err)
+		http.Error(w, "Failed to read API use", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiUsage{
+		KeyID:      k.ID,
+		Name:       k.Name,
+		DailyQuota: k.DailyQuota,
+		UsedToday:  used,
+		Remaining:  max(k.DailyQuota-used, 0),
+		ResetsAt:   resets,
+	})
+}
+
+// apiSite is how sites appear in the JSON API.
+type apiSite struct {
+	ID          int64      `json:"id"`
+	URL         string     `json:"url"`
+	Status      string     `json:"status"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+}
+
+func newAPISite(site Site) apiSite {
+	s := apiSite{ID: site.ID, URL: site.URL, Status: site.Status}
+	if !site.LastChecked.IsZero() {
+		s.LastChecked = &site.LastChecked
+	}
+	return s
+}
+
+// randomHandler returns a random site as JSON, picked like /shuffle.
+func (rl *Roulette) randomHandler(w http.ResponseWriter, r *http.Request) {
+	if shadowed(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newAPISite(rl.decoySite()))
+		return
+	}
+	site, err := rl.PickRandomSite()
+	if err == ErrNoSites {
+		rl.bootstrap()
+		retryAfterWarming(w)
+		http.Error(w, "No sites available yet, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		httpLog.Error("Failed to fetch a random site", "err", err)
+		http.Error(w, "Failed to fetch a random site", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAPISite(site))
+}
@@ -0,0 +1,59 @@
+package roulette
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+//go:embed templates
+var embeddedAssets embed.FS
+
+// Assets returns the HTML templates and static files, with files in dir
+// taking precedence over the built-in ones. Anything dir doesn't have,
+// or all of it when dir is empty or missing, comes from the binary.
+func Assets(dir string) fs.FS {
+	builtin, _ := fs.Sub(embeddedAssets, "templates")
+	if dir == "" {
+		return builtin
+	}
+	return overlayFS{top: os.DirFS(dir), bottom: builtin}
+}
+
+// overlayFS serves files from top, falling back to bottom.
+type overlayFS struct {
+	top, bottom fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if f, err := o.top.Open(name); err == nil {
+		return f, nil
+	}
+	return o.bottom.Open(name)
+}
+
+// staticHandler serves the files under static/ without directory
+// listings, which wouldn't show both layers anyway.
+func staticHandler(assets fs.FS) http.Handler {
+	static, _ := fs.Sub(assets, "static")
+	files := http.FileServer(http.FS(static))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info, err := fs.Stat(static, cleanStaticPath(r.URL.Path)); err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+// cleanStaticPath turns a request path into an fs.FS name.
+func cleanStaticPath(p string) string {
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
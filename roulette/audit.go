@@ -0,0 +1,199 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const auditPageSize = 100 // Entries shown per audit log page
+
+// Audited admin actions
+const (
+	AuditReload          = "config.reload"
+	AuditRefresh         = "refresh.trigger"
+	AuditRefreshApprove  = "refresh.approve"
+	AuditRefreshDiscard  = "refresh.discard"
+	AuditSiteDelete      = "site.delete"
+	AuditTakedownApprove = "takedown.approve"
+	AuditTakedownReject  = "takedown.reject"
+	AuditBanAdd          = "ban.add"
+	AuditBanRemove       = "ban.remove"
+	AuditLoginLockout    = "login.lockout"
+	AuditTagRuleAdd      = "tag_rule.add"
+	AuditTagRuleRemove   = "tag_rule.remove"
+)
+
+// AuditEntry records one admin mutation. Before and After are JSON
+// snapshots of what changed, empty when there is nothing to show.
+type AuditEntry struct {
+	ID     int64
+	Time   time.Time
+	Actor  string
+	Action string
+	Target string
+	Before string
+	After  string
+}
+
+// AuditFilter narrows an audit log query. The zero value matches
+// everything.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Before int64 // Only entries with a lower ID, for paging
+	Limit  int   // At most this many entries, 0 for no limit
+}
+
+// AuditStore is implemented by stores that keep the admin audit log.
+type AuditStore interface {
+	// AddAudit appends an entry to the log.
+	AddAudit(e AuditEntry) error
+	// AuditLog returns matching entries, newest first.
+	AuditLog(filter AuditFilter) ([]AuditEntry, error)
+}
+
+type actorKey struct{}
+
+// withActor records who is behind an admin request.
+func withActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorKey{}, actor))
+}
+
+// actor returns who is behind an admin request.
+func actor(r *http.Request) string {
+	if a, ok := r.Context().Value(actorKey{}).(string); ok {
+		return a
+	}
+	return "unknown"
+}
+
+// audit records an admin mutation made through r. before and after are
+// stored as JSON, nil for none. Failures are logged, they never block the
+// action itself.
+func (rl *Roulette) audit(r *http.Request, action, target string, before, after any) {
+	e := AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  actor(r),
+		Action: action,
+		Target: target,
+		Before: auditJSON(before),
+		After:  auditJSON(after),
+	}
+	httpLog.Info("Audit", "actor", e.Actor, "action", e.Action, "target", e.Target)
+	store, ok := rl.store.(AuditStore)
+	if !ok {
+		return
+	}
+	if err := store.AddAudit(e); err != nil {
+		httpLog.Error("Failed to record audit entry", "err", err)
+	}
+}
+
+func auditJSON(v any) string {
+	if v == nil {
+		return ""
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%q", fmt.Sprint(v))
+	}
+	return string(b)
+}
+
+// auditPage is the data the audit template is rendered with.
+type auditPage struct {
+	basePage
+	Entries   []AuditEntry
+	Actor     string
+	Action    string
+	Actions   []string
+	Older     int64 // ID to page back from, 0 on the last page
+	Error     string
+	Supported bool
+}
+
+// adminAuditHandler shows the audit log, filtered by the actor and action
+// query parameters.
+func (rl *Roulette) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page := auditPage{
+		basePage: rl.pageBase(w, r),
+		Actor:    q.Get("actor"),
+		Action:   q.Get("action"),
+		Actions:  []string{AuditReload, AuditRefresh, AuditRefreshApprove, AuditRefreshDiscard, AuditSiteDelete, AuditTakedownApprove, AuditTakedownReject, AuditBanAdd, AuditBanRemove, AuditLoginLockout},
+	}
+	store, ok := rl.store.(AuditStore)
+	page.Supported = ok
+	if ok {
+		before, _ := strconv.ParseInt(q.Get("before"), 10, 64)
+		entries, err := store.AuditLog(AuditFilter{Actor: page.Actor, Action: page.Action, Before: before, Limit: auditPageSize})
+		if err != nil {
+			httpLog.Error("Failed to read audit log", "err", err)
+			page.Error = err.Error()
+		}
+		page.Entries = entries
+		if len(entries) == auditPageSize {
+			page.Older = entries[len(entries)-1].ID
+		}
+	}
+	rl.render(w, "audit.html", page)
+}
+
+// configChanges returns the top-level config settings that differ between
+// old and c, each keyed by its JSON name. Secrets are replaced by a
+// fingerprint, so the log tells that they changed but not what to.
+func configChanges(old, c *Config) (before, after map[string]json.RawMessage) {
+	oldFields, newFields := redactedFields(old), redactedFields(c)
+	before, after = make(map[string]json.RawMessage), make(map[string]json.RawMessage)
+	for name, v := range newFields {
+		if string(oldFields[name]) != string(v) {
+			before[name], after[name] = oldFields[name], v
+		}
+	}
+	for name, v := range oldFields {
+		if _, ok := newFields[name]; !ok {
+			before[name] = v
+		}
+	}
+	return before, after
+}
+
+func redactedFields(c *Config) map[string]json.RawMessage {
+	safe := *c
+	safe.ShodanAPIKey = redactSecret(c.ShodanAPIKey)
+	safe.AdminPasswordHash = redactSecret(c.AdminPasswordHash)
+	safe.SafeBrowsing.APIKey = redactSecret(c.SafeBrowsing.APIKey)
+	safe.RedirectKey = redactSecret(c.RedirectKey)
+	// Webhook URLs carry their own credentials
+	safe.Alerts.Webhook = redactSecret(c.Alerts.Webhook)
+	safe.Alerts.Discord = redactSecret(c.Alerts.Discord)
+	safe.Alerts.Email.Password = redactSecret(c.Alerts.Email.Password)
+	safe.Digest.Webhook = redactSecret(c.Digest.Webhook)
+	safe.Digest.Email.Password = redactSecret(c.Digest.Email.Password)
+	safe.Newsletter.Email.Password = redactSecret(c.Newsletter.Email.Password)
+	safe.Bot.Telegram.Token = redactSecret(c.Bot.Telegram.Token)
+	safe.S3Export.SecretKey = redactSecret(c.S3Export.SecretKey)
+	safe.Countries.IPInfo.Token = redactSecret(c.Countries.IPInfo.Token)
+	safe.OAuth = nil
+	for _, p := range c.OAuth {
+		p.ClientSecret = redactSecret(p.ClientSecret)
+		safe.OAuth = append(safe.OAuth, p)
+	}
+	var fields map[string]json.RawMessage
+	b, _ := json.Marshal(&safe)
+	json.Unmarshal(b, &fields)
+	return fields
+}
+
+// redactSecret replaces a secret with a short fingerprint of its hash,
+// enough to tell two values apart.
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted " + hashToken(secret)[:8] + "]"
+}
@@ -0,0 +1,334 @@
+package roulette
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const sessionCookie = "roulette_admin" // Cookie holding the admin session ID
+const sessionLifetime = 12 * time.Hour // How long an admin login lasts
+const tokenPrefix = "rlt_"             // Marks roulette API tokens so they are easy to spot in leaks
+
+// APIToken is a bearer token for the admin endpoints. Only a hash of the
+// token is kept, the token itself is shown once when it is created.
+type APIToken struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+}
+
+// HashPassword returns the bcrypt hash to put in admin_password_hash.
+func HashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("the password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// ReadAPITokens returns the tokens stored in path. A missing file means
+// there are none.
+func ReadAPITokens(path string) ([]APIToken, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens: %v", err)
+	}
+	var tokens []APIToken
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse tokens %s: %v", path, err)
+	}
+	return tokens, nil
+}
+
+// writeAPITokens replaces the tokens in path, readable only by the owner.
+func writeAPITokens(path string, tokens []APIToken) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write tokens: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write tokens: %v", err)
+	}
+	return nil
+}
+
+// CreateAPIToken adds a token called name to path and returns the secret,
+// which can't be recovered later.
+func CreateAPIToken(path, name string) (string, APIToken, error) {
+	tokens, err := ReadAPITokens(path)
+	if err != nil {
+		return "", APIToken{}, err
+	}
+	secret := make([]byte, 24)
+	id := make([]byte, 4)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIToken{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", APIToken{}, err
+	}
+	raw := tokenPrefix + hex.EncodeToString(secret)
+	token := APIToken{
+		ID:      hex.EncodeToString(id),
+		Name:    name,
+		Hash:    hashToken(raw),
+		Created: time.Now().UTC(),
+	}
+	if err := writeAPITokens(path, append(tokens, token)); err != nil {
+		return "", APIToken{}, err
+	}
+	return raw, token, nil
+}
+
+// RevokeAPIToken removes the token with the given ID from path.
+func RevokeAPIToken(path, id string) error {
+	tokens, err := ReadAPITokens(path)
+	if err != nil {
+		return err
+	}
+	for i, t := range tokens {
+		if t.ID == id {
+			return writeAPITokens(path, append(tokens[:i], tokens[i+1:]...))
+		}
+	}
+	return fmt.Errorf("no token with ID %q", id)
+}
+
+// hashToken is how tokens are stored. They are random, so unlike
+// passwords a fast hash is enough.
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessions holds logins in memory, so they end when the server restarts.
+// Admin sessions and visitor sessions are kept in separate instances.
+type sessions struct {
+	lifetime time.Duration
+
+	mu   sync.Mutex
+	byID map[string]session
+}
+
+// session is one login.
+type session struct {
+	expires time.Time
+	userID  int64 // The visitor's account, 0 for admin sessions
+}
+
+func newSessions(lifetime time.Duration) *sessions {
+	return &sessions{lifetime: lifetime, byID: make(map[string]session)}
+}
+
+// create starts a session for userID and returns its ID.
+func (s *sessions) create(userID int64) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, sess := range s.byID {
+		if now.After(sess.expires) {
+			delete(s.byID, k)
+		}
+	}
+	s.byID[id] = session{expires: now.Add(s.lifetime), userID: userID}
+	return id, nil
+}
+
+// get returns the live session with the given ID.
+func (s *sessions) get(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.byID[id]
+	if !ok || time.Now().After(sess.expires) {
+		return session{}, false
+	}
+	return sess, true
+}
+
+func (s *sessions) valid(id string) bool {
+	_, ok := s.get(id)
+	return ok
+}
+
+func (s *sessions) end(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byID, id)
+}
+
+// authConfigured reports whether an admin password or any API token is
+// set up. Without either, the admin endpoints are closed to everyone: a
+// reverse proxy on the same machine would make every client look local.
+func (rl *Roulette) authConfigured() bool {
+	if rl.Config().AdminPasswordHash != "" {
+		return true
+	}
+	tokens, err := ReadAPITokens(rl.Config().TokensFile)
+	return err != nil || len(tokens) > 0
+}
+
+// adminActor returns who r is authenticated as: the name of its API token
+// or the admin session. ok is false if it is neither.
+func (rl *Roulette) adminActor(r *http.Request) (actor string, ok bool) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		hash := hashToken(strings.TrimPrefix(auth, "Bearer "))
+		tokens, _ := ReadAPITokens(rl.Config().TokensFile)
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) == 1 {
+				return "token:" + t.Name, true
+			}
+		}
+		return "", false
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil && rl.sessions.valid(cookie.Value) {
+		return "admin", true
+	}
+	return "", false
+}
+
+// requireAdmin lets requests through to h only if they are authenticated,
+// recording who they are for the audit log. Browsers are sent to the login
+// page, API clients get 401.
+func (rl *Roulette) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !rl.authConfigured() {
+			http.Error(w, "Forbidden: set an admin password or create an API token with the admin command first", http.StatusForbidden)
+			return
+		}
+		if actor, ok := rl.adminActor(r); ok {
+			h(w, withActor(r, actor))
+			return
+		}
+		if r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && rl.Config().AdminPasswordHash != "" {
+			redirectRelative(w, "login")
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="roulette"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// adminPathPrefixes are the routes AdminAllow restricts.
+var adminPathPrefixes = []string{"/admin", "/api/v1/admin"}
+
+// adminAllowlist refuses requests for the admin routes from clients
+// outside AdminAllow, before they get to authenticate. The client IP is
+// taken from X-Forwarded-For only through trusted proxies.
+func (rl *Roulette) adminAllowlist(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := rl.Config()
+		if len(c.adminAllow) > 0 && isAdminPath(r.URL.Path) && !c.adminAllowed(c.ClientIP(r)) {
+			httpLog.Warn("Refused admin request", "client", c.clientKey(r))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isAdminPath(path string) bool {
+	for _, p := range adminPathPrefixes {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) adminAllowed(ip net.IP) bool {
+	for _, n := range c.adminAllow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectRelative sends a 303 to a location relative to the current
+// page. Unlike http.Redirect it leaves the path for the browser to
+// resolve, which keeps working when the handler is mounted under a prefix.
+func redirectRelative(w http.ResponseWriter, location string) {
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// loginPage is the data the login template is rendered with.
+type loginPage struct {
+	basePage
+	Error string
+}
+
+// loginHandler serves the admin login form and checks the password.
+func (rl *Roulette) loginHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config()
+	page := loginPage{basePage: rl.pageBase(w, r)}
+	if c.AdminPasswordHash == "" {
+		page.Error = "No admin password is configured. Set admin_password_hash in the config, see the admin password command."
+	} else if r.Method == http.MethodPost && rl.loginLocked(r) {
+		// Don't even check the password, a lockout must not be an oracle
+		page.Error = lockedOut(w, c.Login.Lockout)
+	} else if r.Method == http.MethodPost {
+		err := bcrypt.CompareHashAndPassword([]byte(c.AdminPasswordHash), []byte(r.FormValue("password")))
+		if err == nil {
+			rl.loginSucceeded(r)
+			id, err := rl.sessions.create(0)
+			if err != nil {
+				http.Error(w, "Failed to start session", http.StatusInternalServerError)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookie,
+				Value:    id,
+				Path:     "/",
+				MaxAge:   int(sessionLifetime.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			redirectRelative(w, "./")
+			return
+		}
+		rl.loginFailed(r)
+		page.Error = "Wrong password"
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	rl.render(w, "login.html", page)
+}
+
+// logoutHandler ends the admin session.
+func (rl *Roulette) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		rl.sessions.end(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	redirectRelative(w, "login")
+}
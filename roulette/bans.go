@@ -0,0 +1,299 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const banCacheFor = 30 * time.Second // How long the ban list is cached, so bans from other instances sharing the database apply soon
+
+// Ban kinds and modes
+const (
+	BanIP      = "ip"      // Value is an IP or CIDR
+	BanVisitor = "visitor" // Value is a visitor key, user:ID or anon:ID
+	BanBlock   = "ban"     // Public endpoints answer 403
+	BanShadow  = "shadow"  // Public endpoints answer from the decoy pool
+)
+
+// Ban keeps an abusive client away from the public endpoints.
+type Ban struct {
+	ID      int64     `json:"id"`
+	Kind    string    `json:"kind"`
+	Value   string    `json:"value"`
+	Mode    string    `json:"mode"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+// BanStore is implemented by stores that keep bans.
+type BanStore interface {
+	// AddBan stores b and returns it with its ID.
+	AddBan(b Ban) (Ban, error)
+	// Bans lists every ban, oldest first.
+	Bans() ([]Ban, error)
+	// RemoveBan lifts the ban with the given ID.
+	RemoveBan(id int64) error
+}
+
+// parsedBan is a ban ready for matching.
+type parsedBan struct {
+	Ban
+	network *net.IPNet // For IP bans
+}
+
+// banCache holds the parsed ban list between reloads from the store.
+type banCache struct {
+	mu     sync.Mutex
+	bans   []parsedBan
+	loaded time.Time
+}
+
+func (rl *Roulette) banStore() (BanStore, error) {
+	bans, ok := rl.store.(BanStore)
+	if !ok {
+		return nil, fmt.Errorf("bans aren't supported by this store")
+	}
+	return bans, nil
+}
+
+// activeBans returns the cached ban list, reloading it when stale.
+func (rl *Roulette) activeBans() []parsedBan {
+	rl.bans.mu.Lock()
+	defer rl.bans.mu.Unlock()
+	if time.Since(rl.bans.loaded) < banCacheFor {
+		return rl.bans.bans
+	}
+	rl.bans.loaded = time.Now()
+	store, ok := rl.store.(BanStore)
+	if !ok {
+		return nil
+	}
+	bans, err := store.Bans()
+	if err != nil {
+		// Keep enforcing the last known list
+		httpLog.Error("Failed to load bans", "err", err)
+		return rl.bans.bans
+	}
+	parsed := make([]parsedBan, 0, len(bans))
+	for _, b := range bans {
+		p := parsedBan{Ban: b}
+		if b.Kind == BanIP {
+			nets, err := parseCIDRs([]string{b.Value})
+			if err != nil {
+				httpLog.Warn("Ignoring ban", "ban", b.ID, "err", err)
+				continue
+			}
+			p.network = nets[0]
+		}
+		parsed = append(parsed, p)
+	}
+	rl.bans.bans = parsed
+	return parsed
+}
+
+// invalidateBans makes the next check reload the ban list.
+func (rl *Roulette) invalidateBans() {
+	rl.bans.mu.Lock()
+	defer rl.bans.mu.Unlock()
+	rl.bans.loaded = time.Time{}
+}
+
+// banOf returns the ban covering r's client, if any. Blocking bans win
+// over shadow bans.
+func (rl *Roulette) banOf(r *http.Request) (Ban, bool) {
+	bans := rl.activeBans()
+	if len(bans) == 0 {
+		return Ban{}, false
+	}
+	ip := rl.Config().ClientIP(r)
+	keys := rl.visitorKeys(r)
+	var found Ban
+	ok := false
+	for _, b := range bans {
+		matches := false
+		switch b.Kind {
+		case BanIP:
+			matches = b.network.Contains(ip)
+		case BanVisitor:
+			for _, k := range keys {
+				matches = matches || k == b.Value
+			}
+		}
+		if matches && (!ok || b.Mode == BanBlock) {
+			found, ok = b.Ban, true
+		}
+	}
+	return found, ok
+}
+
+// visitorKeys returns r's visitor identities without setting any cookies.
+func (rl *Roulette) visitorKeys(r *http.Request) []string {
+	var keys []string
+	if user := rl.loggedInUser(r); user != nil {
+		keys = append(keys, Visitor{User: user}.Key())
+	}
+	if cookie, err := r.Cookie(anonCookie); err == nil && cookie.Value != "" {
+		keys = append(keys, Visitor{AnonID: cookie.Value}.Key())
+	}
+	return keys
+}
+
+type shadowKey struct{}
+
+// shadowed reports whether r comes from a shadow banned client.
+func shadowed(r *http.Request) bool {
+	return r.Context().Value(shadowKey{}) != nil
+}
+
+// notBanned keeps banned clients away from h with a 403. Shadow banned
+// ones get through, marked so that h can answer from the decoy pool.
+func (rl *Roulette) notBanned(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, ok := rl.banOf(r)
+		if !ok {
+			h(w, r)
+			return
+		}
+		if b.Mode == BanShadow {
+			h(w, r.WithContext(context.WithValue(r.Context(), shadowKey{}, true)))
+			return
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
+
+// decoySite picks from the shadow decoy pool: the configured list or,
+// without one, the built-in sample list.
+func (rl *Roulette) decoySite() Site {
+	decoys := rl.Config().ShadowDecoys
+	if len(decoys) == 0 {
+		decoys, _ = ReadURLs(demoReader())
+	}
+	url := decoys[rand.Intn(len(decoys))]
+	host, port := splitHostPort(url)
+	return Site{URL: url, Host: host, Port: port, Status: StatusUnknown}
+}
+
+// banRequest is the body of POST /api/v1/admin/bans.
+type banRequest struct {
+	Kind   string `json:"kind"`
+	Value  string `json:"value"`
+	Mode   string `json:"mode"`
+	Reason string `json:"reason"`
+}
+
+// AddBan bans a client identifier in the given mode, BanBlock if empty.
+func (rl *Roulette) AddBan(kind, value, mode, reason string) (Ban, error) {
+	store, err := rl.banStore()
+	if err != nil {
+		return Ban{}, err
+	}
+	value = strings.TrimSpace(value)
+	if mode == "" {
+		mode = BanBlock
+	}
+	switch {
+	case kind != BanIP && kind != BanVisitor:
+		return Ban{}, fmt.Errorf("kind must be %q or %q", BanIP, BanVisitor)
+	case mode != BanBlock && mode != BanShadow:
+		return Ban{}, fmt.Errorf("mode must be %q or %q", BanBlock, BanShadow)
+	case value == "":
+		return Ban{}, fmt.Errorf("value must not be empty")
+	}
+	if kind == BanIP {
+		if _, err := parseCIDRs([]string{value}); err != nil {
+			return Ban{}, fmt.Errorf("invalid IP or CIDR: %v", err)
+		}
+	}
+	b, err := store.AddBan(Ban{Kind: kind, Value: value, Mode: mode, Reason: reason, Created: time.Now().UTC()})
+	if err != nil {
+		return Ban{}, err
+	}
+	rl.invalidateBans()
+	httpLog.Info("Ban added", "ban", b.ID, "kind", b.Kind, "value", b.Value, "mode", b.Mode)
+	return b, nil
+}
+
+// RemoveBan lifts a ban.
+func (rl *Roulette) RemoveBan(id int64) error {
+	store, err := rl.banStore()
+	if err != nil {
+		return err
+	}
+	if err := store.RemoveBan(id); err != nil {
+		return err
+	}
+	rl.invalidateBans()
+	httpLog.Info("Ban removed", "ban", id)
+	return nil
+}
+
+// adminBansHandler lists bans on GET /api/v1/admin/bans and adds one on
+// POST with a JSON banRequest.
+func (rl *Roulette) adminBansHandler(w http.ResponseWriter, r *http.Request) {
+	store, err := rl.banStore()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if r.Method == http.MethodPost {
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		b, err := rl.AddBan(req.Kind, req.Value, req.Mode, req.Reason)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rl.audit(r, AuditBanAdd, fmt.Sprintf("ban #%d", b.ID), nil, b)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(b)
+		return
+	}
+	bans, err := store.Bans()
+	if err != nil {
+		httpLog.Error("Failed to list bans", "err", err)
+		http.Error(w, "Failed to list bans", http.StatusInternalServerError)
+		return
+	}
+	if bans == nil {
+		bans = []Ban{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
+
+// adminBanHandler lifts a ban on DELETE /api/v1/admin/bans/{id}.
+func (rl *Roulette) adminBanHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ban ID", http.StatusBadRequest)
+		return
+	}
+	var before any
+	if store, err := rl.banStore(); err == nil {
+		bans, _ := store.Bans()
+		for _, b := range bans {
+			if b.ID == id {
+				before = b
+			}
+		}
+	}
+	if err := rl.RemoveBan(id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	rl.audit(r, AuditBanRemove, fmt.Sprintf("ban #%d", id), before, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
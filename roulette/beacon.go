@@ -0,0 +1,139 @@
+package roulette
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const beaconMaxBody = 2048       // Bytes, beacons are tiny
+const beaconMessageMax = 500     // Characters of a beacon's message kept
+const beaconTrackedSites = 10000 // Sites with reports held before stale ones are swept
+
+// Beacon kinds
+const (
+	BeaconLoadFailed = "load_failed" // The site didn't load in the player frame
+	BeaconJSError    = "js_error"    // The player page's script failed
+)
+
+// Beacon is what the player frontend posts to /api/v1/beacon.
+type Beacon struct {
+	SiteID  int64  `json:"site_id"`
+	Kind    string `json:"kind"`
+	Message string `json:"message,omitempty"`
+}
+
+func (b Beacon) validate() error {
+	if b.SiteID <= 0 {
+		return fmt.Errorf("site_id must be positive")
+	}
+	if b.Kind != BeaconLoadFailed && b.Kind != BeaconJSError {
+		return fmt.Errorf("kind must be %q or %q", BeaconLoadFailed, BeaconJSError)
+	}
+	if len([]rune(b.Message)) > beaconMessageMax {
+		return fmt.Errorf("message must be under %d characters", beaconMessageMax)
+	}
+	return nil
+}
+
+// BeaconConfig decides when visitors' reports of a site failing to load
+// mark it down, ahead of the next probe.
+type BeaconConfig struct {
+	// Reporters is how many different clients must report a site within
+	// Window, 0 only logs the reports
+	Reporters int `json:"reporters"`
+	// Window is how long a report counts
+	Window Duration `json:"window"`
+}
+
+// beaconReports holds the recent load failure reports of each site, by
+// client.
+type beaconReports struct {
+	mu     sync.Mutex
+	bySite map[int64]map[string]time.Time
+}
+
+// add records client's report of id at now and returns how many clients
+// reported it within window.
+func (b *beaconReports) add(id int64, client string, now time.Time, window time.Duration) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bySite == nil {
+		b.bySite = make(map[int64]map[string]time.Time)
+	}
+	if len(b.bySite) >= beaconTrackedSites {
+		for site, clients := range b.bySite {
+			pruneReports(clients, now, window)
+			if len(clients) == 0 {
+				delete(b.bySite, site)
+			}
+		}
+	}
+	clients := b.bySite[id]
+	if clients == nil {
+		clients = make(map[string]time.Time)
+		b.bySite[id] = clients
+	}
+	clients[client] = now
+	pruneReports(clients, now, window)
+	return len(clients)
+}
+
+// clear forgets the reports of id.
+func (b *beaconReports) clear(id int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.bySite, id)
+}
+
+func pruneReports(clients map[string]time.Time, now time.Time, window time.Duration) {
+	for c, t := range clients {
+		if now.Sub(t) > window {
+			delete(clients, c)
+		}
+	}
+}
+
+// beaconHandler takes failure reports from the player frontend. Enough
+// clients reporting a site that didn't load mark it down, the probe then
+// rechecks it first.
+func (rl *Roulette) beaconHandler(w http.ResponseWriter, r *http.Request) {
+	var b Beacon
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, beaconMaxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&b); err != nil {
+		http.Error(w, "Invalid beacon", http.StatusBadRequest)
+		return
+	}
+	if err := b.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	if shadowed(r) {
+		return
+	}
+
+	c := rl.Config()
+	if b.Kind == BeaconJSError {
+		httpLog.Info("Player script error", "site", b.SiteID, "message", sanitizeText(b.Message, beaconMessageMax))
+		return
+	}
+	httpLog.Debug("Site failed to load for a visitor", "site", b.SiteID)
+	if c.Beacon.Reporters <= 0 {
+		return
+	}
+	reporters := rl.beacons.add(b.SiteID, c.clientKey(r), time.Now(), time.Duration(c.Beacon.Window))
+	if reporters < c.Beacon.Reporters {
+		return
+	}
+	rl.beacons.clear(b.SiteID)
+	site, err := rl.store.Site(b.SiteID)
+	if err != nil || site.Status == StatusDown {
+		return
+	}
+	rl.markDown(site, fmt.Sprintf("failed to load for %d visitors", reporters))
+	httpLog.Info("Marked site down on visitor reports", "site", site.ID, "reporters", reporters)
+}
@@ -0,0 +1,259 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+const telegramAPI = "https://api.telegram.org/bot"
+const telegramPollTimeout = 30 // Seconds a getUpdates call waits for messages
+const botRetryDelay = 30 * time.Second
+const botIdleDelay = time.Minute // Between checks for a bot being configured
+const discordMaxBody = 64 << 10
+
+// BotConfig answers /roll commands in a chat with a random site from the
+// pool.
+type BotConfig struct {
+	// Telegram polls a Telegram bot for commands
+	Telegram TelegramBotConfig `json:"telegram"`
+	// Discord answers the /roll slash command of a Discord application
+	// whose interactions endpoint URL is set to /bot/discord
+	Discord DiscordBotConfig `json:"discord"`
+}
+
+// TelegramBotConfig is a Telegram bot.
+type TelegramBotConfig struct {
+	// Token is the bot token from BotFather, empty turns the bot off
+	Token string `json:"token,omitempty"`
+	// Chat is the ID of the chat the bot answers in
+	Chat int64 `json:"chat"`
+}
+
+// DiscordBotConfig is a Discord application.
+type DiscordBotConfig struct {
+	// PublicKey is the application's public key, in hex. Empty turns the
+	// bot off.
+	PublicKey string `json:"public_key,omitempty"`
+	// Channel is the ID of the channel the bot answers in
+	Channel string `json:"channel,omitempty"`
+}
+
+func (b BotConfig) validate() error {
+	if b.Telegram.Token != "" && b.Telegram.Chat == 0 {
+		return fmt.Errorf("bot.telegram.chat is required with a token")
+	}
+	if b.Discord.PublicKey != "" {
+		if key, err := hex.DecodeString(b.Discord.PublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("bot.discord.public_key must be %d bytes in hex", ed25519.PublicKeySize)
+		}
+		if b.Discord.Channel == "" {
+			return fmt.Errorf("bot.discord.channel is required with a public key")
+		}
+	}
+	return nil
+}
+
+// isRollCommand reports whether text is the /roll command, possibly
+// addressed to a bot by name as in group chats.
+func isRollCommand(text string) bool {
+	command, _, _ := strings.Cut(strings.TrimSpace(text), " ")
+	command, _, _ = strings.Cut(command, "@")
+	return command == "/roll"
+}
+
+// roll picks a site the way /shuffle does, never a flagged one, and
+// describes it for a chat.
+func (rl *Roulette) roll(ctx context.Context) string {
+	site, _, err := rl.shuffle(ctx, shuffleOptions{})
+	if err == ErrNoSites || err == errNoSuitableSite {
+		return "No site to roll right now, try again later."
+	}
+	if err != nil {
+		botLog.Error("Failed to fetch a random site", "err", err)
+		return "Something went wrong, try again later."
+	}
+	country := rl.countryOf(site.URL)
+	if country == "" {
+		country = "unknown country"
+	}
+	// The pool keeps no page titles, the host stands in for one
+	return fmt.Sprintf("%s (%s)\n%s", site.Host, country, site.URL)
+}
+
+// startBots runs the Telegram bot until ctx is cancelled. The Discord bot
+// needs no loop, Discord calls discordBotHandler.
+func (rl *Roulette) startBots(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		offset := int64(0)
+		for {
+			delay := time.Duration(0)
+			if c := rl.Config().Bot.Telegram; c.Token == "" {
+				delay = botIdleDelay
+			} else if next, err := rl.pollTelegram(ctx, c, offset); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				botLog.Error("Failed to poll Telegram", "err", err)
+				delay = botRetryDelay
+			} else {
+				offset = next
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+	}()
+}
+
+// telegramUpdate is the part of a Telegram update the bot reads.
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// pollTelegram waits for updates after offset, answers the /roll commands
+// among them and returns the offset to poll from next.
+func (rl *Roulette) pollTelegram(ctx context.Context, c TelegramBotConfig, offset int64) (int64, error) {
+	var updates []telegramUpdate
+	query := fmt.Sprintf("getUpdates?timeout=%d&offset=%d&allowed_updates=%s", telegramPollTimeout, offset, neturl.QueryEscape(`["message"]`))
+	if err := telegramCall(ctx, c.Token, http.MethodGet, query, nil, &updates); err != nil {
+		return offset, err
+	}
+	for _, u := range updates {
+		offset = u.UpdateID + 1
+		if u.Message == nil || u.Message.Chat.ID != c.Chat || !isRollCommand(u.Message.Text) {
+			continue
+		}
+		reply := map[string]any{"chat_id": c.Chat, "text": rl.roll(ctx), "disable_web_page_preview": true}
+		if err := telegramCall(ctx, c.Token, http.MethodPost, "sendMessage", reply, nil); err != nil {
+			botLog.Error("Failed to answer on Telegram", "err", err)
+		}
+	}
+	return offset, nil
+}
+
+// telegramCall calls a Bot API method, decoding its result into result if
+// not nil.
+func telegramCall(ctx context.Context, token, httpMethod, method string, body, result any) error {
+	ctx, cancel := context.WithTimeout(ctx, (telegramPollTimeout+10)*time.Second)
+	defer cancel()
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, httpMethod, telegramAPI+token+"/"+method, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	var uerr *neturl.Error
+	if errors.As(err, &uerr) {
+		// The URL carries the token
+		return uerr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	if !answer.OK {
+		return fmt.Errorf("%s: %s", resp.Status, answer.Description)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(answer.Result, result)
+}
+
+// Discord interaction and response types
+const (
+	discordPing      = 1
+	discordCommand   = 2
+	discordPong      = 1
+	discordMessage   = 4
+	discordEphemeral = 64 // Message flag: only the user who asked sees it
+)
+
+// discordBotHandler answers Discord interactions: its endpoint checks and
+// the /roll command in the configured channel.
+func (rl *Roulette) discordBotHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config().Bot.Discord
+	if c.PublicKey == "" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, discordMaxBody))
+	if err != nil {
+		http.Error(w, "Invalid interaction", http.StatusBadRequest)
+		return
+	}
+	// Discord checks that unsigned requests are refused
+	key, _ := hex.DecodeString(c.PublicKey)
+	sig, err := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	if err != nil || len(sig) != ed25519.SignatureSize || !ed25519.Verify(key, append([]byte(timestamp), body...), sig) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var interaction struct {
+		Type      int    `json:"type"`
+		ChannelID string `json:"channel_id"`
+		Data      struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		http.Error(w, "Invalid interaction", http.StatusBadRequest)
+		return
+	}
+	var response any
+	switch {
+	case interaction.Type == discordPing:
+		response = map[string]any{"type": discordPong}
+	case interaction.Type == discordCommand && interaction.Data.Name == "roll":
+		if interaction.ChannelID != c.Channel {
+			response = map[string]any{"type": discordMessage, "data": map[string]any{
+				"content": "Rolls are answered in another channel.", "flags": discordEphemeral}}
+			break
+		}
+		response = map[string]any{"type": discordMessage, "data": map[string]any{"content": rl.roll(r.Context())}}
+	default:
+		http.Error(w, "Unsupported interaction", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,265 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const crawlTimeout = 15 * time.Second // Per listing crawled
+const changedSample = 5               // New files named in a changed event
+const changeFeedBuffer = 64           // Events a slow feed client falls behind by before missing some
+const changeFeedKeepalive = 30 * time.Second
+
+// ChangesConfig re-crawls the listings of sites that are up and reports
+// the ones where new files appeared, on /api/v1/changes and in the site
+// timelines. Changing open directories are the interesting ones.
+type ChangesConfig struct {
+	// Enabled crawls every Interval and serves /api/v1/changes
+	Enabled  bool     `json:"enabled"`
+	Interval Duration `json:"interval"`
+	// KnownFiles tags sites hosting files it recognizes, while crawling
+	KnownFiles KnownFilesConfig `json:"known_files"`
+}
+
+// InventoryStore is implemented by stores that keep what each site's
+// listing held when last crawled.
+type InventoryStore interface {
+	// Inventory returns the entries of the site's listing, and false if it
+	// was never crawled.
+	Inventory(siteID int64) ([]string, bool, error)
+	// SetInventory replaces the entries of the site's listing.
+	SetInventory(siteID int64, entries []string) error
+}
+
+// startChanges crawls the pool every interval while enabled, until ctx is
+// cancelled, then ends the feed's streams.
+func (rl *Roulette) startChanges(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		defer rl.changeFeed.close()
+		for {
+			interval := time.Duration(rl.Config().Changes.Interval)
+			if interval <= 0 {
+				interval = time.Hour
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			if !rl.Config().Changes.Enabled {
+				continue
+			}
+			if err := rl.withLease(ctx, crawlLease, rl.crawlChanges); err != nil && err != ErrNotLeader {
+				probeLog.Error("Crawl failed", "err", err)
+			}
+		}
+	}()
+}
+
+// crawlChanges crawls the listing of every site that is up and records a
+// changed event for each where new entries appeared since the last crawl.
+func (rl *Roulette) crawlChanges(ctx context.Context) error {
+	store, ok := rl.store.(InventoryStore)
+	if !ok {
+		return fmt.Errorf("this store doesn't keep listings")
+	}
+	sites, err := rl.store.List(SiteFilter{Status: StatusUp})
+	if err != nil {
+		return err
+	}
+	client := rl.siteClient(crawlTimeout)
+	queue := make(chan Site)
+	var mu sync.Mutex
+	var events []SiteEvent
+	known := make(map[string][]string) // Tags of known files by site URL
+	var wg sync.WaitGroup
+	for i := 0; i < rl.Config().Probe.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for site := range queue {
+				e, changed, tags := rl.crawlSite(ctx, client, store, site)
+				mu.Lock()
+				if changed {
+					events = append(events, e)
+				}
+				if len(tags) > 0 {
+					known[site.URL] = tags
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, site := range sites {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- site
+	}
+	close(queue)
+	wg.Wait()
+	rl.recordEvents(events...)
+	// A cut short crawl hasn't seen every site, so it keeps the old tags
+	if ctx.Err() == nil {
+		rl.replaceTags(TagOriginKnownFiles, known)
+	}
+	probeLog.Info("Crawled listings", "sites", len(sites), "changed", len(events), "known_files", len(known))
+	return ctx.Err()
+}
+
+// crawlSite crawls one listing, returning the changed event it makes, if
+// any, and the tags of the known files it lists.
+func (rl *Roulette) crawlSite(ctx context.Context, client *http.Client, store InventoryStore, site Site) (e SiteEvent, changed bool, known []string) {
+	body, err := fetchListing(ctx, client, site.URL)
+	if err != nil {
+		probeLog.Debug("Failed to crawl listing", "url", site.URL, "err", err)
+		return SiteEvent{}, false, nil
+	}
+	entries := listingEntries(site.URL, body)
+	known = rl.knownFileTags(ctx, client, site.URL, entries)
+	old, crawled, err := store.Inventory(site.ID)
+	if err != nil {
+		probeLog.Error("Failed to read listing", "site", site.ID, "err", err)
+		return SiteEvent{}, false, known
+	}
+	if err := store.SetInventory(site.ID, entries); err != nil {
+		probeLog.Error("Failed to record listing", "site", site.ID, "err", err)
+		return SiteEvent{}, false, known
+	}
+	if !crawled {
+		return SiteEvent{}, false, known
+	}
+	seen := make(map[string]bool, len(old))
+	for _, e := range old {
+		seen[e] = true
+	}
+	var added []string
+	for _, e := range entries {
+		if !seen[e] {
+			added = append(added, e)
+		}
+	}
+	if len(added) == 0 {
+		return SiteEvent{}, false, known
+	}
+	sample := added[:min(len(added), changedSample)]
+	detail := fmt.Sprintf("%d new: %s", len(added), strings.Join(sample, ", "))
+	if len(added) > len(sample) {
+		detail += ", ..."
+	}
+	return siteEvent(site, EventChanged, detail), true, known
+}
+
+// changeFeed hands new changed events to the clients streaming
+// /api/v1/changes.
+type changeFeed struct {
+	mu     sync.Mutex
+	subs   map[chan SiteEvent]bool
+	closed bool
+}
+
+func (f *changeFeed) subscribe() chan SiteEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan SiteEvent, changeFeedBuffer)
+	if f.closed {
+		close(ch)
+		return ch
+	}
+	if f.subs == nil {
+		f.subs = make(map[chan SiteEvent]bool)
+	}
+	f.subs[ch] = true
+	return ch
+}
+
+func (f *changeFeed) unsubscribe(ch chan SiteEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs[ch] {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// publish passes the changed events on, skipping clients too far behind.
+func (f *changeFeed) publish(events []SiteEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range events {
+		if e.Kind != EventChanged {
+			continue
+		}
+		for ch := range f.subs {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+}
+
+// close ends every stream, for shutdown.
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		close(ch)
+	}
+	f.subs, f.closed = nil, true
+}
+
+// feedEvent is how changed events are streamed.
+type feedEvent struct {
+	SiteID int64     `json:"site_id"`
+	URL    string    `json:"url"`
+	Time   time.Time `json:"time"`
+	Detail string    `json:"detail"`
+}
+
+// changesHandler streams changed events as server-sent events as the
+// crawls find them.
+func (rl *Roulette) changesHandler(w http.ResponseWriter, r *http.Request) {
+	if !rl.Config().Changes.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	if shadowed(r) {
+		return
+	}
+	events := rl.changeFeed.subscribe()
+	defer rl.changeFeed.unsubscribe(events)
+	keepalive := time.NewTicker(changeFeedKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(feedEvent{SiteID: e.SiteID, URL: e.URL, Time: e.Time, Detail: e.Detail})
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", EventChanged, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
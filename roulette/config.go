@@ -0,0 +1,640 @@
+package roulette
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the roulette's settings. Everything except the storage
+// locations can change while running, see Roulette.Reload.
+type Config struct {
+	// ShodanAPIKey is used when neither SHODAN_API_KEY nor
+	// SHODAN_API_KEY_FILE is set
+	ShodanAPIKey string `json:"shodan_api_key,omitempty"`
+	// ShodanAPIKeyFile is a file holding the Shodan key, used when
+	// shodan_api_key isn't set. Without either, the shodan_api_key Docker
+	// secret is read if it exists
+	ShodanAPIKeyFile string `json:"shodan_api_key_file,omitempty"`
+	// ShodanQueries are the searches merged into the URL list on refresh
+	ShodanQueries []string `json:"shodan_queries"`
+	// ShodanWorkers is how many result pages of a query are fetched at once
+	ShodanWorkers int `json:"shodan_workers"`
+	// ShodanPageInterval is the least time between any two page requests,
+	// whichever workers make them, to stay inside Shodan's rate limit
+	ShodanPageInterval Duration `json:"shodan_page_interval"`
+	// ShodanAPIURL replaces Shodan's API, for a proxy or the mock-shodan
+	// command's server
+	ShodanAPIURL string `json:"shodan_api_url,omitempty"`
+	// AltPorts looks for more listings on other ports of the hosts Shodan
+	// finds
+	AltPorts AltPortsConfig `json:"alt_ports"`
+	// DataDir is where relative data paths (URL list, database, exports,
+	// certificates) are resolved. Empty means the working directory.
+	DataDir string `json:"data_dir,omitempty"`
+	// URLsFile is the URL list the pool is synced from
+	URLsFile string `json:"urls_file,omitempty"`
+	// URLSources are more URL lists merged into the pool, such as a
+	// urls.d directory of hand-curated lists
+	URLSources []URLSource `json:"url_sources,omitempty"`
+	// WatchURLsFile syncs the pool as soon as URLsFile or a source is
+	// edited
+	WatchURLsFile bool `json:"watch_urls_file"`
+	// DBPath is the SQLite database, see OpenStore
+	DBPath string `json:"db_path,omitempty"`
+	// TemplatesDir holds templates and static/ files overriding the
+	// built-in ones, see Assets
+	TemplatesDir string `json:"templates_dir,omitempty"`
+	// TokensFile holds the hashed API tokens, see CreateAPIToken
+	TokensFile string `json:"tokens_file,omitempty"`
+	// AdminPasswordHash is the bcrypt hash of the admin web UI password,
+	// see HashPassword
+	AdminPasswordHash string `json:"admin_password_hash,omitempty"`
+	// SafeBrowsing checks destinations for malware before redirecting
+	SafeBrowsing SafeBrowsingConfig `json:"safe_browsing"`
+	// Consent is the warning shown before a visitor's first redirect
+	Consent ConsentConfig `json:"consent"`
+	// OAuth lists the login providers for visitor accounts. Without any,
+	// every visitor is anonymous.
+	OAuth []OAuthProvider `json:"oauth"`
+	// Branding customizes the text and logo of the index page
+	Branding Branding `json:"branding"`
+	// Demo serves the embedded sample list from memory and disables all
+	// outbound Shodan and probe traffic
+	Demo bool `json:"demo,omitempty"`
+	// FakeSites serves the made up sites seed --fake adds on /fake/, for
+	// development without the internet
+	FakeSites bool `json:"fake_sites,omitempty"`
+	// RefreshHoldPercent holds refreshes that would remove more than this
+	// percentage of the pool for admin approval, 100 never holds them
+	RefreshHoldPercent float64 `json:"refresh_hold_percent"`
+	// RefreshInterval is how often Shodan is queried for new URLs
+	RefreshInterval Duration `json:"refresh_interval"`
+	// Blocklist holds hostnames or IPs that are never added to the pool
+	Blocklist []string `json:"blocklist"`
+	// Shuffle controls which sites /shuffle picks
+	Shuffle ShuffleConfig `json:"shuffle"`
+	// Network keeps private and other non-public addresses out of the
+	// pool and away from the prober
+	Network NetworkPolicy `json:"network"`
+	// Countries keeps hosts in excluded countries out of the pool
+	Countries CountryPolicy `json:"countries"`
+	// Outbound sets how probes and proxy fetches identify themselves
+	Outbound OutboundConfig `json:"outbound"`
+	// RedirectKey signs /out links. Instances behind one load balancer need
+	// the same key, without one a random key is made at startup.
+	RedirectKey string `json:"redirect_key,omitempty"`
+	// Proxy fetches sites on visitors' behalf instead of redirecting them
+	Proxy ProxyConfig `json:"proxy"`
+	// ShadowDecoys are the URLs shadow banned visitors are sent to instead
+	// of the pool, the built-in sample list if empty
+	ShadowDecoys []string `json:"shadow_decoys"`
+	// Privacy hashes client IPs and purges old personal data
+	Privacy PrivacyConfig `json:"privacy"`
+	// Submissions caps the public forms that feed the moderation queue
+	Submissions SubmissionConfig `json:"submissions"`
+	// API controls access to the public JSON API
+	API APIConfig `json:"api"`
+	// MaxBodyBytes caps request bodies, bigger ones get 413
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+	// RateLimit throttles /shuffle and the API per client IP
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Login throttles guessing of the admin password
+	Login LoginConfig `json:"login"`
+	// AdminAllow, if set, restricts /admin and /api/v1/admin to clients
+	// in these IPs or CIDRs, on top of authentication
+	AdminAllow []string `json:"admin_allow"`
+	// TrustedProxies are the IPs or CIDRs of reverse proxies whose
+	// X-Forwarded-For header identifies the real client
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Profile names the built-in defaults the config starts from, see
+	// Profiles. The --profile flag takes precedence.
+	Profile string `json:"profile,omitempty"`
+	// LogLevel is debug, info, warn or error
+	LogLevel string `json:"log_level"`
+	// LogFormat is LogFormatText or LogFormatJSON
+	LogFormat string `json:"log_format"`
+	// LogFile writes the log to a rotated file instead of standard error
+	LogFile LogFileConfig `json:"log_file"`
+	// SlowQueryThreshold logs database queries that take longer, 0 never
+	// does
+	SlowQueryThreshold Duration `json:"slow_query_threshold"`
+	// Probe controls how hard the probe command works
+	Probe ProbeConfig `json:"probe"`
+	// Transport tunes the connections probes and the proxy make to sites
+	Transport TransportConfig `json:"transport"`
+	// Tracing exports OpenTelemetry traces
+	Tracing TracingConfig `json:"tracing"`
+	// ErrorReporting sends panics and failed jobs to Sentry
+	ErrorReporting ErrorReportingConfig `json:"error_reporting"`
+	// Alerts notifies the operator when the pool or jobs look unwell
+	Alerts AlertsConfig `json:"alerts"`
+	// Digest sends a daily summary of the pool
+	Digest DigestConfig `json:"digest"`
+	// Newsletter mails subscribed visitors the week's best new finds
+	Newsletter NewsletterConfig `json:"newsletter"`
+	// Beacon marks sites down when visitors report them failing to load
+	Beacon BeaconConfig `json:"beacon"`
+	// Analytics publishes aggregate spin counters on /stats
+	Analytics AnalyticsConfig `json:"analytics"`
+	// Browse publishes the pool as a searchable list
+	Browse BrowseConfig `json:"browse"`
+	// Favorites lets visitors save sites and export them as bookmarks
+	Favorites FavoritesConfig `json:"favorites"`
+	// Snapshots keeps a copy of each site's listing for when it's down
+	Snapshots SnapshotsConfig `json:"snapshots"`
+	// Verify lets logged in visitors classify sites nobody has yet
+	Verify VerifyConfig `json:"verify"`
+	// Changes reports sites whose listings gained files
+	Changes ChangesConfig `json:"changes"`
+	// Bot answers /roll commands on Telegram and Discord
+	Bot BotConfig `json:"bot"`
+	// S3Export uploads snapshots of the pool to S3-compatible storage
+	S3Export S3ExportConfig `json:"s3_export"`
+	// Hooks run external commands as sites are discovered, probed and served
+	Hooks HooksConfig `json:"hooks"`
+	// ReloadTemplates re-reads templates on every request instead of once
+	ReloadTemplates bool `json:"reload_templates"`
+
+	// path is the file the config was loaded from, for Reload
+	path string
+	// forcedProfile is the profile given on the command line, kept for Reload
+	forcedProfile string
+	// trustedProxies is TrustedProxies parsed by validate
+	trustedProxies []*net.IPNet
+	// adminAllow is AdminAllow parsed by validate
+	adminAllow []*net.IPNet
+}
+
+// ProbeConfig controls probing.
+type ProbeConfig struct {
+	// Workers is the number of concurrent probes
+	Workers int `json:"workers"`
+	// Timeout bounds each probe request
+	Timeout Duration `json:"timeout"`
+	// QueueSize caps the sites one run checks. When the pool is bigger,
+	// routine rechecks of sites that were up are deferred to the next run
+	// first, new and down sites last.
+	QueueSize int `json:"queue_size"`
+	// AgeSamples is how many of the files a site lists are asked for
+	// their Last-Modified each probe, to tell how long it's been left
+	// alone for dusty shuffles. 0 turns sampling off.
+	AgeSamples int `json:"age_samples"`
+}
+
+// Branding is the operator-specific text shown on the index page. Text
+// is escaped, so it can't inject markup.
+type Branding struct {
+	// Title is the page title
+	Title string `json:"title"`
+	// Heading is shown above the button
+	Heading string `json:"heading"`
+	// Tagline is shown below the button
+	Tagline string `json:"tagline"`
+	// LogoURL is an optional image above the heading, such as
+	// "static/logo.png" for a file in the templates directory
+	LogoURL string `json:"logo_url,omitempty"`
+	// Disclaimer is optional small print about the listed sites
+	Disclaimer string `json:"disclaimer,omitempty"`
+	// Footer is optional text at the bottom of the page
+	Footer string `json:"footer,omitempty"`
+}
+
+// ShuffleConfig controls how /shuffle picks a site.
+type ShuffleConfig struct {
+	// Weights biases the pick by probe status. Statuses left out keep their
+	// default weight and a weight of 0 excludes the status entirely.
+	Weights map[string]float64 `json:"weights"`
+	// Ports optionally restricts the pick to sites on these ports
+	Ports []int `json:"ports"`
+	// LiveCheck makes sure a picked site answers before redirecting to it,
+	// picking another if it doesn't
+	LiveCheck bool `json:"live_check"`
+	// Wayback sends visitors to the latest Wayback Machine snapshot of a
+	// site LiveCheck finds down, when there is one, instead of skipping it
+	Wayback bool `json:"wayback"`
+	// Redirect is how visitors are sent to the site: RedirectSeeOther,
+	// RedirectFound, RedirectTemporary or RedirectMeta for an HTML page
+	// that refreshes to it
+	Redirect string `json:"redirect"`
+	// DustyAfter is how long a site's newest file must be untouched for
+	// /shuffle?dusty=1 to pick it. Ages come from probe.age_samples.
+	DustyAfter Duration `json:"dusty_after"`
+	// Themes narrow the default shuffle on a schedule, the first on wins
+	Themes []Theme `json:"themes,omitempty"`
+}
+
+// Duration is a time.Duration that reads from JSON strings like "24h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"24h\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// DefaultShodanQuery finds Python's http.server / SimpleHTTPServer
+const DefaultShodanQuery = "product:SimpleHTTPServer"
+
+// defaultStatusWeights keeps the historic behavior of never serving sites
+// that are known to be down.
+var defaultStatusWeights = map[string]float64{
+	StatusUp:      1,
+	StatusUnknown: 1,
+	StatusDown:    0,
+}
+
+// DefaultConfig returns the settings used when there is no config file,
+// which are those of DefaultProfile.
+func DefaultConfig() *Config {
+	c := &Config{
+		ShodanQueries:      []string{DefaultShodanQuery},
+		ShodanWorkers:      4,
+		ShodanPageInterval: Duration(time.Second),
+		AltPorts:           AltPortsConfig{Ports: []int{8000, 8080, 8888, 80}, Timeout: Duration(3 * time.Second)},
+		URLsFile:           "urls.txt",
+		WatchURLsFile:      true,
+		LogFormat:          LogFormatText,
+		SlowQueryThreshold: Duration(250 * time.Millisecond),
+		LogFile:            LogFileConfig{MaxSizeMB: 100, Keep: 7},
+		DBPath:             MemoryDB,
+		TemplatesDir:       "templates",
+		TokensFile:         "tokens.json",
+		Network:            NetworkPolicy{Deny: defaultDeniedNetworks},
+		RateLimit:          RateLimitConfig{RPS: 2, Burst: 20},
+		MaxBodyBytes:       DefaultMaxBodyBytes,
+		RefreshHoldPercent: 50,
+		Consent:            ConsentConfig{Enabled: true, Text: defaultConsentText},
+		Countries:          CountryPolicy{IPInfo: IPInfoConfig{RPS: 1, CacheFor: Duration(30 * 24 * time.Hour)}},
+		SafeBrowsing:       SafeBrowsingConfig{Action: SafetyBlock, CacheFor: Duration(24 * time.Hour)},
+		Submissions:        SubmissionConfig{PerIP: 5, Global: 100},
+		Login:              LoginConfig{MaxFailures: 5, AccountMaxFailures: 20, Lockout: Duration(15 * time.Minute)},
+		Privacy:            PrivacyConfig{Retention: Duration(30 * 24 * time.Hour)},
+		Probe:              ProbeConfig{QueueSize: DefaultProbeQueueSize},
+		Transport:          TransportConfig{MaxConnsPerHost: 2, MaxIdleConns: 100, IdleTimeout: Duration(30 * time.Second)},
+		Alerts:             AlertsConfig{Interval: Duration(5 * time.Minute)},
+		Digest:             DigestConfig{Hour: 8, Format: DigestMarkdown},
+		Newsletter:         NewsletterConfig{Weekday: 1, Hour: 9},
+		Beacon:             BeaconConfig{Reporters: 3, Window: Duration(time.Hour)},
+		Shuffle:            ShuffleConfig{Redirect: RedirectSeeOther, DustyAfter: Duration(3 * 365 * 24 * time.Hour)},
+		Browse:             BrowseConfig{PageSize: 50},
+		Favorites:          FavoritesConfig{Max: 500},
+		Snapshots:          SnapshotsConfig{MaxBytes: 256 << 10},
+		Verify:             VerifyConfig{Votes: 3},
+		Changes:            ChangesConfig{Interval: Duration(6 * time.Hour), KnownFiles: KnownFilesConfig{PrefixBytes: 4096, PerSite: 5}},
+		S3Export:           S3ExportConfig{Region: "us-east-1", Interval: Duration(24 * time.Hour)},
+		Hooks:              HooksConfig{BeforeServeTimeout: Duration(2 * time.Second)},
+		Proxy:              ProxyConfig{MaxBytes: 10 << 20, Timeout: Duration(15 * time.Second), ContentTypes: defaultProxyContentTypes},
+		Branding: Branding{
+			Title:   "Simple HTTP Roulette",
+			Heading: "SimpleHTTPServer Roulette",
+			Tagline: "Why do people share their whole filesystems?",
+		},
+	}
+	profiles[DefaultProfile].apply(c)
+	return c
+}
+
+// LoadConfig reads and validates the JSON config file at path, filling in
+// defaults for anything it leaves out. An empty path means DefaultConfig.
+func LoadConfig(path string) (*Config, error) {
+	return LoadConfigProfile(path, "")
+}
+
+// LoadConfigProfile is like LoadConfig but starts from the named profile's
+// defaults. An empty profile means the one named in the file, if any.
+func LoadConfigProfile(path, profile string) (*Config, error) {
+	var data []byte
+	if path != "" {
+		var err error
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %v", err)
+		}
+	}
+
+	// The profile has to be known before the file is applied on top of it
+	name := profile
+	if name == "" && data != nil {
+		var named struct {
+			Profile string `json:"profile"`
+		}
+		if err := json.Unmarshal(data, &named); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+		}
+		name = named.Profile
+	}
+	p, err := lookupProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := DefaultConfig()
+	p.apply(c)
+
+	if data != nil {
+		if err := json.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %v", path, err)
+		}
+	}
+	if name == "" {
+		name = DefaultProfile
+	}
+	c.Profile = name
+	c.forcedProfile = profile
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %v", path, err)
+	}
+	c.path = path
+	return c, nil
+}
+
+// DataPath resolves name against DataDir. Absolute paths are returned
+// unchanged.
+func (c *Config) DataPath(name string) string {
+	if c.DataDir == "" || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(c.DataDir, name)
+}
+
+// resolvePaths returns a copy of c with its data paths resolved against
+// DataDir. In-memory and URI-style database paths are left alone.
+func (c *Config) resolvePaths() *Config {
+	resolved := *c
+	resolved.URLsFile = c.DataPath(c.URLsFile)
+	resolved.TokensFile = c.DataPath(c.TokensFile)
+	resolved.URLSources = nil
+	for _, src := range c.URLSources {
+		if src.Path != "" {
+			src.Path = c.DataPath(src.Path)
+		}
+		resolved.URLSources = append(resolved.URLSources, src)
+	}
+	if c.ShodanAPIKeyFile != "" {
+		resolved.ShodanAPIKeyFile = c.DataPath(c.ShodanAPIKeyFile)
+	}
+	if c.Countries.Database != "" {
+		resolved.Countries.Database = c.DataPath(c.Countries.Database)
+	}
+	if c.SafeBrowsing.MalwareList != "" {
+		resolved.SafeBrowsing.MalwareList = c.DataPath(c.SafeBrowsing.MalwareList)
+	}
+	if c.LogFile.Path != "" {
+		resolved.LogFile.Path = c.DataPath(c.LogFile.Path)
+	}
+	if c.DBPath != MemoryStorePath && !strings.HasPrefix(c.DBPath, "file:") {
+		resolved.DBPath = c.DataPath(c.DBPath)
+	}
+	return &resolved
+}
+
+// Path returns the file the config was loaded from, if any.
+func (c *Config) Path() string {
+	return c.path
+}
+
+func (c *Config) validate() error {
+	if len(c.ShodanQueries) == 0 {
+		return fmt.Errorf("shodan_queries must not be empty")
+	}
+	if c.ShodanWorkers <= 0 {
+		return fmt.Errorf("shodan_workers must be positive")
+	}
+	if c.ShodanPageInterval < 0 {
+		return fmt.Errorf("shodan_page_interval must not be negative")
+	}
+	if c.RefreshInterval <= 0 {
+		return fmt.Errorf("refresh_interval must be positive")
+	}
+	switch c.LogLevel {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		return fmt.Errorf("log_level must be %q, %q, %q or %q", LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError)
+	}
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		return fmt.Errorf("log_format must be %q or %q", LogFormatText, LogFormatJSON)
+	}
+	if err := c.LogFile.validate(); err != nil {
+		return err
+	}
+	if c.SlowQueryThreshold < 0 {
+		return fmt.Errorf("slow_query_threshold must not be negative")
+	}
+	if c.Probe.Workers <= 0 {
+		return fmt.Errorf("probe.workers must be positive")
+	}
+	if c.Probe.Timeout <= 0 {
+		return fmt.Errorf("probe.timeout must be positive")
+	}
+	if c.Probe.QueueSize <= 0 {
+		return fmt.Errorf("probe.queue_size must be positive")
+	}
+	if err := c.AltPorts.validate(); err != nil {
+		return err
+	}
+	if c.Probe.AgeSamples < 0 || c.Probe.AgeSamples > ageSamplesMax {
+		return fmt.Errorf("probe.age_samples must be between 0 and %d", ageSamplesMax)
+	}
+	if c.ErrorReporting.DSN != "" {
+		if _, _, err := parseDSN(c.ErrorReporting.DSN); err != nil {
+			return err
+		}
+	}
+	if err := c.Alerts.validate(); err != nil {
+		return err
+	}
+	if err := c.Digest.validate(); err != nil {
+		return err
+	}
+	if err := c.Newsletter.validate(); err != nil {
+		return err
+	}
+	if c.Beacon.Reporters < 0 || c.Beacon.Window < 0 {
+		return fmt.Errorf("beacon settings must not be negative")
+	}
+	if c.Changes.Enabled && c.Changes.Interval <= 0 {
+		return fmt.Errorf("changes.interval must be positive")
+	}
+	if c.Verify.Enabled && c.Verify.Votes <= 0 {
+		return fmt.Errorf("verify.votes must be positive")
+	}
+	if err := c.Snapshots.validate(); err != nil {
+		return err
+	}
+	if err := c.Changes.KnownFiles.validate(); err != nil {
+		return err
+	}
+	if c.Browse.PageSize <= 0 {
+		return fmt.Errorf("browse.page_size must be positive")
+	}
+	if c.Favorites.Max <= 0 {
+		return fmt.Errorf("favorites.max must be positive")
+	}
+	if err := c.Bot.validate(); err != nil {
+		return err
+	}
+	if err := c.S3Export.validate(); err != nil {
+		return err
+	}
+	if len(c.Hooks.BeforeServe) > 0 && c.Hooks.BeforeServeTimeout <= 0 {
+		return fmt.Errorf("hooks.before_serve_timeout must be positive")
+	}
+	for _, src := range c.URLSources {
+		if err := src.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Transport.MaxConnsPerHost < 0 || c.Transport.MaxIdleConns < 0 || c.Transport.IdleTimeout < 0 {
+		return fmt.Errorf("transport limits must not be negative")
+	}
+	for _, cc := range c.Countries.Exclude {
+		if len(cc) != 2 {
+			return fmt.Errorf("countries.exclude entry %q is not a two-letter country code", cc)
+		}
+	}
+	if err := c.Countries.IPInfo.validate(); err != nil {
+		return err
+	}
+	if c.SafeBrowsing.Action != SafetyBlock && c.SafeBrowsing.Action != SafetyWarn {
+		return fmt.Errorf("safe_browsing.action must be %q or %q", SafetyBlock, SafetyWarn)
+	}
+	if c.Proxy.MaxBytes <= 0 {
+		return fmt.Errorf("proxy.max_bytes must be positive")
+	}
+	if c.Proxy.Timeout <= 0 {
+		return fmt.Errorf("proxy.timeout must be positive")
+	}
+	if c.Privacy.Retention <= 0 {
+		return fmt.Errorf("privacy.retention must be positive")
+	}
+	if c.Submissions.PerIP < 0 || c.Submissions.Global < 0 {
+		return fmt.Errorf("submissions caps must not be negative")
+	}
+	if c.Login.MaxFailures < 0 || c.Login.AccountMaxFailures < 0 {
+		return fmt.Errorf("login failure caps must not be negative")
+	}
+	if c.Login.Lockout <= 0 {
+		return fmt.Errorf("login.lockout must be positive")
+	}
+	if c.RefreshHoldPercent < 0 || c.RefreshHoldPercent > 100 {
+		return fmt.Errorf("refresh_hold_percent must be between 0 and 100")
+	}
+	if c.MaxBodyBytes <= 0 {
+		return fmt.Errorf("max_body_bytes must be positive")
+	}
+	if c.RateLimit.RPS < 0 {
+		return fmt.Errorf("rate_limit.rps must not be negative")
+	}
+	if c.RateLimit.RPS > 0 && c.RateLimit.Burst < 1 {
+		return fmt.Errorf("rate_limit.burst must be at least 1")
+	}
+	seen := make(map[string]bool)
+	for _, p := range c.OAuth {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("oauth provider %s is listed twice", p.Name)
+		}
+		seen[p.Name] = true
+	}
+	if err := c.Network.parse(); err != nil {
+		return err
+	}
+	proxies, err := parseCIDRs(c.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("invalid trusted_proxies entry: %v", err)
+	}
+	c.trustedProxies = proxies
+	adminAllow, err := parseCIDRs(c.AdminAllow)
+	if err != nil {
+		return fmt.Errorf("invalid admin_allow entry: %v", err)
+	}
+	c.adminAllow = adminAllow
+	for status, weight := range c.Shuffle.Weights {
+		if weight < 0 {
+			return fmt.Errorf("shuffle weight for %q must not be negative", status)
+		}
+	}
+	if !validRedirect(c.Shuffle.Redirect) {
+		return fmt.Errorf("shuffle.redirect must be %q, %q, %q or %q", RedirectSeeOther, RedirectFound, RedirectTemporary, RedirectMeta)
+	}
+	if c.Shuffle.DustyAfter <= 0 {
+		return fmt.Errorf("shuffle.dusty_after must be positive")
+	}
+	names := make(map[string]bool)
+	for i := range c.Shuffle.Themes {
+		t := &c.Shuffle.Themes[i]
+		if err := t.parse(); err != nil {
+			return err
+		}
+		if names[t.Name] {
+			return fmt.Errorf("theme %q is configured twice", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return nil
+}
+
+// statusWeight returns the shuffle weight for sites with the given status.
+func (c *Config) statusWeight(status string) float64 {
+	if w, ok := c.Shuffle.Weights[status]; ok {
+		return w
+	}
+	return defaultStatusWeights[status]
+}
+
+// isBlocked reports whether rawURL points at a blocklisted host.
+func (c *Config) isBlocked(rawURL string) bool {
+	host, _ := splitHostPort(rawURL)
+	for _, blocked := range c.Blocklist {
+		if strings.EqualFold(host, blocked) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHostPort extracts the host and port of a site URL, filling in the
+// scheme's default port.
+func splitHostPort(rawURL string) (string, int) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", 0
+	}
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	n, _ := strconv.Atoi(port)
+	// Normalize IPs so blocklist entries match however the URL spelled them
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return strings.ToLower(host), n
+}
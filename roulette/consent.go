@@ -0,0 +1,65 @@
+package roulette
+
+import (
+	"net/http"
+)
+
+const consentCookie = "roulette_consent" // Session cookie set once the visitor accepted the warning
+
+// defaultConsentText is shown on the interstitial unless the config
+// replaces it.
+const defaultConsentText = "You are about to visit a random, unvetted third-party server. " +
+	"Its owner may not know it is public, and it may host anything, including malware. " +
+	"Don't download or run files you don't trust."
+
+// ConsentConfig controls the warning shown before the first redirect of
+// a browser session.
+type ConsentConfig struct {
+	// Enabled shows the warning, it is on by default
+	Enabled bool `json:"enabled"`
+	// Text is the warning shown to visitors
+	Text string `json:"text"`
+}
+
+// consentPage is the data the consent template is rendered with.
+type consentPage struct {
+	basePage
+	Text string
+}
+
+// hasConsented reports whether r's visitor accepted the warning in this
+// browser session, or doesn't need to.
+func (rl *Roulette) hasConsented(r *http.Request) bool {
+	if !rl.Config().Consent.Enabled {
+		return true
+	}
+	_, err := r.Cookie(consentCookie)
+	return err == nil
+}
+
+// renderConsent shows the warning in place of a redirect.
+func (rl *Roulette) renderConsent(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config()
+	w.Header().Set("Cache-Control", "no-store")
+	rl.render(w, "consent.html", consentPage{basePage: rl.pageBase(w, r), Text: c.Consent.Text})
+}
+
+// consentHandler records the visitor's acceptance and continues to
+// /shuffle.
+func (rl *Roulette) consentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// No expiry, so it lasts for the browser session
+	http.SetCookie(w, &http.Cookie{
+		Name:     consentCookie,
+		Value:    "1",
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	redirectRelative(w, "shuffle")
+}
@@ -0,0 +1,168 @@
+package roulette
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CountryPolicy keeps hosts in some countries out of the pool. Shodan
+// reports the country of each result; for imported URLs and the URL list
+// the country of IP addresses comes from Database.
+type CountryPolicy struct {
+	// Exclude lists ISO 3166-1 alpha-2 country codes never stored or served
+	Exclude []string `json:"exclude"`
+	// Database is an IP-to-country CSV, rows of start,end,country. Ranges
+	// can be IP addresses (DB-IP) or IPv4 integers (IP2Location).
+	Database string `json:"database,omitempty"`
+	// ExcludeUnknown also drops hosts whose country can't be determined
+	ExcludeUnknown bool `json:"exclude_unknown"`
+	// IPInfo looks countries up online instead, when Database is unset
+	IPInfo IPInfoConfig `json:"ipinfo"`
+}
+
+// excludes reports whether hosts in country must be kept out. An empty
+// country is unknown.
+func (p CountryPolicy) excludes(country string) bool {
+	if len(p.Exclude) == 0 {
+		return false
+	}
+	if country == "" {
+		return p.ExcludeUnknown
+	}
+	for _, cc := range p.Exclude {
+		if strings.EqualFold(cc, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// countryRange is one row of the country database.
+type countryRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// countryDB is the parsed country database, reloaded when the file changes.
+type countryDB struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	ranges  []countryRange // Sorted by start
+}
+
+// lookup returns the country of ip, or "" if the database doesn't know.
+func (db *countryDB) lookup(path string, ip netip.Addr) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.path != path || !info.ModTime().Equal(db.modTime) {
+		start := time.Now()
+		ranges, err := readCountryDB(path)
+		if err != nil {
+			return "", err
+		}
+		db.path, db.modTime, db.ranges = path, info.ModTime(), ranges
+		appLog.Info("Loaded country ranges", "count", len(ranges), "path", path, "took", time.Since(start).Round(time.Millisecond))
+	}
+	ip = ip.Unmap()
+	// The last range starting at or before ip is the only candidate
+	i := sort.Search(len(db.ranges), func(i int) bool { return db.ranges[i].start.Compare(ip) > 0 }) - 1
+	if i >= 0 && db.ranges[i].end.Compare(ip) >= 0 {
+		return db.ranges[i].country, nil
+	}
+	return "", nil
+}
+
+func readCountryDB(path string) ([]countryRange, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	var ranges []countryRange
+	for line := 1; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse country database: %v", err)
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("country database line %d: want start,end,country", line)
+		}
+		start, err1 := parseRangeAddr(record[0])
+		end, err2 := parseRangeAddr(record[1])
+		if err1 != nil || err2 != nil {
+			// Tolerate a header row
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("country database line %d: invalid address", line)
+		}
+		ranges = append(ranges, countryRange{start: start, end: end, country: strings.ToUpper(record[2])})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	return ranges, nil
+}
+
+// parseRangeAddr reads an address written as an IP or an IPv4 integer.
+func parseRangeAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return addr.Unmap(), nil
+}
+
+// countryOf returns the country of the host rawURL points at, or "" if it
+// is unknown: hostnames aren't resolved, only IP addresses are looked up,
+// in Database or else on ipinfo.io.
+func (rl *Roulette) countryOf(rawURL string) string {
+	c := rl.Config().Countries
+	ipinfo := rl.ipinfoStore()
+	if c.Database == "" && ipinfo == nil {
+		return ""
+	}
+	host, _ := splitHostPort(rawURL)
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return ""
+	}
+	if ipinfo != nil {
+		return rl.ipinfo.country(ipinfo, ip, time.Duration(c.IPInfo.CacheFor))
+	}
+	country, err := rl.countries.lookup(c.Database, ip)
+	if err != nil {
+		appLog.Error("Failed to look up country", "err", err)
+		return ""
+	}
+	return country
+}
+
+// countryExcluded reports whether rawURL's host is in an excluded country.
+func (rl *Roulette) countryExcluded(rawURL string) bool {
+	c := rl.Config().Countries
+	if len(c.Exclude) == 0 {
+		return false
+	}
+	return c.excludes(rl.countryOf(rawURL))
+}
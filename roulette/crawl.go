@@ -0,0 +1,67 @@
+package roulette
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const listingMaxBytes = 1 << 20 // Bytes of a listing read at most
+
+// hrefPattern finds the links in a listing. Directory listings are simple
+// enough that this beats parsing the HTML.
+var hrefPattern = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*["']([^"']+)["']`)
+
+// fetchListing downloads the page at url for the crawlers.
+func fetchListing(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, listingMaxBytes))
+}
+
+// listingEntries returns the files and directories a listing at base links
+// to, as paths relative to it, sorted. Sort links, the parent directory
+// and links elsewhere are left out. Directories end in a slash.
+func listingEntries(base string, body []byte) []string {
+	root, err := neturl.Parse(base)
+	if err != nil {
+		return nil
+	}
+	dir := root.Path
+	if !strings.HasSuffix(dir, "/") {
+		dir = dir[:strings.LastIndex(dir, "/")+1]
+	}
+	var entries []string
+	for _, m := range hrefPattern.FindAllSubmatch(body, -1) {
+		link, err := neturl.Parse(string(m[1]))
+		if err != nil || link.RawQuery != "" {
+			continue
+		}
+		u := root.ResolveReference(link)
+		if u.Host != root.Host || u.Scheme != root.Scheme {
+			continue
+		}
+		name, ok := strings.CutPrefix(u.Path, dir)
+		if !ok || name == "" || name == root.Path[len(dir):] || strings.ContainsAny(name, "\r\n") {
+			continue
+		}
+		entries = append(entries, name)
+	}
+	slices.Sort(entries)
+	return slices.Compact(entries)
+}
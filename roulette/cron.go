@@ -0,0 +1,88 @@
+package roulette
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression: minute, hour, day of month,
+// month and day of week, each a bit set of the values it matches.
+type cronSchedule struct {
+	fields [5]uint64
+	// Whether day of month and day of week were restricted, cron matches
+	// either when both are
+	domSet, dowSet bool
+}
+
+// cronFields are the bounds of each field of a cron expression.
+var cronFields = [5]struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 6}}
+
+// parseCron parses a five field cron expression, with *, lists, ranges
+// and steps such as "*/15 9-17 * * 1,3,5". Sunday is 0, or 7.
+func parseCron(expr string) (cronSchedule, error) {
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return cronSchedule{}, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+	var s cronSchedule
+	for i, part := range parts {
+		f := cronFields[i]
+		max := f.max
+		if i == 4 {
+			max = 7 // Sunday again
+		}
+		for _, item := range strings.Split(part, ",") {
+			rng, stepText, hasStep := strings.Cut(item, "/")
+			step := 1
+			if hasStep {
+				n, err := strconv.Atoi(stepText)
+				if err != nil || n <= 0 {
+					return cronSchedule{}, fmt.Errorf("cron expression %q: bad step in the %s field", expr, f.name)
+				}
+				step = n
+			}
+			lo, hi := f.min, max
+			if rng != "*" {
+				loText, hiText, isRange := strings.Cut(rng, "-")
+				var err error
+				if lo, err = strconv.Atoi(loText); err != nil {
+					return cronSchedule{}, fmt.Errorf("cron expression %q: bad %s %q", expr, f.name, item)
+				}
+				hi = lo
+				if isRange {
+					if hi, err = strconv.Atoi(hiText); err != nil {
+						return cronSchedule{}, fmt.Errorf("cron expression %q: bad %s %q", expr, f.name, item)
+					}
+				} else if hasStep {
+					hi = max
+				}
+			}
+			if lo < f.min || hi > max || lo > hi {
+				return cronSchedule{}, fmt.Errorf("cron expression %q: %s %q is out of range", expr, f.name, item)
+			}
+			for v := lo; v <= hi; v += step {
+				s.fields[i] |= 1 << (v % (f.max + 1))
+			}
+		}
+	}
+	s.domSet, s.dowSet = parts[2] != "*", parts[4] != "*"
+	return s, nil
+}
+
+// matches reports whether the schedule matches the minute of t.
+func (s cronSchedule) matches(t time.Time) bool {
+	has := func(field, v int) bool { return s.fields[field]&(1<<v) != 0 }
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	if s.domSet && s.dowSet {
+		return dom || dow
+	}
+	return dom && dow
+}
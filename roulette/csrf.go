@@ -0,0 +1,78 @@
+package roulette
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+const csrfCookie = "roulette_csrf" // Cookie holding the browser's CSRF token
+const csrfField = "csrf_token"     // Form field the token is echoed in
+const csrfHeader = "X-CSRF-Token"  // Header alternative to the form field
+
+// basePage is embedded in the data of every page template.
+type basePage struct {
+	Branding Branding
+	// CSRF is the token forms must send back in the csrf_token field
+	CSRF string
+}
+
+// pageBase returns the common page data, giving the browser a CSRF token
+// cookie if it doesn't have one yet.
+func (rl *Roulette) pageBase(w http.ResponseWriter, r *http.Request) basePage {
+	return basePage{Branding: rl.Config().Branding, CSRF: csrfToken(w, r)}
+}
+
+// csrfToken returns the browser's CSRF token, issuing one if needed.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(csrfCookie); err == nil && len(cookie.Value) == 32 {
+		return cookie.Value
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// csrfProtect rejects state-changing requests that could have been sent by
+// another site. Browsers must echo the token from their CSRF cookie, as
+// the csrf_token form field or the X-CSRF-Token header. Requests with a
+// bearer token, and non-browser clients that send no cookies and no
+// Origin or Sec-Fetch-Site, don't need one.
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		browser := r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "" || r.Header.Get("Cookie") != ""
+		if !browser {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrfCookie)
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.PostFormValue(csrfField)
+		}
+		if err != nil || sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) != 1 {
+			http.Error(w, "Invalid or missing CSRF token, reload the page and try again", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,22 @@
+package roulette
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+)
+
+// demoURLs is a small curated list of public mirrors and archives that
+// deliberately publish directory listings, for demos without Shodan.
+//
+//go:embed demo_urls.txt
+var demoURLs []byte
+
+// ErrDemoMode is returned by operations that would reach out to Shodan or
+// the listed hosts, or modify the URL list, while in demo mode.
+var ErrDemoMode = errors.New("disabled in demo mode")
+
+// demoReader returns the embedded sample list.
+func demoReader() *bytes.Reader {
+	return bytes.NewReader(demoURLs)
+}
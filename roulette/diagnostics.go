@@ -0,0 +1,223 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const jobHistory = 10 // Finished runs kept per job
+
+// Names of the jobs that run without a lease, next to refreshLease and
+// probeLease
+const (
+	syncJob  = "sync"
+	purgeJob = "purge"
+)
+
+// Job states
+const (
+	JobIdle    = "idle" // Never run
+	JobRunning = "running"
+	JobOK      = "ok" // The last run succeeded
+	JobFailed  = "failed"
+)
+
+// JobTiming sums up the runs of one background job. While it's Running,
+// LastStart is when the current run started and Progress, if the job
+// reports any, how far it got.
+type JobTiming struct {
+	State        string       `json:"state"`
+	Runs         int64        `json:"runs"`
+	Running      bool         `json:"running"`
+	LastStart    time.Time    `json:"last_start"`
+	LastDuration Duration     `json:"last_duration"`
+	LastError    string       `json:"last_error,omitempty"`
+	Progress     *JobProgress `json:"progress,omitempty"`
+	Recent       []JobRun     `json:"recent,omitempty"` // Oldest first
+}
+
+// JobProgress counts the work a run has done out of what it has to do.
+type JobProgress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// JobRun is one finished run of a job.
+type JobRun struct {
+	Start    time.Time `json:"start"`
+	Duration Duration  `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// clone returns a copy of t that shares nothing with it.
+func (t JobTiming) clone() JobTiming {
+	if t.Progress != nil {
+		p := *t.Progress
+		t.Progress = &p
+	}
+	t.Recent = slices.Clone(t.Recent)
+	if t.State == "" {
+		t.State = JobIdle
+	}
+	return t
+}
+
+// jobTimings records how the background jobs have been running.
+type jobTimings struct {
+	mu   sync.Mutex
+	jobs map[string]JobTiming
+}
+
+// timed wraps the job fn so its runs are recorded under name.
+func (rl *Roulette) timed(name string, fn func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		start := time.Now()
+		rl.timings.update(name, func(t *JobTiming) {
+			t.State = JobRunning
+			t.Running = true
+			t.LastStart = start.UTC()
+			t.Progress = nil
+		})
+		ctx, span := rl.startSpan(ctx, "job "+name)
+		defer func() {
+			if v := recover(); v != nil {
+				rl.reportPanic(v, map[string]string{"job": name})
+				panic(v)
+			}
+		}()
+		err := fn(ctx)
+		span.finish(err)
+		if reportable(err) {
+			rl.reportError(err, map[string]string{"job": name})
+		}
+		rl.timings.update(name, func(t *JobTiming) {
+			t.Runs++
+			t.State = JobOK
+			t.Running = false
+			t.LastDuration = Duration(time.Since(start))
+			t.LastError = ""
+			if err != nil {
+				t.State = JobFailed
+				t.LastError = err.Error()
+			}
+			t.Progress = nil
+			t.Recent = append(t.Recent, JobRun{Start: t.LastStart, Duration: t.LastDuration, Error: t.LastError})
+			if len(t.Recent) > jobHistory {
+				t.Recent = slices.Delete(t.Recent, 0, len(t.Recent)-jobHistory)
+			}
+		})
+		return err
+	}
+}
+
+// update changes the timing of the job called name.
+func (j *jobTimings) update(name string, change func(t *JobTiming)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.jobs == nil {
+		j.jobs = make(map[string]JobTiming)
+	}
+	t := j.jobs[name]
+	change(&t)
+	j.jobs[name] = t
+}
+
+// progress records how far the running job called name got. Jobs call it
+// as they go; done and total are in whatever units suit the job.
+func (rl *Roulette) progress(name string, done, total int) {
+	rl.timings.update(name, func(t *JobTiming) {
+		if t.Running {
+			t.Progress = &JobProgress{Done: done, Total: total}
+		}
+	})
+}
+
+// JobStatus returns the timing of the job called name.
+func (rl *Roulette) JobStatus(name string) JobTiming {
+	rl.timings.mu.Lock()
+	defer rl.timings.mu.Unlock()
+	return rl.timings.jobs[name].clone()
+}
+
+// Job is one background job's name and timing.
+type Job struct {
+	Name string `json:"name"`
+	JobTiming
+}
+
+// Jobs returns every background job that has run, by name.
+func (rl *Roulette) Jobs() []Job {
+	rl.timings.mu.Lock()
+	defer rl.timings.mu.Unlock()
+	jobs := make([]Job, 0, len(rl.timings.jobs))
+	for name, t := range rl.timings.jobs {
+		jobs = append(jobs, Job{Name: name, JobTiming: t.clone()})
+	}
+	slices.SortFunc(jobs, func(a, b Job) int { return strings.Compare(a.Name, b.Name) })
+	return jobs
+}
+
+// Diagnostics is the roulette's part of /debug/vars.
+type Diagnostics struct {
+	Pool        int                  `json:"pool"`
+	Goroutines  int                  `json:"goroutines"`
+	Jobs        map[string]JobTiming `json:"jobs"`
+	Stats       StatsCounters        `json:"stats"`
+	Panics      int64                `json:"panics"`       // Requests that panicked
+	SlowQueries int64                `json:"slow_queries"` // Database queries over the slow query threshold
+}
+
+// Diagnostics returns the pool size, goroutine count, job timings, visit
+// statistics queue counts, panicked requests and slow queries.
+func (rl *Roulette) Diagnostics() Diagnostics {
+	d := Diagnostics{
+		Goroutines:  runtime.NumGoroutine(),
+		Jobs:        make(map[string]JobTiming),
+		Stats:       rl.StatsCounters(),
+		Panics:      rl.panics.Load(),
+		SlowQueries: logging.slowQueries.Load(),
+	}
+	if sites, err := rl.store.List(SiteFilter{}); err == nil {
+		d.Pool = len(sites)
+	}
+	rl.timings.mu.Lock()
+	for name, t := range rl.timings.jobs {
+		d.Jobs[name] = t.clone()
+	}
+	rl.timings.mu.Unlock()
+	return d
+}
+
+// DebugVars serves the expvar variables, like expvar.Handler, with the
+// roulette's Diagnostics added as "roulette". It's for admins only, see
+// RequireAdmin.
+func (rl *Roulette) DebugVars() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := make(map[string]json.RawMessage)
+		expvar.Do(func(kv expvar.KeyValue) {
+			vars[kv.Key] = json.RawMessage(kv.Value.String())
+		})
+		d, err := json.Marshal(rl.Diagnostics())
+		if err != nil {
+			http.Error(w, "Failed to encode diagnostics", http.StatusInternalServerError)
+			return
+		}
+		vars["roulette"] = d
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(vars)
+	})
+}
+
+// RequireAdmin lets only admins through to h, the same way as the admin
+// routes: an API token or admin session. Without either configured, no
+// one gets through.
+func (rl *Roulette) RequireAdmin(h http.Handler) http.Handler {
+	return rl.requireAdmin(h.ServeHTTP)
+}
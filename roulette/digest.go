@@ -0,0 +1,285 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const digestJob = "digest"
+const digestListMax = 20 // Sites listed per digest section, the rest are only counted
+const digestTopVisited = 10
+
+// Digest formats
+const (
+	DigestHTML     = "html"
+	DigestMarkdown = "markdown"
+)
+
+// DigestConfig sends a daily summary of the pool, so owners can follow it
+// passively. Without a webhook or email it's only shown at /admin/digest.
+type DigestConfig struct {
+	// Hour is the hour of the day, UTC, the digest goes out at
+	Hour int `json:"hour"`
+	// Format is DigestHTML or DigestMarkdown
+	Format string `json:"format"`
+	// Webhook is POSTed a JSON object with the subject, format and body
+	Webhook string `json:"webhook,omitempty"`
+	// Email mails the digest
+	Email AlertEmail `json:"email"`
+}
+
+func (d DigestConfig) validate() error {
+	if d.Hour < 0 || d.Hour > 23 {
+		return fmt.Errorf("digest.hour must be between 0 and 23")
+	}
+	if d.Format != DigestHTML && d.Format != DigestMarkdown {
+		return fmt.Errorf("digest.format must be %q or %q", DigestHTML, DigestMarkdown)
+	}
+	return d.Email.validate("digest.email")
+}
+
+// Digest sums up a day of the pool.
+type Digest struct {
+	From, To   time.Time
+	Pool       int
+	Up         int
+	New        DigestSites // Discovered
+	Dead       DigestSites // Quarantined
+	Removed    DigestSites
+	TopVisited []VisitedSite
+	Refresh    JobTiming       // As seen by this instance
+	Syncs      []RefreshReport // Newest first
+}
+
+// DigestSites are the events of one kind in a digest, the first
+// digestListMax of them listed.
+type DigestSites struct {
+	Count  int
+	Events []SiteEvent
+}
+
+func (d *DigestSites) add(e SiteEvent) {
+	d.Count++
+	if len(d.Events) < digestListMax {
+		d.Events = append(d.Events, e)
+	}
+}
+
+// VisitedSite is a site and how many visitors it was sent.
+type VisitedSite struct {
+	ID     int64
+	URL    string
+	Visits int
+}
+
+// Subject is the digest's title, for mails and webhooks.
+func (d Digest) Subject() string {
+	return "Daily digest for " + d.To.Format("2006-01-02")
+}
+
+// BuildDigest sums up the day up to now. Parts the store doesn't keep
+// are left empty.
+func (rl *Roulette) BuildDigest() (Digest, error) {
+	now := time.Now().UTC()
+	d := Digest{From: now.Add(-24 * time.Hour), To: now, Refresh: rl.JobStatus(refreshLease)}
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return Digest{}, err
+	}
+	urls := make(map[int64]string, len(sites))
+	for _, s := range sites {
+		urls[s.ID] = s.URL
+		if s.Status == StatusUp {
+			d.Up++
+		}
+	}
+	d.Pool = len(sites)
+
+	if store, ok := rl.store.(SiteEventStore); ok {
+		events, err := store.SiteEventsSince(d.From)
+		if err != nil {
+			return Digest{}, err
+		}
+		for _, e := range events {
+			switch e.Kind {
+			case EventDiscovered:
+				d.New.add(e)
+			case EventQuarantined:
+				d.Dead.add(e)
+			case EventRemoved:
+				d.Removed.add(e)
+			}
+		}
+	}
+	if store, ok := rl.store.(StatsStore); ok {
+		top, err := store.TopVisits(d.From.Format("2006-01-02"), digestTopVisited)
+		if err != nil {
+			return Digest{}, err
+		}
+		for _, v := range top {
+			d.TopVisited = append(d.TopVisited, VisitedSite{ID: v.SiteID, URL: urls[v.SiteID], Visits: v.Count})
+		}
+	}
+	if store, ok := rl.store.(RefreshHistoryStore); ok {
+		reports, err := store.RefreshReports(refreshHistoryPage)
+		if err != nil {
+			return Digest{}, err
+		}
+		for _, r := range reports {
+			if r.Time.Before(d.From) {
+				break
+			}
+			d.Syncs = append(d.Syncs, r)
+		}
+	}
+	return d, nil
+}
+
+var digestMarkdown = template.Must(template.New("digest").Funcs(template.FuncMap{"minus": func(a, b int) int { return a - b }}).Parse(`# {{.Subject}}
+
+{{.Pool}} sites in the pool, {{.Up}} up.
+
+## Refresh
+
+{{with .Refresh}}Last refresh: {{if .LastStart.IsZero}}not run on this instance{{else}}{{.State}}, started {{.LastStart.Format "2006-01-02 15:04"}} UTC{{with .LastError}} ({{.}}){{end}}{{end}}{{end}}
+{{range .Syncs}}
+- {{.Time.Format "15:04"}} {{.Source}}: {{.Added}} added, {{.Removed}} removed{{with .Error}}, failed: {{.}}{{end}}{{end}}
+{{define "sites"}}{{.Count}}
+{{range .Events}}
+- {{.URL}}{{end}}{{if gt .Count (len .Events)}}
+- and {{minus .Count (len .Events)}} more{{end}}
+{{end}}
+## New sites: {{template "sites" .New}}
+## Dead sites: {{template "sites" .Dead}}
+## Removed sites: {{template "sites" .Removed}}
+## Top visited
+{{range .TopVisited}}
+- {{.URL}}: {{.Visits}}{{else}}
+None.{{end}}
+`))
+
+// renderDigest renders d in format, DigestHTML or DigestMarkdown.
+func (rl *Roulette) renderDigest(d Digest, format string) (string, error) {
+	var b bytes.Buffer
+	if format == DigestMarkdown {
+		if err := digestMarkdown.Execute(&b, d); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+	tmpl, err := rl.template("digest.html")
+	if err != nil {
+		return "", err
+	}
+	if err := tmpl.Execute(&b, d); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// sendDigest builds today's digest and sends it to the configured
+// webhook and email.
+func (rl *Roulette) sendDigest(ctx context.Context) error {
+	c := rl.Config().Digest
+	d, err := rl.BuildDigest()
+	if err != nil {
+		return fmt.Errorf("failed to build the digest: %v", err)
+	}
+	body, err := rl.renderDigest(d, c.Format)
+	if err != nil {
+		return fmt.Errorf("failed to render the digest: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, alertSendTimeout)
+	defer cancel()
+	var errs []string
+	if c.Webhook != "" {
+		if err := postJSON(ctx, c.Webhook, map[string]string{"subject": d.Subject(), "format": c.Format, "body": body}); err != nil {
+			errs = append(errs, fmt.Sprintf("webhook: %v", err))
+		}
+	}
+	if c.Email.SMTP != "" {
+		contentType := "text/html"
+		if c.Format == DigestMarkdown {
+			contentType = "text/markdown"
+		}
+		if err := sendMail(c.Email, d.Subject(), contentType, body); err != nil {
+			errs = append(errs, fmt.Sprintf("email: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to send the digest: %s", strings.Join(errs, ", "))
+	}
+	appLog.Info("Sent the daily digest", "new", d.New.Count, "dead", d.Dead.Count, "removed", d.Removed.Count)
+	return nil
+}
+
+// digestSchedule remembers the day the digest last went out.
+type digestSchedule struct {
+	sent string
+}
+
+// due reports whether the digest should go out at now for hour, marking
+// it sent if so.
+func (s *digestSchedule) due(now time.Time, hour int) bool {
+	day := now.Format("2006-01-02")
+	if now.Hour() != hour || s.sent == day {
+		return false
+	}
+	s.sent = day
+	return true
+}
+
+// startDigest sends the digest every day at the configured hour, while a
+// webhook or email is configured, until ctx is cancelled.
+func (rl *Roulette) startDigest(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		var schedule digestSchedule
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c := rl.Config().Digest
+				if (c.Webhook != "" || c.Email.SMTP != "") && schedule.due(now.UTC(), c.Hour) {
+					rl.timed(digestJob, rl.sendDigest)(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// adminDigestHandler shows the digest as it would go out now, as HTML or,
+// with format=markdown, as Markdown.
+func (rl *Roulette) adminDigestHandler(w http.ResponseWriter, r *http.Request) {
+	d, err := rl.BuildDigest()
+	if err != nil {
+		httpLog.Error("Failed to build the digest", "err", err)
+		http.Error(w, "Failed to build the digest", http.StatusInternalServerError)
+		return
+	}
+	format := DigestHTML
+	if r.URL.Query().Get("format") == DigestMarkdown {
+		format = DigestMarkdown
+	}
+	body, err := rl.renderDigest(d, format)
+	if err != nil {
+		httpLog.Error("Failed to render the digest", "err", err)
+		http.Error(w, "Failed to render the digest", http.StatusInternalServerError)
+		return
+	}
+	if format == DigestMarkdown {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	fmt.Fprint(w, body)
+}
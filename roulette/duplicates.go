@@ -0,0 +1,97 @@
+package roulette
+
+import (
+	"strings"
+	"sync"
+)
+
+// ContentHashStore is implemented by stores that keep a hash of what each
+// site served when last probed.
+type ContentHashStore interface {
+	// SetContentHashes records the hashes of the sites in hashes, an empty
+	// one dropping the site's hash.
+	SetContentHashes(hashes map[int64]string) error
+	// ContentHashes returns every site's hash by site ID.
+	ContentHashes() (map[int64]string, error)
+}
+
+// duplicateSet maps sites serving the same listing as another site on the
+// same host, such as http://host:8000 and https://host:8443, to the one
+// visitors are sent to. It's worked out again after every probe.
+type duplicateSet struct {
+	mu   sync.Mutex
+	of   map[int64]int64
+	once sync.Once // Links the stored hashes before the first lookup
+}
+
+// recordHashes stores the content hashes a probe run found and links the
+// duplicates anew.
+func (rl *Roulette) recordHashes(hashes map[int64]string) {
+	store, ok := rl.store.(ContentHashStore)
+	if !ok || len(hashes) == 0 {
+		return
+	}
+	if err := store.SetContentHashes(hashes); err != nil {
+		probeLog.Error("Failed to record content hashes", "err", err)
+		return
+	}
+	rl.linkDuplicates()
+}
+
+// linkDuplicates groups the sites that are up by host and content hash.
+// Each group is one logical site, entered through its https variant or,
+// failing that, the oldest.
+func (rl *Roulette) linkDuplicates() {
+	of := make(map[int64]int64)
+	if store, ok := rl.store.(ContentHashStore); ok {
+		hashes, err := store.ContentHashes()
+		if err != nil {
+			probeLog.Error("Failed to read content hashes", "err", err)
+			return
+		}
+		sites, err := rl.store.List(SiteFilter{Status: StatusUp})
+		if err != nil {
+			probeLog.Error("Failed to list sites", "err", err)
+			return
+		}
+		preferred := make(map[string]Site)
+		var linked []Site
+		for _, site := range sites {
+			hash := hashes[site.ID]
+			if hash == "" {
+				continue
+			}
+			key := strings.ToLower(site.Host) + " " + hash
+			p, ok := preferred[key]
+			switch {
+			case !ok:
+				preferred[key] = site
+				continue
+			case !strings.HasPrefix(p.URL, "https://") && strings.HasPrefix(site.URL, "https://"):
+				// List returns sites oldest first, so only a switch to
+				// https replaces the preferred one
+				preferred[key], site = site, p
+			}
+			linked = append(linked, site)
+		}
+		for _, site := range linked {
+			of[site.ID] = preferred[strings.ToLower(site.Host)+" "+hashes[site.ID]].ID
+		}
+	}
+	rl.duplicates.mu.Lock()
+	rl.duplicates.of = of
+	rl.duplicates.mu.Unlock()
+	if len(of) > 0 {
+		probeLog.Info("Linked duplicate sites", "duplicates", len(of))
+	}
+}
+
+// duplicateOf returns the site visitors are sent to instead of the site
+// with the given ID, if it's a duplicate.
+func (rl *Roulette) duplicateOf(id int64) (int64, bool) {
+	rl.duplicates.once.Do(rl.linkDuplicates)
+	rl.duplicates.mu.Lock()
+	defer rl.duplicates.mu.Unlock()
+	preferred, ok := rl.duplicates.of[id]
+	return preferred, ok
+}
@@ -0,0 +1,234 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const errorReportTimeout = 5 * time.Second // Per event sent
+const errorReportQueue = 100               // Events waiting to be sent before new ones are dropped
+const errorReportsPerMinute = 30           // Cap, so a failure loop doesn't flood the project
+
+// ErrorReportingConfig sends panics and failed jobs to Sentry, or a
+// compatible service such as GlitchTip, since log files on a VPS go
+// unread.
+type ErrorReportingConfig struct {
+	// DSN is the project's DSN, https://key@host/project. Empty turns
+	// reporting off.
+	DSN string `json:"dsn,omitempty"`
+	// Environment tags the events, by default the profile name
+	Environment string `json:"environment,omitempty"`
+}
+
+// parseDSN returns the envelope endpoint and public key of a DSN.
+func parseDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return "", "", fmt.Errorf("invalid error_reporting.dsn")
+	}
+	project := strings.Trim(u.Path, "/")
+	// Self-hosted instances may live under a path, the project ID is last
+	prefix, id := "", project
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, id = "/"+project[:i], project[i+1:]
+	}
+	if id == "" {
+		return "", "", fmt.Errorf("invalid error_reporting.dsn: no project ID")
+	}
+	return fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, id), u.User.Username(), nil
+}
+
+// errorEvent is a Sentry event, trimmed to what we fill in.
+type errorEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   struct {
+		Values []errorException `json:"values"`
+	} `json:"exception"`
+}
+
+type errorException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []errorFrame `json:"frames"` // Outermost first
+	} `json:"stacktrace"`
+}
+
+type errorFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// errorReporter sends events from the background, except for panics,
+// which are sent before the panic carries on.
+type errorReporter struct {
+	rl     *Roulette
+	events chan errorEvent
+	http   *http.Client
+
+	mu     sync.Mutex
+	window time.Time // Start of the minute being counted
+	sent   int
+}
+
+func (rl *Roulette) startErrorReporter() {
+	r := &errorReporter{rl: rl, events: make(chan errorEvent, errorReportQueue), http: &http.Client{Timeout: errorReportTimeout}}
+	rl.reporter = r
+	go func() {
+		for e := range r.events {
+			r.send(e)
+		}
+	}()
+}
+
+// reportError reports a failure that won't fix itself by retrying. tags
+// carry the context, such as the job name or site ID.
+func (rl *Roulette) reportError(err error, tags map[string]string) {
+	if rl.reporter == nil || rl.Config().ErrorReporting.DSN == "" || !rl.reporter.allow() {
+		return
+	}
+	kind := fmt.Sprintf("%T", err)
+	// Plain and wrapped errors have no telling type, only their message
+	if kind == "*errors.errorString" || strings.HasPrefix(kind, "*fmt.") {
+		kind = "error"
+	}
+	e := rl.newErrorEvent("error", kind, err.Error(), 3, tags)
+	select {
+	case rl.reporter.events <- e:
+	default:
+	}
+}
+
+// reportPanic reports a recovered panic value now, so it isn't lost if
+// the panic goes on to end the process. Call it from the deferred
+// function that recovered.
+func (rl *Roulette) reportPanic(v any, tags map[string]string) {
+	if rl.reporter == nil || rl.Config().ErrorReporting.DSN == "" || !rl.reporter.allow() {
+		return
+	}
+	rl.reporter.send(rl.newErrorEvent("fatal", "panic", fmt.Sprint(v), 4, tags))
+}
+
+// allow counts an event against the per-minute cap.
+func (r *errorReporter) allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.window) > time.Minute {
+		r.window, r.sent = now, 0
+	}
+	r.sent++
+	return r.sent <= errorReportsPerMinute
+}
+
+// newErrorEvent builds an event with the stack of its caller's caller,
+// skip frames up.
+func (rl *Roulette) newErrorEvent(level, kind, message string, skip int, tags map[string]string) errorEvent {
+	c := rl.Config()
+	id := make([]byte, 16)
+	rand.Read(id)
+	e := errorEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Platform:    "go",
+		Level:       level,
+		Release:     "simplehttproulette@" + GetBuildInfo().Version,
+		Environment: c.ErrorReporting.Environment,
+		Tags:        tags,
+	}
+	if e.Environment == "" {
+		e.Environment = c.Profile
+	}
+	if e.Environment == "" {
+		e.Environment = DefaultProfile
+	}
+	e.ServerName, _ = os.Hostname()
+	ex := errorException{Type: kind, Value: message}
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip, pcs)])
+	for {
+		f, more := frames.Next()
+		ex.Stacktrace.Frames = append(ex.Stacktrace.Frames, errorFrame{
+			Function: f.Function,
+			Filename: f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(f.Function, "simplehttproulette"),
+		})
+		if !more {
+			break
+		}
+	}
+	// Sentry wants the outermost frame first
+	for i, j := 0, len(ex.Stacktrace.Frames)-1; i < j; i, j = i+1, j-1 {
+		ex.Stacktrace.Frames[i], ex.Stacktrace.Frames[j] = ex.Stacktrace.Frames[j], ex.Stacktrace.Frames[i]
+	}
+	e.Exception.Values = []errorException{ex}
+	return e
+}
+
+// send posts e as an envelope. Failures are only logged.
+func (r *errorReporter) send(e errorEvent) {
+	dsn := r.rl.Config().ErrorReporting.DSN
+	endpoint, key, err := parseDSN(dsn)
+	if err != nil {
+		appLog.Error("Failed to report error", "err", err)
+		return
+	}
+	event, err := json.Marshal(e)
+	if err != nil {
+		appLog.Error("Failed to encode error report", "err", err)
+		return
+	}
+	var body bytes.Buffer
+	header, _ := json.Marshal(map[string]string{"event_id": e.EventID, "dsn": dsn})
+	body.Write(header)
+	fmt.Fprintf(&body, "\n{\"type\":\"event\",\"length\":%d}\n", len(event))
+	body.Write(event)
+	body.WriteByte('\n')
+
+	ctx, cancel := context.WithTimeout(context.Background(), errorReportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		appLog.Error("Failed to report error", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=simplehttproulette/%s", key, GetBuildInfo().Version))
+	resp, err := r.http.Do(req)
+	if err != nil {
+		appLog.Warn("Failed to report error", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		appLog.Warn("Failed to report error", "status", resp.Status)
+	}
+}
+
+// reportable reports whether a job's err is worth an error report:
+// losing the lease, demo mode and shutting down are expected.
+func reportable(err error) bool {
+	return err != nil && !errors.Is(err, ErrNotLeader) && !errors.Is(err, ErrDemoMode) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
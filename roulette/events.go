@@ -0,0 +1,138 @@
+package roulette
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Site lifecycle events
+const (
+	EventDiscovered  = "discovered"  // Added to the pool by a sync
+	EventAlive       = "alive"       // Probed up after being down or unchecked
+	EventQuarantined = "quarantined" // Probed down after being up or unchecked
+	EventReported    = "reported"    // Named in a takedown request
+	EventRemoved     = "removed"
+	EventChanged     = "changed" // New entries appeared in its listing
+)
+
+// SiteEvent is one step in a site's life, which together explain how it
+// came to be in its current state. Detail says what caused it.
+type SiteEvent struct {
+	ID     int64
+	SiteID int64
+	URL    string
+	Time   time.Time
+	Kind   string
+	Detail string
+}
+
+// SiteEventStore is implemented by stores that keep site timelines.
+type SiteEventStore interface {
+	// AddSiteEvents records events.
+	AddSiteEvents(events []SiteEvent) error
+	// SiteEvents returns the events of the site with the given ID, oldest
+	// first. They outlive the site itself.
+	SiteEvents(siteID int64) ([]SiteEvent, error)
+	// SiteEventsSince returns the events of every site from since on,
+	// oldest first.
+	SiteEventsSince(since time.Time) ([]SiteEvent, error)
+}
+
+func siteEvent(site Site, kind, detail string) SiteEvent {
+	return SiteEvent{SiteID: site.ID, URL: site.URL, Time: time.Now().UTC(), Kind: kind, Detail: detail}
+}
+
+// recordEvents stores events. Failures are logged, they never fail what
+// caused the events.
+func (rl *Roulette) recordEvents(events ...SiteEvent) {
+	store, ok := rl.store.(SiteEventStore)
+	if !ok || len(events) == 0 {
+		return
+	}
+	if err := store.AddSiteEvents(events); err != nil {
+		storeLog.Error("Failed to record site events", "count", len(events), "err", err)
+	}
+	rl.changeFeed.publish(events)
+}
+
+// probeEvent returns the event a probe result makes, if the status
+// changed.
+func probeEvent(site Site, status string) (SiteEvent, bool) {
+	if status == site.Status {
+		return SiteEvent{}, false
+	}
+	kind := EventQuarantined
+	if status == StatusUp {
+		kind = EventAlive
+	}
+	return siteEvent(site, kind, fmt.Sprintf("probed %s, was %s", status, site.Status)), true
+}
+
+// siteInfoPage is the data the site template is rendered with.
+type siteInfoPage struct {
+	basePage
+	ID     int64
+	Site   Site // Zero once the site is removed
+	URL    string
+	Events []SiteEvent
+	Tags   []string
+	// DuplicateOf is the site visitors get instead, if this one serves
+	// the same listing
+	DuplicateOf int64
+	// Modified is when its files last changed, as far as they tell
+	Modified time.Time
+	// Snapshot is when its listing was last kept, zero if it wasn't
+	Snapshot time.Time
+	// Related are the sites most like it
+	Related   []RelatedSite
+	Error     string
+	Supported bool
+}
+
+// siteInfoHandler shows a site's state and timeline, also after it was
+// removed.
+func (rl *Roulette) siteInfoHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	page := siteInfoPage{basePage: rl.pageBase(w, r), ID: id}
+	site, err := rl.store.Site(id)
+	if err != nil && err != errNoSuchSite {
+		httpLog.Error("Failed to look up site", "site", id, "err", err)
+		page.Error = err.Error()
+	}
+	page.Site, page.URL = site, site.URL
+	page.Tags = rl.siteTags(id)
+	page.DuplicateOf, _ = rl.duplicateOf(id)
+	page.Modified, _ = rl.siteModified(id)
+	if snap, ok := rl.siteSnapshot(id); ok {
+		page.Snapshot = snap.Taken
+	}
+	if site.URL != "" {
+		if page.Related, err = rl.relatedSites(site, relatedShown); err != nil {
+			httpLog.Error("Failed to find similar sites", "site", id, "err", err)
+		}
+	}
+	store, ok := rl.store.(SiteEventStore)
+	page.Supported = ok
+	if ok {
+		events, err := store.SiteEvents(id)
+		if err != nil {
+			httpLog.Error("Failed to read site events", "site", id, "err", err)
+			page.Error = err.Error()
+		}
+		page.Events = events
+		if page.URL == "" && len(events) > 0 {
+			page.URL = events[0].URL
+		}
+	}
+	if page.URL == "" && page.Error == "" {
+		http.NotFound(w, r)
+		return
+	}
+	rl.render(w, "site.html", page)
+}
@@ -0,0 +1,156 @@
+package roulette
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html"
+	"math/rand/v2"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const fakeDepthMax = 3      // Directory levels of a fake site's tree
+const fakeSeedMax = 1000000 // Fake sites seed adds at most
+const fakeGrowingDays = 7   // Days a growing fake site's new files go back
+
+// fakeWords name the files and directories of fake sites.
+var fakeWords = []string{
+	"backup", "photos", "music", "docs", "invoices", "projects", "old", "share", "media", "downloads",
+	"scans", "notes", "archive", "videos", "src", "config", "logs", "misc", "reports", "temp",
+}
+
+var fakeExtensions = []string{".txt", ".pdf", ".jpg", ".mp3", ".zip", ".tar.gz", ".iso", ".csv", ".log", ".mkv"}
+
+// fakeDir is the listing of one directory of a fake site.
+type fakeDir struct {
+	dirs, files []string
+}
+
+// fakeRand returns the random source for dir of fake site n, so every
+// request for it answers the same.
+func fakeRand(n int, dir string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(dir))
+	return rand.New(rand.NewPCG(uint64(n), h.Sum64()))
+}
+
+// fakeListing makes up the listing of dir, a path ending in a slash, on
+// fake site n. Every fifth site gains a file a day in its root, for work
+// on change tracking.
+func fakeListing(n int, dir string) fakeDir {
+	r := fakeRand(n, dir)
+	var d fakeDir
+	if strings.Count(dir, "/") <= fakeDepthMax {
+		for range r.IntN(5) {
+			if name := fakeWords[r.IntN(len(fakeWords))] + "/"; !slices.Contains(d.dirs, name) {
+				d.dirs = append(d.dirs, name)
+			}
+		}
+	}
+	for range 1 + r.IntN(12) {
+		name := fakeWords[r.IntN(len(fakeWords))]
+		if r.IntN(2) == 0 {
+			name += "-" + strconv.Itoa(2000+r.IntN(26))
+		}
+		if name += fakeExtensions[r.IntN(len(fakeExtensions))]; !slices.Contains(d.files, name) {
+			d.files = append(d.files, name)
+		}
+	}
+	if dir == "/" && n%5 == 0 {
+		today := time.Now().UTC().Truncate(24 * time.Hour)
+		for i := range fakeGrowingDays {
+			d.files = append(d.files, "log-"+today.AddDate(0, 0, -i).Format("2006-01-02")+".txt")
+		}
+	}
+	return d
+}
+
+// fakeModified makes up when file path on fake site n last changed. Each
+// site was left alone up to ten years ago, its files are older still, bar
+// the daily log files of growing sites.
+func fakeModified(n int, path string) time.Time {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	if day, ok := strings.CutPrefix(path, "/log-"); ok && n%5 == 0 {
+		if t, err := time.Parse("2006-01-02", strings.TrimSuffix(day, ".txt")); err == nil {
+			return t
+		}
+	}
+	left := today.AddDate(0, 0, -fakeRand(n, "").IntN(10*365))
+	return left.AddDate(0, 0, -fakeRand(n, path).IntN(1000))
+}
+
+// fakeHandler serves /fake/{n}/{path...}, made up sites that look like
+// Python's SimpleHTTPServer, for development without the internet. Every
+// tenth site is down.
+func (rl *Roulette) fakeHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if !rl.Config().FakeSites || err != nil || n <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Server", "SimpleHTTP/0.6 Python/3.11.4")
+	if n%10 == 0 {
+		http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	// Walk the path down from the root, every part must be listed
+	path := "/" + r.PathValue("path")
+	dir := "/"
+	for _, part := range strings.SplitAfter(path[1:], "/") {
+		if part == "" {
+			break
+		}
+		d := fakeListing(n, dir)
+		if strings.HasSuffix(part, "/") && slices.Contains(d.dirs, part) {
+			dir += part
+			continue
+		}
+		if dir+part == path && slices.Contains(d.files, part) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Last-Modified", fakeModified(n, path).Format(http.TimeFormat))
+			fmt.Fprintf(w, "Fake file %s of fake site %d\n", path, n)
+			return
+		}
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	d := fakeListing(n, dir)
+	title := html.EscapeString("Directory listing for " + dir)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<!DOCTYPE HTML>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n<body>\n<h1>%s</h1>\n<hr>\n<ul>\n", title, title)
+	for _, name := range append(d.dirs, d.files...) {
+		// The names are made of fakeWords, nothing to escape
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a></li>\n", name, name)
+	}
+	fmt.Fprint(w, "</ul>\n<hr>\n</body>\n</html>\n")
+}
+
+// SeedFake adds n fake sites to the URL list, each a directory under base
+// served by fakeHandler, such as http://127.0.0.1:8080/fake/. It returns
+// how many were new.
+func (rl *Roulette) SeedFake(base string, n int) (int, error) {
+	u, err := neturl.Parse(base)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, fmt.Errorf("the base of fake sites must be an http or https URL")
+	}
+	if n <= 0 || n > fakeSeedMax {
+		return 0, fmt.Errorf("the number of fake sites must be between 1 and %d", fakeSeedMax)
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	c := rl.Config()
+	// Import would leave them all out without a word
+	if !c.Network.allowsURL(base) {
+		return 0, fmt.Errorf("network.deny keeps %s out of the pool, allow it in the config for fake sites", u.Hostname())
+	}
+	urls := make([]string, 0, n)
+	for i := 1; i <= n; i++ {
+		urls = append(urls, base+strconv.Itoa(i)+"/")
+	}
+	return rl.Import(urls)
+}
@@ -0,0 +1,267 @@
+package roulette
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const playlistNameMax = 64 // Runes kept of a playlist's name
+
+// FavoritesConfig lets visitors save sites from /browse, sorted into
+// playlists if they like, and export them as bookmarks or OPML.
+type FavoritesConfig struct {
+	// Enabled serves /favorites
+	Enabled bool `json:"enabled"`
+	// Max is how many favorites one visitor may keep, across playlists
+	Max int `json:"max"`
+}
+
+// Favorite is a site a visitor saved. The URL is kept, so it outlives the
+// site leaving the pool.
+type Favorite struct {
+	URL string
+	// Playlist is the name of the playlist it was saved to, empty for
+	// plain favorites
+	Playlist string
+	Added    time.Time
+}
+
+// FavoriteStore is implemented by stores that keep visitors' favorites,
+// keyed by Visitor.Key.
+type FavoriteStore interface {
+	// AddFavorite saves f for visitor. Saving a URL again to the same
+	// playlist keeps the first.
+	AddFavorite(visitor string, f Favorite) error
+	// RemoveFavorite drops url from the visitor's playlist.
+	RemoveFavorite(visitor, playlist, url string) error
+	// Favorites returns the visitor's favorites by playlist, plain
+	// favorites first, oldest first within each.
+	Favorites(visitor string) ([]Favorite, error)
+}
+
+// playlist is a visitor's favorites with the same Playlist.
+type playlist struct {
+	Name      string // Empty for plain favorites
+	Favorites []Favorite
+}
+
+// playlists groups favorites, in the order FavoriteStore returns them, by
+// playlist.
+func playlists(favorites []Favorite) []playlist {
+	var lists []playlist
+	for _, f := range favorites {
+		if len(lists) == 0 || lists[len(lists)-1].Name != f.Playlist {
+			lists = append(lists, playlist{Name: f.Playlist})
+		}
+		last := &lists[len(lists)-1]
+		last.Favorites = append(last.Favorites, f)
+	}
+	return lists
+}
+
+// playlistName tidies a playlist name given by a visitor, dropping control
+// characters and capping its length.
+func playlistName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if r := []rune(name); len(r) > playlistNameMax {
+		name = strings.TrimSpace(string(r[:playlistNameMax]))
+	}
+	return name
+}
+
+// favoritesPage is the data the favorites template is rendered with.
+type favoritesPage struct {
+	basePage
+	Error     string
+	Playlists []playlist
+}
+
+// favoritesHandler lists the visitor's favorites and, on POST, adds the
+// site in the site field or removes the url field, to or from playlist.
+func (rl *Roulette) favoritesHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config().Favorites
+	store, ok := rl.store.(FavoriteStore)
+	if !c.Enabled || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	visitor := rl.Visitor(w, r).Key()
+	page := favoritesPage{basePage: rl.pageBase(w, r)}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		// Shadow banned clients' changes look made, but aren't
+		if !shadowed(r) {
+			status, page.Error = rl.editFavorites(store, visitor, r)
+		}
+		if page.Error == "" {
+			redirectRelative(w, "favorites")
+			return
+		}
+	}
+	favorites, err := store.Favorites(visitor)
+	if err != nil {
+		httpLog.Error("Failed to read favorites", "err", err)
+		http.Error(w, "Failed to read favorites", http.StatusInternalServerError)
+		return
+	}
+	page.Playlists = playlists(favorites)
+	w.WriteHeader(status)
+	rl.render(w, "favorites.html", page)
+}
+
+// editFavorites makes the change a POST to /favorites asks for, returning
+// the status and error to show if it can't.
+func (rl *Roulette) editFavorites(store FavoriteStore, visitor string, r *http.Request) (int, string) {
+	list := playlistName(r.FormValue("playlist"))
+	if r.FormValue("action") == "remove" {
+		if err := store.RemoveFavorite(visitor, list, r.FormValue("url")); err != nil {
+			httpLog.Error("Failed to remove favorite", "err", err)
+			return http.StatusInternalServerError, "Failed to remove the favorite"
+		}
+		return 0, ""
+	}
+	// Sites are saved by ID, so only URLs from the pool end up in exports
+	id, err := strconv.ParseInt(r.FormValue("site"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, "No site given"
+	}
+	site, err := rl.store.Site(id)
+	if err == errNoSuchSite {
+		return http.StatusNotFound, "That site is no longer in the pool"
+	}
+	if err != nil {
+		httpLog.Error("Failed to look up site", "site", id, "err", err)
+		return http.StatusInternalServerError, "Failed to save the favorite"
+	}
+	favorites, err := store.Favorites(visitor)
+	if err != nil {
+		httpLog.Error("Failed to read favorites", "err", err)
+		return http.StatusInternalServerError, "Failed to save the favorite"
+	}
+	if limit := rl.Config().Favorites.Max; len(favorites) >= limit {
+		return http.StatusForbidden, fmt.Sprintf("You can keep up to %d favorites, remove some first", limit)
+	}
+	if err := store.AddFavorite(visitor, Favorite{URL: site.URL, Playlist: list, Added: time.Now().UTC()}); err != nil {
+		httpLog.Error("Failed to save favorite", "err", err)
+		return http.StatusInternalServerError, "Failed to save the favorite"
+	}
+	return 0, ""
+}
+
+// exportFavoritesHandler downloads the visitor's favorites as a Netscape
+// bookmark file, which browsers import, or with format=opml as OPML for
+// feed readers. Playlists become folders.
+func (rl *Roulette) exportFavoritesHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config()
+	store, ok := rl.store.(FavoriteStore)
+	if !c.Favorites.Enabled || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var favorites []Favorite
+	if !shadowed(r) {
+		var err error
+		favorites, err = store.Favorites(rl.Visitor(w, r).Key())
+		if err != nil {
+			httpLog.Error("Failed to read favorites", "err", err)
+			http.Error(w, "Failed to read favorites", http.StatusInternalServerError)
+			return
+		}
+	}
+	lists := playlists(favorites)
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "bookmarks":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="favorites.html"`)
+		w.Write([]byte(bookmarksFile(c.Branding.Title, lists)))
+	case "opml":
+		body, err := opmlFile(c.Branding.Title, lists)
+		if err != nil {
+			http.Error(w, "Failed to export favorites", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-opml; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="favorites.opml"`)
+		w.Write(body)
+	default:
+		http.Error(w, fmt.Sprintf("Unknown format %q, use bookmarks or opml", format), http.StatusBadRequest)
+	}
+}
+
+// bookmarksFile writes lists in the Netscape bookmark format, inside one
+// folder named title. Plain favorites go in it directly, playlists in
+// subfolders.
+func bookmarksFile(title string, lists []playlist) string {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE NETSCAPE-Bookmark-file-1>\n")
+	b.WriteString(`<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">` + "\n")
+	b.WriteString("<TITLE>Bookmarks</TITLE>\n<H1>Bookmarks</H1>\n<DL><p>\n")
+	fmt.Fprintf(&b, "    <DT><H3>%s</H3>\n    <DL><p>\n", html.EscapeString(title))
+	for _, l := range lists {
+		indent := "        "
+		if l.Name != "" {
+			fmt.Fprintf(&b, "%s<DT><H3 ADD_DATE=\"%d\">%s</H3>\n%s<DL><p>\n", indent, l.Favorites[0].Added.Unix(), html.EscapeString(l.Name), indent)
+			indent += "    "
+		}
+		for _, f := range l.Favorites {
+			u := html.EscapeString(f.URL)
+			fmt.Fprintf(&b, "%s<DT><A HREF=\"%s\" ADD_DATE=\"%d\">%s</A>\n", indent, u, f.Added.Unix(), u)
+		}
+		if l.Name != "" {
+			b.WriteString("        </DL><p>\n")
+		}
+	}
+	b.WriteString("    </DL><p>\n</DL><p>\n")
+	return b.String()
+}
+
+type opmlOutline struct {
+	Text     string        `xml:"text,attr"`
+	Type     string        `xml:"type,attr,omitempty"`
+	URL      string        `xml:"url,attr,omitempty"`
+	Created  string        `xml:"created,attr,omitempty"`
+	Outlines []opmlOutline `xml:"outline"`
+}
+
+// opmlFile writes lists as OPML 2.0 link outlines, playlists as parent
+// outlines.
+func opmlFile(title string, lists []playlist) ([]byte, error) {
+	doc := struct {
+		XMLName xml.Name `xml:"opml"`
+		Version string   `xml:"version,attr"`
+		Head    struct {
+			Title       string `xml:"title"`
+			DateCreated string `xml:"dateCreated"`
+		} `xml:"head"`
+		Body []opmlOutline `xml:"body>outline"`
+	}{Version: "2.0"}
+	doc.Head.Title = title + " favorites"
+	doc.Head.DateCreated = time.Now().UTC().Format(time.RFC1123Z)
+	for _, l := range lists {
+		links := make([]opmlOutline, 0, len(l.Favorites))
+		for _, f := range l.Favorites {
+			links = append(links, opmlOutline{Text: f.URL, Type: "link", URL: f.URL, Created: f.Added.Format(time.RFC1123Z)})
+		}
+		if l.Name == "" {
+			doc.Body = append(doc.Body, links...)
+		} else {
+			doc.Body = append(doc.Body, opmlOutline{Text: l.Name, Outlines: links})
+		}
+	}
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
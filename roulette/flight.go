@@ -0,0 +1,44 @@
+package roulette
+
+import "sync"
+
+// flightGroup lets only one run of each named job happen at a time in
+// this process. Callers that ask for a job while it runs wait for that
+// run and share its result instead of starting another.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a run in progress.
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do runs fn as the job called name, or waits for the run already in
+// progress. shared reports whether the result came from another caller's
+// run.
+func (g *flightGroup) do(name string, fn func() error) (err error, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.calls[name]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.err, true
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[name] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, name)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.err = fn()
+	return f.err, false
+}
@@ -0,0 +1,342 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Handler returns the roulette's routes. Links are relative, so it can be
+// mounted under a prefix with http.StripPrefix.
+func (rl *Roulette) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", rl.indexHandler)
+	mux.Handle("/static/", http.StripPrefix("/static", staticHandler(Assets(rl.Config().TemplatesDir))))
+	mux.HandleFunc("/shuffle", rl.rateLimited(rl.notBanned(rl.shuffleHandler)))
+	mux.HandleFunc("/consent", rl.notBanned(rl.consentHandler))
+	mux.HandleFunc("/takedown", rl.rateLimited(rl.notBanned(rl.takedownHandler)))
+	mux.HandleFunc("/subscribe", rl.rateLimited(rl.notBanned(rl.subscribeHandler)))
+	mux.HandleFunc("GET /subscribe/confirm", rl.rateLimited(rl.confirmSubscriptionHandler))
+	mux.HandleFunc("/unsubscribe", rl.rateLimited(rl.unsubscribeHandler))
+	mux.HandleFunc("GET /stats", rl.rateLimited(rl.statsHandler))
+	mux.HandleFunc("GET /browse", rl.rateLimited(rl.notBanned(rl.browseHandler)))
+	mux.HandleFunc("/favorites", rl.rateLimited(rl.notBanned(rl.favoritesHandler)))
+	mux.HandleFunc("/verify", rl.rateLimited(rl.notBanned(rl.verifyHandler)))
+	mux.HandleFunc("GET /favorites/export", rl.rateLimited(rl.notBanned(rl.exportFavoritesHandler)))
+	mux.HandleFunc("POST /bot/discord", rl.discordBotHandler)
+	mux.HandleFunc("/healthz", rl.healthzHandler)
+	mux.HandleFunc("GET /fake/{n}/{path...}", rl.fakeHandler)
+	mux.HandleFunc("/auth/login/{provider}", rl.oauthLoginHandler)
+	mux.HandleFunc("/auth/callback/{provider}", rl.oauthCallbackHandler)
+	mux.HandleFunc("/auth/logout", rl.oauthLogoutHandler)
+	mux.HandleFunc("/admin/", rl.requireAdmin(rl.adminHandler))
+	mux.HandleFunc("/admin/login", rl.loginHandler)
+	mux.HandleFunc("/admin/logout", rl.logoutHandler)
+	mux.HandleFunc("/admin/reload", rl.requireAdmin(rl.reloadHandler))
+	mux.HandleFunc("GET /admin/takedowns", rl.requireAdmin(rl.adminTakedownsHandler))
+	mux.HandleFunc("POST /admin/takedowns/{id}/{action}", rl.requireAdmin(rl.adminTakedownsHandler))
+	mux.HandleFunc("POST /admin/refresh", rl.requireAdmin(rl.refreshHandler))
+	mux.HandleFunc("POST /admin/refresh/pending/{action}", rl.requireAdmin(rl.adminPendingHandler))
+	mux.HandleFunc("POST /admin/sites/delete", rl.requireAdmin(rl.deleteSiteHandler))
+	mux.HandleFunc("GET /admin/audit", rl.requireAdmin(rl.adminAuditHandler))
+	mux.HandleFunc("GET /admin/refreshes", rl.requireAdmin(rl.adminRefreshesHandler))
+	mux.HandleFunc("GET /admin/digest", rl.requireAdmin(rl.adminDigestHandler))
+	mux.HandleFunc("/admin/rules", rl.requireAdmin(rl.adminTagRulesHandler))
+	mux.HandleFunc("POST /admin/rules/{id}/delete", rl.requireAdmin(rl.adminTagRulesHandler))
+	mux.HandleFunc("GET /admin/sites/{id}/info", rl.requireAdmin(rl.siteInfoHandler))
+	mux.HandleFunc("GET /admin/sites/{id}/snapshot", rl.requireAdmin(rl.snapshotHandler))
+	mux.HandleFunc("GET /site/{id}/qr.png", rl.rateLimited(rl.notBanned(rl.qrHandler)))
+	mux.HandleFunc("GET /out/{id}", rl.rateLimited(rl.notBanned(rl.outHandler)))
+	mux.HandleFunc("GET /view/{id}/{path...}", rl.rateLimited(rl.notBanned(rl.viewHandler)))
+	mux.HandleFunc("/api/v1/version", rl.rateLimited(rl.versionHandler))
+	mux.HandleFunc("/api/v1/random", rl.rateLimited(rl.notBanned(rl.apiQuota(rl.randomHandler))))
+	mux.HandleFunc("GET /api/v1/changes", rl.rateLimited(rl.notBanned(rl.changesHandler)))
+	mux.HandleFunc("GET /api/v1/sites", rl.rateLimited(rl.notBanned(rl.apiQuota(rl.sitesHandler))))
+	mux.HandleFunc("/api/v1/usage", rl.rateLimited(rl.usageHandler))
+	mux.HandleFunc("POST /api/v1/beacon", rl.rateLimited(rl.notBanned(rl.beaconHandler)))
+	mux.HandleFunc("GET /api/v1/admin/refresh", rl.requireAdmin(rl.refreshStatusHandler))
+	mux.HandleFunc("GET /api/v1/admin/jobs", rl.requireAdmin(rl.jobsHandler))
+	mux.HandleFunc("GET /api/v1/admin/bans", rl.requireAdmin(rl.adminBansHandler))
+	mux.HandleFunc("POST /api/v1/admin/bans", rl.requireAdmin(rl.adminBansHandler))
+	mux.HandleFunc("DELETE /api/v1/admin/bans/{id}", rl.requireAdmin(rl.adminBanHandler))
+	return rl.traced(rl.recoverPanics(advertiseVersion(rl.securityHeaders(rl.adminAllowlist(rl.limitBodies(csrfProtect(mux)))))))
+}
+
+// advertiseVersion adds the Server header to every response.
+func advertiseVersion(h http.Handler) http.Handler {
+	header := []string{serverHeader()}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header()["Server"] = header
+		h.ServeHTTP(w, r)
+	})
+}
+
+// versionHandler reports the build information as JSON.
+func (rl *Roulette) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(GetBuildInfo())
+}
+
+func (rl *Roulette) shuffleHandler(w http.ResponseWriter, r *http.Request) {
+	// Warn first-time visitors before sending them anywhere
+	if !rl.hasConsented(r) {
+		rl.renderConsent(w, r)
+		return
+	}
+	if shadowed(r) {
+		rl.redirectAway(w, r, rl.decoySite().URL)
+		return
+	}
+
+	// In block mode flagged sites are skipped, in warn mode the visitor is
+	// warned first
+	opts := shuffleOptions{allowFlagged: rl.Config().SafeBrowsing.Action == SafetyWarn}
+	if r.URL.RawQuery != "" {
+		opts.dusty = r.URL.Query().Get("dusty") != ""
+		opts.like, _ = strconv.ParseInt(r.URL.Query().Get("like"), 10, 64)
+	}
+	site, threat, archived, err := rl.shuffleLive(r.Context(), opts)
+	switch {
+	case err == ErrNoSites:
+		rl.renderWarming(w, r)
+		return
+	case err == errNoSuitableSite:
+		http.Error(w, "No suitable site found, try again", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		httpLog.Error("Failed to fetch a random site", "err", err)
+		http.Error(w, "Failed to fetch a random site", http.StatusInternalServerError)
+		return
+	}
+	proxied := rl.Config().Proxy.Enabled
+	if threat != "" {
+		link := rl.outPath(site)
+		if proxied {
+			link = viewPath(site)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		rl.render(w, "warning.html", warningPage{basePage: rl.pageBase(w, r), URL: site.URL, Link: link, Threat: threat})
+		return
+	}
+
+	// Redirect the user to the random site, or its proxied view. This is
+	// the hot path: debug logging only costs when it's on.
+	rl.recordVisit(site)
+	if archived != "" {
+		rl.redirectAway(w, r, archived)
+		return
+	}
+	// Presenter mode shows the site as a QR code instead
+	if r.URL.Query().Get("qr") != "" {
+		w.Header().Set("Cache-Control", "no-store")
+		rl.render(w, "qr.html", qrPage{basePage: rl.pageBase(w, r), Site: site, Link: rl.outPath(site)})
+		return
+	}
+	if proxied {
+		link := viewPath(site)
+		if httpLog.Enabled(r.Context(), slog.LevelDebug) {
+			httpLog.Debug("Redirecting", "to", link)
+		}
+		redirectRelative(w, link)
+		return
+	}
+	if httpLog.Enabled(r.Context(), slog.LevelDebug) {
+		httpLog.Debug("Redirecting", "to", site.URL)
+	}
+	rl.redirectAway(w, r, site.URL)
+}
+
+func (rl *Roulette) indexHandler(w http.ResponseWriter, r *http.Request) {
+	// Render the HTML template
+	c := rl.Config()
+	page := indexPage{basePage: rl.pageBase(w, r), User: rl.loggedInUser(r), Newsletter: c.Newsletter.Enabled, Favorites: c.Favorites.Enabled, Dusty: c.Probe.AgeSamples > 0, Verify: c.Verify.Enabled}
+	if theme := c.activeTheme(time.Now()); theme != nil {
+		page.Theme = theme.Name
+	}
+	for _, p := range c.OAuth {
+		page.Providers = append(page.Providers, p.Name)
+	}
+	rl.render(w, "index.html", page)
+}
+
+// indexPage is the data the index template is rendered with.
+type indexPage struct {
+	basePage
+	User      *User    // The logged in visitor, if any
+	Providers []string // Names of the OAuth login providers
+	// Newsletter links the weekly email's subscription form
+	Newsletter bool
+	// Favorites links the visitor's favorites
+	Favorites bool
+	// Dusty offers a shuffle of sites left alone for years
+	Dusty bool
+	// Verify links the site classifying game
+	Verify bool
+	// Theme names the theme Explore keeps to right now, if any
+	Theme string
+}
+
+// template parses the named template, or returns the cached copy unless
+// the config asks for templates to be reloaded on every request.
+func (rl *Roulette) template(name string) (*template.Template, error) {
+	c := rl.Config()
+	if !c.ReloadTemplates {
+		rl.templatesMu.Lock()
+		tmpl := rl.templates[name]
+		rl.templatesMu.Unlock()
+		if tmpl != nil {
+			return tmpl, nil
+		}
+	}
+	tmpl, err := template.New(name).Funcs(templateFuncs).ParseFS(Assets(c.TemplatesDir), name)
+	if err != nil {
+		return nil, err
+	}
+	if !c.ReloadTemplates {
+		rl.templatesMu.Lock()
+		rl.templates[name] = tmpl
+		rl.templatesMu.Unlock()
+	}
+	return tmpl, nil
+}
+
+// clearTemplates drops the parsed templates so changes are picked up.
+func (rl *Roulette) clearTemplates() {
+	rl.templatesMu.Lock()
+	defer rl.templatesMu.Unlock()
+	rl.templates = make(map[string]*template.Template)
+}
+
+// render executes the named template with data.
+func (rl *Roulette) render(w http.ResponseWriter, name string, data any) {
+	tmpl, err := rl.template(name)
+	if err != nil {
+		httpLog.Error("Failed to load template", "err", err)
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, data)
+}
+
+// healthzHandler reports whether the server is healthy, for container and
+// load balancer health probes.
+func (rl *Roulette) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := rl.HealthCheck(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// adminPage is the data the admin template is rendered with.
+type adminPage struct {
+	basePage
+	Build   BuildInfo
+	Profile string
+	Sites   int
+	Pending *PendingRefresh // A refresh held for approval, if any
+}
+
+// adminHandler serves the admin dashboard.
+func (rl *Roulette) adminHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/admin/" {
+		http.NotFound(w, r)
+		return
+	}
+	c := rl.Config()
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		httpLog.Error("Failed to list sites", "err", err)
+	}
+	pending, err := rl.PendingRefresh()
+	if err != nil {
+		httpLog.Error("Failed to read held refresh", "err", err)
+	}
+	rl.render(w, "admin.html", adminPage{
+		basePage: rl.pageBase(w, r),
+		Build:    GetBuildInfo(),
+		Profile:  c.Profile,
+		Sites:    len(sites),
+		Pending:  pending,
+	})
+}
+
+// reloadHandler reloads the config file on POST /admin/reload.
+func (rl *Roulette) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	old := rl.Config()
+	if err := rl.Reload(); err != nil {
+		httpLog.Error("Failed to reload configuration", "err", err)
+		http.Error(w, fmt.Sprintf("Failed to reload configuration: %v", err), http.StatusBadRequest)
+		return
+	}
+	before, after := configChanges(old, rl.Config())
+	rl.audit(r, AuditReload, old.path, before, after)
+	fmt.Fprintln(w, "Configuration reloaded")
+}
+
+// refreshHandler starts a Shodan refresh on POST /admin/refresh. It runs
+// in the background, the outcome is logged.
+func (rl *Roulette) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	if rl.Config().Demo {
+		http.Error(w, ErrDemoMode.Error(), http.StatusConflict)
+		return
+	}
+	if !rl.HasShodanAPIKey() {
+		http.Error(w, "No Shodan API key configured", http.StatusConflict)
+		return
+	}
+	if rl.JobStatus(refreshLease).Running {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, "A refresh is already running")
+		return
+	}
+	rl.audit(r, AuditRefresh, "shodan", nil, map[string]any{"queries": rl.Config().ShodanQueries})
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		if err := rl.Refresh(context.Background()); err != nil {
+			shodanLog.Error("Triggered refresh failed", "err", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Refresh started")
+}
+
+// jobsHandler lists the background jobs and how their runs went as JSON.
+func (rl *Roulette) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.Jobs())
+}
+
+// refreshStatusHandler reports on the Shodan refresh job as JSON.
+func (rl *Roulette) refreshStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rl.JobStatus(refreshLease))
+}
+
+// deleteSiteHandler removes the site given by the url form field on
+// POST /admin/sites/delete.
+func (rl *Roulette) deleteSiteHandler(w http.ResponseWriter, r *http.Request) {
+	site, err := rl.RemoveSite(r.FormValue("url"))
+	if err == errNoSuchSite {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		httpLog.Error("Failed to remove site", "err", err)
+		http.Error(w, fmt.Sprintf("Failed to remove site: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rl.audit(r, AuditSiteDelete, site.URL, site, nil)
+	fmt.Fprintf(w, "Removed %s\n", site.URL)
+}
@@ -0,0 +1,72 @@
+package roulette
+
+import (
+	"net/http"
+	"strings"
+)
+
+// contentSecurityPolicy allows the pages to load only their own styles
+// and images (plus remote logos) and no scripts at all. There's no
+// form-action, browsers would apply it to the redirect off-site that the
+// Explore and consent forms end in.
+const contentSecurityPolicy = "default-src 'none'; style-src 'self'; img-src 'self' https: data:; " +
+	"base-uri 'none'; frame-ancestors 'none'"
+
+const hstsMaxAge = "max-age=31536000" // One year, sent only over HTTPS
+
+// frameablePaths may be embedded in frames on the same site, for the
+// /play iframe mode. Everything else refuses to be framed.
+var frameablePaths = []string{"/play"}
+
+// Header values shared by every response, so setting them doesn't
+// allocate. The keys they are stored under must be canonical and the
+// slices are never modified.
+var (
+	nosniffValue      = []string{"nosniff"}
+	noReferrerValue   = []string{"no-referrer"}
+	frameDenyValue    = []string{"DENY"}
+	frameSameOrigin   = []string{"SAMEORIGIN"}
+	cspValue          = []string{contentSecurityPolicy}
+	frameableCSPValue = []string{strings.Replace(contentSecurityPolicy, "frame-ancestors 'none'", "frame-ancestors 'self'", 1)}
+	hstsValue         = []string{hstsMaxAge}
+)
+
+// securityHeaders sets the browser security headers on every response.
+// Referrer-Policy matters most: without it the redirect to a site would
+// tell its owner where the visitor came from.
+func (rl *Roulette) securityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header["X-Content-Type-Options"] = nosniffValue
+		header["Referrer-Policy"] = noReferrerValue
+		if isFrameable(r.URL.Path) {
+			header["X-Frame-Options"] = frameSameOrigin
+			header["Content-Security-Policy"] = frameableCSPValue
+		} else {
+			header["X-Frame-Options"] = frameDenyValue
+			header["Content-Security-Policy"] = cspValue
+		}
+		if rl.Config().isHTTPS(r) {
+			header["Strict-Transport-Security"] = hstsValue
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func isFrameable(path string) bool {
+	for _, p := range frameablePaths {
+		if path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTPS reports whether the client reached us over TLS, directly or
+// through a trusted proxy that says so in X-Forwarded-Proto.
+func (c *Config) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return c.isTrustedProxy(remoteIP(r)) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
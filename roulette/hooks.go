@@ -0,0 +1,173 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const hookBatchTimeout = 5 * time.Minute // For OnSiteDiscovered and OnProbeComplete commands
+const hookOutputMax = 1024               // Bytes of a failed hook's standard error logged
+
+// Hook events, as sent to hook commands
+const (
+	HookSiteDiscovered = "site_discovered"
+	HookProbeComplete  = "probe_complete"
+	HookBeforeServe    = "before_serve"
+)
+
+// Hooks extend how sites are processed without forking. Any may be nil.
+// OnSiteDiscovered and OnProbeComplete run in the background, after the
+// sync or probe that caused them.
+type Hooks struct {
+	// OnSiteDiscovered is called with the sites a sync added
+	OnSiteDiscovered func(ctx context.Context, sites []Site)
+	// OnProbeComplete is called with every site a probe run checked,
+	// carrying its new status
+	OnProbeComplete func(ctx context.Context, sites []Site)
+	// BeforeServe is called before anyone is sent to site, returning false
+	// skips it for another
+	BeforeServe func(ctx context.Context, site Site) bool
+}
+
+// SetHooks installs Go hooks, alongside any hook commands configured. Call
+// it before serving.
+func (rl *Roulette) SetHooks(h Hooks) {
+	rl.hooks = h
+}
+
+// HooksConfig runs external commands at the hook points. Each is a program
+// and its arguments, run without a shell, and is sent one JSON object on
+// standard input: {"event": ..., "sites": [...]} or, for BeforeServe,
+// {"event": ..., "site": {...}}.
+type HooksConfig struct {
+	OnSiteDiscovered []string `json:"on_site_discovered,omitempty"`
+	OnProbeComplete  []string `json:"on_probe_complete,omitempty"`
+	// BeforeServe exits 0 to serve the site and 1 to skip it. Any other
+	// failure is logged and the site served. It runs for every spin, keep
+	// it fast.
+	BeforeServe []string `json:"before_serve,omitempty"`
+	// BeforeServeTimeout is how long BeforeServe may take
+	BeforeServeTimeout Duration `json:"before_serve_timeout"`
+}
+
+// hookSite is how sites are sent to hook commands.
+type hookSite struct {
+	ID          int64      `json:"id"`
+	URL         string     `json:"url"`
+	Host        string     `json:"host"`
+	Port        int        `json:"port"`
+	Status      string     `json:"status"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+}
+
+func newHookSite(s Site) hookSite {
+	h := hookSite{ID: s.ID, URL: s.URL, Host: s.Host, Port: s.Port, Status: s.Status}
+	if !s.LastChecked.IsZero() {
+		h.LastChecked = &s.LastChecked
+	}
+	return h
+}
+
+// errHookSkip is returned by runHook when the command asked to skip.
+var errHookSkip = errors.New("hook skipped the site")
+
+// runHook runs argv with input as JSON on standard input.
+func runHook(ctx context.Context, argv []string, timeout time.Duration, input any) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 1 {
+		return errHookSkip
+	}
+	if err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > hookOutputMax {
+			msg = msg[:hookOutputMax]
+		}
+		if msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// batchHook runs a background hook with sites, the Go hook then the
+// command.
+func (rl *Roulette) batchHook(event string, fn func(context.Context, []Site), argv []string, sites []Site) {
+	if (fn == nil && len(argv) == 0) || len(sites) == 0 {
+		return
+	}
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), hookBatchTimeout)
+		defer cancel()
+		if fn != nil {
+			fn(ctx, sites)
+		}
+		if len(argv) == 0 {
+			return
+		}
+		list := make([]hookSite, 0, len(sites))
+		for _, s := range sites {
+			list = append(list, newHookSite(s))
+		}
+		input := map[string]any{"event": event, "sites": list}
+		if err := runHook(ctx, argv, hookBatchTimeout, input); err != nil && err != errHookSkip {
+			appLog.Error("Hook failed", "event", event, "err", err)
+		}
+	}()
+}
+
+// siteDiscovered runs the OnSiteDiscovered hooks.
+func (rl *Roulette) siteDiscovered(sites []Site) {
+	rl.batchHook(HookSiteDiscovered, rl.hooks.OnSiteDiscovered, rl.Config().Hooks.OnSiteDiscovered, sites)
+}
+
+// probeComplete runs the OnProbeComplete hooks.
+func (rl *Roulette) probeComplete(sites []Site) {
+	rl.batchHook(HookProbeComplete, rl.hooks.OnProbeComplete, rl.Config().Hooks.OnProbeComplete, sites)
+}
+
+// hasProbeHooks reports whether a probe run needs to collect its results
+// for the hooks.
+func (rl *Roulette) hasProbeHooks() bool {
+	return rl.hooks.OnProbeComplete != nil || len(rl.Config().Hooks.OnProbeComplete) > 0
+}
+
+// beforeServe runs the BeforeServe hooks, reporting whether site may be
+// served.
+func (rl *Roulette) beforeServe(ctx context.Context, site Site) bool {
+	if rl.hooks.BeforeServe != nil && !rl.hooks.BeforeServe(ctx, site) {
+		return false
+	}
+	c := rl.Config().Hooks
+	if len(c.BeforeServe) == 0 {
+		return true
+	}
+	input := map[string]any{"event": HookBeforeServe, "site": newHookSite(site)}
+	err := runHook(ctx, c.BeforeServe, time.Duration(c.BeforeServeTimeout), input)
+	if err == errHookSkip {
+		return false
+	}
+	if err != nil {
+		appLog.Error("Hook failed, serving the site", "event", HookBeforeServe, "url", site.URL, "err", err)
+	}
+	return true
+}
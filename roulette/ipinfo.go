@@ -0,0 +1,244 @@
+package roulette
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ipinfoURL = "https://ipinfo.io/"
+const ipinfoTimeout = 5 * time.Second
+const ipinfoSweepInterval = time.Hour // The pool is checked for addresses to look up this often
+const ipinfoBackoff = time.Minute     // Pause after ipinfo.io turns a lookup down
+const ipinfoPendingMax = 10000        // Addresses queued for lookup at once
+
+// IPInfoConfig looks countries up on ipinfo.io when no country database is
+// configured, so small instances can filter by country without one.
+// Lookups run in the background and are cached in the store; until an
+// address has been looked up its country is unknown.
+type IPInfoConfig struct {
+	// Token is the ipinfo.io access token, empty turns lookups off
+	Token string `json:"token,omitempty"`
+	// RPS is the most lookups made per second, keep it within the
+	// token's plan
+	RPS float64 `json:"rps"`
+	// CacheFor is how long a country is kept before it is looked up again
+	CacheFor Duration `json:"cache_for"`
+}
+
+func (c IPInfoConfig) validate() error {
+	if c.Token == "" {
+		return nil
+	}
+	if c.RPS <= 0 {
+		return fmt.Errorf("countries.ipinfo.rps must be positive")
+	}
+	if c.CacheFor <= 0 {
+		return fmt.Errorf("countries.ipinfo.cache_for must be positive")
+	}
+	return nil
+}
+
+// IPCountry is a cached country lookup for an IP address.
+type IPCountry struct {
+	IP      string
+	Country string // Empty if ipinfo.io doesn't know
+	Checked time.Time
+}
+
+// IPCountryStore is implemented by stores that can cache country lookups.
+type IPCountryStore interface {
+	// IPCountries returns every cached lookup, keyed by IP.
+	IPCountries() (map[string]IPCountry, error)
+	// SaveIPCountry caches c, replacing any older lookup for its IP.
+	SaveIPCountry(c IPCountry) error
+}
+
+// ipinfoCache keeps the looked up countries in memory, since countryOf is
+// called for every site of a search, and queues the addresses to look up.
+type ipinfoCache struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]IPCountry
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+// country returns the cached country of ip, queueing it for a lookup if
+// it's missing or older than cacheFor.
+func (c *ipinfoCache) country(store IPCountryStore, ip netip.Addr, cacheFor time.Duration) string {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return ""
+	}
+	key := ip.String()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load(store)
+	e, ok := c.entries[key]
+	if (!ok || time.Since(e.Checked) > cacheFor) && len(c.pending) < ipinfoPendingMax && !c.pending[key] {
+		c.pending[key] = true
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+	return e.Country
+}
+
+// load reads the cache from store the first time it's needed. The caller
+// holds mu.
+func (c *ipinfoCache) load(store IPCountryStore) {
+	if c.loaded {
+		return
+	}
+	c.loaded = true
+	c.pending = make(map[string]bool)
+	entries, err := store.IPCountries()
+	if err != nil {
+		storeLog.Error("Failed to read cached countries", "err", err)
+	}
+	if entries == nil {
+		entries = make(map[string]IPCountry)
+	}
+	c.entries = entries
+}
+
+// next takes an address off the queue, "" if it's empty.
+func (c *ipinfoCache) next() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for ip := range c.pending {
+		delete(c.pending, ip)
+		return ip
+	}
+	return ""
+}
+
+// save caches e, in memory and in store.
+func (c *ipinfoCache) save(store IPCountryStore, e IPCountry) {
+	c.mu.Lock()
+	c.entries[e.IP] = e
+	c.mu.Unlock()
+	if err := store.SaveIPCountry(e); err != nil {
+		storeLog.Error("Failed to cache country", "ip", e.IP, "err", err)
+	}
+}
+
+// ipinfoStore returns the store to cache lookups in, nil unless ipinfo.io
+// is to be used.
+func (rl *Roulette) ipinfoStore() IPCountryStore {
+	c := rl.Config()
+	store, ok := rl.store.(IPCountryStore)
+	// Demos make no outbound requests
+	if !ok || c.Countries.Database != "" || c.Countries.IPInfo.Token == "" || c.Demo {
+		return nil
+	}
+	return store
+}
+
+// startIPInfo looks up the queued addresses while ipinfo.io is
+// configured, checking the pool for more every hour, until ctx is
+// cancelled.
+func (rl *Roulette) startIPInfo(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		sweep := time.NewTicker(ipinfoSweepInterval)
+		defer sweep.Stop()
+		rl.queueIPInfoSweep()
+		for {
+			rl.lookUpQueued(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-rl.ipinfo.wake:
+			case <-sweep.C:
+				rl.queueIPInfoSweep()
+			}
+		}
+	}()
+}
+
+// queueIPInfoSweep queues every IP address in the pool that isn't cached
+// or is due another lookup.
+func (rl *Roulette) queueIPInfoSweep() {
+	if rl.ipinfoStore() == nil {
+		return
+	}
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		storeLog.Error("Failed to list sites for country lookups", "err", err)
+		return
+	}
+	for _, s := range sites {
+		rl.countryOf(s.URL)
+	}
+}
+
+// lookUpQueued looks up queued addresses at the configured rate until the
+// queue is empty or ctx is cancelled. Addresses that fail are queued again
+// when next asked about.
+func (rl *Roulette) lookUpQueued(ctx context.Context) {
+	for {
+		store := rl.ipinfoStore()
+		if store == nil {
+			return
+		}
+		ip := rl.ipinfo.next()
+		if ip == "" {
+			return
+		}
+		c := rl.Config().Countries.IPInfo
+		country, err := lookupIPInfo(ctx, c.Token, ip)
+		if err != nil {
+			appLog.Warn("ipinfo.io lookup failed", "ip", ip, "err", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(ipinfoBackoff):
+			}
+			continue
+		}
+		rl.ipinfo.save(store, IPCountry{IP: ip, Country: country, Checked: time.Now()})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(float64(time.Second) / c.RPS)):
+		}
+	}
+}
+
+// lookupIPInfo returns ipinfo.io's country for ip, "" if it has none, as
+// for private addresses.
+func lookupIPInfo(ctx context.Context, token, ip string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ipinfoTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ipinfoURL+ip+"/country", nil)
+	if err != nil {
+		return "", err
+	}
+	// In a header rather than the query, so it stays out of logged errors
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+	if err != nil {
+		return "", err
+	}
+	country := strings.ToUpper(strings.TrimSpace(string(body)))
+	if len(country) != 2 {
+		return "", nil
+	}
+	return country, nil
+}
@@ -0,0 +1,144 @@
+package roulette
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+const knownHashCacheSize = 100000 // File hashes cached before the cache is emptied
+
+// KnownFilesConfig tags sites hosting recognizable files, such as sample
+// datasets everyone downloads or stock router firmware, by hashing the
+// start of files the crawl finds. Crawls run while changes are enabled.
+type KnownFilesConfig struct {
+	// Files are the files to recognize. None turns hashing off.
+	Files []KnownFile `json:"files"`
+	// PrefixBytes is how much of the start of a file is hashed
+	PrefixBytes int64 `json:"prefix_bytes"`
+	// PerSite is how many files of each listing are hashed at most
+	PerSite int `json:"per_site"`
+}
+
+// KnownFile is a file KnownFilesConfig recognizes.
+type KnownFile struct {
+	// Tag is given to the sites serving it
+	Tag string `json:"tag"`
+	// SHA256 is the hex hash of its first prefix_bytes, or all of it if
+	// it's shorter, as from head -c 4096 FILE | sha256sum
+	SHA256 string `json:"sha256"`
+	// Name is optional, files listed under it are hashed before others
+	Name string `json:"name,omitempty"`
+}
+
+func (c KnownFilesConfig) validate() error {
+	if len(c.Files) == 0 {
+		return nil
+	}
+	if c.PrefixBytes <= 0 || c.PerSite <= 0 {
+		return fmt.Errorf("changes.known_files.prefix_bytes and per_site must be positive")
+	}
+	for _, f := range c.Files {
+		if normalizeTag(f.Tag) == "" {
+			return fmt.Errorf("known file %s needs a tag", f.SHA256)
+		}
+		if b, err := hex.DecodeString(f.SHA256); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("known file %q: sha256 must be 64 hex digits", f.Tag)
+		}
+	}
+	return nil
+}
+
+// knownHashCache remembers the prefix hashes of files already fetched, by
+// URL, so each crawl only fetches files new to it.
+type knownHashCache struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+// knownFileTags returns the tags of the known files among the entries of
+// the listing at base, hashing up to PerSite of its files.
+func (rl *Roulette) knownFileTags(ctx context.Context, client *http.Client, base string, entries []string) []string {
+	c := rl.Config().Changes.KnownFiles
+	if len(c.Files) == 0 {
+		return nil
+	}
+	byHash := make(map[string]string, len(c.Files))
+	names := make(map[string]bool)
+	for _, f := range c.Files {
+		byHash[strings.ToLower(f.SHA256)] = normalizeTag(f.Tag)
+		if f.Name != "" {
+			names[strings.ToLower(f.Name)] = true
+		}
+	}
+	// Files with a known name first, then the rest in listing order
+	var named, rest []string
+	for _, e := range entries {
+		switch {
+		case strings.HasSuffix(e, "/"):
+		case names[strings.ToLower(path.Base(e))]:
+			named = append(named, e)
+		default:
+			rest = append(rest, e)
+		}
+	}
+	files := append(named, rest...)
+	var tags []string
+	for _, file := range files[:min(len(files), c.PerSite)] {
+		u, err := neturl.JoinPath(base, file)
+		if err != nil {
+			continue
+		}
+		hash, ok := rl.prefixHash(ctx, client, u, c.PrefixBytes)
+		if ok {
+			tags = addTag(tags, byHash[hash])
+		}
+	}
+	return tags
+}
+
+// prefixHash returns the hash of the first n bytes of the file at url,
+// from the cache if it was fetched before.
+func (rl *Roulette) prefixHash(ctx context.Context, client *http.Client, url string, n int64) (string, bool) {
+	k := &rl.knownHashes
+	k.mu.Lock()
+	hash, ok := k.entries[url]
+	k.mu.Unlock()
+	if ok {
+		return hash, true
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", false
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	resp, err := client.Do(req)
+	if err != nil {
+		probeLog.Debug("Failed to fetch file to hash", "url", url, "err", err)
+		return "", false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", false
+	}
+	// Servers ignoring Range send it all, only the start is read
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(resp.Body, n)); err != nil {
+		return "", false
+	}
+	hash = hex.EncodeToString(h.Sum(nil))
+	k.mu.Lock()
+	if k.entries == nil || len(k.entries) >= knownHashCacheSize {
+		k.entries = make(map[string]string)
+	}
+	k.entries[url] = hash
+	k.mu.Unlock()
+	return hash, true
+}
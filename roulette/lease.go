@@ -0,0 +1,81 @@
+package roulette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const leaseTTL = 2 * time.Minute // How long a job lease lasts without renewal
+
+// Lease names for the background jobs
+const (
+	refreshLease = "refresh"
+	probeLease   = "probe"
+	exportLease  = "export"
+	crawlLease   = "crawl"
+)
+
+// ErrNotLeader is returned by Refresh and Probe when another instance
+// sharing the database holds the job's lease.
+var ErrNotLeader = errors.New("another instance is running this job")
+
+// leaseHolder identifies this process in the leases table. In Kubernetes
+// the hostname is the pod name.
+func leaseHolder() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// withLease runs fn while holding the named lease, renewing it in the
+// background. fn's context is cancelled if the lease is lost. Stores that
+// aren't Lockers always run fn.
+func (rl *Roulette) withLease(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	fn = rl.timed(name, fn)
+	locker, ok := rl.store.(Locker)
+	if !ok {
+		return fn(ctx)
+	}
+	acquired, err := locker.AcquireLease(name, rl.holder, leaseTTL)
+	if err != nil {
+		return fmt.Errorf("failed to acquire the %s lease: %v", name, err)
+	}
+	if !acquired {
+		return ErrNotLeader
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ok, err := locker.AcquireLease(name, rl.holder, leaseTTL)
+				if err != nil || !ok {
+					appLog.Warn("Lost the lease, stopping the job", "lease", name)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	err = fn(ctx)
+	cancel()
+	<-renewed
+	if err := locker.ReleaseLease(name, rl.holder); err != nil {
+		appLog.Error("Failed to release the lease", "lease", name, "err", err)
+	}
+	return err
+}
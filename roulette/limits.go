@@ -0,0 +1,60 @@
+package roulette
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+const DefaultMaxBodyBytes = 64 << 10 // Default request body cap, plenty for every form
+const MaxHeaderBytes = 16 << 10      // Request header cap for the servers the roulette command runs
+const maxMultipartMemory = 1 << 20   // Multipart parts beyond this go to temporary files, like net/http's default
+
+// LimitBodies caps request bodies at max bytes, answering 413 when one is
+// bigger. Form bodies are parsed up front so the handlers' FormValue calls
+// can't silently see a truncated form.
+func LimitBodies(h http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveLimited(h, max, w, r)
+	})
+}
+
+// serveLimited serves r through h with its body capped at max.
+func serveLimited(h http.Handler, max int64, w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > max {
+		tooLarge(w, max)
+		return
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		h.ServeHTTP(w, r)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, max)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var err error
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		err = r.ParseForm()
+	case "multipart/form-data":
+		err = r.ParseMultipartForm(maxMultipartMemory)
+	}
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		tooLarge(w, max)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+func tooLarge(w http.ResponseWriter, max int64) {
+	w.Header().Set("Connection", "close")
+	http.Error(w, fmt.Sprintf("Request body too large, the limit is %d bytes", max), http.StatusRequestEntityTooLarge)
+}
+
+// limitBodies applies the configured body cap, following reloads.
+func (rl *Roulette) limitBodies(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveLimited(h, rl.Config().MaxBodyBytes, w, r)
+	})
+}
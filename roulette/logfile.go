@@ -0,0 +1,169 @@
+package roulette
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const logFileTimeFormat = "20060102-150405" // Suffix of rotated log files
+
+// LogFileConfig writes the log to a file instead of standard error,
+// rotating it by size or age, for running bare under nohup rather than a
+// supervisor that collects output.
+type LogFileConfig struct {
+	// Path is the log file, empty logs to standard error
+	Path string `json:"path,omitempty"`
+	// MaxSizeMB rotates the file before it grows past this many megabytes,
+	// 0 never does
+	MaxSizeMB int `json:"max_size_mb"`
+	// RotateEvery rotates the file when a new period starts, such as every
+	// day at midnight UTC for 24h. 0 never does.
+	RotateEvery Duration `json:"rotate_every"`
+	// Keep is how many rotated files are kept, 0 keeps all of them
+	Keep int `json:"keep"`
+	// MaxAge deletes rotated files older than this, 0 never does
+	MaxAge Duration `json:"max_age"`
+}
+
+func (l LogFileConfig) validate() error {
+	if l.MaxSizeMB < 0 || l.RotateEvery < 0 || l.Keep < 0 || l.MaxAge < 0 {
+		return fmt.Errorf("log_file settings must not be negative")
+	}
+	return nil
+}
+
+// logFile is an append-only log file that rotates itself as it's written.
+// Rotated files are renamed to the path with a timestamp suffix.
+type logFile struct {
+	mu     sync.Mutex
+	config LogFileConfig
+	file   *os.File
+	size   int64
+	period time.Time // Start of the RotateEvery period the file was written in
+}
+
+func openLogFile(c LogFileConfig) (*logFile, error) {
+	l := &logFile{config: c}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the log file, carrying on an existing one.
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	l.file, l.size = f, info.Size()
+	// An existing file belongs to the period it was last written in
+	l.period = l.periodOf(time.Now())
+	if l.size > 0 {
+		l.period = l.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+func (l *logFile) periodOf(t time.Time) time.Time {
+	if l.config.RotateEvery <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(time.Duration(l.config.RotateEvery))
+}
+
+// setConfig applies changed settings for the same path.
+func (l *logFile) setConfig(c LogFileConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = c
+	l.period = l.periodOf(time.Now())
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	maxSize := int64(l.config.MaxSizeMB) << 20
+	full := maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > maxSize
+	if full || l.periodOf(time.Now()) != l.period {
+		if err := l.rotate(); err != nil {
+			// Keep logging to the old file rather than losing records
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file aside, starts a new one and prunes old
+// ones. The caller holds mu.
+func (l *logFile) rotate() error {
+	if l.size == 0 {
+		l.period = l.periodOf(time.Now())
+		return nil
+	}
+	rotated := l.config.Path + "." + time.Now().UTC().Format(logFileTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s.%d", l.config.Path, time.Now().UTC().Format(logFileTimeFormat), i)
+	}
+	if err := os.Rename(l.config.Path, rotated); err != nil {
+		return err
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	old.Close()
+	l.period = l.periodOf(time.Now())
+	l.prune()
+	return nil
+}
+
+// prune deletes the rotated files past Keep or MaxAge.
+func (l *logFile) prune() {
+	matches, err := filepath.Glob(l.config.Path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, name := range matches {
+		suffix := strings.TrimPrefix(name, l.config.Path+".")
+		if len(suffix) < len(logFileTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(logFileTimeFormat, suffix[:len(logFileTimeFormat)]); err == nil {
+			rotated = append(rotated, name)
+		}
+	}
+	// The timestamp suffixes sort oldest first
+	slices.Sort(rotated)
+	for i, name := range rotated {
+		old := l.config.Keep > 0 && i < len(rotated)-l.config.Keep
+		if info, err := os.Stat(name); err == nil && l.config.MaxAge > 0 && time.Since(info.ModTime()) > time.Duration(l.config.MaxAge) {
+			old = true
+		}
+		if old {
+			os.Remove(name)
+		}
+	}
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,170 @@
+package roulette
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Log formats for Config.LogFormat
+const (
+	LogFormatText = "text" // key=value pairs
+	LogFormatJSON = "json" // One JSON object per line
+)
+
+// Loggers for each part of the program. Their records carry a subsystem
+// attribute, so one part's output can be picked out or filtered away.
+var (
+	appLog    = subsystemLogger("app")
+	shodanLog = subsystemLogger("shodan")
+	syncLog   = subsystemLogger("sync")
+	probeLog  = subsystemLogger("probe")
+	httpLog   = subsystemLogger("http")
+	storeLog  = subsystemLogger("store")
+	botLog    = subsystemLogger("bot")
+)
+
+// logging is where records go and how they're written. The loggers above
+// follow changes to it, so they can be made before the config is read.
+var logging struct {
+	level   slog.LevelVar
+	mu      sync.Mutex // Guards the fields up to handler
+	out     io.Writer
+	format  string
+	base    io.Writer // The output SetupLogging was given, used without a log file
+	file    *logFile  // Set while logging to Config.LogFile
+	handler atomic.Pointer[slog.Handler]
+
+	slowQuery   atomic.Int64 // Config.SlowQueryThreshold in nanoseconds
+	slowQueries atomic.Int64 // Queries logged as slow
+}
+
+func init() {
+	logging.base = os.Stderr
+	setLogHandler(os.Stderr, LogFormatText)
+}
+
+// SetupLogging sends all logging to w in text format until a config says
+// otherwise, including that of the log package. w is usually wrapped in
+// RedactSecrets.
+func SetupLogging(w io.Writer) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.base = w
+	if logging.file == nil {
+		setLogHandler(w, logging.format)
+	}
+	slog.SetDefault(slog.New(logHandler{}))
+}
+
+// configureLogging applies c's log level, format, log file and slow query
+// threshold.
+func configureLogging(c *Config) {
+	level := slog.LevelInfo
+	switch c.LogLevel {
+	case LogLevelDebug:
+		level = slog.LevelDebug
+	case LogLevelWarn:
+		level = slog.LevelWarn
+	case LogLevelError:
+		level = slog.LevelError
+	}
+	logging.level.Set(level)
+	logging.slowQuery.Store(int64(c.SlowQueryThreshold))
+
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	out, format := logging.out, logging.format
+	if c.LogFormat != "" {
+		format = c.LogFormat
+	}
+	switch {
+	case c.LogFile.Path == "" && logging.file != nil:
+		logging.file.Close()
+		logging.file, out = nil, logging.base
+	case logging.file != nil && logging.file.config.Path == c.LogFile.Path:
+		logging.file.setConfig(c.LogFile)
+	case c.LogFile.Path != "":
+		f, err := openLogFile(c.LogFile)
+		if err != nil {
+			// Keep the current output, the error goes to it below
+			defer appLog.Error("Failed to switch to the log file", "err", err)
+			break
+		}
+		if logging.file != nil {
+			logging.file.Close()
+		}
+		logging.file, out = f, RedactSecrets(f)
+	}
+	if out != logging.out || format != logging.format {
+		setLogHandler(out, format)
+	}
+}
+
+// setLogHandler switches the output. The caller holds logging.mu, except
+// during init.
+func setLogHandler(w io.Writer, format string) {
+	opts := &slog.HandlerOptions{Level: &logging.level}
+	var h slog.Handler
+	if format == LogFormatJSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		format = LogFormatText
+		h = slog.NewTextHandler(w, opts)
+	}
+	logging.out, logging.format = w, format
+	logging.handler.Store(&h)
+}
+
+func subsystemLogger(name string) *slog.Logger {
+	return slog.New(logHandler{attrs: []slog.Attr{slog.String("subsystem", name)}})
+}
+
+// logHandler passes records on to the current handler, with its own
+// attributes ahead of the record's.
+type logHandler struct {
+	attrs []slog.Attr
+}
+
+func (h logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= logging.level.Level()
+}
+
+func (h logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if len(h.attrs) > 0 {
+		withAttrs := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+		withAttrs.AddAttrs(h.attrs...)
+		r.Attrs(func(a slog.Attr) bool {
+			withAttrs.AddAttrs(a)
+			return true
+		})
+		r = withAttrs
+	}
+	return (*logging.handler.Load()).Handle(ctx, r)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+// WithGroup binds to the current handler; a grouped logger doesn't follow
+// later format changes.
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return (*logging.handler.Load()).WithAttrs(h.attrs).WithGroup(name)
+}
+
+// logSlowQuery logs query if it has taken longer than the slow query
+// threshold since start.
+func logSlowQuery(query string, start time.Time) {
+	threshold := time.Duration(logging.slowQuery.Load())
+	if took := time.Since(start); threshold > 0 && took > threshold {
+		logging.slowQueries.Add(1)
+		storeLog.Warn("Slow query", "query", strings.Join(strings.Fields(query), " "), "duration", took)
+	}
+}
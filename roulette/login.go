@@ -0,0 +1,126 @@
+package roulette
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const adminAccount = "account:admin" // Throttle key for the admin password, whoever guesses it
+
+// LoginConfig throttles guessing of the admin password. Failures are kept
+// in the store, so a restart doesn't reset a lockout.
+type LoginConfig struct {
+	// MaxFailures is how many failed logins one client can make within
+	// Lockout before it is locked out, 0 for no cap
+	MaxFailures int `json:"max_failures"`
+	// AccountMaxFailures is how many failed logins from all clients
+	// together lock the admin account, 0 for no cap. It catches guessing
+	// spread over many IPs; admin_allow keeps the lockout from shutting
+	// out the real admin.
+	AccountMaxFailures int `json:"account_max_failures"`
+	// Lockout is the period failures are counted over
+	Lockout Duration `json:"lockout"`
+}
+
+// LoginThrottleStore is implemented by stores that keep failed logins.
+type LoginThrottleStore interface {
+	// AddLoginFailure records a failed login for key at t.
+	AddLoginFailure(key string, t time.Time) error
+	// LoginFailures counts key's failed logins since since.
+	LoginFailures(key string, since time.Time) (int, error)
+	// ClearLoginFailures forgets key's failed logins.
+	ClearLoginFailures(key string) error
+	// PruneLoginFailures forgets every failed login from before before.
+	PruneLoginFailures(before time.Time) error
+}
+
+// loginLimit is one of the caps a login attempt is counted against.
+type loginLimit struct {
+	key string
+	max int
+}
+
+func (c *Config) loginLimits(r *http.Request) []loginLimit {
+	return []loginLimit{
+		{"ip:" + c.clientKey(r), c.Login.MaxFailures},
+		{adminAccount, c.Login.AccountMaxFailures},
+	}
+}
+
+// loginLocked reports whether r's client or the admin account is locked
+// out. Store errors are logged and don't lock anyone out, the password is
+// still checked.
+func (rl *Roulette) loginLocked(r *http.Request) bool {
+	store, ok := rl.store.(LoginThrottleStore)
+	if !ok {
+		return false
+	}
+	c := rl.Config()
+	since := time.Now().Add(-time.Duration(c.Login.Lockout))
+	for _, l := range c.loginLimits(r) {
+		if l.max == 0 {
+			continue
+		}
+		n, err := store.LoginFailures(l.key, since)
+		if err != nil {
+			httpLog.Error("Failed to check login failures", "err", err)
+			continue
+		}
+		if n >= l.max {
+			return true
+		}
+	}
+	return false
+}
+
+// loginFailed counts a failed login from r, raising the alert when it
+// locks something out.
+func (rl *Roulette) loginFailed(r *http.Request) {
+	store, ok := rl.store.(LoginThrottleStore)
+	if !ok {
+		return
+	}
+	c := rl.Config()
+	now := time.Now()
+	since := now.Add(-time.Duration(c.Login.Lockout))
+	// Failures older than the window never count again
+	if err := store.PruneLoginFailures(since); err != nil {
+		httpLog.Error("Failed to prune login failures", "err", err)
+	}
+	for _, l := range c.loginLimits(r) {
+		if err := store.AddLoginFailure(l.key, now); err != nil {
+			httpLog.Error("Failed to record login failure", "err", err)
+			continue
+		}
+		if l.max == 0 {
+			continue
+		}
+		if n, err := store.LoginFailures(l.key, since); err == nil && n == l.max {
+			httpLog.Warn("Admin login locked", "key", l.key, "failures", n, "within", time.Duration(c.Login.Lockout))
+			rl.audit(withActor(r, "login:"+c.clientKey(r)), AuditLoginLockout, l.key, nil, map[string]int{"failures": n})
+		}
+	}
+}
+
+// loginSucceeded clears the failures counted against r's client and the
+// admin account.
+func (rl *Roulette) loginSucceeded(r *http.Request) {
+	store, ok := rl.store.(LoginThrottleStore)
+	if !ok {
+		return
+	}
+	for _, l := range rl.Config().loginLimits(r) {
+		if err := store.ClearLoginFailures(l.key); err != nil {
+			httpLog.Error("Failed to clear login failures", "err", err)
+		}
+	}
+}
+
+// lockedOut answers a login attempt made during a lockout.
+func lockedOut(w http.ResponseWriter, lockout Duration) string {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Duration(lockout).Seconds())))
+	w.WriteHeader(http.StatusTooManyRequests)
+	return fmt.Sprintf("Too many failed logins, try again in %s", time.Duration(lockout))
+}
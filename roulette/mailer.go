@@ -0,0 +1,80 @@
+package roulette
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// mailMessage is one email.
+type mailMessage struct {
+	To          []string
+	Subject     string
+	ContentType string
+	Body        string
+	// Headers are added as they are, with names and values free of line
+	// breaks
+	Headers map[string]string
+}
+
+// sendMail mails body, of the given content type, to e.To.
+func sendMail(e AlertEmail, subject, contentType, body string) error {
+	return e.send(mailMessage{To: e.To, Subject: subject, ContentType: contentType, Body: body})
+}
+
+// send mails m through e's server, from e.From.
+func (e AlertEmail) send(m mailMessage) error {
+	for _, v := range append(m.To, m.Subject) {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("line break in mail header %q", v)
+		}
+	}
+	host, _, _ := net.SplitHostPort(e.SMTP)
+	conn, err := net.DialTimeout("tcp", e.SMTP, alertSendTimeout)
+	if err != nil {
+		return err
+	}
+	// smtp has no timeouts of its own, a stuck server mustn't hold up the job
+	conn.SetDeadline(time.Now().Add(alertSendTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.Username, e.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: [roulette] %s\r\nDate: %s\r\nContent-Type: %s; charset=utf-8\r\n",
+		e.From, strings.Join(m.To, ", "), m.Subject, time.Now().Format(time.RFC1123Z), m.ContentType)
+	for name, value := range m.Headers {
+		fmt.Fprintf(w, "%s: %s\r\n", name, value)
+	}
+	fmt.Fprintf(w, "\r\n%s\r\n", m.Body)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,117 @@
+package roulette
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultDeniedNetworks keep the pool and the prober away from anything
+// that isn't the public internet: private, loopback, link-local, CGNAT,
+// benchmarking, multicast and reserved ranges.
+var defaultDeniedNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b:1::/48",
+	"100::/64",
+	"2001:db8::/32",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// errAddressNotAllowed is returned when a connection to a site would go to
+// a denied address.
+var errAddressNotAllowed = errors.New("address not allowed by the network policy")
+
+// NetworkPolicy restricts the addresses sites may point at. It is applied
+// to IP literals before they are stored and to every address the prober
+// connects to, which also covers hostnames that resolve to a private
+// address.
+type NetworkPolicy struct {
+	// Deny lists the forbidden CIDRs, by default the non-public ranges
+	Deny []string `json:"deny"`
+	// Allow lists CIDRs permitted even though Deny covers them
+	Allow []string `json:"allow"`
+
+	deny, allow []*net.IPNet
+}
+
+func (p *NetworkPolicy) parse() error {
+	var err error
+	if p.deny, err = parseCIDRs(p.Deny); err != nil {
+		return fmt.Errorf("invalid network.deny entry: %v", err)
+	}
+	if p.allow, err = parseCIDRs(p.Allow); err != nil {
+		return fmt.Errorf("invalid network.allow entry: %v", err)
+	}
+	return nil
+}
+
+// allows reports whether connecting to ip is permitted.
+func (p *NetworkPolicy) allows(ip net.IP) bool {
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsURL reports whether rawURL may be stored. IP literals are checked
+// against the policy now, hostnames when they are connected to.
+func (p *NetworkPolicy) allowsURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.allows(ip)
+	}
+	// Names that always mean this machine or the local network
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || strings.HasSuffix(host, ".local") {
+		return false
+	}
+	return true
+}
+
+// siteClient returns an HTTP client for talking to listed sites. Its
+// dialer refuses addresses the network policy denies, after DNS
+// resolution and for every redirect, so sites can't point it inwards.
+// Requests identify themselves as configured in Outbound.
+func (rl *Roulette) siteClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: identifyTransport{
+			outbound: rl.Config().Outbound,
+			base:     rl.siteTransport(),
+		},
+	}
+}
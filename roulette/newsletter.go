@@ -0,0 +1,361 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/mail"
+	neturl "net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const newsletterJob = "newsletter"
+const newsletterFindsMax = 10                       // Sites in each weekly email
+const newsletterPeriod = 7 * 24 * time.Hour         // The email covers sites discovered this long ago at most
+const newsletterUnconfirmedFor = 7 * 24 * time.Hour // Subscriptions left unconfirmed this long are dropped
+
+// NewsletterConfig lets visitors subscribe to a weekly email of the best
+// new finds, confirming their address first. Links in the emails point at
+// BaseURL.
+type NewsletterConfig struct {
+	// Enabled serves /subscribe and sends the weekly email
+	Enabled bool `json:"enabled"`
+	// BaseURL is where visitors reach this server, such as
+	// https://roulette.example/
+	BaseURL string `json:"base_url,omitempty"`
+	// Weekday, 0 for Sunday, and Hour, UTC, are when the email goes out
+	Weekday int `json:"weekday"`
+	Hour    int `json:"hour"`
+	// Email is the server the emails are sent through. To is unused,
+	// subscribers are the recipients.
+	Email AlertEmail `json:"email"`
+}
+
+func (n NewsletterConfig) validate() error {
+	if !n.Enabled {
+		return nil
+	}
+	if u, err := neturl.Parse(n.BaseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("newsletter.base_url must be an http or https URL")
+	}
+	if n.Weekday < 0 || n.Weekday > 6 {
+		return fmt.Errorf("newsletter.weekday must be between 0 and 6")
+	}
+	if n.Hour < 0 || n.Hour > 23 {
+		return fmt.Errorf("newsletter.hour must be between 0 and 23")
+	}
+	if n.Email.SMTP == "" || n.Email.From == "" {
+		return fmt.Errorf("newsletter.email needs an smtp server and a from address")
+	}
+	return nil
+}
+
+// link returns the absolute URL of path, relative to the root of the
+// handler, with the given query.
+func (n NewsletterConfig) link(path string, query neturl.Values) string {
+	return strings.TrimSuffix(n.BaseURL, "/") + "/" + path + "?" + query.Encode()
+}
+
+// Subscriber is an address subscribed to the weekly email. Token confirms
+// the subscription and later unsubscribes it.
+type Subscriber struct {
+	ID        int64
+	Email     string
+	Token     string
+	Confirmed bool
+	Created   time.Time
+}
+
+// SubscriptionStore is implemented by stores that keep newsletter
+// subscribers.
+type SubscriptionStore interface {
+	// AddSubscriber records an unconfirmed subscription for email, or
+	// gives an unconfirmed one a new token and creation time. It reports
+	// whether email is already confirmed, in which case nothing changes.
+	AddSubscriber(email, token string, created time.Time) (confirmed bool, err error)
+	// ConfirmSubscriber confirms the subscription with token, reporting
+	// whether there is one.
+	ConfirmSubscriber(token string) (bool, error)
+	// RemoveSubscriber deletes the subscription with token, reporting
+	// whether there was one.
+	RemoveSubscriber(token string) (bool, error)
+	// Subscribers returns the confirmed subscriptions.
+	Subscribers() ([]Subscriber, error)
+	// PruneSubscribers deletes subscriptions still unconfirmed that were
+	// made before cutoff.
+	PruneSubscribers(cutoff time.Time) (int64, error)
+}
+
+// newsletterMail is the data the newsletter email templates are rendered
+// with.
+type newsletterMail struct {
+	Branding    Branding
+	Confirm     string // The link confirming the subscription
+	Finds       []VisitedSite
+	Unsubscribe string
+}
+
+// renderMail renders the named email template.
+func (rl *Roulette) renderMail(name string, data newsletterMail) (string, error) {
+	tmpl, err := rl.template(name)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// newsletterFinds returns the best sites discovered since from that are
+// still up: the most visited, newest first among equals.
+func (rl *Roulette) newsletterFinds(from time.Time) ([]VisitedSite, error) {
+	store, ok := rl.store.(SiteEventStore)
+	if !ok {
+		return nil, nil
+	}
+	events, err := store.SiteEventsSince(from)
+	if err != nil {
+		return nil, err
+	}
+	sites, err := rl.store.List(SiteFilter{Status: StatusUp})
+	if err != nil {
+		return nil, err
+	}
+	up := make(map[int64]string, len(sites))
+	for _, s := range sites {
+		up[s.ID] = s.URL
+	}
+	visits := make(map[int64]int)
+	if stats, ok := rl.store.(StatsStore); ok {
+		top, err := stats.TopVisits(from.Format("2006-01-02"), 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range top {
+			visits[v.SiteID] = v.Count
+		}
+	}
+	var finds []VisitedSite
+	seen := make(map[int64]bool)
+	// Newest first, so the stable sort keeps them first among equals
+	for i := len(events) - 1; i >= 0; i-- {
+		e := events[i]
+		url, ok := up[e.SiteID]
+		if e.Kind != EventDiscovered || !ok || seen[e.SiteID] {
+			continue
+		}
+		seen[e.SiteID] = true
+		finds = append(finds, VisitedSite{ID: e.SiteID, URL: url, Visits: visits[e.SiteID]})
+	}
+	sort.SliceStable(finds, func(i, j int) bool { return finds[i].Visits > finds[j].Visits })
+	return finds[:min(len(finds), newsletterFindsMax)], nil
+}
+
+// sendNewsletter mails this week's finds to every confirmed subscriber.
+func (rl *Roulette) sendNewsletter(ctx context.Context) error {
+	store, ok := rl.store.(SubscriptionStore)
+	if !ok {
+		return fmt.Errorf("this store doesn't keep subscribers")
+	}
+	c := rl.Config()
+	if n, err := store.PruneSubscribers(time.Now().Add(-newsletterUnconfirmedFor)); err != nil {
+		appLog.Error("Failed to drop unconfirmed subscriptions", "err", err)
+	} else if n > 0 {
+		appLog.Info("Dropped unconfirmed subscriptions", "count", n)
+	}
+	subscribers, err := store.Subscribers()
+	if err != nil {
+		return fmt.Errorf("failed to list subscribers: %v", err)
+	}
+	finds, err := rl.newsletterFinds(time.Now().Add(-newsletterPeriod))
+	if err != nil {
+		return fmt.Errorf("failed to pick this week's finds: %v", err)
+	}
+	if len(finds) == 0 || len(subscribers) == 0 {
+		appLog.Info("Nothing to send in the newsletter", "finds", len(finds), "subscribers", len(subscribers))
+		return nil
+	}
+	subject := "This week's finds, " + time.Now().UTC().Format("2006-01-02")
+	failed := 0
+	var lastErr error
+	for _, s := range subscribers {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		unsubscribe := c.Newsletter.link("unsubscribe", neturl.Values{"token": {s.Token}})
+		body, err := rl.renderMail("newsletter.html", newsletterMail{Branding: c.Branding, Finds: finds, Unsubscribe: unsubscribe})
+		if err != nil {
+			return fmt.Errorf("failed to render the newsletter: %v", err)
+		}
+		err = c.Newsletter.Email.send(mailMessage{
+			To: []string{s.Email}, Subject: subject, ContentType: "text/html", Body: body,
+			Headers: map[string]string{"List-Unsubscribe": "<" + unsubscribe + ">"},
+		})
+		if err != nil {
+			failed++
+			lastErr = err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to mail %d of %d subscribers: %v", failed, len(subscribers), lastErr)
+	}
+	appLog.Info("Sent the newsletter", "subscribers", len(subscribers), "finds", len(finds))
+	return nil
+}
+
+// startNewsletter sends the newsletter every week at the configured time,
+// while enabled, until ctx is cancelled.
+func (rl *Roulette) startNewsletter(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		var schedule digestSchedule
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				c := rl.Config().Newsletter
+				now = now.UTC()
+				if c.Enabled && int(now.Weekday()) == c.Weekday && schedule.due(now, c.Hour) {
+					rl.timed(newsletterJob, rl.sendNewsletter)(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// subscribePage is the data the subscribe template is rendered with.
+type subscribePage struct {
+	basePage
+	Email string
+	Error string
+	// State is what the page shows: "" for the form, "sent", "confirmed",
+	// "unsubscribe" to ask first, or "unsubscribed"
+	State string
+	Token string
+}
+
+// subscribeHandler shows the subscription form and, on POST, mails the
+// address a link confirming it.
+func (rl *Roulette) subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config()
+	store, ok := rl.store.(SubscriptionStore)
+	if !c.Newsletter.Enabled || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	page := subscribePage{basePage: rl.pageBase(w, r)}
+	if r.Method != http.MethodPost {
+		rl.render(w, "subscribe.html", page)
+		return
+	}
+	page.Email = r.FormValue("email")
+	status, err := rl.admitSubmission(r)
+	if err == nil && shadowed(r) {
+		rl.render(w, "subscribe.html", subscribePage{basePage: page.basePage, State: "sent"})
+		return
+	}
+	if err == nil {
+		status, err = rl.subscribe(store, page.Email)
+	}
+	if err != nil {
+		page.Error = err.Error()
+		if e, ok := err.(errTooManySubmissions); ok {
+			w.Header().Set("Retry-After", fmt.Sprint(int(e.retryAfter.Seconds())+1))
+		}
+		w.WriteHeader(status)
+	} else {
+		page.State = "sent"
+	}
+	rl.render(w, "subscribe.html", page)
+}
+
+// subscribe records an unconfirmed subscription for address and mails it
+// the confirmation link. Addresses already confirmed aren't mailed again,
+// and look the same to the visitor. The status goes with the error.
+func (rl *Roulette) subscribe(store SubscriptionStore, address string) (int, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil || strings.ContainsAny(addr.Address, "\r\n") {
+		return http.StatusBadRequest, fmt.Errorf("that doesn't look like an email address")
+	}
+	email := strings.ToLower(addr.Address)
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	token := hex.EncodeToString(b)
+	confirmed, err := store.AddSubscriber(email, token, time.Now().UTC())
+	if err != nil {
+		httpLog.Error("Failed to record subscriber", "err", err)
+		return http.StatusInternalServerError, fmt.Errorf("failed to record the subscription")
+	}
+	if confirmed {
+		return 0, nil
+	}
+	c := rl.Config()
+	body, err := rl.renderMail("newsletter_confirm.html", newsletterMail{
+		Branding: c.Branding,
+		Confirm:  c.Newsletter.link("subscribe/confirm", neturl.Values{"token": {token}}),
+	})
+	if err == nil {
+		err = c.Newsletter.Email.send(mailMessage{To: []string{email}, Subject: "Confirm your subscription", ContentType: "text/html", Body: body})
+	}
+	if err != nil {
+		httpLog.Error("Failed to send the confirmation email", "err", err)
+		return http.StatusBadGateway, fmt.Errorf("failed to send the confirmation email, try again later")
+	}
+	return 0, nil
+}
+
+// confirmSubscriptionHandler confirms the subscription the emailed link
+// is for.
+func (rl *Roulette) confirmSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := rl.store.(SubscriptionStore)
+	if !rl.Config().Newsletter.Enabled || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	page := subscribePage{basePage: rl.pageBase(w, r), State: "confirmed"}
+	found, err := store.ConfirmSubscriber(r.URL.Query().Get("token"))
+	if err != nil {
+		httpLog.Error("Failed to confirm subscriber", "err", err)
+		page.State, page.Error = "", "Failed to confirm the subscription"
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if !found {
+		page.State, page.Error = "", "This link has expired or was already used to unsubscribe, subscribe again below."
+		w.WriteHeader(http.StatusNotFound)
+	}
+	rl.render(w, "subscribe.html", page)
+}
+
+// unsubscribeHandler asks whether to unsubscribe and, on POST, does. Mail
+// scanners follow links, so GET alone changes nothing.
+func (rl *Roulette) unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := rl.store.(SubscriptionStore)
+	if !rl.Config().Newsletter.Enabled || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	page := subscribePage{basePage: rl.pageBase(w, r), State: "unsubscribe", Token: r.FormValue("token")}
+	if r.Method == http.MethodPost {
+		if _, err := store.RemoveSubscriber(page.Token); err != nil {
+			httpLog.Error("Failed to remove subscriber", "err", err)
+			page.Error = "Failed to unsubscribe, try again later"
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			// Unknown tokens were already unsubscribed
+			page.State = "unsubscribed"
+		}
+	}
+	rl.render(w, "subscribe.html", page)
+}
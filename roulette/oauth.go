@@ -0,0 +1,386 @@
+package roulette
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const visitorCookie = "roulette_user"                     // Cookie holding a logged in visitor's session ID
+const anonCookie = "roulette_anon"                        // Cookie identifying an anonymous visitor
+const oauthStateCookie = "roulette_oauth_state"           // Cookie tying an OAuth callback to the login that started it
+const visitorSessionLifetime = 30 * 24 * time.Hour        // How long a visitor login lasts
+const oauthTimeout = 10 * time.Second                     // Upper bound for each request to a provider
+const githubAPI = "https://api.github.com/user"           // GitHub's user endpoint
+const oidcDiscovery = "/.well-known/openid-configuration" // Appended to the issuer to find its endpoints
+
+// OAuthProvider is a login provider for visitor accounts. Type "github"
+// uses GitHub's OAuth apps, "oidc" any OpenID Connect provider such as
+// Google, found through its issuer URL.
+type OAuthProvider struct {
+	// Name identifies the provider in /auth/login/NAME and is shown on the
+	// login button
+	Name string `json:"name"`
+	// Type is "github" or "oidc"
+	Type         string `json:"type"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// Issuer is the OIDC issuer, like https://accounts.google.com
+	Issuer string `json:"issuer,omitempty"`
+	// RedirectURL is the callback registered with the provider, this
+	// server's public URL followed by /auth/callback/NAME
+	RedirectURL string `json:"redirect_url"`
+	// Scopes default to openid and profile for OIDC and none for GitHub
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+func (p OAuthProvider) validate() error {
+	if p.Name == "" || strings.ContainsAny(p.Name, "/?#") {
+		return fmt.Errorf("oauth provider needs a name without slashes")
+	}
+	if p.Type != "github" && p.Type != "oidc" {
+		return fmt.Errorf("oauth provider %s: type must be \"github\" or \"oidc\"", p.Name)
+	}
+	if p.Type == "oidc" && p.Issuer == "" {
+		return fmt.Errorf("oauth provider %s: oidc needs an issuer", p.Name)
+	}
+	if p.ClientID == "" || p.RedirectURL == "" {
+		return fmt.Errorf("oauth provider %s: client_id and redirect_url are required", p.Name)
+	}
+	return nil
+}
+
+// oauthEndpoints are where a provider's authorization code flow happens.
+type oauthEndpoints struct {
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	UserInfo      string `json:"userinfo_endpoint"`
+}
+
+var oauthClient = &http.Client{Timeout: oauthTimeout}
+
+// endpoints returns the provider's endpoints, asking OIDC providers for
+// them.
+func (p OAuthProvider) endpoints(ctx context.Context) (oauthEndpoints, error) {
+	if p.Type == "github" {
+		return oauthEndpoints{
+			Authorization: "https://github.com/login/oauth/authorize",
+			Token:         "https://github.com/login/oauth/access_token",
+			UserInfo:      githubAPI,
+		}, nil
+	}
+	var e oauthEndpoints
+	err := getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+oidcDiscovery, "", &e)
+	if err != nil {
+		return e, fmt.Errorf("failed to discover OIDC endpoints: %v", err)
+	}
+	if e.Authorization == "" || e.Token == "" || e.UserInfo == "" {
+		return e, fmt.Errorf("the OIDC provider doesn't advertise the endpoints needed")
+	}
+	return e, nil
+}
+
+func (p OAuthProvider) scopes() string {
+	if len(p.Scopes) == 0 && p.Type == "oidc" {
+		return "openid profile"
+	}
+	return strings.Join(p.Scopes, " ")
+}
+
+// exchange trades an authorization code for an access token.
+func (p OAuthProvider) exchange(ctx context.Context, e oauthEndpoints, code string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"client_secret": {p.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Token, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to parse token response: %v", err)
+	}
+	if token.Error != "" {
+		return "", fmt.Errorf("%s: %s", token.Error, token.ErrorDescription)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("no access token in response (status %d)", resp.StatusCode)
+	}
+	return token.AccessToken, nil
+}
+
+// identify returns the provider's ID and display name for the account
+// the access token belongs to.
+func (p OAuthProvider) identify(ctx context.Context, e oauthEndpoints, accessToken string) (string, string, error) {
+	if p.Type == "github" {
+		var user struct {
+			ID    int64  `json:"id"`
+			Login string `json:"login"`
+			Name  string `json:"name"`
+		}
+		if err := getJSON(ctx, e.UserInfo, accessToken, &user); err != nil {
+			return "", "", err
+		}
+		if user.ID == 0 {
+			return "", "", fmt.Errorf("GitHub returned no user ID")
+		}
+		return strconv.FormatInt(user.ID, 10), firstNonEmpty(user.Name, user.Login), nil
+	}
+	var info struct {
+		Subject  string `json:"sub"`
+		Name     string `json:"name"`
+		Username string `json:"preferred_username"`
+		Email    string `json:"email"`
+	}
+	if err := getJSON(ctx, e.UserInfo, accessToken, &info); err != nil {
+		return "", "", err
+	}
+	if info.Subject == "" {
+		return "", "", fmt.Errorf("the provider returned no subject")
+	}
+	return info.Subject, firstNonEmpty(info.Name, info.Username, info.Email, info.Subject), nil
+}
+
+// getJSON fetches url into v, with a bearer token if one is given.
+func getJSON(ctx context.Context, url, bearer string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// oauthProvider returns the configured provider called name.
+func (rl *Roulette) oauthProvider(name string) (OAuthProvider, bool) {
+	for _, p := range rl.Config().OAuth {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return OAuthProvider{}, false
+}
+
+// oauthLoginHandler sends the visitor to the provider's consent page.
+func (rl *Roulette) oauthLoginHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := rl.oauthProvider(r.PathValue("provider"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	e, err := p.endpoints(r.Context())
+	if err != nil {
+		httpLog.Warn("OAuth login failed", "provider", p.Name, "err", err)
+		http.Error(w, "Login provider unavailable", http.StatusBadGateway)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	state := hex.EncodeToString(b)
+	// Lax, since the provider sends the browser back from another site
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    p.Name + ":" + state,
+		Path:     "/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientID},
+		"redirect_uri":  {p.RedirectURL},
+		"state":         {state},
+	}
+	if scopes := p.scopes(); scopes != "" {
+		q.Set("scope", scopes)
+	}
+	sep := "?"
+	if strings.Contains(e.Authorization, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, e.Authorization+sep+q.Encode(), http.StatusFound)
+}
+
+// oauthCallbackHandler finishes the login the provider sent the visitor
+// back from.
+func (rl *Roulette) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := rl.oauthProvider(r.PathValue("provider"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || cookie.Value != p.Name+":"+r.FormValue("state") || r.FormValue("state") == "" {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/", MaxAge: -1})
+	if msg := r.FormValue("error"); msg != "" {
+		http.Error(w, "Login was cancelled: "+msg, http.StatusForbidden)
+		return
+	}
+	users, ok := rl.store.(UserStore)
+	if !ok {
+		http.Error(w, "Accounts aren't supported by this store", http.StatusNotImplemented)
+		return
+	}
+
+	ctx := r.Context()
+	e, err := p.endpoints(ctx)
+	if err == nil {
+		var accessToken, subject, name string
+		accessToken, err = p.exchange(ctx, e, r.FormValue("code"))
+		if err == nil {
+			subject, name, err = p.identify(ctx, e, accessToken)
+		}
+		if err == nil {
+			var user User
+			user, err = users.UpsertUser(p.Name, subject, name)
+			if err == nil {
+				err = rl.startVisitorSession(w, r, user)
+			}
+		}
+	}
+	if err != nil {
+		httpLog.Warn("OAuth login failed", "provider", p.Name, "err", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	// Back from /auth/callback/NAME to the index
+	redirectRelative(w, "../../")
+}
+
+func (rl *Roulette) startVisitorSession(w http.ResponseWriter, r *http.Request, user User) error {
+	id, err := rl.visitors.create(user.ID)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(visitorSessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// oauthLogoutHandler ends the visitor's login.
+func (rl *Roulette) oauthLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(visitorCookie); err == nil {
+		rl.visitors.end(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: visitorCookie, Path: "/", MaxAge: -1})
+	redirectRelative(w, "../")
+}
+
+// Visitor identifies who made a request, so per-visitor features can
+// follow accounts across devices and fall back to a cookie for anonymous
+// visitors.
+type Visitor struct {
+	User   *User  // The logged in account, nil for anonymous visitors
+	AnonID string // Random ID from a cookie when anonymous
+}
+
+// Key is a stable identifier to attach per-visitor data to.
+func (v Visitor) Key() string {
+	if v.User != nil {
+		return "user:" + strconv.FormatInt(v.User.ID, 10)
+	}
+	return "anon:" + v.AnonID
+}
+
+// loggedInUser returns the account of r's visitor session, if any.
+func (rl *Roulette) loggedInUser(r *http.Request) *User {
+	cookie, err := r.Cookie(visitorCookie)
+	if err != nil {
+		return nil
+	}
+	sess, ok := rl.visitors.get(cookie.Value)
+	if !ok {
+		return nil
+	}
+	users, ok := rl.store.(UserStore)
+	if !ok {
+		return nil
+	}
+	user, err := users.User(sess.userID)
+	if err != nil {
+		return nil
+	}
+	return &user
+}
+
+// Visitor returns who made r, handing anonymous visitors an ID cookie on
+// their first request.
+func (rl *Roulette) Visitor(w http.ResponseWriter, r *http.Request) Visitor {
+	if user := rl.loggedInUser(r); user != nil {
+		return Visitor{User: user}
+	}
+	if cookie, err := r.Cookie(anonCookie); err == nil && cookie.Value != "" {
+		return Visitor{AnonID: cookie.Value}
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     anonCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int((365 * 24 * time.Hour).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return Visitor{AnonID: id}
+}
@@ -0,0 +1,74 @@
+package roulette
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const outLinkTTL = 10 * time.Minute // How long a signed /out link works
+
+// processRedirectKey signs /out links when no redirect_key is configured.
+var processRedirectKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// outSignature signs a site ID and expiry as a Unix time.
+func (c *Config) outSignature(id int64, expires int64) string {
+	key := processRedirectKey
+	if c.RedirectKey != "" {
+		key = []byte(c.RedirectKey)
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "out:%d:%d", id, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// outPath returns a signed link to /out/{id} for site, relative to the
+// root of the handler. It stops working after outLinkTTL.
+func (rl *Roulette) outPath(site Site) string {
+	expires := time.Now().Add(outLinkTTL).Unix()
+	return fmt.Sprintf("out/%d?exp=%d&sig=%s", site.ID, expires, rl.Config().outSignature(site.ID, expires))
+}
+
+// outHandler redirects to the site behind a signed /out/{id} link. Links
+// only ever lead to sites in the pool and must carry an unexpired
+// signature, so the endpoint can't be used as an open redirector.
+func (rl *Roulette) outHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	want := rl.Config().outSignature(id, expires)
+	if err != nil || !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(want)) {
+		http.Error(w, "Invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "This link has expired, shuffle again", http.StatusGone)
+		return
+	}
+	site, err := rl.store.Site(id)
+	if err == errNoSuchSite {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		httpLog.Error("Failed to look up site", "site", id, "err", err)
+		rl.reportError(err, map[string]string{"site_id": strconv.FormatInt(id, 10)})
+		http.Error(w, "Failed to look up site", http.StatusInternalServerError)
+		return
+	}
+	rl.recordVisit(site)
+	w.Header().Set("Cache-Control", "no-store")
+	rl.redirectAway(w, r, site.URL)
+}
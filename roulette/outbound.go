@@ -0,0 +1,105 @@
+package roulette
+
+import (
+	"net/http"
+	"strings"
+)
+
+// OutboundConfig controls how requests to listed sites identify
+// themselves, so their owners can tell who is visiting and reach the
+// operator.
+type OutboundConfig struct {
+	// UserAgent replaces the default SimpleHTTPRoulette/version
+	UserAgent string `json:"user_agent,omitempty"`
+	// ContactURL is appended to the User-Agent as (+URL). A mailto: URL is
+	// also sent in the From header.
+	ContactURL string `json:"contact_url,omitempty"`
+	// HonorRobotsTag drops hosts whose responses carry an X-Robots-Tag of
+	// noindex or none, for all agents or for ours
+	HonorRobotsTag bool `json:"honor_robots_tag"`
+}
+
+// userAgent is the User-Agent header sent to sites.
+func (o OutboundConfig) userAgent() string {
+	ua := o.UserAgent
+	if ua == "" {
+		ua = serverHeader()
+	}
+	if o.ContactURL != "" {
+		ua += " (+" + o.ContactURL + ")"
+	}
+	return ua
+}
+
+// robotsName is the agent name X-Robots-Tag directives can address us
+// by: the product name at the start of the User-Agent.
+func (o OutboundConfig) robotsName() string {
+	name, _, _ := strings.Cut(o.userAgent(), "/")
+	name, _, _ = strings.Cut(name, " ")
+	return strings.ToLower(name)
+}
+
+// identifyTransport adds the configured User-Agent and From headers to
+// every request.
+type identifyTransport struct {
+	outbound OutboundConfig
+	base     http.RoundTripper
+}
+
+func (t identifyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.outbound.userAgent())
+	if email, ok := strings.CutPrefix(t.outbound.ContactURL, "mailto:"); ok {
+		req.Header.Set("From", email)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// robotsOptOut reports whether the X-Robots-Tag headers in h ask agent
+// not to index the page. Directives are either for every agent
+// ("noindex") or for a named one ("roulette: noindex").
+func robotsOptOut(h http.Header, agent string) bool {
+	for _, value := range h.Values("X-Robots-Tag") {
+		scope := ""
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			// A "name:" prefix applies to the rest of the header value
+			if name, rest, ok := strings.Cut(directive, ":"); ok && !strings.Contains(name, " ") && name != "unavailable_after" {
+				scope, directive = strings.TrimSpace(name), strings.TrimSpace(rest)
+			}
+			if scope != "" && scope != agent {
+				continue
+			}
+			if directive == "noindex" || directive == "none" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dropOptedOut denies site's host and removes its sites from the pool,
+// for hosts that opted out with X-Robots-Tag.
+func (rl *Roulette) dropOptedOut(site Site) {
+	probeLog.Info("Dropping host, its X-Robots-Tag opts out of indexing", "host", site.Host)
+	if mod, ok := rl.store.(ModerationStore); ok {
+		if err := mod.Deny(site.Host, "X-Robots-Tag"); err != nil {
+			probeLog.Error("Failed to deny host", "host", site.Host, "err", err)
+		}
+	}
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		probeLog.Error("Failed to list sites", "err", err)
+		return
+	}
+	defer rl.sitesChanged()
+	for _, s := range sites {
+		if s.Host == site.Host {
+			if err := rl.store.Remove(s.URL); err != nil {
+				probeLog.Error("Failed to remove site", "url", s.URL, "err", err)
+				continue
+			}
+			rl.recordEvents(siteEvent(s, EventRemoved, "X-Robots-Tag opts out of indexing"))
+		}
+	}
+}
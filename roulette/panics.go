@@ -0,0 +1,80 @@
+package roulette
+
+import (
+	"net/http"
+	"runtime/debug"
+	"strings"
+)
+
+// errorPage is the data the error template is rendered with.
+type errorPage struct {
+	Branding Branding
+}
+
+// recoverPanics turns a panic in h into a logged stack trace, an error
+// report and a 500 page, instead of a dropped connection.
+// http.ErrAbortHandler is let through, it's how handlers abort on purpose.
+func (rl *Roulette) recoverPanics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pw := &panicWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			rl.panics.Add(1)
+			httpLog.Error("Panic serving request", "method", r.Method, "path", r.URL.Path, "panic", v, "stack", string(debug.Stack()))
+			rl.reportPanic(v, map[string]string{"method": r.Method, "path": r.URL.Path})
+			if pw.wrote {
+				// Too late for an error page, cut the response short
+				panic(http.ErrAbortHandler)
+			}
+			rl.serveError(w, r)
+		}()
+		h.ServeHTTP(pw, r)
+	})
+}
+
+// serveError answers with a 500, an error page for browsers and plain
+// text for the API.
+func (rl *Roulette) serveError(w http.ResponseWriter, r *http.Request) {
+	const msg = "Something went wrong"
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	tmpl, err := rl.template("error.html")
+	if err != nil {
+		httpLog.Error("Failed to load template", "err", err)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusInternalServerError)
+	tmpl.Execute(w, errorPage{Branding: rl.Config().Branding})
+}
+
+// panicWriter remembers whether the handler started its response.
+type panicWriter struct {
+	http.ResponseWriter
+	wrote bool
+}
+
+func (w *panicWriter) WriteHeader(code int) {
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *panicWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *panicWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
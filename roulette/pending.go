@@ -0,0 +1,175 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// errNoPendingRefresh is returned when there is no held refresh to act on.
+var errNoPendingRefresh = errors.New("no refresh is waiting for approval")
+
+// PendingRefresh is a refresh result held back because it would remove
+// too much of the pool, until an admin approves or discards it.
+type PendingRefresh struct {
+	URLs    []string  `json:"urls"`    // The new URL list
+	Added   []string  `json:"added"`   // URLs that would join the pool
+	Removed []string  `json:"removed"` // URLs that would leave it
+	Pool    int       `json:"pool"`    // Sites the previous refresh listed
+	Created time.Time `json:"created"`
+}
+
+// pendingRefreshPath is where a held refresh waits, next to the URL list.
+func (c *Config) pendingRefreshPath() string {
+	return c.URLsFile + ".pending.json"
+}
+
+// holdMassDeletion checks urls, the result of a refresh, against the list
+// the previous refresh wrote. Sites from url_sources and alt ports aren't
+// the refresh's to remove, so they don't count. If it would remove more
+// than RefreshHoldPercent of the listed sites, it is saved for approval
+// instead and held is true.
+func (rl *Roulette) holdMassDeletion(urls []string) (held bool, err error) {
+	c := rl.Config()
+	defer func() {
+		// A refresh that goes through supersedes any held one
+		if !held && err == nil {
+			os.Remove(c.pendingRefreshPath())
+		}
+	}()
+	listed, err := ReadURLsFile(c.URLsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if len(listed) == 0 {
+		return false, nil
+	}
+	pending := PendingRefresh{URLs: urls, Pool: len(listed), Created: time.Now().UTC()}
+	pending.Added, pending.Removed = diffURLs(normalizeURLs(urls), normalizeURLs(listed))
+	if float64(len(pending.Removed))*100 <= c.RefreshHoldPercent*float64(len(listed)) {
+		return false, nil
+	}
+
+	b, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	path := c.pendingRefreshPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return false, fmt.Errorf("failed to save held refresh: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return false, fmt.Errorf("failed to save held refresh: %v", err)
+	}
+	shodanLog.Warn("Holding the refresh for admin approval", "removed", len(pending.Removed), "sites", len(listed))
+	return true, nil
+}
+
+// normalizeURLs returns urls normalized the way the pool keeps them.
+func normalizeURLs(urls []string) []string {
+	normalized := make([]string, 0, len(urls))
+	for _, url := range urls {
+		normalized = append(normalized, normalizeURL(url))
+	}
+	return normalized
+}
+
+// PendingRefresh returns the refresh waiting for approval, or nil.
+func (rl *Roulette) PendingRefresh() (*PendingRefresh, error) {
+	b, err := os.ReadFile(rl.Config().pendingRefreshPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pending PendingRefresh
+	if err := json.Unmarshal(b, &pending); err != nil {
+		return nil, fmt.Errorf("failed to parse held refresh: %v", err)
+	}
+	return &pending, nil
+}
+
+// ApprovePendingRefresh applies the held refresh to the URL list and pool.
+func (rl *Roulette) ApprovePendingRefresh() (*PendingRefresh, error) {
+	pending, err := rl.PendingRefresh()
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, errNoPendingRefresh
+	}
+	urlsFile := rl.Config().URLsFile
+	if err := WriteURLsFile(urlsFile, pending.URLs); err != nil {
+		return nil, fmt.Errorf("error writing URLs to file: %v", err)
+	}
+	if err := os.Remove(rl.Config().pendingRefreshPath()); err != nil {
+		return nil, err
+	}
+	shodanLog.Info("Held refresh approved", "urls", len(pending.URLs), "file", urlsFile)
+	// The alt ports found go with the list, as after any other refresh
+	if err := rl.updateDerivedList(context.Background(), pending.URLs); err != nil {
+		return nil, err
+	}
+	rl.sync(context.Background(), SourceShodan)
+	return pending, nil
+}
+
+// DiscardPendingRefresh drops the held refresh, keeping the pool as is.
+func (rl *Roulette) DiscardPendingRefresh() (*PendingRefresh, error) {
+	pending, err := rl.PendingRefresh()
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil {
+		return nil, errNoPendingRefresh
+	}
+	if err := os.Remove(rl.Config().pendingRefreshPath()); err != nil {
+		return nil, err
+	}
+	shodanLog.Info("Held refresh discarded")
+	return pending, nil
+}
+
+// pendingSummary is how a held refresh appears in the audit log, without
+// the full URL lists.
+func pendingSummary(p *PendingRefresh) map[string]any {
+	return map[string]any{"pool": p.Pool, "added": len(p.Added), "removed": len(p.Removed), "created": p.Created}
+}
+
+// adminPendingHandler approves or discards the held refresh on
+// POST /admin/refresh/pending/{action}.
+func (rl *Roulette) adminPendingHandler(w http.ResponseWriter, r *http.Request) {
+	var pending *PendingRefresh
+	var err error
+	action := ""
+	switch r.PathValue("action") {
+	case "approve":
+		action = AuditRefreshApprove
+		pending, err = rl.ApprovePendingRefresh()
+	case "discard":
+		action = AuditRefreshDiscard
+		pending, err = rl.DiscardPendingRefresh()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err == errNoPendingRefresh {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		shodanLog.Error("Failed to resolve held refresh", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rl.audit(r, action, "held refresh", pendingSummary(pending), nil)
+	// Back to the dashboard from /admin/refresh/pending/{action}
+	redirectRelative(w, "../../")
+}
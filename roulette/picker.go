@@ -0,0 +1,143 @@
+package roulette
+
+import (
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const pickCacheFor = 30 * time.Second // How long the cached pool is used, so changes made by other instances sharing the database show up soon
+
+// sitePicker keeps the pool in memory grouped by status, so /shuffle can
+// pick without a database round trip. Changes made through this instance
+// invalidate it right away.
+type sitePicker struct {
+	mu       sync.RWMutex
+	ports    []int // The port filter the cache was loaded with
+	byStatus map[string][]Site
+	loaded   time.Time
+
+	// narrowedKey names the keep function narrowedSites are the sites of
+	// byStatus it returns true for, see pickCached
+	narrowedKey   string
+	narrowedSites map[string][]Site
+}
+
+// sitesChanged tells the picker the pool changed. Removals must be
+// followed by it, so removed sites stop being served at once.
+func (rl *Roulette) sitesChanged() {
+	rl.picker.mu.Lock()
+	defer rl.picker.mu.Unlock()
+	rl.picker.loaded = time.Time{}
+	rl.picker.narrowedKey, rl.picker.narrowedSites = "", nil
+}
+
+// pickCached picks a site like SiteStore.Random but from the cached pool,
+// reloading it when stale. If the pool can't be loaded it falls back to
+// the store's own Random. keep, unless nil, narrows the pick further to
+// the sites it returns true for. If key isn't empty it names keep, and
+// the sites keep returns true for are kept under it until the pool or
+// key changes, rather than found again on every pick.
+func (rl *Roulette) pickCached(filter SiteFilter, weight func(status string) float64, keep func(Site) bool, key string) (Site, error) {
+	p := &rl.picker
+	p.mu.RLock()
+	if p.fresh(filter.Ports) {
+		if byStatus, ok := p.kept(keep, key); ok {
+			defer p.mu.RUnlock()
+			return pickWeighted(byStatus, weight)
+		}
+	}
+	p.mu.RUnlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Another request may have reloaded it meanwhile
+	if !p.fresh(filter.Ports) {
+		sites, err := rl.store.List(filter)
+		if err != nil && keep == nil {
+			httpLog.Error("Failed to load the pool for picking", "err", err)
+			return rl.store.Random(filter, weight)
+		}
+		if err != nil {
+			return Site{}, err
+		}
+		byStatus := make(map[string][]Site)
+		for _, s := range sites {
+			byStatus[s.Status] = append(byStatus[s.Status], s)
+		}
+		p.byStatus = byStatus
+		p.ports = slices.Clone(filter.Ports)
+		p.loaded = time.Now()
+		p.narrowedKey, p.narrowedSites = "", nil
+	}
+	byStatus, ok := p.kept(keep, key)
+	if !ok {
+		byStatus = narrowed(p.byStatus, keep)
+		p.narrowedKey, p.narrowedSites = key, byStatus
+	}
+	return pickWeighted(byStatus, weight)
+}
+
+// kept returns the sites of the cache keep returns true for, unless
+// they are for a key that isn't cached yet. The caller holds mu.
+func (p *sitePicker) kept(keep func(Site) bool, key string) (map[string][]Site, bool) {
+	switch {
+	case keep == nil:
+		return p.byStatus, true
+	case key == "":
+		return narrowed(p.byStatus, keep), true
+	case key == p.narrowedKey:
+		return p.narrowedSites, true
+	}
+	return nil, false
+}
+
+// narrowed returns the sites of byStatus that keep returns true for,
+// byStatus itself if keep is nil.
+func narrowed(byStatus map[string][]Site, keep func(Site) bool) map[string][]Site {
+	if keep == nil {
+		return byStatus
+	}
+	kept := make(map[string][]Site)
+	for status, sites := range byStatus {
+		for _, s := range sites {
+			if keep(s) {
+				kept[status] = append(kept[status], s)
+			}
+		}
+	}
+	return kept
+}
+
+// fresh reports whether the cache can serve picks for ports. The caller
+// holds mu.
+func (p *sitePicker) fresh(ports []int) bool {
+	return time.Since(p.loaded) < pickCacheFor && slices.Equal(p.ports, ports)
+}
+
+// pickWeighted picks a status by its sites' total weight, then a site
+// uniformly within it.
+func pickWeighted(byStatus map[string][]Site, weight func(status string) float64) (Site, error) {
+	total := 0.0
+	for status, sites := range byStatus {
+		total += float64(len(sites)) * weight(status)
+	}
+	if total <= 0 {
+		return Site{}, ErrNoSites
+	}
+	r := rand.Float64() * total
+	var chosen []Site
+	for status, sites := range byStatus {
+		w := float64(len(sites)) * weight(status)
+		if w <= 0 {
+			continue
+		}
+		chosen = sites
+		if r < w {
+			break
+		}
+		r -= w
+	}
+	return chosen[rand.Intn(len(chosen))], nil
+}
@@ -0,0 +1,101 @@
+package roulette
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+)
+
+const purgeInterval = time.Hour // How often the privacy purge job runs
+
+// PrivacyConfig controls privacy mode, for instances that must keep as
+// little personal data as possible.
+type PrivacyConfig struct {
+	// Enabled replaces client IPs with keyed hashes everywhere they would
+	// be logged or stored, and purges personal data after Retention
+	Enabled bool `json:"enabled"`
+	// Retention is how long audit entries, API usage counters, the contact
+	// details of resolved takedowns and unconfirmed newsletter
+	// subscriptions are kept in privacy mode. Confirmed subscribers are
+	// kept until they unsubscribe, the newsletter goes to them.
+	Retention Duration `json:"retention"`
+	// HashKey keys the IP hashes. Without one a random key is made at
+	// startup, so hashes can't be linked across restarts.
+	HashKey string `json:"hash_key,omitempty"`
+}
+
+// RetentionStore is implemented by stores that can purge old personal
+// data.
+type RetentionStore interface {
+	// PurgeBefore deletes audit entries, API usage counters and unconfirmed
+	// newsletter subscriptions from before cutoff and clears the contact
+	// details and reasons of takedowns resolved before it. It returns how
+	// many records it changed.
+	PurgeBefore(cutoff time.Time) (int64, error)
+}
+
+// processHashKey keys IP hashes when no hash_key is configured.
+var processHashKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// clientLabel is how ip appears in logs and stored data: as is, or in
+// privacy mode as a keyed hash that still tells clients apart.
+func (c *Config) clientLabel(ip net.IP) string {
+	if !c.Privacy.Enabled {
+		return ip.String()
+	}
+	key := processHashKey
+	if c.Privacy.HashKey != "" {
+		key = []byte(c.Privacy.HashKey)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(ip.To16())
+	return "ip-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// clientKey identifies r's client for rate limits and logging, see
+// clientLabel.
+func (c *Config) clientKey(r *http.Request) string {
+	return c.clientLabel(c.ClientIP(r))
+}
+
+// startPurge runs the privacy purge now and then while privacy mode is on.
+func (rl *Roulette) startPurge(ctx context.Context) {
+	store, ok := rl.store.(RetentionStore)
+	if !ok {
+		return
+	}
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		ticker := time.NewTicker(purgeInterval)
+		defer ticker.Stop()
+		for {
+			if p := rl.Config().Privacy; p.Enabled {
+				rl.timed(purgeJob, func(context.Context) error {
+					cutoff := time.Now().Add(-time.Duration(p.Retention))
+					n, err := store.PurgeBefore(cutoff)
+					if err != nil {
+						appLog.Error("Failed to purge old data", "err", err)
+					} else if n > 0 {
+						appLog.Info("Purged old data", "records", n, "before", cutoff.Format(time.RFC3339))
+					}
+					return err
+				})(ctx)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
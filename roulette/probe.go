@@ -0,0 +1,198 @@
+package roulette
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const probeTimeout = 10 * time.Second // Default per-site timeout for a probe request
+const ProbeWorkers = 16               // Default number of concurrent probes
+const probeHashBytes = 4096           // Start of the body a probe reads and hashes
+
+// probeResult is what probing a site found.
+type probeResult struct {
+	Status string
+	// OptOut is whether the response's X-Robots-Tag opts out of indexing
+	OptOut bool
+	// Hash is of the start of the body, for telling identical listings
+	// apart. Empty unless the site is up.
+	Hash string
+	// Body is the start of the body, for sampling the ages of the files it
+	// lists and snapshots
+	Body []byte
+	// ContentType is the response's Content-Type
+	ContentType string
+	// Header is the response's header, nil unless the site is up
+	Header http.Header
+}
+
+// probeSite reports whether url answers with a successful response, and
+// whether the response's X-Robots-Tag opts out of indexing by agent.
+func probeSite(ctx context.Context, client *http.Client, url, agent string) probeResult {
+	return probeSiteKeeping(ctx, client, url, agent, probeHashBytes)
+}
+
+// probeSiteKeeping is probeSite reading up to keep bytes of the body, at
+// least probeHashBytes.
+func probeSiteKeeping(ctx context.Context, client *http.Client, url, agent string, keep int64) probeResult {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return probeResult{Status: StatusDown}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, errAddressNotAllowed) {
+			probeLog.Info("Not probing site", "url", url, "err", err)
+		}
+		return probeResult{Status: StatusDown}
+	}
+	defer resp.Body.Close()
+	result := probeResult{Status: StatusDown, OptOut: robotsOptOut(resp.Header, agent), ContentType: resp.Header.Get("Content-Type")}
+	// Read a little of the body so slow or broken servers count as down
+	body, err := io.ReadAll(io.LimitReader(resp.Body, max(keep, probeHashBytes)))
+	if err != nil {
+		return result
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return result
+	}
+	result.Status = StatusUp
+	if len(body) > 0 {
+		hash := sha256.Sum256(body[:min(len(body), probeHashBytes)])
+		result.Hash = hex.EncodeToString(hash[:])
+		result.Body = body
+	}
+	result.Header = resp.Header
+	return result
+}
+
+// Probe checks every site in the pool with the given number of workers
+// and records the results. It returns the number of sites up and down.
+// Zero workers means the configured number. Like Refresh, it returns
+// ErrNotLeader if another instance sharing the database is probing.
+func (rl *Roulette) Probe(ctx context.Context, workers int) (up int, down int, err error) {
+	if rl.Config().Demo {
+		return 0, 0, ErrDemoMode
+	}
+	err = rl.withLease(ctx, probeLease, func(ctx context.Context) error {
+		var err error
+		up, down, err = rl.probe(ctx, workers)
+		return err
+	})
+	return up, down, err
+}
+
+func (rl *Roulette) probe(ctx context.Context, workers int) (up int, down int, err error) {
+	c := rl.Config()
+	targets, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if workers <= 0 {
+		workers = c.Probe.Workers
+	}
+	client := rl.siteClient(time.Duration(c.Probe.Timeout))
+	agent := c.Outbound.robotsName()
+	keep := int64(probeHashBytes)
+	if c.Snapshots.Enabled {
+		// One byte over tells a listing was cut off
+		keep = c.Snapshots.MaxBytes + 1
+	}
+
+	// New sites first, then quarantined ones, routine rechecks last
+	sortProbeTargets(targets)
+	queue := newProbeQueue(c.Probe.QueueSize)
+	for _, t := range targets {
+		queue.push(t)
+	}
+	if shed := queue.shed; shed != [probePriorities]int{} {
+		probeLog.Warn("Probe queue full, deferring sites to the next run",
+			"new", shed[probeNew], "quarantined", shed[probeQuarantined], "routine", shed[probeRoutine])
+	}
+
+	total := queue.len
+	rl.progress(probeLease, 0, total)
+	results := rl.newStatusWriter()
+	var mu sync.Mutex
+	var events []SiteEvent
+	var checked []Site // For the hooks, if any
+	hashes := make(map[int64]string)
+	modified := make(map[int64]time.Time)
+	banners := make(map[int64]Banner)
+	_, bannered := rl.store.(TagRuleStore)
+	collect := rl.hasProbeHooks()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				t, ok := queue.pop()
+				if !ok {
+					return
+				}
+				result := probeSiteKeeping(ctx, client, t.URL, agent, keep)
+				status := result.Status
+				if ctx.Err() != nil {
+					// Don't record sites as down just because we were interrupted
+					return
+				}
+				if result.OptOut && c.Outbound.HonorRobotsTag {
+					rl.dropOptedOut(t)
+					continue
+				}
+				results.record(StatusUpdate{ID: t.ID, Status: status, Checked: time.Now()})
+				if c.Snapshots.Enabled && len(result.Body) > 0 && isHTML(result.ContentType) {
+					rl.saveSnapshot(t.ID, result.Body)
+				}
+				var m time.Time
+				if c.Probe.AgeSamples > 0 && len(result.Body) > 0 {
+					m = sampleModified(ctx, client, t.URL, result.Body, c.Probe.AgeSamples)
+				}
+				mu.Lock()
+				if status == StatusUp {
+					up++
+				} else {
+					down++
+				}
+				hashes[t.ID] = result.Hash
+				if !m.IsZero() {
+					modified[t.ID] = m
+				}
+				if bannered && status == StatusUp {
+					banners[t.ID] = newBanner(result.Header, result.Body)
+				}
+				if e, ok := probeEvent(t, status); ok {
+					events = append(events, e)
+				}
+				if collect {
+					t.Status, t.LastChecked = status, time.Now()
+					checked = append(checked, t)
+				}
+				rl.progress(probeLease, up+down, total)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	results.close()
+	rl.recordHashes(hashes)
+	rl.recordModified(modified)
+	rl.recordBanners(banners)
+	rl.applyTagRules()
+	rl.recordEvents(events...)
+	rl.probeComplete(checked)
+	spanFromContext(ctx).set(attrInt("probe.sites", total), attrInt("probe.up", up), attrInt("probe.down", down))
+	// Every host was visited once, their idle connections won't be reused
+	rl.siteTransport().CloseIdleConnections()
+	// The new statuses change the odds
+	rl.sitesChanged()
+	return up, down, ctx.Err()
+}
@@ -0,0 +1,94 @@
+package roulette
+
+import (
+	"sort"
+	"sync"
+)
+
+const DefaultProbeQueueSize = 20000 // Default cap on the sites one probe run checks
+
+// Probe priorities, most urgent first
+const (
+	probeNew         = iota // Never probed, not yet known to work
+	probeQuarantined        // Down last time, rechecked to see if it's back
+	probeRoutine            // Up last time
+	probePriorities
+)
+
+func probePriority(s Site) int {
+	switch {
+	case s.LastChecked.IsZero():
+		return probeNew
+	case s.Status == StatusDown:
+		return probeQuarantined
+	default:
+		return probeRoutine
+	}
+}
+
+// probeQueue is a bounded priority queue of sites to probe. Once it is
+// full, a more urgent site pushes out the last queued site of the least
+// urgent priority, so a pool bigger than a run can handle defers routine
+// rechecks to the next run instead of growing the queue.
+type probeQueue struct {
+	mu      sync.Mutex
+	buckets [probePriorities][]Site // FIFO per priority
+	len     int
+	max     int
+	shed    [probePriorities]int // Sites dropped, by priority
+}
+
+func newProbeQueue(max int) *probeQueue {
+	return &probeQueue{max: max}
+}
+
+// push queues s, reporting false if it was shed instead.
+func (q *probeQueue) push(s Site) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := probePriority(s)
+	if q.len >= q.max {
+		worst := probePriorities - 1
+		for worst > p && len(q.buckets[worst]) == 0 {
+			worst--
+		}
+		if worst <= p {
+			q.shed[p]++
+			return false
+		}
+		q.buckets[worst] = q.buckets[worst][:len(q.buckets[worst])-1]
+		q.shed[worst]++
+		q.len--
+	}
+	q.buckets[p] = append(q.buckets[p], s)
+	q.len++
+	return true
+}
+
+// pop returns the most urgent queued site, or false when the queue is
+// empty.
+func (q *probeQueue) pop() (Site, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for p := range q.buckets {
+		if len(q.buckets[p]) > 0 {
+			s := q.buckets[p][0]
+			q.buckets[p] = q.buckets[p][1:]
+			q.len--
+			return s, true
+		}
+	}
+	return Site{}, false
+}
+
+// sortProbeTargets orders sites the way they should be queued: by
+// priority, and within one, those checked longest ago first.
+func sortProbeTargets(sites []Site) {
+	sort.SliceStable(sites, func(i, j int) bool {
+		pi, pj := probePriority(sites[i]), probePriority(sites[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return sites[i].LastChecked.Before(sites[j].LastChecked)
+	})
+}
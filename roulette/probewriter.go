@@ -0,0 +1,79 @@
+package roulette
+
+import (
+	"strconv"
+	"time"
+)
+
+const probeBatchSize = 100                 // Probe results written per transaction
+const probeFlushInterval = 2 * time.Second // Longest a probe result waits to be written
+
+// statusWriter writes probe results as they come in, in small batches, so
+// a run that crashes keeps everything it found up to the last flush.
+type statusWriter struct {
+	rl      *Roulette
+	updates chan StatusUpdate
+	done    chan struct{}
+}
+
+func (rl *Roulette) newStatusWriter() *statusWriter {
+	w := &statusWriter{rl: rl, updates: make(chan StatusUpdate, probeBatchSize), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+// record queues a result for writing.
+func (w *statusWriter) record(u StatusUpdate) {
+	w.updates <- u
+}
+
+// close writes the remaining results and stops the writer.
+func (w *statusWriter) close() {
+	close(w.updates)
+	<-w.done
+}
+
+func (w *statusWriter) run() {
+	defer close(w.done)
+	ticker := time.NewTicker(probeFlushInterval)
+	defer ticker.Stop()
+	batch := make([]StatusUpdate, 0, probeBatchSize)
+	for {
+		select {
+		case u, ok := <-w.updates:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, u)
+			if len(batch) == probeBatchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes batch in one transaction if the store can, one by one
+// otherwise.
+func (w *statusWriter) flush(batch []StatusUpdate) {
+	if len(batch) == 0 {
+		return
+	}
+	if store, ok := w.rl.store.(StatusBatchStore); ok {
+		if err := store.UpdateStatuses(batch); err != nil {
+			probeLog.Error("Failed to record probe results", "count", len(batch), "err", err)
+			w.rl.reportError(err, map[string]string{"job": probeLease, "sites": strconv.Itoa(len(batch))})
+		}
+		return
+	}
+	for _, u := range batch {
+		if err := w.rl.store.UpdateStatus(u.ID, u.Status, u.Checked); err != nil {
+			probeLog.Error("Failed to record probe result", "site", u.ID, "err", err)
+			w.rl.reportError(err, map[string]string{"job": probeLease, "site_id": strconv.FormatInt(u.ID, 10)})
+		}
+	}
+}
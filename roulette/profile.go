@@ -0,0 +1,86 @@
+package roulette
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Log levels for Config.LogLevel
+const (
+	LogLevelDebug = "debug" // Also log every redirect and proxy fetch
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn" // Only problems
+	LogLevelError = "error"
+)
+
+// DefaultProfile is used when neither the flag nor the config names one.
+const DefaultProfile = "prod"
+
+// Profile is a named set of defaults for one kind of deployment. Settings
+// in the config file still win over the profile.
+type Profile struct {
+	LogLevel        string
+	RefreshInterval time.Duration
+	ProbeWorkers    int
+	ProbeTimeout    time.Duration
+	ReloadTemplates bool
+}
+
+var profiles = map[string]Profile{
+	// dev logs everything, picks up template edits without a restart and
+	// probes gently so a laptop stays usable
+	"dev": {
+		LogLevel:        LogLevelDebug,
+		RefreshInterval: 24 * time.Hour,
+		ProbeWorkers:    4,
+		ProbeTimeout:    5 * time.Second,
+		ReloadTemplates: true,
+	},
+	"staging": {
+		LogLevel:        LogLevelInfo,
+		RefreshInterval: 168 * time.Hour,
+		ProbeWorkers:    8,
+		ProbeTimeout:    probeTimeout,
+		ReloadTemplates: true,
+	},
+	"prod": {
+		LogLevel:        LogLevelInfo,
+		RefreshInterval: 768 * time.Hour,
+		ProbeWorkers:    ProbeWorkers,
+		ProbeTimeout:    probeTimeout,
+		ReloadTemplates: false,
+	},
+}
+
+// Profiles returns the names of the built-in profiles.
+func Profiles() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupProfile returns the named profile, or DefaultProfile for "".
+func lookupProfile(name string) (Profile, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown profile %q (want one of %s)", name, strings.Join(Profiles(), ", "))
+	}
+	return p, nil
+}
+
+// apply sets the profile's defaults on c.
+func (p Profile) apply(c *Config) {
+	c.LogLevel = p.LogLevel
+	c.RefreshInterval = Duration(p.RefreshInterval)
+	c.Probe.Workers = p.ProbeWorkers
+	c.Probe.Timeout = Duration(p.ProbeTimeout)
+	c.ReloadTemplates = p.ReloadTemplates
+}
@@ -0,0 +1,205 @@
+package roulette
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyContentSecurityPolicy applies to proxied pages. They are served
+// from our origin, so sandbox puts them in an opaque one without scripts,
+// where they can't read our cookies or act on the visitor's behalf.
+const proxyContentSecurityPolicy = "sandbox; default-src 'none'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; " +
+	"base-uri 'none'; frame-ancestors 'none'"
+
+// proxyCopyHeaders are the response headers passed on from sites.
+var proxyCopyHeaders = []string{"Content-Type", "Last-Modified", "ETag"}
+
+// ProxyConfig controls proxy mode, where /shuffle sends visitors to
+// /view/{id}/ and the site is fetched on their behalf.
+type ProxyConfig struct {
+	// Enabled turns proxy mode on, so visitors' IPs are never exposed to
+	// the sites
+	Enabled bool `json:"enabled"`
+	// MaxBytes caps how much of each response is passed on
+	MaxBytes int64 `json:"max_bytes"`
+	// Timeout bounds each fetch, including reading the body
+	Timeout Duration `json:"timeout"`
+	// ContentTypes are the media types passed on, "type/*" matches a whole
+	// type. Anything else is refused.
+	ContentTypes []string `json:"content_types"`
+}
+
+// defaultProxyContentTypes leave out types that can carry scripts, like
+// SVG and PDF.
+var defaultProxyContentTypes = []string{"text/html", "text/plain", "text/csv", "text/markdown",
+	"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// allowsType reports whether a Content-Type header value may be passed on.
+func (p ProxyConfig) allowsType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// viewPath is where proxy mode shows site, relative to the root of the
+// handler.
+func viewPath(site Site) string {
+	return "view/" + strconv.FormatInt(site.ID, 10) + "/"
+}
+
+// viewHandler fetches /view/{id}/{path...} from the site and streams it
+// to the visitor. Only the path and query are forwarded, no cookies or
+// other headers of the visitor's.
+func (rl *Roulette) viewHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config()
+	if !c.Proxy.Enabled || shadowed(r) {
+		http.NotFound(w, r)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	site, err := rl.store.Site(id)
+	if err == errNoSuchSite {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		httpLog.Error("Failed to look up site", "site", id, "err", err)
+		rl.reportError(err, map[string]string{"site_id": strconv.FormatInt(id, 10)})
+		http.Error(w, "Failed to look up site", http.StatusInternalServerError)
+		return
+	}
+
+	base, err := neturl.Parse(site.URL)
+	if err != nil {
+		http.Error(w, "Invalid site URL", http.StatusBadGateway)
+		return
+	}
+	rest := "/" + r.PathValue("path")
+	target := *base
+	target.Path = path.Join(base.Path, rest)
+	if strings.HasSuffix(rest, "/") && !strings.HasSuffix(target.Path, "/") {
+		target.Path += "/"
+	}
+	target.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target.String(), nil)
+	if err != nil {
+		http.Error(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("Accept", r.Header.Get("Accept"))
+	client := rl.siteClient(time.Duration(c.Proxy.Timeout))
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if errors.Is(err, errAddressNotAllowed) {
+			httpLog.Info("Not proxying site", "url", site.URL, "err", err)
+			http.Error(w, "The site didn't answer", http.StatusBadGateway)
+			return
+		}
+		httpLog.Debug("Proxy fetch failed", "url", target.String(), "err", err)
+		if !rl.cachedListing(w, site, rest) {
+			http.Error(w, "The site didn't answer", http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 && rl.cachedListing(w, site, rest) {
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Security-Policy", proxyContentSecurityPolicy)
+	header.Set("Cache-Control", "private, no-store")
+	if loc := resp.Header.Get("Location"); resp.StatusCode >= 300 && resp.StatusCode < 400 && loc != "" {
+		rl.proxyRedirect(w, req.URL, rest, loc)
+		return
+	}
+	if c.Outbound.HonorRobotsTag && robotsOptOut(resp.Header, c.Outbound.robotsName()) {
+		http.Error(w, "The site asks not to be indexed", http.StatusForbidden)
+		return
+	}
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode == http.StatusOK && !c.Proxy.allowsType(ct) {
+		http.Error(w, fmt.Sprintf("Content type %q isn't shown through the proxy", ct), http.StatusUnsupportedMediaType)
+		return
+	}
+	if resp.ContentLength > c.Proxy.MaxBytes {
+		http.Error(w, "Response too large to proxy", http.StatusBadGateway)
+		return
+	}
+	for _, name := range proxyCopyHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	if resp.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	// Bodies without a length are cut off at the cap
+	n, err := io.Copy(w, io.LimitReader(resp.Body, c.Proxy.MaxBytes))
+	if err != nil {
+		httpLog.Debug("Proxying stopped early", "url", target.String(), "bytes", n, "err", err)
+	} else if n == c.Proxy.MaxBytes && resp.ContentLength < 0 {
+		httpLog.Info("Truncated proxied response", "url", site.URL, "bytes", n)
+	}
+}
+
+// proxyRedirect passes on a redirect that stays on the site, rewritten to
+// point into /view. Redirects elsewhere are refused, following them would
+// leave proxy mode.
+func (rl *Roulette) proxyRedirect(w http.ResponseWriter, from *neturl.URL, rest, location string) {
+	to, err := from.Parse(location)
+	if err != nil || to.Host != from.Host || to.Scheme != from.Scheme {
+		http.Error(w, "The site redirects elsewhere", http.StatusBadGateway)
+		return
+	}
+	// Relative to the current page's directory under /view/{id}/
+	depth := strings.Count(path.Dir(rest+"x"), "/")
+	if path.Dir(rest+"x") == "/" {
+		depth = 0
+	}
+	rel := strings.Repeat("../", depth) + strings.TrimPrefix(to.Path, "/")
+	if rel == "" {
+		rel = "./"
+	}
+	if to.RawQuery != "" {
+		rel += "?" + to.RawQuery
+	}
+	redirectRelative(w, rel)
+}
+
+// cachedListing shows the snapshot of the site instead, when the root
+// listing was asked for and there is one. It reports whether it did.
+func (rl *Roulette) cachedListing(w http.ResponseWriter, site Site, rest string) bool {
+	if rest != "/" {
+		return false
+	}
+	snap, ok := rl.siteSnapshot(site.ID)
+	if ok {
+		writeSnapshot(w, snap, ", the site isn't answering right now")
+	}
+	return ok
+}
@@ -0,0 +1,482 @@
+package roulette
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"strconv"
+)
+
+// A small QR code encoder: byte mode, error correction level M, versions
+// 1 to 10, enough for URLs of up to 213 bytes. It follows ISO/IEC 18004.
+
+const qrQuietZone = 4 // Light modules around the code, as the standard asks
+
+// errQRTooLong is returned for text that doesn't fit version 10.
+var errQRTooLong = errors.New("too long for a QR code")
+
+// qrVersion is the block structure of one version at level M.
+type qrVersion struct {
+	ecPerBlock int   // Error correction codewords per block
+	blocks     []int // Data codewords of each block
+	align      []int // Alignment pattern centres, empty for version 1
+}
+
+var qrVersions = []qrVersion{
+	1:  {10, []int{16}, nil},
+	2:  {16, []int{28}, []int{6, 18}},
+	3:  {26, []int{44}, []int{6, 22}},
+	4:  {18, []int{32, 32}, []int{6, 26}},
+	5:  {24, []int{43, 43}, []int{6, 30}},
+	6:  {16, []int{27, 27, 27, 27}, []int{6, 34}},
+	7:  {18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	8:  {22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	9:  {22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	10: {26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// qrCode is an encoded symbol, dark modules true.
+type qrCode struct {
+	size     int
+	modules  [][]bool
+	function [][]bool // Modules taken by patterns, not data
+}
+
+// encodeQR encodes text in the smallest version it fits.
+func encodeQR(text []byte) (*qrCode, error) {
+	for ver := 1; ver < len(qrVersions); ver++ {
+		v := qrVersions[ver]
+		capacity := 0
+		for _, n := range v.blocks {
+			capacity += n
+		}
+		countBits := 8
+		if ver >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(text) > 8*capacity {
+			continue
+		}
+		data := qrData(text, countBits, capacity)
+		return newQRCode(ver, qrInterleave(v, data)), nil
+	}
+	return nil, errQRTooLong
+}
+
+// qrData lays out text in byte mode and pads it to capacity codewords.
+func qrData(text []byte, countBits, capacity int) []byte {
+	var bits []bool
+	push := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>i&1 == 1)
+		}
+	}
+	push(0b0100, 4)
+	push(len(text), countBits)
+	for _, b := range text {
+		push(int(b), 8)
+	}
+	push(0, min(4, 8*capacity-len(bits))) // Terminator
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	data := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		data = append(data, b)
+	}
+	for pad := byte(0xEC); len(data) < capacity; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+	return data
+}
+
+// qrInterleave splits data into the version's blocks, adds each block's
+// error correction and interleaves the lot.
+func qrInterleave(v qrVersion, data []byte) []byte {
+	divisor := rsDivisor(v.ecPerBlock)
+	blocks := make([][]byte, len(v.blocks))
+	ecc := make([][]byte, len(v.blocks))
+	longest := 0
+	for i, n := range v.blocks {
+		blocks[i], data = data[:n], data[n:]
+		ecc[i] = rsRemainder(blocks[i], divisor)
+		longest = max(longest, n)
+	}
+	var out []byte
+	for i := 0; i < longest; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, e := range ecc {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given
+// degree, leading coefficient left out.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return result
+}
+
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+func newQRCode(ver int, codewords []byte) *qrCode {
+	size := 17 + 4*ver
+	q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	q.drawPatterns(ver)
+	q.drawCodewords(codewords)
+
+	// Keep the mask that leaves the fewest confusing patterns
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask) // Masking twice undoes it
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+	return q
+}
+
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *qrCode) drawPatterns(ver int) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				dist := max(abs(dx), abs(dy))
+				q.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+	align := qrVersions[ver].align
+	for i, ay := range align {
+		for j, ax := range align {
+			// The corners with finder patterns get none
+			if i == 0 && j == 0 || i == 0 && j == len(align)-1 || i == len(align)-1 && j == 0 {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(ax+dx, ay+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormat(0) // Reserves the format areas
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// drawFormat draws the level and mask, twice, and the dark module.
+func (q *qrCode) drawFormat(mask int) {
+	const levelM = 0b00
+	data := levelM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// drawCodewords fills the data modules in the standard zigzag, two
+// columns at a time from the bottom right.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip the vertical timing pattern
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for j := 0; j < 2; j++ {
+				x := right - j
+				if q.function[y][x] || i >= len(data)*8 {
+					continue
+				}
+				q.modules[y][x] = data[i>>3]>>(7-i&7)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !q.function[y][x] {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol by the standard's four rules, lower being
+// easier to scan.
+func (q *qrCode) penalty() int {
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			x, y = y, x
+		}
+		return q.modules[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	score, dark := 0, 0
+	for _, vertical := range []bool{false, true} {
+		for a := 0; a < q.size; a++ {
+			run := 0
+			for b := 0; b < q.size; b++ {
+				// Runs of five or more of a colour
+				if b > 0 && at(b, a, vertical) == at(b-1, a, vertical) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					score += 3
+				} else if run > 5 {
+					score++
+				}
+				// Finder-like patterns with four light modules on a side
+				if b+7 > q.size {
+					continue
+				}
+				match := true
+				for k, want := range finder {
+					match = match && at(b+k, a, vertical) == want
+				}
+				if match && (q.light(b-4, b, a, vertical) || q.light(b+7, b+11, a, vertical)) {
+					score += 40
+				}
+			}
+		}
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			// 2x2 blocks of a colour
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if c == q.modules[y-1][x] && c == q.modules[y][x-1] && c == q.modules[y-1][x-1] {
+					score += 3
+				}
+			}
+		}
+	}
+	// Imbalance between dark and light
+	total := q.size * q.size
+	k := (abs(dark*20-total*10) + total - 1) / total
+	return score + (k-1)*10
+}
+
+// light reports whether modules from up to before to along line a are
+// all light, counting those outside the symbol.
+func (q *qrCode) light(from, to, a int, vertical bool) bool {
+	for b := from; b < to; b++ {
+		if b < 0 || b >= q.size {
+			continue
+		}
+		x, y := b, a
+		if vertical {
+			x, y = a, b
+		}
+		if q.modules[y][x] {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// qrPNG renders text as a QR code, scale pixels per module.
+func qrPNG(text string, scale int) ([]byte, error) {
+	q, err := encodeQR([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	side := (q.size + 2*qrQuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = 0xFF
+	}
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetGray((x+qrQuietZone)*scale+dx, (y+qrQuietZone)*scale+dy, color.Gray{})
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const qrScale = 8 // Pixels per module of /site/{id}/qr.png
+
+// qrHandler serves a QR code of a pool site's URL, for visitors to open
+// it on their phones.
+func (rl *Roulette) qrHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || shadowed(r) {
+		http.NotFound(w, r)
+		return
+	}
+	site, err := rl.store.Site(id)
+	if err == errNoSuchSite {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		httpLog.Error("Failed to look up site", "site", id, "err", err)
+		http.Error(w, "Failed to look up site", http.StatusInternalServerError)
+		return
+	}
+	img, err := qrPNG(site.URL, qrScale)
+	if err != nil {
+		http.Error(w, "The site's URL is "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(img)
+}
+
+// qrPage is the data the presenter page is rendered with.
+type qrPage struct {
+	basePage
+	Site Site
+	Link string // Signed /out link to the site
+}
@@ -0,0 +1,161 @@
+package roulette
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitIdleAfter = 10 * time.Minute // Buckets unused this long are dropped
+
+// RateLimitConfig limits how fast a single client can hit /shuffle and
+// the API. Each client IP gets a token bucket refilled at RPS tokens per
+// second and holding at most Burst.
+type RateLimitConfig struct {
+	// RPS is the sustained requests per second allowed, 0 disables limiting
+	RPS float64 `json:"rps"`
+	// Burst is how many requests a client can make at once
+	Burst int `json:"burst"`
+}
+
+// bucket is one client's token bucket.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter keeps a token bucket per client IP.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+// allow takes a token from key's bucket. If there is none it returns false
+// and how long until there will be.
+func (l *rateLimiter) allow(key string, limit RateLimitConfig, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Forget idle clients now and then so the map doesn't grow forever
+	if now.Sub(l.lastSweep) > rateLimitIdleAfter {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > rateLimitIdleAfter {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	burst := float64(limit.Burst)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.RPS)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / limit.RPS * float64(time.Second))
+	return false, wait
+}
+
+// rateLimited applies the configured per-client rate limit to h, answering
+// 429 Too Many Requests with a Retry-After header once it is exceeded.
+func (rl *Roulette) rateLimited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := rl.Config()
+		if c.RateLimit.RPS > 0 {
+			ok, wait := rl.limiter.allow(c.clientKey(r), c.RateLimit, time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// ClientIP returns the address of the client behind r. X-Forwarded-For is
+// only believed when the request comes from one of TrustedProxies, and
+// then the rightmost untrusted hop is taken so clients can't spoof it.
+// Unix socket peers are reported as the loopback address unless a
+// trusted proxy forwarded them.
+func (c *Config) ClientIP(r *http.Request) net.IP {
+	peer := remoteIP(r)
+	if !c.isTrustedProxy(peer) {
+		return peer
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !c.isTrustedProxy(ip) {
+			return ip
+		}
+		peer = ip
+	}
+	return peer
+}
+
+// remoteIP is the address of the connection's peer.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Unix sockets have no peer address, they are local by definition
+		return net.IPv6loopback
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	return net.IPv6loopback
+}
+
+// isTrustedProxy reports whether ip is listed in TrustedProxies.
+func (c *Config) isTrustedProxy(ip net.IP) bool {
+	for _, n := range c.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a list of CIDRs or bare IPs.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,53 @@
+package roulette
+
+import "net/http"
+
+// Ways of sending visitors off to a site, for Shuffle.Redirect
+const (
+	RedirectSeeOther  = "303"  // The default
+	RedirectFound     = "302"  // For clients that mishandle 303 across origins
+	RedirectTemporary = "307"  // Like 302, but keeps the method
+	RedirectMeta      = "meta" // An HTML page that refreshes to the site
+)
+
+// validRedirect reports whether mode is one of the Redirect constants.
+func validRedirect(mode string) bool {
+	switch mode {
+	case RedirectSeeOther, RedirectFound, RedirectTemporary, RedirectMeta:
+		return true
+	}
+	return false
+}
+
+// redirectPage is the data the meta refresh template is rendered with.
+type redirectPage struct {
+	basePage
+	URL string
+}
+
+// redirectAway sends the visitor to url, off-site, as Shuffle.Redirect
+// says. A redirect query parameter with another mode overrides it for
+// that request, for debugging clients that mishandle one. The redirects
+// go out bare, without http.Redirect's body, as they're on the hot path.
+func (rl *Roulette) redirectAway(w http.ResponseWriter, r *http.Request, url string) {
+	mode := rl.Config().Shuffle.Redirect
+	if r.URL.RawQuery != "" {
+		if q := r.URL.Query().Get("redirect"); validRedirect(q) {
+			mode = q
+		}
+	}
+	switch mode {
+	case RedirectMeta:
+		w.Header().Set("Cache-Control", "no-store")
+		rl.render(w, "redirect.html", redirectPage{basePage: rl.pageBase(w, r), URL: url})
+	case RedirectFound:
+		w.Header()["Location"] = []string{url}
+		w.WriteHeader(http.StatusFound)
+	case RedirectTemporary:
+		w.Header()["Location"] = []string{url}
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	default:
+		w.Header()["Location"] = []string{url}
+		w.WriteHeader(http.StatusSeeOther)
+	}
+}
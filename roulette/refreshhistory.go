@@ -0,0 +1,91 @@
+package roulette
+
+import (
+	"net/http"
+	"time"
+)
+
+const refreshSamples = 10       // Added and removed URLs kept per report
+const refreshHistoryPage = 100  // Reports shown on the history page
+const refreshHistoryKeep = 1000 // Reports kept before the oldest are dropped
+
+// Where a sync's URL list came from
+const (
+	SourceShodan = "shodan" // A refresh, or an approved held one
+	SourceFile   = "file"   // The URL list file as it was, at startup or reload
+	SourceImport = "import"
+	SourceRemote = "remote" // A fetched URL source changed
+	SourceDemo   = "demo"
+)
+
+// RefreshReport sums up one sync: how the pool changed and a sample of the
+// URLs that came and went, so a change in what Shodan returns shows up as
+// a jump between reports.
+type RefreshReport struct {
+	ID       int64
+	Time     time.Time // When the sync started
+	Source   string
+	Duration Duration
+	Sites    int // URLs in the list, after exclusions
+	Added    int
+	Removed  int
+	Excluded int
+	// SampleAdded and SampleRemoved are the first few URLs added and
+	// removed, in list order
+	SampleAdded   []string
+	SampleRemoved []string
+	Error         string
+}
+
+// RefreshHistoryStore is implemented by stores that keep sync reports.
+type RefreshHistoryStore interface {
+	// AddRefreshReport records r, dropping the oldest reports past
+	// refreshHistoryKeep.
+	AddRefreshReport(r RefreshReport) error
+	// RefreshReports returns up to limit reports, newest first.
+	RefreshReports(limit int) ([]RefreshReport, error)
+}
+
+// recordRefresh stores r. Failures are logged, history never fails a
+// sync.
+func (rl *Roulette) recordRefresh(r RefreshReport) {
+	store, ok := rl.store.(RefreshHistoryStore)
+	if !ok {
+		return
+	}
+	if err := store.AddRefreshReport(r); err != nil {
+		syncLog.Error("Failed to record refresh report", "err", err)
+	}
+}
+
+// sample returns the first refreshSamples of urls.
+func sample(urls []string) []string {
+	if len(urls) > refreshSamples {
+		urls = urls[:refreshSamples]
+	}
+	return append([]string(nil), urls...)
+}
+
+// refreshesPage is the data the refreshes template is rendered with.
+type refreshesPage struct {
+	basePage
+	Reports   []RefreshReport
+	Error     string
+	Supported bool
+}
+
+// adminRefreshesHandler shows the latest sync reports.
+func (rl *Roulette) adminRefreshesHandler(w http.ResponseWriter, r *http.Request) {
+	page := refreshesPage{basePage: rl.pageBase(w, r)}
+	store, ok := rl.store.(RefreshHistoryStore)
+	page.Supported = ok
+	if ok {
+		reports, err := store.RefreshReports(refreshHistoryPage)
+		if err != nil {
+			httpLog.Error("Failed to read refresh history", "err", err)
+			page.Error = err.Error()
+		}
+		page.Reports = reports
+	}
+	rl.render(w, "refreshes.html", page)
+}
@@ -0,0 +1,183 @@
+package roulette
+
+import (
+	"math"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const relatedShown = 10                  // Similar sites listed on a site's info page
+const relatedPool = 50                   // Most similar sites a "shuffle among similar" picks from
+const relatedMinScore = 0.5              // Least similarity for a site to count as related
+const profileCacheFor = 10 * time.Minute // How long site profiles are reused before being read again
+
+// siteProfile is what sites are compared on to find similar ones.
+type siteProfile struct {
+	network netip.Prefix       // The /24, or /48 for IPv6, the host is in
+	title   string             // The listing's title, if it isn't the stock one
+	exts    map[string]float64 // Share of the listing's entries by extension, "/" for directories
+}
+
+// RelatedSite is a site similar to another, and how similar.
+type RelatedSite struct {
+	Site
+	Score float64
+	// Why lists what the sites share
+	Why []string
+}
+
+// siteProfiles caches every site's profile, since finding similar sites
+// compares one against the whole pool.
+type siteProfiles struct {
+	mu    sync.Mutex
+	sites []Site
+	of    map[int64]siteProfile
+	built time.Time
+}
+
+// networkOf returns the network the host is in, invalid if it isn't an IP.
+func networkOf(host string) netip.Prefix {
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Prefix{}
+	}
+	ip = ip.Unmap()
+	bits := 24
+	if ip.Is6() {
+		bits = 48
+	}
+	network, _ := ip.Prefix(bits)
+	return network
+}
+
+// profileOf works out the site's profile from its host and snapshot.
+func (rl *Roulette) profileOf(site Site) siteProfile {
+	p := siteProfile{network: networkOf(site.Host)}
+	title, entries := rl.listingPreview(site)
+	// Python's http.server titles every listing alike
+	if !strings.HasPrefix(title, "Directory listing for") {
+		p.title = strings.ToLower(strings.TrimSpace(title))
+	}
+	if len(entries) > 0 {
+		p.exts = make(map[string]float64)
+		for _, name := range entries {
+			ext := "/"
+			if !strings.HasSuffix(name, "/") {
+				ext = strings.ToLower(path.Ext(name))
+			}
+			p.exts[ext] += 1 / float64(len(entries))
+		}
+	}
+	return p
+}
+
+// similarity scores how alike two profiles are, from 0 up to 3: a point
+// each for the same network and title, and up to one for the extensions.
+func similarity(a, b siteProfile) (float64, []string) {
+	var score float64
+	var why []string
+	if a.network.IsValid() && a.network == b.network {
+		score++
+		why = append(why, "network")
+	}
+	if a.title != "" && a.title == b.title {
+		score++
+		why = append(why, "title")
+	}
+	// Cosine similarity of the extension shares
+	var dot, na, nb float64
+	for ext, share := range a.exts {
+		dot += share * b.exts[ext]
+		na += share * share
+	}
+	for _, share := range b.exts {
+		nb += share * share
+	}
+	if dot > 0 {
+		cos := dot / math.Sqrt(na*nb)
+		score += cos
+		if cos >= relatedMinScore {
+			why = append(why, "file types")
+		}
+	}
+	return score, why
+}
+
+// profiles returns the sites that are up and their profiles, reading them
+// again when stale.
+func (rl *Roulette) profiles() ([]Site, map[int64]siteProfile, error) {
+	p := &rl.profileCache
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.of != nil && time.Since(p.built) < profileCacheFor {
+		return p.sites, p.of, nil
+	}
+	sites, err := rl.store.List(SiteFilter{Status: StatusUp})
+	if err != nil {
+		return nil, nil, err
+	}
+	of := make(map[int64]siteProfile, len(sites))
+	for _, s := range sites {
+		of[s.ID] = rl.profileOf(s)
+	}
+	p.sites, p.of, p.built = sites, of, time.Now()
+	return sites, of, nil
+}
+
+// relatedSites returns up to n sites that are up and most like site, most
+// similar first.
+func (rl *Roulette) relatedSites(site Site, n int) ([]RelatedSite, error) {
+	sites, of, err := rl.profiles()
+	if err != nil {
+		return nil, err
+	}
+	profile, ok := of[site.ID]
+	if !ok {
+		profile = rl.profileOf(site)
+	}
+	var related []RelatedSite
+	for _, s := range sites {
+		if s.ID == site.ID {
+			continue
+		}
+		if score, why := similarity(profile, of[s.ID]); score >= relatedMinScore {
+			related = append(related, RelatedSite{Site: s, Score: score, Why: why})
+		}
+	}
+	slices.SortStableFunc(related, func(a, b RelatedSite) int {
+		switch {
+		case a.Score > b.Score:
+			return -1
+		case a.Score < b.Score:
+			return 1
+		}
+		return 0
+	})
+	return related[:min(len(related), n)], nil
+}
+
+// similarFilter returns a filter keeping the sites most like the one with
+// the given ID, for shuffles among similar sites. It keeps none if the
+// site can't be found.
+func (rl *Roulette) similarFilter(id int64) func(Site) bool {
+	site, err := rl.store.Site(id)
+	if err != nil {
+		if err != errNoSuchSite {
+			httpLog.Error("Failed to look up site", "site", id, "err", err)
+		}
+		return func(Site) bool { return false }
+	}
+	related, err := rl.relatedSites(site, relatedPool)
+	if err != nil {
+		httpLog.Error("Failed to find similar sites", "site", id, "err", err)
+	}
+	ids := make(map[int64]bool, len(related))
+	for _, s := range related {
+		ids[s.ID] = true
+	}
+	return func(s Site) bool { return ids[s.ID] }
+}
@@ -0,0 +1,140 @@
+package roulette
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const remoteListsDir = "sources"               // Under DataDir, where fetched lists are kept
+const remoteListTimeout = 30 * time.Second     // Per fetch
+const remoteListMax = 16 << 20                 // Bytes of a fetched list read at most
+const remoteListInterval = Duration(time.Hour) // For sources without an interval
+const remoteListsCheck = time.Minute           // How often sources are checked for being due
+
+// remoteListPath is where the last fetched copy of the list at url is kept.
+func (c *Config) remoteListPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return c.DataPath(filepath.Join(remoteListsDir, hex.EncodeToString(sum[:8])+".txt"))
+}
+
+// remoteListName names a fetched list after the last part of its URL, or
+// its host.
+func remoteListName(url string) string {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return ""
+	}
+	name := strings.TrimSuffix(path.Base(u.Path), ".txt")
+	if name == "" || name == "." || name == "/" {
+		return u.Hostname()
+	}
+	return name
+}
+
+// startRemoteLists fetches each URL source when it's due, and syncs the
+// pool when one has changed, until ctx is cancelled. Every source is due
+// at startup.
+func (rl *Roulette) startRemoteLists(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		fetched := make(map[string]time.Time)
+		ticker := time.NewTicker(remoteListsCheck)
+		defer ticker.Stop()
+		for {
+			c := rl.Config()
+			changed := false
+			for _, src := range c.URLSources {
+				interval := src.Interval
+				if interval == 0 {
+					interval = remoteListInterval
+				}
+				if src.URL == "" || time.Since(fetched[src.URL]) < time.Duration(interval) {
+					continue
+				}
+				fetched[src.URL] = time.Now()
+				updated, err := rl.fetchRemoteList(ctx, c, src.URL)
+				if err != nil {
+					syncLog.Error("Failed to fetch URL source", "url", src.URL, "err", err)
+					continue
+				}
+				changed = changed || updated
+			}
+			if changed {
+				rl.sync(ctx, SourceRemote)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// fetchRemoteList downloads the list at url over the kept copy, reporting
+// whether it changed. The ETag of the copy is kept next to it and sent
+// back, so unchanged lists aren't downloaded again.
+func (rl *Roulette) fetchRemoteList(ctx context.Context, c *Config, url string) (bool, error) {
+	dest := c.remoteListPath(url)
+	etagPath := dest + ".etag"
+	ctx, cancel := context.WithTimeout(ctx, remoteListTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(dest); err == nil {
+		if etag, err := os.ReadFile(etagPath); err == nil {
+			req.Header.Set("If-None-Match", strings.TrimSpace(string(etag)))
+		}
+	}
+	// Sources are chosen by the operator, so the network policy for sites
+	// doesn't apply
+	client := &http.Client{Transport: identifyTransport{outbound: c.Outbound, base: http.DefaultTransport}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s", resp.Status)
+	}
+	urls, err := ReadURLs(io.LimitReader(resp.Body, remoteListMax))
+	if err != nil {
+		return false, fmt.Errorf("failed to read the list: %v", err)
+	}
+
+	old, _ := ReadURLsFile(dest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, fmt.Errorf("failed to create %s: %v", filepath.Dir(dest), err)
+	}
+	if err := WriteURLsFile(dest, urls); err != nil {
+		return false, err
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		if err := os.WriteFile(etagPath, []byte(etag+"\n"), 0644); err != nil {
+			syncLog.Warn("Failed to keep ETag", "url", url, "err", err)
+		}
+	} else {
+		os.Remove(etagPath)
+	}
+	updated := strings.Join(old, "\n") != strings.Join(urls, "\n")
+	if updated {
+		syncLog.Info("Fetched changed URL source", "url", url, "urls", len(urls))
+	}
+	return updated, nil
+}
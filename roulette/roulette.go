@@ -0,0 +1,352 @@
+// Package roulette sends visitors to a random open directory listing from a
+// pool discovered through Shodan. It runs standalone through the roulette
+// command, or can be mounted into an existing server:
+//
+//	rl, err := roulette.New(roulette.DefaultConfig())
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer rl.Close()
+//	rl.Start(ctx)
+//	mux.Handle("/roulette/", http.StripPrefix("/roulette", rl.Handler()))
+package roulette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const refreshLoopBeatInterval = time.Minute   // How often the refresh loop reports in
+const refreshLoopStaleAfter = 3 * time.Minute // Beats older than this mean the loop is stuck
+const healthCheckTimeout = 5 * time.Second    // Upper bound for a single health check
+const shuffleAttempts = 5                     // Sites /shuffle tries before giving up on finding an acceptable one
+
+// Roulette is a site pool together with its background jobs and HTTP handlers.
+type Roulette struct {
+	store  SiteStore
+	config atomic.Pointer[Config]
+
+	// jobs tracks background goroutines so Close can wait for them before
+	// closing the store
+	jobs sync.WaitGroup
+
+	// refreshLoopBeat holds the UnixNano time the Shodan refresh loop last
+	// reported in, so the health check can tell a wedged loop from a live one
+	refreshLoopBeat atomic.Int64
+	// panics counts the requests recoverPanics caught
+	panics atomic.Int64
+
+	// templates caches parsed templates unless ReloadTemplates is set
+	templatesMu sync.Mutex
+	templates   map[string]*template.Template
+
+	// sessions are the logged in admins of the web UI
+	sessions *sessions
+	// visitors are the visitors logged in through OAuth
+	visitors *sessions
+
+	// limiter throttles clients of the public endpoints
+	limiter *rateLimiter
+	// submissions caps the public forms feeding the moderation queue, and
+	// submissionCheck optionally vets them
+	submissions     *submissionLimiter
+	submissionCheck SubmissionCheck
+
+	// bans caches the ban list
+	bans banCache
+	// picker caches the pool for PickRandomSite
+	picker sitePicker
+	// bootstrapper refreshes when the pool is found empty
+	bootstrapper bootstrapper
+
+	// malware caches the local malware domain list
+	malware malwareList
+	// countries caches the IP-to-country database
+	countries countryDB
+	// ipinfo caches the countries looked up on ipinfo.io
+	ipinfo ipinfoCache
+
+	// timings records the background jobs' runs for Diagnostics, and
+	// flights keeps each from running twice at once
+	timings jobTimings
+	flights flightGroup
+	// transport is shared by the clients that talk to sites
+	transport siteTransport
+	// stats buffers visits for the store, nil if it keeps none
+	stats *statsQueue
+	// tracer exports spans when tracing is configured
+	tracer *tracer
+	// reporter sends error reports when a DSN is configured
+	reporter *errorReporter
+	// alerts tracks which alert rules are firing
+	alerts alertState
+	// beacons holds visitors' recent reports of sites failing to load
+	beacons beaconReports
+	// wayback caches Wayback Machine snapshot lookups
+	wayback waybackCache
+	// hooks are the Go hooks installed with SetHooks
+	hooks Hooks
+	// urlsWatch tracks the URL list version last synced
+	urlsWatch urlsWatch
+	// duplicates links sites serving the same listing to the one preferred
+	duplicates duplicateSet
+	// ages caches when each site's files last changed
+	ages siteAges
+	// knownHashes caches the hashes of files checked for known ones
+	knownHashes knownHashCache
+	// verdicts caches what /verify players settled sites on
+	verdicts playerVerdicts
+	// themes caches the pool filter of the theme on
+	themes themeFilters
+	// profileCache keeps what sites are compared on to find similar ones
+	profileCache siteProfiles
+	// changeFeed passes changed events to /api/v1/changes streams
+	changeFeed changeFeed
+
+	// holder identifies this instance when taking job leases
+	holder string
+
+	reloadHooksMu sync.Mutex
+	reloadHooks   []func(*Config)
+}
+
+// New opens the store described by c and fills the pool from its URL list.
+// A nil c means DefaultConfig.
+func New(c *Config) (*Roulette, error) {
+	if c == nil {
+		c = DefaultConfig()
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	c = c.resolvePaths()
+	if c.DataDir != "" {
+		if err := os.MkdirAll(c.DataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %v", err)
+		}
+	}
+	// Demos must not touch a real database
+	if c.Demo {
+		return NewWithStore(c, NewMemoryStore()), nil
+	}
+	store, err := OpenStore(c.DBPath)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithStore(c, store), nil
+}
+
+// NewWithStore is like New but uses an already opened store.
+func NewWithStore(c *Config, store SiteStore) *Roulette {
+	// validate also prepares the parsed forms of CIDR lists
+	if err := c.validate(); err != nil {
+		appLog.Error("Invalid configuration", "err", err)
+	}
+	rl := &Roulette{
+		store:       store,
+		holder:      leaseHolder(),
+		limiter:     newRateLimiter(),
+		submissions: newSubmissionLimiter(),
+		templates:   make(map[string]*template.Template),
+		sessions:    newSessions(sessionLifetime),
+		visitors:    newSessions(visitorSessionLifetime),
+		ipinfo:      ipinfoCache{wake: make(chan struct{}, 1)},
+	}
+	registerSecrets(c)
+	configureLogging(c)
+	rl.config.Store(c)
+	rl.startTracer()
+	rl.startErrorReporter()
+	rl.Sync()
+	rl.startStats()
+	return rl
+}
+
+// Start launches the background jobs. They stop when ctx is cancelled.
+func (rl *Roulette) Start(ctx context.Context) {
+	appLog.Info("Starting background jobs", "profile", rl.Config().Profile)
+	if rl.Config().Demo {
+		appLog.Info("Demo mode: serving the built-in sample list, Shodan refreshes are disabled")
+		return
+	}
+	rl.startShodanQuery(ctx)
+	rl.startPurge(ctx)
+	rl.startAlerts(ctx)
+	rl.startDigest(ctx)
+	rl.startNewsletter(ctx)
+	rl.startBots(ctx)
+	rl.startS3Export(ctx)
+	rl.startURLsWatch(ctx)
+	rl.startRemoteLists(ctx)
+	rl.startChanges(ctx)
+	rl.startIPInfo(ctx)
+}
+
+// Close waits for background jobs to finish and closes the store. Cancel
+// the context passed to Start first.
+func (rl *Roulette) Close() error {
+	rl.jobs.Wait()
+	if rl.stats != nil {
+		rl.stats.close()
+	}
+	rl.tracer.close()
+	return rl.store.Close()
+}
+
+// Store returns the underlying site store.
+func (rl *Roulette) Store() SiteStore {
+	return rl.store
+}
+
+// Config returns the active configuration. Callers must not modify it.
+func (rl *Roulette) Config() *Config {
+	return rl.config.Load()
+}
+
+// OnReload registers fn to run after every successful Reload.
+func (rl *Roulette) OnReload(fn func(*Config)) {
+	rl.reloadHooksMu.Lock()
+	defer rl.reloadHooksMu.Unlock()
+	rl.reloadHooks = append(rl.reloadHooks, fn)
+}
+
+// Reload re-reads the config file the active configuration came from and
+// swaps it in. Storage locations can't change while running and are kept.
+// On error the previous configuration stays active.
+func (rl *Roulette) Reload() error {
+	old := rl.Config()
+	if old.path == "" {
+		return fmt.Errorf("the configuration wasn't loaded from a file")
+	}
+	c, err := LoadConfigProfile(old.path, old.forcedProfile)
+	if err != nil {
+		return err
+	}
+	c.DataDir = old.DataDir
+	c = c.resolvePaths()
+	c.URLsFile = old.URLsFile
+	c.DBPath = old.DBPath
+	c.Demo = old.Demo
+	c.TemplatesDir = old.TemplatesDir
+	c.TokensFile = old.TokensFile
+	registerSecrets(c)
+	configureLogging(c)
+	rl.config.Store(c)
+	rl.clearTemplates()
+	appLog.Info("Configuration reloaded", "path", c.path, "profile", c.Profile)
+
+	// Re-apply the blocklist to the pool
+	rl.Sync()
+
+	rl.reloadHooksMu.Lock()
+	hooks := append([]func(*Config){}, rl.reloadHooks...)
+	rl.reloadHooksMu.Unlock()
+	for _, fn := range hooks {
+		fn(c)
+	}
+	return nil
+}
+
+// HealthCheck verifies that the store answers and the refresh loop is
+// still running.
+func (rl *Roulette) HealthCheck(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := rl.store.Ping(ctx); err != nil {
+		return fmt.Errorf("database unreachable: %v", err)
+	}
+	if beat := rl.refreshLoopBeat.Load(); beat != 0 {
+		if age := time.Since(time.Unix(0, beat)); age > refreshLoopStaleAfter {
+			return fmt.Errorf("refresh loop has not reported in for %s", age.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// PickRandomSite chooses a site honoring the configured port filter, with
+// each site's chance proportional to the weight of its probe status.
+func (rl *Roulette) PickRandomSite() (Site, error) {
+	c := rl.Config()
+	return rl.pickCached(SiteFilter{Ports: c.Shuffle.Ports}, c.statusWeight, nil, "")
+}
+
+// Spin picks a site the way /shuffle does, never a flagged one.
+func (rl *Roulette) Spin(ctx context.Context) (Site, error) {
+	site, _, err := rl.shuffle(ctx, shuffleOptions{})
+	return site, err
+}
+
+// errNoSuitableSite is returned by shuffle when every site it tried was
+// excluded.
+var errNoSuitableSite = errors.New("no suitable site found")
+
+// shuffleOptions narrow down what shuffle picks.
+type shuffleOptions struct {
+	allowFlagged bool  // Flagged sites may be picked, for the warning
+	dusty        bool  // Only sites untouched for Shuffle.DustyAfter
+	like         int64 // Only sites similar to the one with this ID, unless 0
+}
+
+// shuffle picks a site to send a visitor to, skipping sites in excluded
+// countries, those a BeforeServe hook turns down and, unless
+// opts.allowFlagged, flagged sites. threat is what a flagged site returned
+// was flagged for. Shuffles that aren't dusty or among similar sites keep
+// to the theme on, if any.
+func (rl *Roulette) shuffle(ctx context.Context, opts shuffleOptions) (site Site, threat string, err error) {
+	var keep func(Site) bool
+	themeKey := "" // Names the theme's filter, so the picker keeps what it keeps
+	if opts.dusty {
+		keep = rl.dustyFilter()
+	} else if opts.like != 0 {
+		keep = rl.similarFilter(opts.like)
+	} else if theme := rl.Config().activeTheme(time.Now()); theme != nil {
+		keep, themeKey = rl.themeFilter(theme)
+	}
+	for attempt := 0; attempt < shuffleAttempts; attempt++ {
+		c := rl.Config()
+		site, err = rl.pickCached(SiteFilter{Ports: c.Shuffle.Ports}, c.statusWeight, keep, themeKey)
+		if err == ErrNoSites && themeKey != "" {
+			// Better the whole pool than nothing while the theme is on
+			httpLog.Debug("No sites fit the theme, shuffling the whole pool")
+			keep, themeKey = nil, ""
+			site, err = rl.pickCached(SiteFilter{Ports: c.Shuffle.Ports}, c.statusWeight, nil, "")
+		}
+		if err == ErrNoSites && keep != nil {
+			// The pool isn't empty, just nothing in it fits
+			return Site{}, "", errNoSuitableSite
+		}
+		if err != nil {
+			return Site{}, "", err
+		}
+		// The pool is synced without excluded countries, this catches
+		// sites picked before a policy change took effect
+		if rl.countryExcluded(site.URL) {
+			httpLog.Debug("Skipping site in an excluded country", "url", site.URL)
+			continue
+		}
+		if preferred, ok := rl.duplicateOf(site.ID); ok {
+			httpLog.Debug("Skipping duplicate site", "url", site.URL, "preferred", preferred)
+			continue
+		}
+		if rl.rejected(site.ID) {
+			httpLog.Debug("Skipping site players rejected", "url", site.URL)
+			continue
+		}
+		if !rl.beforeServe(ctx, site) {
+			httpLog.Debug("Skipping site a hook turned down", "url", site.URL)
+			continue
+		}
+		threat = rl.checkSafety(ctx, site.URL)
+		if threat == "" || opts.allowFlagged {
+			return site, threat, nil
+		}
+		httpLog.Info("Skipping flagged site", "url", site.URL, "threat", threat)
+	}
+	return Site{}, "", errNoSuitableSite
+}
@@ -0,0 +1,37 @@
+package roulette
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkShuffle picks sites the way /shuffle does, from pools of
+// growing size in the memory store.
+func BenchmarkShuffle(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			c := DefaultConfig()
+			c.DataDir = b.TempDir()
+			c.URLsFile = filepath.Join(c.DataDir, "urls.txt")
+			urls := make([]string, n)
+			for i := range urls {
+				urls[i] = fmt.Sprintf("http://11.%d.%d.%d:8000/", i>>16&0xff, i>>8&0xff, i&0xff)
+			}
+			if err := WriteURLsFile(c.URLsFile, urls); err != nil {
+				b.Fatal(err)
+			}
+			// NewWithStore syncs the list into the pool
+			rl := NewWithStore(c, NewMemoryStore())
+			defer rl.Close()
+			ctx := context.Background()
+			b.ResetTimer()
+			for range b.N {
+				if _, _, err := rl.shuffle(ctx, shuffleOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
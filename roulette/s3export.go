@@ -0,0 +1,238 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const s3UploadTimeout = 10 * time.Minute // Per object uploaded
+
+// S3ExportConfig uploads snapshots of the site list and, optionally, a
+// backup of the database to an S3-compatible bucket on a schedule. Each
+// snapshot goes under Prefix/YYYYMMDD-HHMMSS/; pruning old ones is left to
+// the bucket's lifecycle rules.
+type S3ExportConfig struct {
+	// Endpoint is the storage service's URL, such as
+	// https://s3.eu-west-1.amazonaws.com. Empty turns exporting off.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Region is the bucket's region, us-east-1 for most other services
+	Region string `json:"region"`
+	// Bucket is addressed path-style, Endpoint/Bucket/key
+	Bucket string `json:"bucket,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	// AccessKey and SecretKey sign the uploads
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	// Interval is how often a snapshot is uploaded
+	Interval Duration `json:"interval"`
+	// Database also uploads a backup of the SQLite database
+	Database bool `json:"database"`
+}
+
+func (e S3ExportConfig) validate() error {
+	if e.Endpoint == "" {
+		return nil
+	}
+	if u, err := neturl.Parse(e.Endpoint); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("s3_export.endpoint must be an http or https URL")
+	}
+	if e.Bucket == "" || e.AccessKey == "" || e.SecretKey == "" {
+		return fmt.Errorf("s3_export needs a bucket, access_key and secret_key")
+	}
+	if e.Interval <= 0 {
+		return fmt.Errorf("s3_export.interval must be positive")
+	}
+	return nil
+}
+
+// BackupStore is implemented by stores that can copy their database.
+type BackupStore interface {
+	// Backup writes a consistent copy of the database to path, which must
+	// not exist.
+	Backup(path string) error
+}
+
+// startS3Export uploads a snapshot every interval while an endpoint is
+// configured, until ctx is cancelled.
+func (rl *Roulette) startS3Export(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		for {
+			interval := time.Duration(rl.Config().S3Export.Interval)
+			if interval <= 0 {
+				interval = time.Hour
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			if rl.Config().S3Export.Endpoint == "" {
+				continue
+			}
+			if err := rl.withLease(ctx, exportLease, rl.exportS3); err != nil && err != ErrNotLeader {
+				appLog.Error("S3 export failed", "err", err)
+			}
+		}
+	}()
+}
+
+// exportS3 uploads the site list and, if configured, a database backup.
+func (rl *Roulette) exportS3(ctx context.Context) error {
+	c := rl.Config().S3Export
+	dir := c.Prefix
+	if dir != "" && !strings.HasSuffix(dir, "/") {
+		dir += "/"
+	}
+	dir += time.Now().UTC().Format("20060102-150405") + "/"
+
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return fmt.Errorf("failed to list sites: %v", err)
+	}
+	list := make([]apiSite, 0, len(sites))
+	for _, s := range sites {
+		list = append(list, newAPISite(s))
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if err := s3Put(ctx, c, dir+"sites.json", "application/json", bytes.NewReader(body)); err != nil {
+		return fmt.Errorf("failed to upload the site list: %v", err)
+	}
+
+	if c.Database {
+		store, ok := rl.store.(BackupStore)
+		if !ok {
+			return fmt.Errorf("this store can't be backed up")
+		}
+		tmp, err := os.MkdirTemp("", "roulette-backup")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		path := filepath.Join(tmp, "roulette.db")
+		if err := store.Backup(path); err != nil {
+			return fmt.Errorf("failed to back up the database: %v", err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := s3Put(ctx, c, dir+"roulette.db", "application/vnd.sqlite3", f); err != nil {
+			return fmt.Errorf("failed to upload the database: %v", err)
+		}
+	}
+	appLog.Info("Exported snapshot to S3", "bucket", c.Bucket, "key", dir, "sites", len(sites))
+	return nil
+}
+
+// s3Put uploads body as key, signed with AWS Signature Version 4.
+func s3Put(ctx context.Context, c S3ExportConfig, key, contentType string, body io.ReadSeeker) error {
+	// The payload hash is signed, so the body is read twice
+	hash := sha256.New()
+	size, err := io.Copy(hash, body)
+	if err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	ctx, cancel := context.WithTimeout(ctx, s3UploadTimeout)
+	defer cancel()
+	path := "/" + s3Escape(c.Bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, strings.TrimSuffix(c.Endpoint, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	now := time.Now().UTC()
+	s3Sign(req, c, path, payloadHash, now)
+
+	resp, err := http.DefaultClient.Do(req)
+	var uerr *neturl.Error
+	if errors.As(err, &uerr) {
+		return uerr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// s3Sign adds the Signature Version 4 headers for a request to path, its
+// URI already escaped, with no query.
+func s3Sign(req *http.Request, c S3ExportConfig, path, payloadHash string, now time.Time) {
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/" + region + "/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		"",
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + c.SecretKey)
+	for _, part := range []string{now.Format("20060102"), region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way Signature Version 4 expects, leaving
+// slashes between key segments alone.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
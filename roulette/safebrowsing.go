@@ -0,0 +1,212 @@
+package roulette
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const safeBrowsingURL = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+const safeBrowsingTimeout = 5 * time.Second // Upper bound for one Safe Browsing lookup
+
+// Safe Browsing actions
+const (
+	SafetyBlock = "block" // Skip flagged sites
+	SafetyWarn  = "warn"  // Show a warning before flagged sites
+)
+
+// SafeBrowsingConfig checks destinations against Google Safe Browsing
+// and/or a local list of malware domains before redirecting. It is off
+// unless an API key or a list is configured.
+type SafeBrowsingConfig struct {
+	// APIKey enables the Google Safe Browsing Lookup API
+	APIKey string `json:"api_key,omitempty"`
+	// MalwareList is a file of bad domains, one per line. Hosts file lines
+	// like "0.0.0.0 bad.example" and # comments are understood.
+	MalwareList string `json:"malware_list,omitempty"`
+	// Action is SafetyBlock or SafetyWarn
+	Action string `json:"action"`
+	// CacheFor is how long Safe Browsing verdicts are kept in the store
+	CacheFor Duration `json:"cache_for"`
+}
+
+func (s SafeBrowsingConfig) enabled() bool {
+	return s.APIKey != "" || s.MalwareList != ""
+}
+
+// Verdict is a cached safety check result for a URL.
+type Verdict struct {
+	URL     string
+	Threat  string // Empty if the URL is clean
+	Checked time.Time
+}
+
+// VerdictStore is implemented by stores that can cache safety verdicts.
+type VerdictStore interface {
+	// Verdict returns the cached verdict for url, ok is false if there is none.
+	Verdict(url string) (v Verdict, ok bool, err error)
+	// SaveVerdict caches v, replacing any older verdict for its URL.
+	SaveVerdict(v Verdict) error
+}
+
+// malwareList is the parsed local list, reloaded when the file changes.
+type malwareList struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	domains map[string]bool
+}
+
+// contains reports whether host or one of its parent domains is listed.
+func (l *malwareList) contains(path, host string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path != path || !info.ModTime().Equal(l.modTime) {
+		domains, err := readMalwareList(path)
+		if err != nil {
+			return false, err
+		}
+		l.path, l.modTime, l.domains = path, info.ModTime(), domains
+	}
+	for name := host; name != ""; {
+		if l.domains[name] {
+			return true, nil
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return false, nil
+}
+
+func readMalwareList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	domains := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// Hosts file format puts the address first
+		domain := fields[len(fields)-1]
+		domains[strings.TrimSuffix(strings.ToLower(domain), ".")] = true
+	}
+	return domains, scanner.Err()
+}
+
+// checkSafety returns the threat url is flagged for, or "" if it is clean
+// or checking is disabled. Lookup failures are logged and treated as
+// clean, so an outage doesn't take /shuffle down.
+func (rl *Roulette) checkSafety(ctx context.Context, url string) string {
+	c := rl.Config().SafeBrowsing
+	if !c.enabled() {
+		return ""
+	}
+	if c.MalwareList != "" {
+		host, _ := splitHostPort(url)
+		listed, err := rl.malware.contains(c.MalwareList, host)
+		if err != nil {
+			httpLog.Error("Failed to read malware list", "err", err)
+		} else if listed {
+			return "MALWARE_LIST"
+		}
+	}
+	// Demos make no outbound requests
+	if c.APIKey == "" || rl.Config().Demo {
+		return ""
+	}
+
+	cache, _ := rl.store.(VerdictStore)
+	if cache != nil {
+		v, ok, err := cache.Verdict(url)
+		if err != nil {
+			httpLog.Error("Failed to read cached verdict", "err", err)
+		} else if ok && time.Since(v.Checked) < time.Duration(c.CacheFor) {
+			return v.Threat
+		}
+	}
+	threat, err := lookupSafeBrowsing(ctx, c.APIKey, url)
+	if err != nil {
+		httpLog.Warn("Safe Browsing lookup failed", "url", url, "err", err)
+		return ""
+	}
+	if cache != nil {
+		if err := cache.SaveVerdict(Verdict{URL: url, Threat: threat, Checked: time.Now()}); err != nil {
+			httpLog.Error("Failed to cache verdict", "err", err)
+		}
+	}
+	return threat
+}
+
+// lookupSafeBrowsing asks the Safe Browsing v4 Lookup API about url.
+func lookupSafeBrowsing(ctx context.Context, apiKey, url string) (string, error) {
+	body, err := json.Marshal(map[string]any{
+		"client": map[string]string{"clientId": "simplehttproulette", "clientVersion": Version},
+		"threatInfo": map[string]any{
+			"threatTypes":      []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"},
+			"platformTypes":    []string{"ANY_PLATFORM"},
+			"threatEntryTypes": []string{"URL"},
+			"threatEntries":    []map[string]string{{"url": url}},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, safeBrowsingTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, safeBrowsingURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// In a header the key stays out of URLs, which proxies and errors log
+	req.Header.Set("X-Goog-Api-Key", apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var result struct {
+		Matches []struct {
+			ThreatType string `json:"threatType"`
+		} `json:"matches"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", err
+	}
+	if len(result.Matches) > 0 {
+		return result.Matches[0].ThreatType, nil
+	}
+	return "", nil
+}
+
+// warningPage is the data the warning template is rendered with.
+type warningPage struct {
+	basePage
+	URL    string
+	Link   string // Where Continue anyway goes, a signed /out link or the proxied view
+	Threat string
+}
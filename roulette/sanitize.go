@@ -0,0 +1,57 @@
+package roulette
+
+import (
+	"html/template"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const maxRemoteText = 200 // Default rune cap for remote or visitor supplied text in pages
+
+// templateFuncs are the helpers every page template can use. clean should
+// wrap anything that came from a remote host or a visitor: html/template
+// already escapes it, clean makes sure it also renders as one short line.
+var templateFuncs = template.FuncMap{
+	"clean": func(s string, max ...int) string {
+		n := maxRemoteText
+		if len(max) > 0 {
+			n = max[0]
+		}
+		return sanitizeText(s, n)
+	},
+}
+
+// sanitizeText makes untrusted text safe to show: invalid UTF-8, control
+// and invisible formatting characters (including bidi overrides that could
+// make a URL read differently than it is) are dropped, runs of whitespace
+// are collapsed into one space and the result is capped at max runes.
+func sanitizeText(s string, max int) string {
+	var b strings.Builder
+	n := 0
+	space := false
+	for _, r := range strings.ToValidUTF8(s, "") {
+		if unicode.IsSpace(r) {
+			space = b.Len() > 0
+			continue
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) || r == utf8.RuneError {
+			continue
+		}
+		if space {
+			if n++; max > 0 && n > max {
+				break
+			}
+			b.WriteByte(' ')
+			space = false
+		}
+		if n++; max > 0 && n > max {
+			return strings.TrimRight(b.String(), " ") + "…"
+		}
+		b.WriteRune(r)
+	}
+	if max > 0 && n > max {
+		return strings.TrimRight(b.String(), " ") + "…"
+	}
+	return b.String()
+}
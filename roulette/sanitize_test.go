@@ -0,0 +1,84 @@
+package roulette
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeText(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		max  int
+		want string
+	}{
+		{"plain", "http://1.2.3.4:8000/", 200, "http://1.2.3.4:8000/"},
+		{"control characters", "a\x00b\x07c\x1b[31md", 200, "abc[31md"},
+		{"whitespace collapsed", "  a\r\n\t b  ", 200, "a b"},
+		{"bidi override", "http://x/\u202egnp.exe", 200, "http://x/gnp.exe"},
+		{"bidi isolates", "a\u2066b\u2069c", 200, "abc"},
+		{"zero width", "pay\u200bpal\ufeff", 200, "paypal"},
+		{"invalid UTF-8", "a\xffb\xc0\x80c", 200, "abc"},
+		{"under the cap", "abc", 3, "abc"},
+		{"over the cap", "abcdef", 3, "abc…"},
+		{"cap at a space", "ab cd", 3, "ab…"},
+		{"cap counts runes", "ééééé", 2, "éé…"},
+		{"no cap", strings.Repeat("a", 500), 0, strings.Repeat("a", 500)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeText(tt.in, tt.max); got != tt.want {
+				t.Errorf("sanitizeText(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+			}
+		})
+	}
+}
+
+// scriptURL matches a javascript: URL where a browser would follow it. The
+// text of a page may still show one, escaped.
+var scriptURL = regexp.MustCompile(`(?i)(href|src|action|url)\s*=\s*["']?\s*javascript:`)
+
+// TestTemplatesEscapeRemoteText renders pages with a hostile URL and
+// listing text and checks that neither can inject script.
+func TestTemplatesEscapeRemoteText(t *testing.T) {
+	const hostile = `javascript:alert(1)//"><script>alert(1)</script><img src=x onerror=alert(1)>`
+	rl := NewWithStore(DefaultConfig(), NewMemoryStore())
+	defer rl.Close()
+	for _, tt := range []struct {
+		name string
+		data any
+	}{
+		{"redirect.html", redirectPage{URL: hostile}},
+		{"site.html", siteInfoPage{
+			ID:        1,
+			Site:      Site{ID: 1, URL: hostile, Status: StatusUp},
+			URL:       hostile,
+			Tags:      []string{hostile},
+			Related:   []RelatedSite{{Site: Site{ID: 2, URL: hostile}, Why: []string{hostile}}},
+			Events:    []SiteEvent{{SiteID: 1, URL: hostile, Kind: EventChanged, Detail: "<title>" + hostile + "</title>\u202e"}},
+			Supported: true,
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rl.render(w, tt.name, tt.data)
+			out := w.Body.String()
+			if !strings.Contains(out, "</html>") {
+				t.Fatalf("the page didn't render: %s", out)
+			}
+			if strings.Contains(strings.ToLower(out), "<script") {
+				t.Errorf("a script tag got through:\n%s", out)
+			}
+			if strings.Contains(out, "<img") {
+				t.Errorf("an img tag got through:\n%s", out)
+			}
+			if scriptURL.MatchString(out) {
+				t.Errorf("a javascript: URL got through:\n%s", out)
+			}
+			if strings.ContainsRune(out, '\u202e') {
+				t.Errorf("a bidi override got through:\n%s", out)
+			}
+		})
+	}
+}
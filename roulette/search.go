@@ -0,0 +1,285 @@
+package roulette
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const searchQueryMax = 512 // Bytes of a search query parsed at most
+const searchLimitMax = 500 // Sites /api/v1/sites returns per request at most
+
+// Search fields, as written before the colon. A term without a field
+// matches URLs containing it or sites with it as a tag.
+const (
+	SearchCountry = "country"
+	SearchPort    = "port"
+	SearchTag     = "tag"
+	SearchStatus  = "status"
+	SearchHost    = "host"
+)
+
+// SearchTerm is one part of a search query, such as port:80,8080 or
+// -honeypot. Its values are alternatives.
+type SearchTerm struct {
+	Field  string // Empty for a bare word
+	Values []string
+	Negate bool
+}
+
+// SiteQuery is a parsed search: sites must match every term.
+type SiteQuery []SearchTerm
+
+// SearchStore is implemented by stores that can search sites themselves.
+// Country terms are left to the caller, stores don't know where sites
+// are.
+type SearchStore interface {
+	// Search returns the sites matching every term of q but country ones,
+	// in insertion order.
+	Search(q SiteQuery) ([]Site, error)
+}
+
+// parseQuery parses Shodan-style search syntax: whitespace-separated
+// terms, each field:value or a bare word, with - in front to exclude
+// matches and commas between alternatives, as in
+// "country:DE port:8000,8080 tag:nas -honeypot".
+func parseQuery(q string) (SiteQuery, error) {
+	if len(q) > searchQueryMax {
+		return nil, fmt.Errorf("query is longer than %d bytes", searchQueryMax)
+	}
+	var query SiteQuery
+	for _, word := range strings.Fields(q) {
+		var term SearchTerm
+		if rest, ok := strings.CutPrefix(word, "-"); ok && rest != "" {
+			term.Negate, word = true, rest
+		}
+		value := word
+		if field, v, ok := strings.Cut(word, ":"); ok && !strings.Contains(field, "/") {
+			term.Field, value = strings.ToLower(field), v
+		}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			switch term.Field {
+			case SearchCountry:
+				if len(v) != 2 {
+					return nil, fmt.Errorf("country %q is not a two-letter country code", v)
+				}
+				v = strings.ToUpper(v)
+			case SearchPort:
+				if port, err := strconv.Atoi(v); err != nil || port < 1 || port > 65535 {
+					return nil, fmt.Errorf("port %q is not a port number", v)
+				}
+			case SearchTag:
+				v = normalizeTag(v)
+			case SearchStatus, SearchHost, "":
+				v = strings.ToLower(v)
+			default:
+				return nil, fmt.Errorf("unknown search field %q", term.Field)
+			}
+			term.Values = append(term.Values, v)
+		}
+		if len(term.Values) == 0 {
+			return nil, fmt.Errorf("%q has no value", word)
+		}
+		query = append(query, term)
+	}
+	return query, nil
+}
+
+// matches reports whether a site, with its tags and country, matches the
+// term.
+func (t SearchTerm) matches(site Site, tags []string, country string) bool {
+	found := false
+	for _, v := range t.Values {
+		switch t.Field {
+		case SearchCountry:
+			found = country == v
+		case SearchPort:
+			found = strconv.Itoa(site.Port) == v
+		case SearchTag:
+			found = slices.Contains(tags, v)
+		case SearchStatus:
+			found = site.Status == v
+		case SearchHost:
+			host := strings.ToLower(site.Host)
+			found = host == v || strings.HasSuffix(host, "."+v)
+		default:
+			found = strings.Contains(strings.ToLower(site.URL), v) || slices.Contains(tags, v)
+		}
+		if found {
+			break
+		}
+	}
+	return found != t.Negate
+}
+
+// searchSites returns the sites matching q. The store narrows them down
+// where it can and country terms are checked here.
+func (rl *Roulette) searchSites(q SiteQuery) ([]Site, error) {
+	var countries SiteQuery
+	for _, t := range q {
+		if t.Field == SearchCountry {
+			countries = append(countries, t)
+		}
+	}
+	var sites []Site
+	var err error
+	if store, ok := rl.store.(SearchStore); ok {
+		sites, err = store.Search(q)
+	} else {
+		// Without a SearchStore tags aren't kept either, so filter the
+		// whole pool here
+		countries = q
+		sites, err = rl.store.List(SiteFilter{})
+	}
+	if err != nil || len(countries) == 0 {
+		return sites, err
+	}
+	matched := sites[:0]
+	for _, site := range sites {
+		country := rl.countryOf(site.URL)
+		ok := true
+		for _, t := range countries {
+			ok = ok && t.matches(site, nil, country)
+		}
+		if ok {
+			matched = append(matched, site)
+		}
+	}
+	return matched, nil
+}
+
+// BrowseConfig publishes the pool as a searchable list on /browse and
+// /api/v1/sites.
+type BrowseConfig struct {
+	// Enabled serves /browse and /api/v1/sites
+	Enabled bool `json:"enabled"`
+	// PageSize is how many sites /browse shows per page
+	PageSize int `json:"page_size"`
+}
+
+// foundSite is a search result, with what the search syntax can match on.
+type foundSite struct {
+	apiSite
+	Country string   `json:"country,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Out     string   `json:"-"` // Signed link to the site, for /browse
+}
+
+// search runs the search in r's q parameter and returns a page of the
+// results, how many there are in all and, for a bad query, the error for
+// the visitor.
+func (rl *Roulette) search(r *http.Request, offset, limit int) (found []foundSite, total int, bad error, err error) {
+	q, bad := parseQuery(r.URL.Query().Get("q"))
+	if bad != nil {
+		return nil, 0, bad, nil
+	}
+	if shadowed(r) {
+		return nil, 0, nil, nil
+	}
+	sites, err := rl.searchSites(q)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	total = len(sites)
+	if offset > len(sites) {
+		offset = len(sites)
+	}
+	sites = sites[offset:min(offset+limit, len(sites))]
+	var tags map[int64][]string
+	if store, ok := rl.store.(TagStore); ok && len(sites) > 0 {
+		if tags, err = store.AllTags(); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	for _, site := range sites {
+		found = append(found, foundSite{
+			apiSite: newAPISite(site),
+			Country: rl.countryOf(site.URL),
+			Tags:    tags[site.ID],
+			Out:     rl.outPath(site),
+		})
+	}
+	return found, total, nil, nil
+}
+
+type browsePage struct {
+	basePage
+	Query      string
+	Error      string
+	Sites      []foundSite
+	Total      int
+	Page       int
+	Prev, Next string // Links to the neighbouring pages, empty at either end
+	// Favorites offers to save each site
+	Favorites bool
+}
+
+// browseHandler lists the sites matching a search, a page at a time.
+func (rl *Roulette) browseHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config().Browse
+	if !c.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	_, favorites := rl.store.(FavoriteStore)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	page = max(page, 1)
+	found, total, bad, err := rl.search(r, (page-1)*c.PageSize, c.PageSize)
+	if err != nil {
+		httpLog.Error("Failed to search sites", "err", err)
+		http.Error(w, "Failed to search sites", http.StatusInternalServerError)
+		return
+	}
+	p := browsePage{basePage: rl.pageBase(w, r), Query: r.URL.Query().Get("q"), Sites: found, Total: total, Page: page,
+		Favorites: favorites && rl.Config().Favorites.Enabled}
+	if bad != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		p.Error = bad.Error()
+	}
+	pageLink := func(n int) string {
+		return "browse?" + url.Values{"q": {p.Query}, "page": {strconv.Itoa(n)}}.Encode()
+	}
+	if page > 1 {
+		p.Prev = pageLink(page - 1)
+	}
+	if page*c.PageSize < total {
+		p.Next = pageLink(page + 1)
+	}
+	rl.render(w, "browse.html", p)
+}
+
+// sitesHandler returns the sites matching a search as JSON, with limit
+// and offset parameters for paging.
+func (rl *Roulette) sitesHandler(w http.ResponseWriter, r *http.Request) {
+	if !rl.Config().Browse.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > searchLimitMax {
+		limit = searchLimitMax
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	found, total, bad, err := rl.search(r, max(offset, 0), limit)
+	if bad != nil {
+		http.Error(w, bad.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		httpLog.Error("Failed to search sites", "err", err)
+		http.Error(w, "Failed to search sites", http.StatusInternalServerError)
+		return
+	}
+	if found == nil {
+		found = []foundSite{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"total": total, "sites": found})
+}
@@ -0,0 +1,112 @@
+package roulette
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const dockerSecretsDir = "/run/secrets"  // Where Docker and Compose mount secrets
+const shodanKeySecret = "shodan_api_key" // Docker secret name for the Shodan key
+const minRedactedLength = 6              // Shorter values are too likely to occur in ordinary log text
+const redactedSecret = "[redacted]"      // Stands in for secrets in log output
+
+// ShodanKey returns the Shodan API key from, in order: the SHODAN_API_KEY
+// environment variable, the file named by SHODAN_API_KEY_FILE,
+// shodan_api_key, shodan_api_key_file, and the shodan_api_key Docker
+// secret. It is empty if none of them is set.
+func (c *Config) ShodanKey() string {
+	if key := os.Getenv("SHODAN_API_KEY"); key != "" {
+		return key
+	}
+	if path := os.Getenv("SHODAN_API_KEY_FILE"); path != "" {
+		return readSecretFile(path)
+	}
+	if c.ShodanAPIKey != "" {
+		return c.ShodanAPIKey
+	}
+	if c.ShodanAPIKeyFile != "" {
+		return readSecretFile(c.ShodanAPIKeyFile)
+	}
+	path := filepath.Join(dockerSecretsDir, shodanKeySecret)
+	if _, err := os.Stat(path); err == nil {
+		return readSecretFile(path)
+	}
+	return ""
+}
+
+// readSecretFile returns the trimmed contents of a credentials file.
+// Errors are logged and mean no secret.
+func readSecretFile(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		appLog.Error("Failed to read secret", "err", err)
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// secrets are the values that RedactSecrets scrubs from output.
+var secrets struct {
+	mu     sync.RWMutex
+	values map[string]bool
+}
+
+// registerSecrets adds the credentials in c to the values scrubbed from
+// log output. Old values stay registered, they may still turn up in
+// messages about the previous config.
+func registerSecrets(c *Config) {
+	values := []string{c.ShodanKey(), c.AdminPasswordHash, c.SafeBrowsing.APIKey, c.RedirectKey, c.ErrorReporting.DSN,
+		c.Alerts.Webhook, c.Alerts.Discord, c.Alerts.Email.Password, c.Digest.Webhook, c.Digest.Email.Password, c.Newsletter.Email.Password,
+		c.Bot.Telegram.Token, c.S3Export.SecretKey, c.Countries.IPInfo.Token}
+	for _, p := range c.OAuth {
+		values = append(values, p.ClientSecret)
+	}
+	for _, v := range c.Tracing.Headers {
+		values = append(values, v)
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	if secrets.values == nil {
+		secrets.values = make(map[string]bool)
+	}
+	for _, v := range values {
+		if len(v) >= minRedactedLength {
+			secrets.values[v] = true
+		}
+	}
+}
+
+// redact replaces every registered secret in s.
+func redact(s string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	for v := range secrets.values {
+		s = strings.ReplaceAll(s, v, redactedSecret)
+	}
+	return s
+}
+
+// RedactSecrets wraps w so that the configured credentials never reach
+// it. It is meant for the log output:
+//
+//	roulette.SetupLogging(roulette.RedactSecrets(os.Stderr))
+//
+// Log handlers write each record in one call, so secrets can't be split
+// across writes.
+func RedactSecrets(w io.Writer) io.Writer {
+	return redactingWriter{w}
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,344 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ShodanResult struct {
+	IPStr    string `json:"ip_str"`
+	Port     int    `json:"port"`
+	Location struct {
+		CountryCode string `json:"country_code"`
+	} `json:"location"`
+}
+
+type ShodanResponse struct {
+	Matches []ShodanResult `json:"matches"`
+	Total   int            `json:"total"`
+	Error   string         `json:"error"`
+}
+
+const shodanAPI = "https://api.shodan.io"
+const shodanPageSize = 100          // Results Shodan returns per search page
+const shodanMaxPrealloc = 1_000_000 // Cap on the URL slice preallocated from a reported total
+
+// shodanClient talks to the Shodan API. The key is only added by its
+// transport as the request goes out, so it never appears in URLs the rest
+// of the code builds, logs or wraps into errors.
+type shodanClient struct {
+	api      string // Base URL of the API
+	http     *http.Client
+	workers  int           // Pages fetched at once
+	interval time.Duration // Least time between any two requests
+
+	paceMu sync.Mutex
+	next   time.Time // When the next request may go out, see pace
+}
+
+func newShodanClient(api, apiKey string, workers int, interval time.Duration) *shodanClient {
+	if api == "" {
+		api = shodanAPI
+	}
+	return &shodanClient{
+		api:      strings.TrimSuffix(api, "/"),
+		http:     &http.Client{Transport: shodanKeyTransport{key: apiKey, base: http.DefaultTransport}},
+		workers:  workers,
+		interval: interval,
+	}
+}
+
+// shodanKeyTransport authenticates requests to Shodan. Shodan only takes
+// the key as a query parameter, so it is set on a copy of the request
+// that nothing else sees.
+type shodanKeyTransport struct {
+	key  string
+	base http.RoundTripper
+}
+
+func (t shodanKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	authed := req.Clone(req.Context())
+	q := authed.URL.Query()
+	q.Set("key", t.key)
+	authed.URL.RawQuery = q.Encode()
+	resp, err := t.base.RoundTrip(authed)
+	if err != nil {
+		return nil, fmt.Errorf("%s", strings.ReplaceAll(err.Error(), t.key, redactedSecret))
+	}
+	return resp, nil
+}
+
+// pace waits for the client's next request slot. The slots are interval
+// apart however many workers share the client, so together they stay
+// under the rate limit.
+func (c *shodanClient) pace(ctx context.Context) error {
+	c.paceMu.Lock()
+	at := time.Now()
+	if c.next.After(at) {
+		at = c.next
+	}
+	c.next = at.Add(c.interval)
+	c.paceMu.Unlock()
+	wait := time.Until(at)
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+// search fetches one page of results for query, once pace allows.
+func (c *shodanClient) search(ctx context.Context, query string, page int) (ShodanResponse, error) {
+	if err := c.pace(ctx); err != nil {
+		return ShodanResponse{}, err
+	}
+	url := fmt.Sprintf("%s/shodan/host/search?query=%s&page=%d", c.api, neturl.QueryEscape(query), page)
+
+	// Make the HTTP request, aborting if the context is cancelled
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return ShodanResponse{}, fmt.Errorf("failed to build Shodan request: %v", err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return ShodanResponse{}, fmt.Errorf("failed to fetch data from Shodan API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Decode the response as it streams in, pages can be megabytes
+	var shodanResp ShodanResponse
+	if err := json.NewDecoder(resp.Body).Decode(&shodanResp); err != nil {
+		return ShodanResponse{}, fmt.Errorf("failed to parse JSON response (%s): %v", resp.Status, err)
+	}
+	if shodanResp.Error != "" {
+		return ShodanResponse{}, fmt.Errorf("API error: %s", shodanResp.Error)
+	}
+	return shodanResp, nil
+}
+
+// fetchSimpleHTTPServerURLs returns the URLs of the query's results that
+// keep accepts, in page order. The first page tells how many there are,
+// the rest are fetched by the client's workers.
+func fetchSimpleHTTPServerURLs(ctx context.Context, client *shodanClient, query string, keep func(ShodanResult) bool) ([]string, error) {
+	shodanLog.Debug("Fetching results page", "page", 1)
+	first, err := client.search(ctx, query, 1)
+	if err != nil {
+		return nil, err
+	}
+	pages := [][]ShodanResult{first.Matches}
+	if len(first.Matches) > 0 {
+		last := (first.Total + shodanPageSize - 1) / shodanPageSize
+		rest, err := client.searchPages(ctx, query, 2, last)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, rest...)
+	}
+
+	// Extract URLs
+	allURLs := make([]string, 0, min(first.Total, shodanMaxPrealloc))
+	for _, matches := range pages {
+		for _, match := range matches {
+			if !keep(match) {
+				continue
+			}
+			url := fmt.Sprintf("http://%s:%d", match.IPStr, match.Port)
+			allURLs = append(allURLs, url)
+		}
+	}
+	return allURLs, nil
+}
+
+// searchPages fetches pages from through to of query's results and
+// returns them in order. The first error stops every worker.
+func (c *shodanClient) searchPages(ctx context.Context, query string, from, to int) ([][]ShodanResult, error) {
+	if to < from {
+		return nil, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([][]ShodanResult, to-from+1)
+	pages := make(chan int)
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	workers := min(c.workers, len(results))
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for page := range pages {
+				if ctx.Err() != nil {
+					continue
+				}
+				shodanLog.Debug("Fetching results page", "page", page)
+				resp, err := c.search(ctx, query, page)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				results[page-from] = resp.Matches
+			}
+		}()
+	}
+	for page := from; page <= to; page++ {
+		select {
+		case pages <- page:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(pages)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, ctx.Err()
+}
+
+func (rl *Roulette) startShodanQuery(ctx context.Context) {
+	// Set up the ticker to query on the configured interval, picking up
+	// changes when the config is reloaded
+	ticker := time.NewTicker(time.Duration(rl.Config().RefreshInterval))
+	intervalChanged := make(chan struct{}, 1)
+	rl.OnReload(func(*Config) {
+		select {
+		case intervalChanged <- struct{}{}:
+		default:
+		}
+	})
+	heartbeat := time.NewTicker(refreshLoopBeatInterval)
+	rl.refreshLoopBeat.Store(time.Now().UnixNano())
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		defer ticker.Stop()
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				rl.refreshLoopBeat.Store(time.Now().UnixNano())
+			case <-intervalChanged:
+				ticker.Reset(time.Duration(rl.Config().RefreshInterval))
+			case <-ticker.C:
+				err := rl.Refresh(ctx)
+				if err == ErrNotLeader {
+					shodanLog.Info("Skipping the Shodan refresh, another instance is running it")
+				} else if err != nil {
+					shodanLog.Error("Refresh failed", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// keepShodanResult drops results from excluded countries as they are
+// parsed.
+func (rl *Roulette) keepShodanResult(match ShodanResult) bool {
+	if rl.Config().Countries.excludes(match.Location.CountryCode) {
+		shodanLog.Debug("Skipping match in an excluded country", "ip", match.IPStr, "port", match.Port, "country", match.Location.CountryCode)
+		return false
+	}
+	return true
+}
+
+// shodanAPIKey returns the Shodan key, see Config.ShodanKey.
+func (rl *Roulette) shodanAPIKey() string {
+	return rl.Config().ShodanKey()
+}
+
+// HasShodanAPIKey reports whether a Shodan key is available for Refresh.
+func (rl *Roulette) HasShodanAPIKey() bool {
+	return rl.shodanAPIKey() != ""
+}
+
+// Refresh replaces the URL list with fresh results for the configured
+// Shodan queries and syncs the pool from it. When instances share a
+// database only one refreshes at a time, the others get ErrNotLeader.
+// Within one instance, a Refresh called while another runs waits for it
+// and returns its result, so the ticker and an admin trigger can't fetch
+// twice.
+func (rl *Roulette) Refresh(ctx context.Context) error {
+	if rl.Config().Demo {
+		return ErrDemoMode
+	}
+	err, shared := rl.flights.do(refreshLease, func() error {
+		return rl.withLease(ctx, refreshLease, rl.refresh)
+	})
+	if shared {
+		shodanLog.Info("Joined the refresh already running")
+	}
+	return err
+}
+
+func (rl *Roulette) refresh(ctx context.Context) error {
+	apiKey := rl.shodanAPIKey()
+	if apiKey == "" {
+		return fmt.Errorf("no Shodan API key configured")
+	}
+
+	c := rl.Config()
+	client := newShodanClient(c.ShodanAPIURL, apiKey, c.ShodanWorkers, time.Duration(c.ShodanPageInterval))
+	var urls []string
+	seen := make(map[string]bool)
+	for i, query := range c.ShodanQueries {
+		rl.progress(refreshLease, i, len(c.ShodanQueries))
+		shodanLog.Info("Querying Shodan", "query", query)
+		qctx, span := rl.startSpan(ctx, "shodan query", attrString("shodan.query", query))
+		found, err := fetchSimpleHTTPServerURLs(qctx, client, query, rl.keepShodanResult)
+		span.set(attrInt("shodan.results", len(found)))
+		span.finish(err)
+		if err != nil {
+			return fmt.Errorf("error querying Shodan API: %v", err)
+		}
+		// Queries can overlap, keep the first occurrence of each URL
+		for _, url := range found {
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+	}
+
+	// An empty or broken result mustn't wipe the pool unchecked
+	held, err := rl.holdMassDeletion(urls)
+	if err != nil {
+		return err
+	}
+	if held {
+		return nil
+	}
+
+	// Write the URLs to the urls.txt file
+	urlsFile := rl.Config().URLsFile
+	err = WriteURLsFile(urlsFile, urls)
+	if err != nil {
+		return fmt.Errorf("error writing URLs to file: %v", err)
+	}
+	shodanLog.Info("Wrote the URL list", "urls", len(urls), "file", urlsFile)
+	if err := rl.updateDerivedList(ctx, urls); err != nil {
+		return err
+	}
+	rl.sync(ctx, SourceShodan)
+	return nil
+}
@@ -0,0 +1,232 @@
+package roulette
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shodanCheck is one scenario of TestShodanPipeline.
+type shodanCheck struct {
+	name string
+	// setup adjusts the mock and config, run is the check proper
+	setup func(m *MockShodan, c *Config)
+	run   func(ctx context.Context, rl *Roulette, m *MockShodan) error
+}
+
+// TestShodanPipeline runs refreshes against a MockShodan in the usual and
+// the broken cases, from fetching result pages through writing the URL
+// list and syncing the pool.
+func TestShodanPipeline(t *testing.T) {
+	for _, check := range shodanChecks {
+		t.Run(check.name, func(t *testing.T) {
+			m := NewMockShodan(250)
+			c := DefaultConfig()
+			c.DataDir = t.TempDir()
+			c.URLsFile = filepath.Join(c.DataDir, "urls.txt")
+			c.ShodanAPIKey = "mock"
+			c.ShodanPageInterval = 0
+			if err := WriteURLsFile(c.URLsFile, nil); err != nil {
+				t.Fatal(err)
+			}
+			if check.setup != nil {
+				check.setup(m, c)
+			}
+			srv := httptest.NewServer(m)
+			defer srv.Close()
+			c.ShodanAPIURL = srv.URL
+			rl := NewWithStore(c, NewMemoryStore())
+			defer rl.Close()
+			if err := check.run(context.Background(), rl, m); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// wantPool checks that the URL list and the pool both hold n sites.
+func wantPool(rl *Roulette, n int) error {
+	urls, err := ReadURLsFile(rl.Config().URLsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return err
+	}
+	if len(urls) != n || len(sites) != n {
+		return fmt.Errorf("want %d URLs listed and in the pool, have %d and %d", n, len(urls), len(sites))
+	}
+	return nil
+}
+
+// wantRefreshError checks that a refresh fails mentioning want and leaves
+// the pool alone.
+func wantRefreshError(ctx context.Context, rl *Roulette, want string) error {
+	err := rl.Refresh(ctx)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		return fmt.Errorf("want an error mentioning %q, got %v", want, err)
+	}
+	return wantPool(rl, 0)
+}
+
+var shodanChecks = []shodanCheck{
+	{
+		name: "every page is fetched, in order",
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			urls, err := ReadURLsFile(rl.Config().URLsFile)
+			if err != nil {
+				return err
+			}
+			for i, r := range m.Results {
+				if want := normalizeURL(fmt.Sprintf("http://%s:%d", r.IPStr, r.Port)); i >= len(urls) || urls[i] != want {
+					return fmt.Errorf("URL %d isn't %s", i, want)
+				}
+			}
+			if n := m.Requests(); n != 3 {
+				return fmt.Errorf("want 3 page requests, made %d", n)
+			}
+			return wantPool(rl, len(m.Results))
+		},
+	},
+	{
+		name: "excluded countries are dropped",
+		setup: func(m *MockShodan, c *Config) {
+			c.Countries.Exclude = []string{"CN"}
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			return wantPool(rl, len(m.Results)-(len(m.Results)+6)/7)
+		},
+	},
+	{
+		name: "no results leave an empty pool",
+		setup: func(m *MockShodan, c *Config) {
+			m.Results = nil
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			return wantPool(rl, 0)
+		},
+	},
+	{
+		name: "paced workers stay inside the rate limit",
+		setup: func(m *MockShodan, c *Config) {
+			m.RPS = 10
+			c.ShodanWorkers = 1
+			c.ShodanPageInterval = Duration(150 * time.Millisecond)
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			return wantPool(rl, len(m.Results))
+		},
+	},
+	{
+		name: "workers share one pace",
+		setup: func(m *MockShodan, c *Config) {
+			m.RPS = 10
+			c.ShodanWorkers = 4
+			c.ShodanPageInterval = Duration(100 * time.Millisecond)
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			return wantPool(rl, len(m.Results))
+		},
+	},
+	{
+		name: "hitting the rate limit fails the refresh",
+		setup: func(m *MockShodan, c *Config) {
+			m.RPS = 0.1
+			c.ShodanWorkers = 2
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			return wantRefreshError(ctx, rl, "Rate limit reached")
+		},
+	},
+	{
+		name: "a truncated page fails the refresh",
+		setup: func(m *MockShodan, c *Config) {
+			m.Broken = map[int]string{2: MockTruncated}
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			return wantRefreshError(ctx, rl, "failed to parse JSON")
+		},
+	},
+	{
+		name: "an HTML error page fails the refresh",
+		setup: func(m *MockShodan, c *Config) {
+			m.Broken = map[int]string{3: MockHTML}
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			return wantRefreshError(ctx, rl, "502 Bad Gateway")
+		},
+	},
+	{
+		name: "an API error on the first page fails the refresh",
+		setup: func(m *MockShodan, c *Config) {
+			m.Broken = map[int]string{1: MockAPIError}
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			return wantRefreshError(ctx, rl, "timed out")
+		},
+	},
+	{
+		name: "a refresh that would empty the pool is held",
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			m.Results = nil
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			if _, err := os.Stat(rl.Config().pendingRefreshPath()); err != nil {
+				return fmt.Errorf("no held refresh: %v", err)
+			}
+			return wantPool(rl, 250)
+		},
+	},
+	{
+		name: "url_sources sites don't count as removed",
+		setup: func(m *MockShodan, c *Config) {
+			c.URLSources = []URLSource{{Path: filepath.Join(c.DataDir, "curated.txt")}}
+			var curated []string
+			for i := range 1000 {
+				curated = append(curated, fmt.Sprintf("http://12.0.%d.%d:8000", i>>8, i&0xff))
+			}
+			WriteURLsFile(c.URLSources[0].Path, curated)
+		},
+		run: func(ctx context.Context, rl *Roulette, m *MockShodan) error {
+			if err := rl.Refresh(ctx); err != nil {
+				return err
+			}
+			if _, err := os.Stat(rl.Config().pendingRefreshPath()); err == nil {
+				return fmt.Errorf("the refresh was held")
+			}
+			sites, err := rl.store.List(SiteFilter{})
+			if err != nil {
+				return err
+			}
+			if want := len(m.Results) + 1000; len(sites) != want {
+				return fmt.Errorf("want %d sites in the pool, have %d", want, len(sites))
+			}
+			return nil
+		},
+	},
+}
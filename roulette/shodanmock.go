@@ -0,0 +1,100 @@
+package roulette
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Ways MockShodan can break a page, for MockShodan.Broken
+const (
+	MockTruncated = "truncated" // JSON cut off halfway
+	MockHTML      = "html"      // An HTML error page from a proxy
+	MockAPIError  = "error"     // Shodan's own {"error": ...}
+)
+
+// MockShodan is a fake of Shodan's host search API, for exercising the
+// refresh pipeline without a key or the internet. Serve it and point
+// shodan_api_url at it.
+type MockShodan struct {
+	// Results are returned in order, shodanPageSize a page
+	Results []ShodanResult
+	// RPS is how many requests a second it takes, after a burst of two,
+	// before answering 429 as Shodan does. 0 is no limit.
+	RPS float64
+	// Broken maps page numbers to how they break
+	Broken map[int]string
+
+	mu       sync.Mutex
+	requests int
+	limiter  *rateLimiter
+}
+
+// NewMockShodan returns a mock with n results. Every seventh is in China,
+// so country filters have something to drop.
+func NewMockShodan(n int) *MockShodan {
+	m := &MockShodan{limiter: newRateLimiter()}
+	for i := range n {
+		r := ShodanResult{IPStr: fmt.Sprintf("11.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff), Port: 8000 + i%3}
+		r.Location.CountryCode = "US"
+		if i%7 == 0 {
+			r.Location.CountryCode = "CN"
+		}
+		m.Results = append(m.Results, r)
+	}
+	return m
+}
+
+// Requests returns how many searches the mock has answered.
+func (m *MockShodan) Requests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests
+}
+
+func (m *MockShodan) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/shodan/host/search" {
+		http.NotFound(w, r)
+		return
+	}
+	m.mu.Lock()
+	m.requests++
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("key") == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(ShodanResponse{Error: "Please provide a valid API key"})
+		return
+	}
+	if m.RPS > 0 {
+		if ok, _ := m.limiter.allow("", RateLimitConfig{RPS: m.RPS, Burst: 2}, time.Now()); !ok {
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(ShodanResponse{Error: "Rate limit reached (1/s)"})
+			return
+		}
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	switch m.Broken[page] {
+	case MockTruncated:
+		io.WriteString(w, `{"matches": [{"ip_str": "11.0.0.1", "po`)
+		return
+	case MockHTML:
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, "<html><body><h1>502 Bad Gateway</h1></body></html>")
+		return
+	case MockAPIError:
+		json.NewEncoder(w).Encode(ShodanResponse{Error: "The search request has timed out."})
+		return
+	}
+	start := min((page-1)*shodanPageSize, len(m.Results))
+	end := min(start+shodanPageSize, len(m.Results))
+	json.NewEncoder(w).Encode(ShodanResponse{Matches: m.Results[start:end], Total: len(m.Results)})
+}
@@ -0,0 +1,127 @@
+package roulette
+
+import (
+	"context"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ageSamplesMax = 10 // Files probe.age_samples may ask for per site
+
+// ageEarliest is the oldest Last-Modified believed. Servers with unset
+// clocks or files copied off old media claim 1970 and the like.
+var ageEarliest = time.Date(1991, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// SiteAgeStore is implemented by stores that keep an estimate of when each
+// site's files last changed.
+type SiteAgeStore interface {
+	// SetModified records the newest Last-Modified found on the sites in
+	// modified.
+	SetModified(modified map[int64]time.Time) error
+	// Modified returns every site's estimate by site ID.
+	Modified() (map[int64]time.Time, error)
+}
+
+// siteAges caches the stored estimates, since a dusty shuffle checks every
+// site in the pool against them. It's reloaded after every probe.
+type siteAges struct {
+	mu   sync.Mutex
+	of   map[int64]time.Time
+	once sync.Once // Loads the stored estimates before the first lookup
+}
+
+// sampleModified asks for the Last-Modified of up to n files the listing
+// body of the site at base links to, spread over the listing, and returns
+// the newest. It's zero if none of them say.
+func sampleModified(ctx context.Context, client *http.Client, base string, body []byte, n int) time.Time {
+	var files []string
+	for _, e := range listingEntries(base, body) {
+		if !strings.HasSuffix(e, "/") {
+			files = append(files, e)
+		}
+	}
+	var newest time.Time
+	for i := range min(n, len(files)) {
+		file := files[i*len(files)/min(n, len(files))]
+		u, err := neturl.JoinPath(base, file)
+		if err != nil {
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+		if err != nil {
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err != nil || resp.StatusCode != http.StatusOK || modified.Before(ageEarliest) || modified.After(time.Now()) {
+			continue
+		}
+		if modified.After(newest) {
+			newest = modified
+		}
+	}
+	return newest
+}
+
+// recordModified stores the estimates a probe run found and reloads the
+// cache.
+func (rl *Roulette) recordModified(modified map[int64]time.Time) {
+	store, ok := rl.store.(SiteAgeStore)
+	if !ok || len(modified) == 0 {
+		return
+	}
+	if err := store.SetModified(modified); err != nil {
+		probeLog.Error("Failed to record site ages", "err", err)
+		return
+	}
+	rl.loadSiteAges()
+}
+
+// loadSiteAges reads the stored estimates into the cache.
+func (rl *Roulette) loadSiteAges() {
+	store, ok := rl.store.(SiteAgeStore)
+	if !ok {
+		return
+	}
+	of, err := store.Modified()
+	if err != nil {
+		storeLog.Error("Failed to read site ages", "err", err)
+		return
+	}
+	rl.ages.mu.Lock()
+	rl.ages.of = of
+	rl.ages.mu.Unlock()
+}
+
+// siteModified returns when the site with the given ID last changed, as
+// far as its files tell.
+func (rl *Roulette) siteModified(id int64) (time.Time, bool) {
+	rl.ages.once.Do(rl.loadSiteAges)
+	rl.ages.mu.Lock()
+	defer rl.ages.mu.Unlock()
+	modified, ok := rl.ages.of[id]
+	return modified, ok
+}
+
+// dustyFilter returns a filter keeping the sites that look untouched for
+// Shuffle.DustyAfter, for dusty shuffles.
+func (rl *Roulette) dustyFilter() func(Site) bool {
+	rl.ages.once.Do(rl.loadSiteAges)
+	rl.ages.mu.Lock()
+	// Reloads replace the map rather than change it, so it can be read
+	// without the lock
+	of := rl.ages.of
+	rl.ages.mu.Unlock()
+	cutoff := time.Now().Add(-time.Duration(rl.Config().Shuffle.DustyAfter))
+	return func(s Site) bool {
+		modified, ok := of[s.ID]
+		return ok && modified.Before(cutoff)
+	}
+}
@@ -0,0 +1,138 @@
+package roulette
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const snapshotMaxBytes = 8 << 20 // Largest snapshots.max_bytes allowed
+
+// SnapshotsConfig keeps a compressed copy of each site's root listing
+// whenever a probe finds it up, shown on /admin/sites/{id}/info and, in proxy
+// mode, instead of the live listing while the site doesn't answer.
+type SnapshotsConfig struct {
+	// Enabled keeps the snapshots
+	Enabled bool `json:"enabled"`
+	// MaxBytes caps how much of a listing is kept, before compression.
+	// Longer listings are cut off.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+func (c SnapshotsConfig) validate() error {
+	if c.Enabled && (c.MaxBytes <= 0 || c.MaxBytes > snapshotMaxBytes) {
+		return fmt.Errorf("snapshots.max_bytes must be between 1 and %d", snapshotMaxBytes)
+	}
+	return nil
+}
+
+// Snapshot is the root listing of a site as a probe last found it.
+type Snapshot struct {
+	Body      []byte // Gzip compressed HTML
+	Truncated bool   // The listing was longer than snapshots.max_bytes
+	Taken     time.Time
+}
+
+// SnapshotStore is implemented by stores that keep site snapshots.
+type SnapshotStore interface {
+	// SetSnapshot replaces the site's snapshot.
+	SetSnapshot(siteID int64, s Snapshot) error
+	// Snapshot returns the site's snapshot, and false if it has none.
+	Snapshot(siteID int64) (Snapshot, bool, error)
+}
+
+// isHTML reports whether a Content-Type header value is for HTML.
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "text/html"
+}
+
+// saveSnapshot compresses and stores body, the start of the site's root
+// listing. Failures are logged.
+func (rl *Roulette) saveSnapshot(siteID int64, body []byte) {
+	store, ok := rl.store.(SnapshotStore)
+	if !ok {
+		return
+	}
+	snap := Snapshot{Taken: time.Now().UTC()}
+	if limit := rl.Config().Snapshots.MaxBytes; int64(len(body)) > limit {
+		body, snap.Truncated = body[:limit], true
+	}
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write(body)
+	if err := zw.Close(); err != nil {
+		probeLog.Error("Failed to compress snapshot", "site", siteID, "err", err)
+		return
+	}
+	snap.Body = b.Bytes()
+	if err := store.SetSnapshot(siteID, snap); err != nil {
+		probeLog.Error("Failed to store snapshot", "site", siteID, "err", err)
+	}
+}
+
+// siteSnapshot returns the site's snapshot, if snapshots are on and it has
+// one.
+func (rl *Roulette) siteSnapshot(siteID int64) (Snapshot, bool) {
+	store, ok := rl.store.(SnapshotStore)
+	if !ok || !rl.Config().Snapshots.Enabled {
+		return Snapshot{}, false
+	}
+	snap, ok, err := store.Snapshot(siteID)
+	if err != nil {
+		storeLog.Error("Failed to read snapshot", "site", siteID, "err", err)
+		return Snapshot{}, false
+	}
+	return snap, ok
+}
+
+// html returns the listing, uncompressed.
+func (s Snapshot) html() ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(s.Body))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(zr, snapshotMaxBytes))
+}
+
+// writeSnapshot serves snap under a note saying it's a cached copy, and
+// why if why isn't empty, sandboxed like proxied pages.
+func writeSnapshot(w http.ResponseWriter, snap Snapshot, why string) {
+	body, err := snap.html()
+	if err != nil {
+		http.Error(w, "Failed to read the cached copy", http.StatusInternalServerError)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Security-Policy", proxyContentSecurityPolicy)
+	header.Set("Cache-Control", "private, no-store")
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	note := "Cached copy from " + snap.Taken.Format("2006-01-02 15:04 MST") + why + "."
+	if snap.Truncated {
+		note += " Only the start of the listing was kept."
+	}
+	// Before the listing's own markup, browsers put it in the body anyway
+	fmt.Fprintf(w, "<p style=\"background:#ffe9a8;color:#000;padding:8px;margin:0\">%s</p>\n", html.EscapeString(note))
+	w.Write(body)
+}
+
+// snapshotHandler shows the snapshot of /admin/sites/{id}/snapshot.
+func (rl *Roulette) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	snap, ok := rl.siteSnapshot(id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeSnapshot(w, snap, "")
+}
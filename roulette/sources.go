@@ -0,0 +1,151 @@
+package roulette
+
+import (
+	"fmt"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// URLSource is a URL list merged into the pool alongside URLsFile. Only
+// URLsFile is rewritten by refreshes and imports, so lists kept here by
+// hand survive them.
+type URLSource struct {
+	// Path is a list file, or a directory whose *.txt files are each a list
+	Path string `json:"path,omitempty"`
+	// URL is a list fetched over HTTP instead, such as a shared gist. It's
+	// kept under DataDir between fetches, and sites removed from the pool
+	// come back unless they're also dropped upstream.
+	URL string `json:"url,omitempty"`
+	// Interval is how often URL is fetched, hourly if unset
+	Interval Duration `json:"interval,omitempty"`
+	// Tag is given to the sites of the source, by default the name of
+	// each file, or the last part of URL, without .txt
+	Tag string `json:"tag,omitempty"`
+}
+
+func (s URLSource) validate() error {
+	if (s.Path == "") == (s.URL == "") {
+		return fmt.Errorf("url_sources entries need either a path or a url")
+	}
+	if s.URL != "" {
+		if u, err := neturl.Parse(s.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("url_sources url %q must be an http or https URL", s.URL)
+		}
+	}
+	if s.Interval < 0 {
+		return fmt.Errorf("url_sources interval must not be negative")
+	}
+	return nil
+}
+
+// listFile is one URL list the pool is synced from.
+type listFile struct {
+	path   string
+	tag    string // Empty for URLsFile
+	remote bool   // path is the kept copy of a fetched list
+	// derived is whether path is the list alt ports found, only there
+	// once a refresh wrote it
+	derived bool
+}
+
+// listFiles returns URLsFile and the files of every source, in order.
+// Sources that can't be read are logged and left out.
+func (c *Config) listFiles() []listFile {
+	files := []listFile{{path: c.URLsFile}}
+	if c.AltPorts.Enabled {
+		files = append(files, listFile{path: c.derivedListPath(), tag: derivedTag, derived: true})
+	}
+	for _, src := range c.URLSources {
+		if src.URL != "" {
+			tag := src.Tag
+			if tag == "" {
+				tag = remoteListName(src.URL)
+			}
+			files = append(files, listFile{path: c.remoteListPath(src.URL), tag: normalizeTag(tag), remote: true})
+			continue
+		}
+		info, err := os.Stat(src.Path)
+		if err != nil {
+			syncLog.Warn("Skipping URL source", "path", src.Path, "err", err)
+			continue
+		}
+		paths := []string{src.Path}
+		if info.IsDir() {
+			// Glob sorts its matches, so the order is stable
+			paths, _ = filepath.Glob(filepath.Join(src.Path, "*.txt"))
+		}
+		for _, path := range paths {
+			tag := src.Tag
+			if tag == "" {
+				tag = strings.TrimSuffix(filepath.Base(path), ".txt")
+			}
+			files = append(files, listFile{path: path, tag: normalizeTag(tag)})
+		}
+	}
+	return files
+}
+
+// readLists reads every URL list. It returns the URLs in order, the tags
+// the sources give them and the lists' stamp, taken before reading so
+// edits made meanwhile are synced again.
+func (rl *Roulette) readLists() (urls []string, tags map[string][]string, stamp listStamp, err error) {
+	tags = make(map[string][]string)
+	for i, f := range rl.Config().listFiles() {
+		file, err := os.Open(f.path)
+		if err != nil {
+			if (f.remote || f.derived) && os.IsNotExist(err) {
+				continue // Not fetched or found yet
+			}
+			if i == 0 {
+				return nil, nil, "", fmt.Errorf("failed to open the URL list: %v", err)
+			}
+			syncLog.Warn("Skipping URL source", "path", f.path, "err", err)
+			continue
+		}
+		if info, err := file.Stat(); err == nil {
+			stamp += stampOf(f.path, info)
+		}
+		found, err := ReadURLs(file)
+		file.Close()
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("failed to read %s: %v", f.path, err)
+		}
+		for _, url := range found {
+			tags[url] = addTag(tags[url], f.tag)
+		}
+		urls = append(urls, found...)
+	}
+	return urls, tags, stamp, nil
+}
+
+// dropFromLists rewrites each URL list that has URLs drop matches without
+// them. Fetched lists are left alone, the next fetch would undo it.
+func (rl *Roulette) dropFromLists(drop func(url string) bool) error {
+	for i, f := range rl.Config().listFiles() {
+		if f.remote {
+			continue
+		}
+		urls, err := ReadURLsFile(f.path)
+		if err != nil {
+			if (i == 0 || f.derived) && os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		keep := urls[:0:0]
+		for _, url := range urls {
+			if !drop(url) {
+				keep = append(keep, url)
+			}
+		}
+		if len(keep) == len(urls) {
+			continue
+		}
+		if err := WriteURLsFile(f.path, keep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package roulette
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const statsQueueSize = 10000               // Visits buffered before new ones are dropped
+const statsFlushInterval = 5 * time.Second // Longest a visit waits to be written
+const statsBatchSize = 500                 // Distinct site and day counts written per batch
+
+// SiteVisits is how many visitors were sent to one site on one day.
+type SiteVisits struct {
+	SiteID int64
+	Day    string // UTC, as 2006-01-02
+	Count  int
+}
+
+// StatsStore is implemented by stores that keep visit statistics.
+type StatsStore interface {
+	// AddVisits adds each count to its site's total for the day.
+	AddVisits(counts []SiteVisits) error
+	// TopVisits returns the sites' totals from fromDay on, most visited
+	// first, with Day left empty. Limit 0 returns all of them.
+	TopVisits(fromDay string, limit int) ([]SiteVisits, error)
+}
+
+// StatsCounters account for the visit statistics queue.
+type StatsCounters struct {
+	Written int64 `json:"written"` // Visits written to the store
+	Dropped int64 `json:"dropped"` // Visits lost because the queue was full
+	Failed  int64 `json:"failed"`  // Visits lost because the store failed
+}
+
+// visit is one visitor sent to a site, as queued for the stats writer.
+type visit struct {
+	site Site
+	spin bool // Also count it in the analytics
+}
+
+// statsQueue takes visits off the redirect path: recording one is a
+// channel send that never blocks, a background writer adds them up and
+// writes them in batches. When the writer falls behind, visits are
+// dropped and counted rather than slowing visitors down.
+type statsQueue struct {
+	store     StatsStore
+	analytics AnalyticsStore          // Nil if the store keeps no spin counters
+	country   func(url string) string // Country of a site, looked up by the writer
+	visits    chan visit
+	stop      chan struct{}
+	done      chan struct{}
+
+	written, dropped, failed atomic.Int64
+	reported                 int64 // Drops already logged, only used by the writer
+}
+
+// startStats starts the queue if the store keeps statistics.
+func (rl *Roulette) startStats() {
+	store, ok := rl.store.(StatsStore)
+	if !ok {
+		return
+	}
+	q := &statsQueue{
+		store:   store,
+		country: rl.countryOf,
+		visits:  make(chan visit, statsQueueSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	q.analytics, _ = rl.store.(AnalyticsStore)
+	rl.stats = q
+	go q.run()
+}
+
+// recordVisit counts a visitor sent to site.
+func (rl *Roulette) recordVisit(site Site) {
+	q := rl.stats
+	if q == nil {
+		return
+	}
+	select {
+	case q.visits <- visit{site: site, spin: rl.Config().Analytics.Enabled}:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// StatsCounters returns the queue's counts, zero if statistics aren't kept.
+func (rl *Roulette) StatsCounters() StatsCounters {
+	q := rl.stats
+	if q == nil {
+		return StatsCounters{}
+	}
+	return StatsCounters{Written: q.written.Load(), Dropped: q.dropped.Load(), Failed: q.failed.Load()}
+}
+
+// close writes the queued visits and stops the writer.
+func (q *statsQueue) close() {
+	close(q.stop)
+	<-q.done
+}
+
+func (q *statsQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	counts := make(map[SiteVisits]int) // Keyed with Count 0
+	spins := make(map[SpinCount]int)   // Likewise
+	add := func(v visit) {
+		now := time.Now().UTC()
+		counts[SiteVisits{SiteID: v.site.ID, Day: now.Format("2006-01-02")}]++
+		if v.spin && q.analytics != nil {
+			spins[SpinCount{Hour: now.Format(analyticsHourFormat), Country: q.country(v.site.URL)}]++
+		}
+		if len(counts)+len(spins) >= statsBatchSize {
+			q.flush(counts, spins)
+		}
+	}
+	for {
+		select {
+		case v := <-q.visits:
+			add(v)
+		case <-ticker.C:
+			q.flush(counts, spins)
+		case <-q.stop:
+			// Take what was queued before stopping
+			for {
+				select {
+				case v := <-q.visits:
+					add(v)
+				default:
+					q.flush(counts, spins)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush writes counts and spins and empties them.
+func (q *statsQueue) flush(counts map[SiteVisits]int, spins map[SpinCount]int) {
+	if dropped := q.dropped.Load(); dropped > q.reported {
+		storeLog.Warn("Dropped visits, the stats queue was full", "count", dropped-q.reported)
+		q.reported = dropped
+	}
+	if len(spins) > 0 {
+		batch := make([]SpinCount, 0, len(spins))
+		for key, n := range spins {
+			key.Count = n
+			batch = append(batch, key)
+		}
+		clear(spins)
+		if err := q.analytics.AddSpins(batch); err != nil {
+			storeLog.Error("Failed to record spins", "count", len(batch), "err", err)
+		}
+	}
+	if len(counts) == 0 {
+		return
+	}
+	batch := make([]SiteVisits, 0, len(counts))
+	total := 0
+	for key, n := range counts {
+		key.Count = n
+		batch = append(batch, key)
+		total += n
+	}
+	clear(counts)
+	if err := q.store.AddVisits(batch); err != nil {
+		storeLog.Error("Failed to record visits", "count", total, "err", err)
+		q.failed.Add(int64(total))
+		return
+	}
+	q.written.Add(int64(total))
+}
@@ -0,0 +1,179 @@
+package roulette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoSites is returned by SiteStore.Random when no site matches.
+var ErrNoSites = errors.New("no sites available")
+
+// MemoryStorePath selects the pure Go in-memory store instead of SQLite.
+const MemoryStorePath = "memory:"
+
+// Site statuses recorded by the prober
+const (
+	StatusUnknown = "unknown"
+	StatusUp      = "up"
+	StatusDown    = "down"
+)
+
+// Site is one entry in the pool.
+type Site struct {
+	ID          int64
+	URL         string
+	Host        string
+	Port        int
+	Status      string
+	LastChecked time.Time // Zero if the site was never probed
+}
+
+// SiteFilter narrows the sites returned by Random and List. The zero value
+// matches every site.
+type SiteFilter struct {
+	Status string // Only sites with this probe status
+	Ports  []int  // Only sites on one of these ports
+}
+
+// SiteStore keeps the pool of sites.
+type SiteStore interface {
+	// Add inserts a site for url unless it is already present.
+	Add(url string) error
+	// Remove deletes the site for url, if any.
+	Remove(url string) error
+	// Random picks a site matching filter, each with a chance proportional
+	// to weight(status). It returns ErrNoSites when nothing has positive weight.
+	Random(filter SiteFilter, weight func(status string) float64) (Site, error)
+	// List returns the sites matching filter in insertion order.
+	List(filter SiteFilter) ([]Site, error)
+	// Site returns the site with id, or errNoSuchSite if there is none.
+	Site(id int64) (Site, error)
+	// UpdateStatus records a probe result.
+	UpdateStatus(id int64, status string, checked time.Time) error
+	// Ping checks that the store is usable.
+	Ping(ctx context.Context) error
+	// Close releases the store's resources.
+	Close() error
+}
+
+// BatchStore is implemented by stores that can add many sites at once
+// faster than one Add at a time.
+type BatchStore interface {
+	// InsertBatch adds sites for the URLs of sites that aren't already
+	// present. Host and port are filled in from the URL.
+	InsertBatch(sites []Site) error
+}
+
+// StatusUpdate is one probe result for UpdateStatuses.
+type StatusUpdate struct {
+	ID      int64
+	Status  string
+	Checked time.Time
+}
+
+// StatusBatchStore is implemented by stores that can record many probe
+// results in one transaction.
+type StatusBatchStore interface {
+	// UpdateStatuses records all of updates, or none of them.
+	UpdateStatuses(updates []StatusUpdate) error
+}
+
+// Locker is implemented by stores that several instances can share. It
+// hands out named, expiring leases so that only one instance at a time
+// runs each background job. Stores without it are assumed to belong to a
+// single instance.
+type Locker interface {
+	// AcquireLease takes or renews the lease called name for holder until
+	// ttl from now. It reports false while another holder's lease is live.
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives up holder's lease on name, if it still has it.
+	ReleaseLease(name, holder string) error
+}
+
+// User is a visitor account created by logging in through an OAuth
+// provider.
+type User struct {
+	ID       int64
+	Provider string // Config name of the provider the account belongs to
+	Subject  string // The provider's stable ID for the account
+	Name     string // Display name, refreshed on every login
+	Created  time.Time
+}
+
+// UserStore is implemented by stores that can keep visitor accounts.
+type UserStore interface {
+	// UpsertUser returns the account for provider and subject, creating it
+	// on first login and updating its name otherwise.
+	UpsertUser(provider, subject, name string) (User, error)
+	// User returns the account with the given ID.
+	User(id int64) (User, error)
+}
+
+// Takedown request statuses
+const (
+	TakedownPending  = "pending"
+	TakedownApproved = "approved"
+	TakedownRejected = "rejected"
+)
+
+// Takedown is a request from a host's owner to be removed from the pool.
+type Takedown struct {
+	ID       int64
+	Host     string
+	Contact  string
+	Reason   string
+	Status   string
+	Created  time.Time
+	Resolved time.Time // Zero while pending
+}
+
+// ModerationStore is implemented by stores that keep the takedown queue
+// and the denylist of hosts that must never be added again.
+type ModerationStore interface {
+	// AddTakedown queues a takedown request.
+	AddTakedown(host, contact, reason string) (Takedown, error)
+	// Takedowns lists requests with the given status, or all for "",
+	// oldest first.
+	Takedowns(status string) ([]Takedown, error)
+	// ResolveTakedown approves or rejects a pending request.
+	ResolveTakedown(id int64, status string) (Takedown, error)
+	// Deny adds host to the denylist.
+	Deny(host, reason string) error
+	// Denylist returns every denied host.
+	Denylist() ([]string, error)
+}
+
+// OpenStore opens the store at path: MemoryStorePath for the pure Go
+// in-memory store, anything else is a SQLite database. If the default
+// MemoryDB can't be opened, as in a binary built without cgo, the in-memory
+// store is used instead; a configured database file that can't be opened is
+// an error, so persistence never disappears silently.
+func OpenStore(path string) (SiteStore, error) {
+	if path == MemoryStorePath {
+		return NewMemoryStore(), nil
+	}
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		if path != MemoryDB {
+			return nil, fmt.Errorf("failed to open database %s: %v", path, err)
+		}
+		storeLog.Error("Failed to open database, falling back to in-memory storage", "path", path, "err", err)
+		return NewMemoryStore(), nil
+	}
+	return s, nil
+}
+
+// matchesPorts reports whether port is allowed by a SiteFilter port list.
+func matchesPorts(ports []int, port int) bool {
+	if len(ports) == 0 {
+		return true
+	}
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package roulette
+
+import (
+	"fmt"
+	"strings"
+)
+
+// hotQuery is a query run per request or per site, which must not scan
+// a whole table.
+type hotQuery struct {
+	name  string
+	query string
+	args  []interface{}
+}
+
+// hotQueries returns the filtered queries /shuffle, sync and login run,
+// built the same way those paths build them.
+func (s *sqliteStore) hotQueries() []hotQuery {
+	var queries []hotQuery
+	for _, f := range []struct {
+		name   string
+		filter SiteFilter
+	}{
+		{"status filter", SiteFilter{Status: StatusUp}},
+		{"port filter", SiteFilter{Ports: []int{8000, 8080}}},
+		{"status and port filter", SiteFilter{Status: StatusUp, Ports: []int{8000}}},
+	} {
+		where, args := s.where(f.filter)
+		queries = append(queries,
+			hotQuery{f.name + " counts", "SELECT status, COUNT(*) FROM sites" + where + " GROUP BY status", args},
+			hotQuery{f.name + " pick", "SELECT id, url, host, port, status, last_checked FROM sites" + where + " LIMIT 1 OFFSET ?", append(args, 0)},
+		)
+	}
+	return append(queries,
+		hotQuery{"site by URL", "SELECT 1 FROM sites WHERE url = ?", []interface{}{""}},
+		hotQuery{"verdict by URL", "SELECT threat, checked_at FROM url_verdicts WHERE url = ?", []interface{}{""}},
+		hotQuery{"login failures", "SELECT COUNT(*) FROM login_failures WHERE key = ? AND failed_at >= ?", []interface{}{"", ""}},
+	)
+}
+
+// adviseIndexes asks SQLite how it would run the hot queries and warns
+// about any that would scan a whole table, which means a filter was added
+// without an index to serve it.
+func (s *sqliteStore) adviseIndexes() {
+	for _, q := range s.hotQueries() {
+		scans, err := s.fullScans(q.query, q.args...)
+		if err != nil {
+			storeLog.Error("Failed to check the query plan", "query", q.name, "err", err)
+			continue
+		}
+		for _, scan := range scans {
+			storeLog.Warn("Query reads a whole table, add an index for it", "query", q.name, "table", scan)
+		}
+	}
+}
+
+// fullScans returns the tables query's plan reads in full.
+func (s *sqliteStore) fullScans(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var scans []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			return nil, fmt.Errorf("failed to scan query plan: %v", err)
+		}
+		// Scans through an index are fine, "SCAN sites" alone reads every row
+		if strings.HasPrefix(detail, "SCAN ") && !strings.Contains(detail, " INDEX ") {
+			scans = append(scans, strings.TrimPrefix(detail, "SCAN "))
+		}
+	}
+	return scans, rows.Err()
+}
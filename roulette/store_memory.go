@@ -0,0 +1,907 @@
+package roulette
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore is a SiteStore kept entirely in process memory. It needs no
+// cgo and is used when SQLite isn't available.
+type memoryStore struct {
+	mu     sync.RWMutex
+	nextID int64
+	sites  []Site // In insertion order
+	byURL  map[string]int
+	byID   map[int64]int
+	users  []User // Indexed by ID-1
+
+	takedowns []Takedown // Indexed by ID-1
+	denylist  map[string]string
+	verdicts  map[string]Verdict
+
+	audit       []AuditEntry // Oldest first
+	nextAuditID int64
+
+	bans      []Ban
+	nextBanID int64
+
+	apiKeys  []APIKey
+	apiUsage map[string]int // By key ID and day
+
+	loginFailures map[string][]time.Time // Oldest first
+
+	visits map[SiteVisits]int // Keyed with Count 0
+	spins  map[SpinCount]int  // Likewise
+
+	refreshes     []RefreshReport // Oldest first
+	nextRefreshID int64
+
+	events      []SiteEvent // Oldest first
+	nextEventID int64
+
+	tags   map[int64]map[string][]string // By site ID and origin
+	hashes map[int64]string              // Content hashes by site ID
+	ages   map[int64]time.Time           // Newest sampled Last-Modified by site ID
+	listed map[int64][]string            // Crawled listings by site ID
+	snaps  map[int64]Snapshot            // Listing snapshots by site ID
+	votes  map[int64][]Vote              // Verify votes by site ID, oldest first
+
+	tagRules      []TagRule // Oldest first
+	nextTagRuleID int64
+	banners       map[int64]Banner // By site ID
+
+	subscribers      []Subscriber
+	nextSubscriberID int64
+
+	favorites map[string][]Favorite // By visitor key, oldest first
+
+	ipCountries map[string]IPCountry
+}
+
+// NewMemoryStore returns an empty in-memory SiteStore.
+func NewMemoryStore() SiteStore {
+	return &memoryStore{nextID: 1, byURL: make(map[string]int), byID: make(map[int64]int), denylist: make(map[string]string), verdicts: make(map[string]Verdict), apiUsage: make(map[string]int), loginFailures: make(map[string][]time.Time), visits: make(map[SiteVisits]int), spins: make(map[SpinCount]int), tags: make(map[int64]map[string][]string), hashes: make(map[int64]string), ages: make(map[int64]time.Time), listed: make(map[int64][]string), snaps: make(map[int64]Snapshot), votes: make(map[int64][]Vote), banners: make(map[int64]Banner), favorites: make(map[string][]Favorite), ipCountries: make(map[string]IPCountry)}
+}
+
+func (s *memoryStore) PurgeBefore(cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	// Audit entries are appended in time order
+	old := 0
+	for old < len(s.audit) && s.audit[old].Time.Before(cutoff) {
+		old++
+	}
+	s.audit = append([]AuditEntry(nil), s.audit[old:]...)
+	n += int64(old)
+	day := cutoff.UTC().Format("2006-01-02")
+	for k := range s.apiUsage {
+		if k[strings.LastIndex(k, "/")+1:] < day {
+			delete(s.apiUsage, k)
+			n++
+		}
+	}
+	for i, t := range s.takedowns {
+		if t.Status != TakedownPending && t.Resolved.Before(cutoff) && t.Contact != "" {
+			s.takedowns[i].Contact, s.takedowns[i].Reason = "", ""
+			n++
+		}
+	}
+	subscribers := len(s.subscribers)
+	s.subscribers = slices.DeleteFunc(s.subscribers, func(sub Subscriber) bool {
+		return !sub.Confirmed && sub.Created.Before(cutoff)
+	})
+	n += int64(subscribers - len(s.subscribers))
+	return n, nil
+}
+
+func (s *memoryStore) AddLoginFailure(key string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loginFailures[key] = append(s.loginFailures[key], t)
+	return nil
+}
+
+func (s *memoryStore) LoginFailures(key string, since time.Time) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, t := range s.loginFailures[key] {
+		if !t.Before(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) ClearLoginFailures(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.loginFailures, key)
+	return nil
+}
+
+func (s *memoryStore) PruneLoginFailures(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, times := range s.loginFailures {
+		old := 0
+		for old < len(times) && times[old].Before(before) {
+			old++
+		}
+		if old == len(times) {
+			delete(s.loginFailures, key)
+		} else {
+			s.loginFailures[key] = times[old:]
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AddBan(b Ban) (Ban, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextBanID++
+	b.ID = s.nextBanID
+	s.bans = append(s.bans, b)
+	return b, nil
+}
+
+func (s *memoryStore) Bans() ([]Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Ban(nil), s.bans...), nil
+}
+
+func (s *memoryStore) RemoveBan(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range s.bans {
+		if b.ID == id {
+			s.bans = append(s.bans[:i], s.bans[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no ban with ID %d", id)
+}
+
+func (s *memoryStore) AddAudit(e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextAuditID++
+	e.ID = s.nextAuditID
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *memoryStore) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []AuditEntry
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		e := s.audit[i]
+		if filter.Before > 0 && e.ID >= filter.Before {
+			continue
+		}
+		if (filter.Actor != "" && e.Actor != filter.Actor) || (filter.Action != "" && e.Action != filter.Action) {
+			continue
+		}
+		entries = append(entries, e)
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) AddRefreshReport(r RefreshReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextRefreshID++
+	r.ID = s.nextRefreshID
+	s.refreshes = append(s.refreshes, r)
+	if len(s.refreshes) > refreshHistoryKeep {
+		s.refreshes = append([]RefreshReport(nil), s.refreshes[len(s.refreshes)-refreshHistoryKeep:]...)
+	}
+	return nil
+}
+
+func (s *memoryStore) RefreshReports(limit int) ([]RefreshReport, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var reports []RefreshReport
+	for i := len(s.refreshes) - 1; i >= 0 && (limit <= 0 || len(reports) < limit); i-- {
+		reports = append(reports, s.refreshes[i])
+	}
+	return reports, nil
+}
+
+func (s *memoryStore) AddSiteEvents(events []SiteEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		s.nextEventID++
+		e.ID = s.nextEventID
+		s.events = append(s.events, e)
+	}
+	return nil
+}
+
+func (s *memoryStore) SiteEvents(siteID int64) ([]SiteEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var events []SiteEvent
+	for _, e := range s.events {
+		if e.SiteID == siteID {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) SiteEventsSince(since time.Time) ([]SiteEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var events []SiteEvent
+	for _, e := range s.events {
+		if !e.Time.Before(since) {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *memoryStore) AddSubscriber(email, token string, created time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.subscribers {
+		if sub.Email == email {
+			if sub.Confirmed {
+				return true, nil
+			}
+			s.subscribers[i].Token, s.subscribers[i].Created = token, created
+			return false, nil
+		}
+	}
+	s.nextSubscriberID++
+	s.subscribers = append(s.subscribers, Subscriber{ID: s.nextSubscriberID, Email: email, Token: token, Created: created})
+	return false, nil
+}
+
+func (s *memoryStore) AddFavorite(visitor string, f Favorite) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, have := range s.favorites[visitor] {
+		if have.Playlist == f.Playlist && have.URL == f.URL {
+			return nil
+		}
+	}
+	s.favorites[visitor] = append(s.favorites[visitor], f)
+	return nil
+}
+
+func (s *memoryStore) RemoveFavorite(visitor, playlist, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.favorites[visitor] = slices.DeleteFunc(s.favorites[visitor], func(f Favorite) bool {
+		return f.Playlist == playlist && f.URL == url
+	})
+	if len(s.favorites[visitor]) == 0 {
+		delete(s.favorites, visitor)
+	}
+	return nil
+}
+
+func (s *memoryStore) Favorites(visitor string) ([]Favorite, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	favorites := slices.Clone(s.favorites[visitor])
+	// Stable, so each playlist stays oldest first
+	slices.SortStableFunc(favorites, func(a, b Favorite) int { return strings.Compare(a.Playlist, b.Playlist) })
+	return favorites, nil
+}
+
+func (s *memoryStore) ConfirmSubscriber(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.subscribers {
+		if sub.Token == token {
+			s.subscribers[i].Confirmed = true
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) RemoveSubscriber(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sub := range s.subscribers {
+		if sub.Token == token {
+			s.subscribers = slices.Delete(s.subscribers, i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) Subscribers() ([]Subscriber, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var confirmed []Subscriber
+	for _, sub := range s.subscribers {
+		if sub.Confirmed {
+			confirmed = append(confirmed, sub)
+		}
+	}
+	return confirmed, nil
+}
+
+func (s *memoryStore) PruneSubscribers(cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	before := len(s.subscribers)
+	s.subscribers = slices.DeleteFunc(s.subscribers, func(sub Subscriber) bool {
+		return !sub.Confirmed && sub.Created.Before(cutoff)
+	})
+	return int64(before - len(s.subscribers)), nil
+}
+
+func (s *memoryStore) AddAPIKey(k APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiKeys = append(s.apiKeys, k)
+	return nil
+}
+
+func (s *memoryStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.apiKeys {
+		if k.Hash == hash {
+			return k, true, nil
+		}
+	}
+	return APIKey{}, false, nil
+}
+
+func (s *memoryStore) APIKeys() ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]APIKey(nil), s.apiKeys...), nil
+}
+
+func (s *memoryStore) RevokeAPIKey(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.apiKeys {
+		if k.ID == id {
+			s.apiKeys[i].Revoked = true
+			return nil
+		}
+	}
+	return fmt.Errorf("no API key with ID %q", id)
+}
+
+func (s *memoryStore) CountAPIUse(id, day string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apiUsage[id+"/"+day]++
+	return s.apiUsage[id+"/"+day], nil
+}
+
+func (s *memoryStore) APIUse(id, day string) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.apiUsage[id+"/"+day], nil
+}
+
+func (s *memoryStore) Verdict(url string) (Verdict, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.verdicts[url]
+	return v, ok, nil
+}
+
+func (s *memoryStore) SaveVerdict(v Verdict) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verdicts[v.URL] = v
+	return nil
+}
+
+func (s *memoryStore) IPCountries() (map[string]IPCountry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.ipCountries), nil
+}
+
+func (s *memoryStore) SaveIPCountry(c IPCountry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ipCountries[c.IP] = c
+	return nil
+}
+
+func (s *memoryStore) AddTakedown(host, contact, reason string) (Takedown, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := Takedown{
+		ID:      int64(len(s.takedowns) + 1),
+		Host:    host,
+		Contact: contact,
+		Reason:  reason,
+		Status:  TakedownPending,
+		Created: time.Now(),
+	}
+	s.takedowns = append(s.takedowns, t)
+	return t, nil
+}
+
+func (s *memoryStore) Takedowns(status string) ([]Takedown, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Takedown
+	for _, t := range s.takedowns {
+		if status == "" || t.Status == status {
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryStore) ResolveTakedown(id int64, status string) (Takedown, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || id > int64(len(s.takedowns)) || s.takedowns[id-1].Status != TakedownPending {
+		return Takedown{}, fmt.Errorf("no pending takedown with ID %d", id)
+	}
+	s.takedowns[id-1].Status = status
+	s.takedowns[id-1].Resolved = time.Now()
+	return s.takedowns[id-1], nil
+}
+
+func (s *memoryStore) Deny(host, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.denylist[host] = reason
+	return nil
+}
+
+func (s *memoryStore) Denylist() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hosts := make([]string, 0, len(s.denylist))
+	for host := range s.denylist {
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func (s *memoryStore) UpsertUser(provider, subject, name string) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, u := range s.users {
+		if u.Provider == provider && u.Subject == subject {
+			s.users[i].Name = name
+			return s.users[i], nil
+		}
+	}
+	u := User{ID: int64(len(s.users) + 1), Provider: provider, Subject: subject, Name: name, Created: time.Now()}
+	s.users = append(s.users, u)
+	return u, nil
+}
+
+func (s *memoryStore) User(id int64) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id < 1 || id > int64(len(s.users)) {
+		return User{}, fmt.Errorf("no user with ID %d", id)
+	}
+	return s.users[id-1], nil
+}
+
+func (s *memoryStore) Add(url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add(url)
+	return nil
+}
+
+func (s *memoryStore) InsertBatch(sites []Site) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, site := range sites {
+		s.add(site.URL)
+	}
+	return nil
+}
+
+// add inserts url unless present. The caller holds mu.
+func (s *memoryStore) add(url string) {
+	if _, ok := s.byURL[url]; ok {
+		return
+	}
+	host, port := splitHostPort(url)
+	s.byURL[url] = len(s.sites)
+	s.byID[s.nextID] = len(s.sites)
+	s.sites = append(s.sites, Site{ID: s.nextID, URL: url, Host: host, Port: port, Status: StatusUnknown})
+	s.nextID++
+}
+
+func (s *memoryStore) Remove(url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, ok := s.byURL[url]
+	if !ok {
+		return nil
+	}
+	id := s.sites[i].ID
+	delete(s.tags, id)
+	delete(s.hashes, id)
+	delete(s.ages, id)
+	delete(s.listed, id)
+	delete(s.snaps, id)
+	delete(s.votes, id)
+	delete(s.banners, id)
+	s.sites = append(s.sites[:i], s.sites[i+1:]...)
+	delete(s.byURL, url)
+	delete(s.byID, id)
+	// Everything after the removed site moved down one slot
+	for j := i; j < len(s.sites); j++ {
+		s.byURL[s.sites[j].URL] = j
+		s.byID[s.sites[j].ID] = j
+	}
+	return nil
+}
+
+func (s *memoryStore) matches(site Site, filter SiteFilter) bool {
+	if filter.Status != "" && site.Status != filter.Status {
+		return false
+	}
+	return matchesPorts(filter.Ports, site.Port)
+}
+
+func (s *memoryStore) Random(filter SiteFilter, weight func(status string) float64) (Site, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	total := 0.0
+	for _, site := range s.sites {
+		if s.matches(site, filter) {
+			total += weight(site.Status)
+		}
+	}
+	if total <= 0 {
+		return Site{}, ErrNoSites
+	}
+
+	r := rand.Float64() * total
+	var last Site
+	for _, site := range s.sites {
+		if !s.matches(site, filter) {
+			continue
+		}
+		w := weight(site.Status)
+		if w <= 0 {
+			continue
+		}
+		if r < w {
+			return site, nil
+		}
+		r -= w
+		last = site
+	}
+	// Floating point rounding can leave a sliver past the last site
+	return last, nil
+}
+
+func (s *memoryStore) List(filter SiteFilter) ([]Site, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var sites []Site
+	for _, site := range s.sites {
+		if s.matches(site, filter) {
+			sites = append(sites, site)
+		}
+	}
+	return sites, nil
+}
+
+func (s *memoryStore) Site(id int64) (Site, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.byID[id]
+	if !ok {
+		return Site{}, errNoSuchSite
+	}
+	return s.sites[i], nil
+}
+
+func (s *memoryStore) UpdateStatus(id int64, status string, checked time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i, ok := s.byID[id]; ok {
+		s.sites[i].Status = status
+		s.sites[i].LastChecked = checked
+	}
+	return nil
+}
+
+func (s *memoryStore) AddVisits(counts []SiteVisits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range counts {
+		n := c.Count
+		c.Count = 0
+		s.visits[c] += n
+	}
+	return nil
+}
+
+func (s *memoryStore) TopVisits(fromDay string, limit int) ([]SiteVisits, error) {
+	s.mu.RLock()
+	totals := make(map[int64]int)
+	for v, n := range s.visits {
+		if v.Day >= fromDay {
+			totals[v.SiteID] += n
+		}
+	}
+	s.mu.RUnlock()
+	top := make([]SiteVisits, 0, len(totals))
+	for id, n := range totals {
+		top = append(top, SiteVisits{SiteID: id, Count: n})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].SiteID < top[j].SiteID
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top, nil
+}
+
+func (s *memoryStore) AddSpins(counts []SpinCount) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range counts {
+		n := c.Count
+		c.Count = 0
+		s.spins[c] += n
+	}
+	return nil
+}
+
+func (s *memoryStore) Spins(fromHour string) ([]SpinCount, error) {
+	s.mu.RLock()
+	var counts []SpinCount
+	for c, n := range s.spins {
+		if c.Hour >= fromHour {
+			c.Count = n
+			counts = append(counts, c)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Hour != counts[j].Hour {
+			return counts[i].Hour < counts[j].Hour
+		}
+		return counts[i].Country < counts[j].Country
+	})
+	return counts, nil
+}
+
+func (s *memoryStore) ReplaceTags(origin string, tags map[int64][]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, origins := range s.tags {
+		delete(origins, origin)
+		if len(origins) == 0 {
+			delete(s.tags, id)
+		}
+	}
+	for id, t := range tags {
+		if len(t) == 0 {
+			continue
+		}
+		if s.tags[id] == nil {
+			s.tags[id] = make(map[string][]string)
+		}
+		s.tags[id][origin] = slices.Clone(t)
+	}
+	return nil
+}
+
+func (s *memoryStore) SiteTags(siteID int64) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mergedTags(siteID), nil
+}
+
+func (s *memoryStore) AllTags() (map[int64][]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := make(map[int64][]string, len(s.tags))
+	for id := range s.tags {
+		all[id] = s.mergedTags(id)
+	}
+	return all, nil
+}
+
+// mergedTags returns the site's tags from every origin, sorted. The caller
+// holds mu.
+func (s *memoryStore) mergedTags(id int64) []string {
+	var merged []string
+	for _, t := range s.tags[id] {
+		for _, tag := range t {
+			merged = addTag(merged, tag)
+		}
+	}
+	slices.Sort(merged)
+	return merged
+}
+
+func (s *memoryStore) SetContentHashes(hashes map[int64]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, hash := range hashes {
+		if hash == "" {
+			delete(s.hashes, id)
+		} else {
+			s.hashes[id] = hash
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ContentHashes() (map[int64]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.hashes), nil
+}
+
+func (s *memoryStore) SetModified(modified map[int64]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, m := range modified {
+		s.ages[id] = m
+	}
+	return nil
+}
+
+func (s *memoryStore) Modified() (map[int64]time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.ages), nil
+}
+
+func (s *memoryStore) SetSnapshot(siteID int64, snap Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snaps[siteID] = snap
+	return nil
+}
+
+func (s *memoryStore) Snapshot(siteID int64) (Snapshot, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	snap, ok := s.snaps[siteID]
+	return snap, ok, nil
+}
+
+func (s *memoryStore) AddVote(v Vote) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	votes := slices.DeleteFunc(s.votes[v.SiteID], func(old Vote) bool { return old.UserID == v.UserID })
+	s.votes[v.SiteID] = append(votes, v)
+	return nil
+}
+
+func (s *memoryStore) Votes() (map[int64][]Vote, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	votes := make(map[int64][]Vote, len(s.votes))
+	for id, v := range s.votes {
+		votes[id] = slices.Clone(v)
+	}
+	return votes, nil
+}
+
+func (s *memoryStore) AddTagRule(r TagRule) (TagRule, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextTagRuleID++
+	r.ID = s.nextTagRuleID
+	s.tagRules = append(s.tagRules, r)
+	return r, nil
+}
+
+func (s *memoryStore) TagRules() ([]TagRule, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.tagRules), nil
+}
+
+func (s *memoryStore) RemoveTagRule(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.tagRules {
+		if r.ID == id {
+			s.tagRules = slices.Delete(s.tagRules, i, i+1)
+			return nil
+		}
+	}
+	return fmt.Errorf("no tag rule with ID %d", id)
+}
+
+func (s *memoryStore) SetBanners(banners map[int64]Banner) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	maps.Copy(s.banners, banners)
+	return nil
+}
+
+func (s *memoryStore) Banners() (map[int64]Banner, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.banners), nil
+}
+
+func (s *memoryStore) Inventory(siteID int64) ([]string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, ok := s.listed[siteID]
+	return slices.Clone(entries), ok, nil
+}
+
+func (s *memoryStore) SetInventory(siteID int64, entries []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listed[siteID] = slices.Clone(entries)
+	return nil
+}
+
+func (s *memoryStore) Search(q SiteQuery) ([]Site, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var sites []Site
+	for _, site := range s.sites {
+		tags := s.mergedTags(site.ID)
+		ok := true
+		for _, t := range q {
+			if t.Field != SearchCountry && !t.matches(site, tags, "") {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			sites = append(sites, site)
+		}
+	}
+	return sites, nil
+}
+
+func (s *memoryStore) UpdateStatuses(updates []StatusUpdate) error {
+	for _, u := range updates {
+		s.UpdateStatus(u.ID, u.Status, u.Checked)
+	}
+	return nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
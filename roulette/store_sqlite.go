@@ -0,0 +1,1686 @@
+package roulette
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const retryCount = 5
+const retryDelay = time.Millisecond * 100 // Delay between retries if the database is locked
+const queryTimeout = 5 * time.Second      // Longest a query may take, so a stuck one can't hang a request
+
+// Connection pool limits for database files. SQLite serializes writers,
+// more connections only help concurrent reads.
+const sqliteMaxOpenConns = 8
+const sqliteConnMaxLifetime = time.Hour
+
+// MemoryDB is the default database: a shared in-memory SQLite database
+// that lives as long as the process.
+const MemoryDB = "file::memory:?cache=shared"
+
+// migrations upgrade the schema one step at a time. The schema version
+// stored in PRAGMA user_version is the number of migrations applied.
+var migrations = []string{
+	// Create the sites table
+	`CREATE TABLE IF NOT EXISTS sites (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL
+	)`,
+	// Track probe results
+	`ALTER TABLE sites ADD COLUMN status TEXT NOT NULL DEFAULT 'unknown'`,
+	`ALTER TABLE sites ADD COLUMN last_checked DATETIME`,
+	// Host and port for filtering, backfilled on open
+	`ALTER TABLE sites ADD COLUMN host TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE sites ADD COLUMN port INTEGER NOT NULL DEFAULT 0`,
+	// Leases for background jobs shared between instances, see Locker
+	`CREATE TABLE IF NOT EXISTS leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at INTEGER NOT NULL
+	)`,
+	// Visitor accounts from OAuth logins
+	`CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		name TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		UNIQUE (provider, subject)
+	)`,
+	// Takedown requests and the hosts they removed for good
+	`CREATE TABLE IF NOT EXISTS takedowns (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		host TEXT NOT NULL,
+		contact TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		created_at DATETIME NOT NULL,
+		resolved_at DATETIME
+	)`,
+	`CREATE TABLE IF NOT EXISTS denylist (
+		host TEXT PRIMARY KEY,
+		reason TEXT NOT NULL,
+		added_at DATETIME NOT NULL
+	)`,
+	// Cached Safe Browsing verdicts
+	`CREATE TABLE IF NOT EXISTS url_verdicts (
+		url TEXT PRIMARY KEY,
+		threat TEXT NOT NULL,
+		checked_at DATETIME NOT NULL
+	)`,
+	// Public API keys and their use per day
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		hash TEXT NOT NULL UNIQUE,
+		daily_quota INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		revoked INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_usage (
+		key_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (key_id, day)
+	)`,
+	// Admin audit log
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME NOT NULL,
+		actor TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		before TEXT NOT NULL,
+		after TEXT NOT NULL
+	)`,
+	// Banned and shadow banned clients
+	`CREATE TABLE IF NOT EXISTS bans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		mode TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`,
+	// Failed admin logins, for lockouts that survive restarts
+	`CREATE TABLE IF NOT EXISTS login_failures (
+		key TEXT NOT NULL,
+		failed_at DATETIME NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS login_failures_key ON login_failures (key, failed_at)`,
+	// Batch inserts and Add look sites up by URL
+	`CREATE INDEX IF NOT EXISTS sites_url ON sites (url)`,
+	// Visitors sent to each site, by day
+	`CREATE TABLE IF NOT EXISTS site_visits (
+		site_id INTEGER NOT NULL,
+		day TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (site_id, day)
+	)`,
+	// Shuffle filters, by status and port or either alone; see adviseIndexes
+	`CREATE INDEX IF NOT EXISTS sites_status_port ON sites (status, port)`,
+	`CREATE INDEX IF NOT EXISTS sites_port_status ON sites (port, status)`,
+	// One report per sync, samples as JSON arrays
+	`CREATE TABLE IF NOT EXISTS refresh_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		started_at DATETIME NOT NULL,
+		source TEXT NOT NULL,
+		duration_ns INTEGER NOT NULL,
+		sites INTEGER NOT NULL,
+		added INTEGER NOT NULL,
+		removed INTEGER NOT NULL,
+		excluded INTEGER NOT NULL,
+		sample_added TEXT NOT NULL,
+		sample_removed TEXT NOT NULL,
+		error TEXT NOT NULL
+	)`,
+	// Site timelines, kept after the site is removed
+	`CREATE TABLE IF NOT EXISTS site_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		site_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		kind TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS site_events_site ON site_events (site_id, id)`,
+	// Digests read the events of the last day
+	`CREATE INDEX IF NOT EXISTS site_events_created ON site_events (created_at)`,
+	// Tags by what gave them, dropped with their site
+	`CREATE TABLE IF NOT EXISTS site_tags (
+		site_id INTEGER NOT NULL,
+		origin TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		PRIMARY KEY (site_id, origin, tag)
+	)`,
+	`CREATE INDEX IF NOT EXISTS site_tags_tag ON site_tags (tag)`,
+	`CREATE TRIGGER IF NOT EXISTS sites_drop_tags AFTER DELETE ON sites BEGIN
+		DELETE FROM site_tags WHERE site_id = old.id;
+	END`,
+	// Spins by hour and country of the site served, nothing about visitors
+	`CREATE TABLE IF NOT EXISTS spin_counts (
+		hour TEXT NOT NULL,
+		country TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (hour, country)
+	)`,
+	// What each site served when last probed, for linking duplicates
+	`CREATE TABLE IF NOT EXISTS content_hashes (
+		site_id INTEGER PRIMARY KEY,
+		hash TEXT NOT NULL
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS sites_drop_content_hash AFTER DELETE ON sites BEGIN
+		DELETE FROM content_hashes WHERE site_id = old.id;
+	END`,
+	// The entries of each site's listing when last crawled, one per line
+	`CREATE TABLE IF NOT EXISTS site_inventories (
+		site_id INTEGER PRIMARY KEY,
+		entries TEXT NOT NULL,
+		crawled_at DATETIME NOT NULL
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS sites_drop_inventory AFTER DELETE ON sites BEGIN
+		DELETE FROM site_inventories WHERE site_id = old.id;
+	END`,
+	// Newsletter subscribers, by the token in their links
+	`CREATE TABLE IF NOT EXISTS subscribers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email TEXT NOT NULL UNIQUE,
+		token TEXT NOT NULL UNIQUE,
+		confirmed INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL
+	)`,
+	// Visitors' favorites, by Visitor.Key, kept by URL to outlive their site
+	`CREATE TABLE IF NOT EXISTS favorites (
+		visitor TEXT NOT NULL,
+		playlist TEXT NOT NULL,
+		url TEXT NOT NULL,
+		added_at DATETIME NOT NULL,
+		PRIMARY KEY (visitor, playlist, url)
+	)`,
+	// Countries looked up on ipinfo.io, by IP
+	`CREATE TABLE IF NOT EXISTS ip_countries (
+		ip TEXT PRIMARY KEY,
+		country TEXT NOT NULL,
+		checked_at DATETIME NOT NULL
+	)`,
+	// The newest Last-Modified sampled from each site's files
+	`CREATE TABLE IF NOT EXISTS site_ages (
+		site_id INTEGER PRIMARY KEY,
+		modified_at DATETIME NOT NULL
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS sites_drop_age AFTER DELETE ON sites BEGIN
+		DELETE FROM site_ages WHERE site_id = old.id;
+	END`,
+	// Compressed copies of each site's root listing
+	`CREATE TABLE IF NOT EXISTS site_snapshots (
+		site_id INTEGER PRIMARY KEY,
+		body BLOB NOT NULL,
+		truncated INTEGER NOT NULL,
+		taken_at DATETIME NOT NULL
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS sites_drop_snapshot AFTER DELETE ON sites BEGIN
+		DELETE FROM site_snapshots WHERE site_id = old.id;
+	END`,
+	// How /verify players classified sites
+	`CREATE TABLE IF NOT EXISTS site_votes (
+		site_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		class TEXT NOT NULL,
+		voted_at DATETIME NOT NULL,
+		PRIMARY KEY (site_id, user_id)
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS sites_drop_votes AFTER DELETE ON sites BEGIN
+		DELETE FROM site_votes WHERE site_id = old.id;
+	END`,
+	// Admin defined rules tagging sites by their banners
+	`CREATE TABLE IF NOT EXISTS tag_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		field TEXT NOT NULL,
+		pattern TEXT NOT NULL,
+		tag TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	)`,
+	// What each site answered its last successful probe with
+	`CREATE TABLE IF NOT EXISTS site_banners (
+		site_id INTEGER PRIMARY KEY,
+		title TEXT NOT NULL,
+		headers TEXT NOT NULL,
+		body TEXT NOT NULL
+	)`,
+	`CREATE TRIGGER IF NOT EXISTS sites_drop_banner AFTER DELETE ON sites BEGIN
+		DELETE FROM site_banners WHERE site_id = old.id;
+	END`,
+}
+
+// sqliteStore is the SiteStore backed by a SQLite database.
+type sqliteStore struct {
+	db *sql.DB
+
+	// stmts caches prepared statements by query text, see stmt
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
+}
+
+// openSQLiteStore opens the database at path and brings its schema up to date.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	db.SetMaxOpenConns(sqliteMaxOpenConns)
+	db.SetMaxIdleConns(sqliteMaxOpenConns)
+	if isMemoryDB(path) {
+		// An in-memory database is gone once its last connection closes,
+		// so connections must never be retired
+		db.SetConnMaxLifetime(0)
+		db.SetConnMaxIdleTime(0)
+	} else {
+		db.SetConnMaxLifetime(sqliteConnMaxLifetime)
+	}
+	s := &sqliteStore{db: db, stmts: make(map[string]*sql.Stmt)}
+	if _, err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.backfillHostPort(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.adviseIndexes()
+	return s, nil
+}
+
+// isMemoryDB reports whether the SQLite path names an in-memory database.
+func isMemoryDB(path string) bool {
+	return strings.Contains(path, ":memory:") || strings.Contains(path, "mode=memory")
+}
+
+// MigrateSQLite brings the schema of the SQLite database at path up to
+// date and returns its version. Unlike OpenStore it never falls back to
+// memory.
+func MigrateSQLite(path string) (int, error) {
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+	return s.migrate()
+}
+
+// migrate applies any migrations newer than the database's schema version
+// and returns the resulting version.
+func (s *sqliteStore) migrate() (int, error) {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		if _, err := s.db.Exec(migrations[version]); err != nil {
+			return version, fmt.Errorf("failed to apply migration %d: %v", version+1, err)
+		}
+		// PRAGMA doesn't take bind parameters
+		if _, err := s.db.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			return version, fmt.Errorf("failed to record schema version: %v", err)
+		}
+	}
+	return version, nil
+}
+
+// backfillHostPort fills in host and port for rows inserted before those
+// columns existed.
+func (s *sqliteStore) backfillHostPort() error {
+	rows, err := s.db.Query("SELECT id, url FROM sites WHERE host = ''")
+	if err != nil {
+		return fmt.Errorf("failed to query database: %v", err)
+	}
+	var sites []Site
+	for rows.Next() {
+		var site Site
+		if err := rows.Scan(&site.ID, &site.URL); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan database row: %v", err)
+		}
+		sites = append(sites, site)
+	}
+	rows.Close()
+
+	for _, site := range sites {
+		host, port := splitHostPort(site.URL)
+		if err := s.executeWithRetry("UPDATE sites SET host = ?, port = ? WHERE id = ?", host, port, site.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stmt returns query prepared, preparing it on first use, so SQLite doesn't
+// parse it again on every call. The statements live until Close, so only
+// queries with a fixed text may go through it: query, queryRow and
+// executeWithRetry. Queries built from their arguments, whose text can take
+// any number of shapes, use the Uncached variants instead.
+func (s *sqliteStore) stmt(query string) (*sql.Stmt, error) {
+	s.stmtsMu.Lock()
+	defer s.stmtsMu.Unlock()
+	if st, ok := s.stmts[query]; ok {
+		return st, nil
+	}
+	st, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = st
+	return st, nil
+}
+
+// timedRows are query results that release their timeout when closed.
+type timedRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+	query  string
+	start  time.Time
+}
+
+func (r timedRows) Close() error {
+	defer r.cancel()
+	defer logSlowQuery(r.query, r.start)
+	return r.Rows.Close()
+}
+
+// query runs a prepared query bounded by queryTimeout. The timeout
+// covers reading the rows, until they are closed.
+func (s *sqliteStore) query(query string, args ...interface{}) (timedRows, error) {
+	st, err := s.stmt(query)
+	if err != nil {
+		return timedRows{}, err
+	}
+	return timeRows(query, func(ctx context.Context) (*sql.Rows, error) {
+		return st.QueryContext(ctx, args...)
+	})
+}
+
+// queryUncached is query for a query built from its arguments, which is
+// run without being kept prepared.
+func (s *sqliteStore) queryUncached(query string, args ...interface{}) (timedRows, error) {
+	return timeRows(query, func(ctx context.Context) (*sql.Rows, error) {
+		return s.db.QueryContext(ctx, query, args...)
+	})
+}
+
+func timeRows(query string, run func(ctx context.Context) (*sql.Rows, error)) (timedRows, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	rows, err := run(ctx)
+	if err != nil {
+		cancel()
+		return timedRows{}, err
+	}
+	return timedRows{rows, cancel, query, start}, nil
+}
+
+// timedRow is a single row query that runs when scanned, like sql.Row
+// but bounded by queryTimeout.
+type timedRow struct {
+	s     *sqliteStore
+	query string
+	args  []interface{}
+}
+
+func (s *sqliteStore) queryRow(query string, args ...interface{}) timedRow {
+	return timedRow{s, query, args}
+}
+
+func (r timedRow) Scan(dest ...interface{}) error {
+	st, err := r.s.stmt(r.query)
+	if err != nil {
+		return err
+	}
+	defer logSlowQuery(r.query, time.Now())
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	return st.QueryRowContext(ctx, r.args...).Scan(dest...)
+}
+
+func (s *sqliteStore) executeWithRetry(query string, args ...interface{}) error {
+	_, err := s.execResultWithRetry(query, args...)
+	return err
+}
+
+func (s *sqliteStore) execResultWithRetry(query string, args ...interface{}) (sql.Result, error) {
+	st, err := s.stmt(query)
+	if err != nil {
+		storeLog.Error("Failed to prepare query", "err", err)
+		return nil, err
+	}
+	return retryExec(query, func(ctx context.Context) (sql.Result, error) {
+		return st.ExecContext(ctx, args...)
+	})
+}
+
+// executeUncachedWithRetry is executeWithRetry for a statement built from
+// its arguments, which is run without being kept prepared.
+func (s *sqliteStore) executeUncachedWithRetry(query string, args ...interface{}) error {
+	_, err := retryExec(query, func(ctx context.Context) (sql.Result, error) {
+		return s.db.ExecContext(ctx, query, args...)
+	})
+	return err
+}
+
+func retryExec(query string, exec func(ctx context.Context) (sql.Result, error)) (sql.Result, error) {
+	// Time spent waiting out a lock counts, it's still time the caller waits
+	defer logSlowQuery(query, time.Now())
+	var err error
+	for i := 0; i < retryCount; i++ {
+		var res sql.Result
+		ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+		res, err = exec(ctx)
+		cancel()
+		if err != nil && strings.Contains(err.Error(), "database is locked") {
+			time.Sleep(retryDelay)
+			continue
+		} else if err != nil {
+			storeLog.Error("Failed to execute query", "err", err)
+			return nil, err
+		}
+		return res, nil
+	}
+	storeLog.Error("Failed to execute query, the database stayed locked", "retries", retryCount, "err", err)
+	return nil, err
+}
+
+func (s *sqliteStore) Add(url string) error {
+	host, port := splitHostPort(url)
+	return s.executeWithRetry("INSERT INTO sites (url, host, port) SELECT ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM sites WHERE url = ?)", url, host, port, url)
+}
+
+// insertBatchRows keeps a batch insert's bind parameters under 999, the
+// lowest limit SQLite builds have.
+const insertBatchRows = 999 / 3
+
+func (s *sqliteStore) InsertBatch(sites []Site) error {
+	for len(sites) > 0 {
+		chunk := sites[:min(len(sites), insertBatchRows)]
+		sites = sites[len(chunk):]
+		args := make([]interface{}, 0, 3*len(chunk))
+		for _, site := range chunk {
+			host, port := splitHostPort(site.URL)
+			args = append(args, site.URL, host, port)
+		}
+		// A VALUES list can't carry WHERE NOT EXISTS, so select from it
+		query := "INSERT INTO sites (url, host, port) SELECT column1, column2, column3 FROM (VALUES (?, ?, ?)" +
+			strings.Repeat(", (?, ?, ?)", len(chunk)-1) + ") WHERE column1 NOT IN (SELECT url FROM sites)"
+		if err := s.executeUncachedWithRetry(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Remove(url string) error {
+	return s.executeWithRetry("DELETE FROM sites WHERE url = ?", url)
+}
+
+// where builds the WHERE clause for filter.
+func (s *sqliteStore) where(filter SiteFilter) (string, []interface{}) {
+	clause := " WHERE 1=1"
+	var args []interface{}
+	if filter.Status != "" {
+		clause += " AND status = ?"
+		args = append(args, filter.Status)
+	}
+	if len(filter.Ports) > 0 {
+		clause += " AND port IN (?" + strings.Repeat(", ?", len(filter.Ports)-1) + ")"
+		for _, port := range filter.Ports {
+			args = append(args, port)
+		}
+	}
+	return clause, args
+}
+
+func (s *sqliteStore) Random(filter SiteFilter, weight func(status string) float64) (Site, error) {
+	where, args := s.where(filter)
+
+	// Count the candidates in each status bucket
+	rows, err := s.query("SELECT status, COUNT(*) FROM sites"+where+" GROUP BY status", args...)
+	if err != nil {
+		return Site{}, err
+	}
+	type bucket struct {
+		status string
+		count  int
+		weight float64
+	}
+	var buckets []bucket
+	total := 0.0
+	for rows.Next() {
+		var b bucket
+		if err := rows.Scan(&b.status, &b.count); err != nil {
+			rows.Close()
+			return Site{}, err
+		}
+		b.weight = float64(b.count) * weight(b.status)
+		if b.weight > 0 {
+			buckets = append(buckets, b)
+			total += b.weight
+		}
+	}
+	rows.Close()
+	if total == 0 {
+		return Site{}, ErrNoSites
+	}
+
+	// Pick a bucket by weight, then a site uniformly within it
+	chosen := buckets[len(buckets)-1]
+	r := rand.Float64() * total
+	for _, b := range buckets {
+		if r < b.weight {
+			chosen = b
+			break
+		}
+		r -= b.weight
+	}
+	bucketFilter := filter
+	bucketFilter.Status = chosen.status
+	where, args = s.where(bucketFilter)
+	args = append(args, rand.Intn(chosen.count))
+	site, err := scanSite(s.queryRow("SELECT id, url, host, port, status, last_checked FROM sites"+where+" LIMIT 1 OFFSET ?", args...))
+	if err == sql.ErrNoRows {
+		// The site was removed between the two queries
+		return Site{}, ErrNoSites
+	}
+	return site, err
+}
+
+func (s *sqliteStore) List(filter SiteFilter) ([]Site, error) {
+	where, args := s.where(filter)
+	rows, err := s.query("SELECT id, url, host, port, status, last_checked FROM sites"+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+
+	var sites []Site
+	for rows.Next() {
+		site, err := scanSite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		sites = append(sites, site)
+	}
+	return sites, rows.Err()
+}
+
+func (s *sqliteStore) Site(id int64) (Site, error) {
+	site, err := scanSite(s.queryRow("SELECT id, url, host, port, status, last_checked FROM sites WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return Site{}, errNoSuchSite
+	}
+	return site, err
+}
+
+// scanner is satisfied by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSite(row scanner) (Site, error) {
+	var site Site
+	var lastChecked sql.NullTime
+	if err := row.Scan(&site.ID, &site.URL, &site.Host, &site.Port, &site.Status, &lastChecked); err != nil {
+		return Site{}, err
+	}
+	site.LastChecked = lastChecked.Time
+	return site, nil
+}
+
+const updateStatusQuery = "UPDATE sites SET status = ?, last_checked = ? WHERE id = ?"
+
+func (s *sqliteStore) UpdateStatus(id int64, status string, checked time.Time) error {
+	return s.executeWithRetry(updateStatusQuery, status, checked.UTC(), id)
+}
+
+func (s *sqliteStore) UpdateStatuses(updates []StatusUpdate) error {
+	var err error
+	for i := 0; i < retryCount; i++ {
+		err = s.updateStatuses(updates)
+		if err != nil && strings.Contains(err.Error(), "database is locked") {
+			time.Sleep(retryDelay)
+			continue
+		}
+		return err
+	}
+	storeLog.Error("Failed to record probe results, the database stayed locked", "retries", retryCount, "err", err)
+	return err
+}
+
+func (s *sqliteStore) updateStatuses(updates []StatusUpdate) error {
+	st, err := s.stmt(updateStatusQuery)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once committed
+	defer tx.Rollback()
+	update := tx.StmtContext(ctx, st)
+	for _, u := range updates {
+		start := time.Now()
+		if _, err := update.ExecContext(ctx, u.Status, u.Checked.UTC(), u.ID); err != nil {
+			return err
+		}
+		logSlowQuery(updateStatusQuery, start)
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) AddVisits(counts []SiteVisits) error {
+	var err error
+	for i := 0; i < retryCount; i++ {
+		err = s.addVisits(counts)
+		if err != nil && strings.Contains(err.Error(), "database is locked") {
+			time.Sleep(retryDelay)
+			continue
+		}
+		return err
+	}
+	return err
+}
+
+const addVisitsQuery = `INSERT INTO site_visits (site_id, day, count) VALUES (?, ?, ?)
+	ON CONFLICT (site_id, day) DO UPDATE SET count = count + excluded.count`
+
+func (s *sqliteStore) addVisits(counts []SiteVisits) error {
+	st, err := s.stmt(addVisitsQuery)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	add := tx.StmtContext(ctx, st)
+	for _, c := range counts {
+		start := time.Now()
+		if _, err := add.ExecContext(ctx, c.SiteID, c.Day, c.Count); err != nil {
+			return err
+		}
+		logSlowQuery(addVisitsQuery, start)
+	}
+	return tx.Commit()
+}
+
+const addSpinsQuery = `INSERT INTO spin_counts (hour, country, count) VALUES (?, ?, ?)
+	ON CONFLICT (hour, country) DO UPDATE SET count = count + excluded.count`
+
+func (s *sqliteStore) AddSpins(counts []SpinCount) error {
+	var err error
+	for i := 0; i < retryCount; i++ {
+		err = s.addSpins(counts)
+		if err != nil && strings.Contains(err.Error(), "database is locked") {
+			time.Sleep(retryDelay)
+			continue
+		}
+		return err
+	}
+	return err
+}
+
+func (s *sqliteStore) addSpins(counts []SpinCount) error {
+	st, err := s.stmt(addSpinsQuery)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	add := tx.StmtContext(ctx, st)
+	for _, c := range counts {
+		start := time.Now()
+		if _, err := add.ExecContext(ctx, c.Hour, c.Country, c.Count); err != nil {
+			return err
+		}
+		logSlowQuery(addSpinsQuery, start)
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	// The upsert only touches the row if the lease is ours or has expired,
+	// so the affected row count says whether we hold it
+	res, err := s.execResultWithRetry(`INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE leases.holder = excluded.holder OR leases.expires_at < ?`,
+		name, holder, now.Add(ttl).UnixNano(), now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *sqliteStore) ReleaseLease(name, holder string) error {
+	return s.executeWithRetry("DELETE FROM leases WHERE name = ? AND holder = ?", name, holder)
+}
+
+func (s *sqliteStore) UpsertUser(provider, subject, name string) (User, error) {
+	err := s.executeWithRetry(`INSERT INTO users (provider, subject, name, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (provider, subject) DO UPDATE SET name = excluded.name`,
+		provider, subject, name, time.Now().UTC())
+	if err != nil {
+		return User{}, err
+	}
+	return s.scanUser(s.queryRow("SELECT id, provider, subject, name, created_at FROM users WHERE provider = ? AND subject = ?", provider, subject))
+}
+
+func (s *sqliteStore) User(id int64) (User, error) {
+	return s.scanUser(s.queryRow("SELECT id, provider, subject, name, created_at FROM users WHERE id = ?", id))
+}
+
+func (s *sqliteStore) scanUser(row scanner) (User, error) {
+	var u User
+	if err := row.Scan(&u.ID, &u.Provider, &u.Subject, &u.Name, &u.Created); err != nil {
+		return User{}, err
+	}
+	return u, nil
+}
+
+func (s *sqliteStore) PurgeBefore(cutoff time.Time) (int64, error) {
+	day := cutoff.UTC().Format("2006-01-02")
+	var total int64
+	for _, purge := range []struct {
+		query string
+		arg   interface{}
+	}{
+		{"DELETE FROM audit_log WHERE created_at < ?", cutoff.UTC()},
+		{"DELETE FROM api_usage WHERE day < ?", day},
+		{"UPDATE takedowns SET contact = '', reason = '' WHERE status != 'pending' AND resolved_at < ? AND contact != ''", cutoff.UTC()},
+		{"DELETE FROM subscribers WHERE confirmed = 0 AND created_at < ?", cutoff.UTC()},
+	} {
+		res, err := s.execResultWithRetry(purge.query, purge.arg)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+func (s *sqliteStore) AddLoginFailure(key string, t time.Time) error {
+	return s.executeWithRetry("INSERT INTO login_failures (key, failed_at) VALUES (?, ?)", key, t.UTC())
+}
+
+func (s *sqliteStore) LoginFailures(key string, since time.Time) (int, error) {
+	var n int
+	err := s.queryRow("SELECT COUNT(*) FROM login_failures WHERE key = ? AND failed_at >= ?", key, since.UTC()).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query database: %v", err)
+	}
+	return n, nil
+}
+
+func (s *sqliteStore) ClearLoginFailures(key string) error {
+	return s.executeWithRetry("DELETE FROM login_failures WHERE key = ?", key)
+}
+
+func (s *sqliteStore) PruneLoginFailures(before time.Time) error {
+	return s.executeWithRetry("DELETE FROM login_failures WHERE failed_at < ?", before.UTC())
+}
+
+func (s *sqliteStore) AddBan(b Ban) (Ban, error) {
+	res, err := s.execResultWithRetry("INSERT INTO bans (kind, value, mode, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+		b.Kind, b.Value, b.Mode, b.Reason, b.Created.UTC())
+	if err != nil {
+		return Ban{}, err
+	}
+	b.ID, err = res.LastInsertId()
+	return b, err
+}
+
+func (s *sqliteStore) Bans() ([]Ban, error) {
+	rows, err := s.query("SELECT id, kind, value, mode, reason, created_at FROM bans ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var bans []Ban
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.ID, &b.Kind, &b.Value, &b.Mode, &b.Reason, &b.Created); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+func (s *sqliteStore) RemoveBan(id int64) error {
+	res, err := s.execResultWithRetry("DELETE FROM bans WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("no ban with ID %d", id)
+	}
+	return nil
+}
+
+func (s *sqliteStore) AddAudit(e AuditEntry) error {
+	return s.executeWithRetry("INSERT INTO audit_log (created_at, actor, action, target, before, after) VALUES (?, ?, ?, ?, ?, ?)",
+		e.Time.UTC(), e.Actor, e.Action, e.Target, e.Before, e.After)
+}
+
+func (s *sqliteStore) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	query := "SELECT id, created_at, actor, action, target, before, after FROM audit_log WHERE 1 = 1"
+	var args []interface{}
+	if filter.Actor != "" {
+		query += " AND actor = ?"
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		query += " AND action = ?"
+		args = append(args, filter.Action)
+	}
+	if filter.Before > 0 {
+		query += " AND id < ?"
+		args = append(args, filter.Before)
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := s.queryUncached(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.Action, &e.Target, &e.Before, &e.After); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) AddRefreshReport(r RefreshReport) error {
+	added, _ := json.Marshal(r.SampleAdded)
+	removed, _ := json.Marshal(r.SampleRemoved)
+	res, err := s.execResultWithRetry("INSERT INTO refresh_history (started_at, source, duration_ns, sites, added, removed, excluded, sample_added, sample_removed, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		r.Time.UTC(), r.Source, int64(r.Duration), r.Sites, r.Added, r.Removed, r.Excluded, string(added), string(removed), r.Error)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	return s.executeWithRetry("DELETE FROM refresh_history WHERE id <= ?", id-refreshHistoryKeep)
+}
+
+func (s *sqliteStore) RefreshReports(limit int) ([]RefreshReport, error) {
+	query := "SELECT id, started_at, source, duration_ns, sites, added, removed, excluded, sample_added, sample_removed, error FROM refresh_history ORDER BY id DESC"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := s.queryUncached(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var reports []RefreshReport
+	for rows.Next() {
+		var r RefreshReport
+		var added, removed string
+		if err := rows.Scan(&r.ID, &r.Time, &r.Source, &r.Duration, &r.Sites, &r.Added, &r.Removed, &r.Excluded, &added, &removed, &r.Error); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		json.Unmarshal([]byte(added), &r.SampleAdded)
+		json.Unmarshal([]byte(removed), &r.SampleRemoved)
+		reports = append(reports, r)
+	}
+	return reports, rows.Err()
+}
+
+// insertEventRows keeps a batch of events' bind parameters under 999.
+const insertEventRows = 999 / 5
+
+func (s *sqliteStore) AddSiteEvents(events []SiteEvent) error {
+	for len(events) > 0 {
+		chunk := events[:min(len(events), insertEventRows)]
+		events = events[len(chunk):]
+		args := make([]interface{}, 0, 5*len(chunk))
+		for _, e := range chunk {
+			args = append(args, e.SiteID, e.URL, e.Time.UTC(), e.Kind, e.Detail)
+		}
+		query := "INSERT INTO site_events (site_id, url, created_at, kind, detail) VALUES (?, ?, ?, ?, ?)" +
+			strings.Repeat(", (?, ?, ?, ?, ?)", len(chunk)-1)
+		if err := s.executeUncachedWithRetry(query, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) SiteEvents(siteID int64) ([]SiteEvent, error) {
+	rows, err := s.query("SELECT id, site_id, url, created_at, kind, detail FROM site_events WHERE site_id = ? ORDER BY id", siteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var events []SiteEvent
+	for rows.Next() {
+		var e SiteEvent
+		if err := rows.Scan(&e.ID, &e.SiteID, &e.URL, &e.Time, &e.Kind, &e.Detail); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqliteStore) SiteEventsSince(since time.Time) ([]SiteEvent, error) {
+	rows, err := s.query("SELECT id, site_id, url, created_at, kind, detail FROM site_events WHERE created_at >= ? ORDER BY id", since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var events []SiteEvent
+	for rows.Next() {
+		var e SiteEvent
+		if err := rows.Scan(&e.ID, &e.SiteID, &e.URL, &e.Time, &e.Kind, &e.Detail); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqliteStore) TopVisits(fromDay string, limit int) ([]SiteVisits, error) {
+	query := "SELECT site_id, SUM(count) AS total FROM site_visits WHERE day >= ? GROUP BY site_id ORDER BY total DESC, site_id"
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := s.queryUncached(query, fromDay)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var top []SiteVisits
+	for rows.Next() {
+		var v SiteVisits
+		if err := rows.Scan(&v.SiteID, &v.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		top = append(top, v)
+	}
+	return top, rows.Err()
+}
+
+func (s *sqliteStore) Spins(fromHour string) ([]SpinCount, error) {
+	rows, err := s.query("SELECT hour, country, count FROM spin_counts WHERE hour >= ? ORDER BY hour, country", fromHour)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var counts []SpinCount
+	for rows.Next() {
+		var c SpinCount
+		if err := rows.Scan(&c.Hour, &c.Country, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+func (s *sqliteStore) ReplaceTags(origin string, tags map[int64][]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM site_tags WHERE origin = ?", origin); err != nil {
+		return fmt.Errorf("failed to clear tags: %v", err)
+	}
+	insert, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO site_tags (site_id, origin, tag) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for id, t := range tags {
+		for _, tag := range t {
+			if _, err := insert.ExecContext(ctx, id, origin, tag); err != nil {
+				return fmt.Errorf("failed to insert tag: %v", err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) SiteTags(siteID int64) ([]string, error) {
+	rows, err := s.query("SELECT DISTINCT tag FROM site_tags WHERE site_id = ? ORDER BY tag", siteID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+func (s *sqliteStore) AllTags() (map[int64][]string, error) {
+	rows, err := s.query("SELECT DISTINCT site_id, tag FROM site_tags ORDER BY site_id, tag")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	all := make(map[int64][]string)
+	for rows.Next() {
+		var id int64
+		var tag string
+		if err := rows.Scan(&id, &tag); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		all[id] = append(all[id], tag)
+	}
+	return all, rows.Err()
+}
+
+func (s *sqliteStore) SetContentHashes(hashes map[int64]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for id, hash := range hashes {
+		if hash == "" {
+			_, err = tx.ExecContext(ctx, "DELETE FROM content_hashes WHERE site_id = ?", id)
+		} else {
+			_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO content_hashes (site_id, hash) VALUES (?, ?)", id, hash)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to record content hash: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ContentHashes() (map[int64]string, error) {
+	rows, err := s.query("SELECT site_id, hash FROM content_hashes")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	hashes := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+func (s *sqliteStore) SetModified(modified map[int64]time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for id, m := range modified {
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO site_ages (site_id, modified_at) VALUES (?, ?)", id, m.UTC()); err != nil {
+			return fmt.Errorf("failed to record site age: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Modified() (map[int64]time.Time, error) {
+	rows, err := s.query("SELECT site_id, modified_at FROM site_ages")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	modified := make(map[int64]time.Time)
+	for rows.Next() {
+		var id int64
+		var m time.Time
+		if err := rows.Scan(&id, &m); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		modified[id] = m
+	}
+	return modified, rows.Err()
+}
+
+func (s *sqliteStore) Inventory(siteID int64) ([]string, bool, error) {
+	var entries string
+	err := s.queryRow("SELECT entries FROM site_inventories WHERE site_id = ?", siteID).Scan(&entries)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if entries == "" {
+		return nil, true, nil
+	}
+	return strings.Split(entries, "\n"), true, nil
+}
+
+func (s *sqliteStore) SetInventory(siteID int64, entries []string) error {
+	return s.executeWithRetry("INSERT OR REPLACE INTO site_inventories (site_id, entries, crawled_at) VALUES (?, ?, ?)",
+		siteID, strings.Join(entries, "\n"), time.Now().UTC())
+}
+
+func (s *sqliteStore) SetSnapshot(siteID int64, snap Snapshot) error {
+	return s.executeWithRetry("INSERT OR REPLACE INTO site_snapshots (site_id, body, truncated, taken_at) VALUES (?, ?, ?, ?)",
+		siteID, snap.Body, snap.Truncated, snap.Taken.UTC())
+}
+
+func (s *sqliteStore) Snapshot(siteID int64) (Snapshot, bool, error) {
+	var snap Snapshot
+	err := s.queryRow("SELECT body, truncated, taken_at FROM site_snapshots WHERE site_id = ?", siteID).Scan(&snap.Body, &snap.Truncated, &snap.Taken)
+	if err == sql.ErrNoRows {
+		return Snapshot{}, false, nil
+	}
+	if err != nil {
+		return Snapshot{}, false, err
+	}
+	return snap, true, nil
+}
+
+func (s *sqliteStore) AddVote(v Vote) error {
+	return s.executeWithRetry("INSERT OR REPLACE INTO site_votes (site_id, user_id, class, voted_at) VALUES (?, ?, ?, ?)",
+		v.SiteID, v.UserID, v.Class, v.Time.UTC())
+}
+
+func (s *sqliteStore) Votes() (map[int64][]Vote, error) {
+	rows, err := s.query("SELECT site_id, user_id, class, voted_at FROM site_votes ORDER BY voted_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	votes := make(map[int64][]Vote)
+	for rows.Next() {
+		var v Vote
+		if err := rows.Scan(&v.SiteID, &v.UserID, &v.Class, &v.Time); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		votes[v.SiteID] = append(votes[v.SiteID], v)
+	}
+	return votes, rows.Err()
+}
+
+func (s *sqliteStore) AddTagRule(r TagRule) (TagRule, error) {
+	res, err := s.execResultWithRetry("INSERT INTO tag_rules (field, pattern, tag, created_at) VALUES (?, ?, ?, ?)",
+		r.Field, r.Pattern, r.Tag, r.Created.UTC())
+	if err != nil {
+		return TagRule{}, err
+	}
+	r.ID, err = res.LastInsertId()
+	return r, err
+}
+
+func (s *sqliteStore) TagRules() ([]TagRule, error) {
+	rows, err := s.query("SELECT id, field, pattern, tag, created_at FROM tag_rules ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var rules []TagRule
+	for rows.Next() {
+		var r TagRule
+		if err := rows.Scan(&r.ID, &r.Field, &r.Pattern, &r.Tag, &r.Created); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *sqliteStore) RemoveTagRule(id int64) error {
+	res, err := s.execResultWithRetry("DELETE FROM tag_rules WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("no tag rule with ID %d", id)
+	}
+	return nil
+}
+
+func (s *sqliteStore) SetBanners(banners map[int64]Banner) error {
+	ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for id, b := range banners {
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO site_banners (site_id, title, headers, body) VALUES (?, ?, ?, ?)", id, b.Title, b.Headers, b.Body); err != nil {
+			return fmt.Errorf("failed to record banner: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Banners() (map[int64]Banner, error) {
+	rows, err := s.query("SELECT site_id, title, headers, body FROM site_banners")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	banners := make(map[int64]Banner)
+	for rows.Next() {
+		var id int64
+		var b Banner
+		if err := rows.Scan(&id, &b.Title, &b.Headers, &b.Body); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		banners[id] = b
+	}
+	return banners, rows.Err()
+}
+
+const hasTagClause = "EXISTS (SELECT 1 FROM site_tags WHERE site_tags.site_id = sites.id AND site_tags.tag = ?)"
+
+// likeEscaper escapes LIKE wildcards, for patterns with ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (s *sqliteStore) Search(q SiteQuery) ([]Site, error) {
+	clause := " WHERE 1=1"
+	var args []interface{}
+	for _, t := range q {
+		var alternatives []string
+		for _, v := range t.Values {
+			switch t.Field {
+			case SearchCountry:
+				continue
+			case SearchPort:
+				alternatives = append(alternatives, "port = ?")
+				args = append(args, v)
+			case SearchTag:
+				alternatives = append(alternatives, hasTagClause)
+				args = append(args, v)
+			case SearchStatus:
+				alternatives = append(alternatives, "status = ?")
+				args = append(args, v)
+			case SearchHost:
+				alternatives = append(alternatives, "lower(host) = ? OR lower(host) LIKE ? ESCAPE '\\'")
+				args = append(args, v, "%."+likeEscaper.Replace(v))
+			default:
+				alternatives = append(alternatives, "url LIKE ? ESCAPE '\\' OR "+hasTagClause)
+				args = append(args, "%"+likeEscaper.Replace(v)+"%", v)
+			}
+		}
+		if len(alternatives) == 0 {
+			continue
+		}
+		cond := "(" + strings.Join(alternatives, " OR ") + ")"
+		if t.Negate {
+			cond = "NOT " + cond
+		}
+		clause += " AND " + cond
+	}
+	// The query's shape follows the public search string, so it's never
+	// kept prepared
+	rows, err := s.queryUncached("SELECT id, url, host, port, status, last_checked FROM sites"+clause+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+
+	var sites []Site
+	for rows.Next() {
+		site, err := scanSite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		sites = append(sites, site)
+	}
+	return sites, rows.Err()
+}
+
+func (s *sqliteStore) AddSubscriber(email, token string, created time.Time) (bool, error) {
+	var confirmed bool
+	err := s.queryRow("SELECT confirmed FROM subscribers WHERE email = ?", email).Scan(&confirmed)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, s.executeWithRetry("INSERT INTO subscribers (email, token, created_at) VALUES (?, ?, ?)", email, token, created.UTC())
+	case err != nil:
+		return false, err
+	case confirmed:
+		return true, nil
+	}
+	return false, s.executeWithRetry("UPDATE subscribers SET token = ?, created_at = ? WHERE email = ?", token, created.UTC(), email)
+}
+
+func (s *sqliteStore) ConfirmSubscriber(token string) (bool, error) {
+	res, err := s.execResultWithRetry("UPDATE subscribers SET confirmed = 1 WHERE token = ?", token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) RemoveSubscriber(token string) (bool, error) {
+	res, err := s.execResultWithRetry("DELETE FROM subscribers WHERE token = ?", token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteStore) Subscribers() ([]Subscriber, error) {
+	rows, err := s.query("SELECT id, email, token, confirmed, created_at FROM subscribers WHERE confirmed = 1 ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var subscribers []Subscriber
+	for rows.Next() {
+		var sub Subscriber
+		if err := rows.Scan(&sub.ID, &sub.Email, &sub.Token, &sub.Confirmed, &sub.Created); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		subscribers = append(subscribers, sub)
+	}
+	return subscribers, rows.Err()
+}
+
+func (s *sqliteStore) PruneSubscribers(cutoff time.Time) (int64, error) {
+	res, err := s.execResultWithRetry("DELETE FROM subscribers WHERE confirmed = 0 AND created_at < ?", cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqliteStore) AddFavorite(visitor string, f Favorite) error {
+	return s.executeWithRetry("INSERT OR IGNORE INTO favorites (visitor, playlist, url, added_at) VALUES (?, ?, ?, ?)",
+		visitor, f.Playlist, f.URL, f.Added.UTC())
+}
+
+func (s *sqliteStore) RemoveFavorite(visitor, playlist, url string) error {
+	return s.executeWithRetry("DELETE FROM favorites WHERE visitor = ? AND playlist = ? AND url = ?", visitor, playlist, url)
+}
+
+func (s *sqliteStore) Favorites(visitor string) ([]Favorite, error) {
+	rows, err := s.query("SELECT url, playlist, added_at FROM favorites WHERE visitor = ? ORDER BY playlist, added_at, rowid", visitor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var favorites []Favorite
+	for rows.Next() {
+		var f Favorite
+		if err := rows.Scan(&f.URL, &f.Playlist, &f.Added); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		favorites = append(favorites, f)
+	}
+	return favorites, rows.Err()
+}
+
+func (s *sqliteStore) AddAPIKey(k APIKey) error {
+	return s.executeWithRetry("INSERT INTO api_keys (id, name, hash, daily_quota, created_at) VALUES (?, ?, ?, ?, ?)",
+		k.ID, k.Name, k.Hash, k.DailyQuota, k.Created.UTC())
+}
+
+func (s *sqliteStore) APIKeyByHash(hash string) (APIKey, bool, error) {
+	row := s.queryRow("SELECT id, name, hash, daily_quota, created_at, revoked FROM api_keys WHERE hash = ?", hash)
+	k, err := scanAPIKey(row)
+	if err == sql.ErrNoRows {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	return k, true, nil
+}
+
+func (s *sqliteStore) APIKeys() ([]APIKey, error) {
+	rows, err := s.query("SELECT id, name, hash, daily_quota, created_at, revoked FROM api_keys ORDER BY created_at")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var keys []APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func scanAPIKey(row scanner) (APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.ID, &k.Name, &k.Hash, &k.DailyQuota, &k.Created, &k.Revoked)
+	return k, err
+}
+
+func (s *sqliteStore) RevokeAPIKey(id string) error {
+	res, err := s.execResultWithRetry("UPDATE api_keys SET revoked = 1 WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return fmt.Errorf("no API key with ID %q", id)
+	}
+	return nil
+}
+
+func (s *sqliteStore) CountAPIUse(id, day string) (int, error) {
+	err := s.executeWithRetry(`INSERT INTO api_usage (key_id, day, count) VALUES (?, ?, 1)
+		ON CONFLICT (key_id, day) DO UPDATE SET count = count + 1`, id, day)
+	if err != nil {
+		return 0, err
+	}
+	return s.APIUse(id, day)
+}
+
+func (s *sqliteStore) APIUse(id, day string) (int, error) {
+	var count int
+	err := s.queryRow("SELECT count FROM api_usage WHERE key_id = ? AND day = ?", id, day).Scan(&count)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return count, err
+}
+
+func (s *sqliteStore) Verdict(url string) (Verdict, bool, error) {
+	v := Verdict{URL: url}
+	err := s.queryRow("SELECT threat, checked_at FROM url_verdicts WHERE url = ?", url).Scan(&v.Threat, &v.Checked)
+	if err == sql.ErrNoRows {
+		return Verdict{}, false, nil
+	}
+	if err != nil {
+		return Verdict{}, false, err
+	}
+	return v, true, nil
+}
+
+func (s *sqliteStore) IPCountries() (map[string]IPCountry, error) {
+	rows, err := s.query("SELECT ip, country, checked_at FROM ip_countries")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	countries := make(map[string]IPCountry)
+	for rows.Next() {
+		var c IPCountry
+		if err := rows.Scan(&c.IP, &c.Country, &c.Checked); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		countries[c.IP] = c
+	}
+	return countries, rows.Err()
+}
+
+func (s *sqliteStore) SaveIPCountry(c IPCountry) error {
+	return s.executeWithRetry(`INSERT INTO ip_countries (ip, country, checked_at) VALUES (?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET country = excluded.country, checked_at = excluded.checked_at`,
+		c.IP, c.Country, c.Checked.UTC())
+}
+
+func (s *sqliteStore) SaveVerdict(v Verdict) error {
+	return s.executeWithRetry(`INSERT INTO url_verdicts (url, threat, checked_at) VALUES (?, ?, ?)
+		ON CONFLICT (url) DO UPDATE SET threat = excluded.threat, checked_at = excluded.checked_at`,
+		v.URL, v.Threat, v.Checked.UTC())
+}
+
+func (s *sqliteStore) AddTakedown(host, contact, reason string) (Takedown, error) {
+	res, err := s.execResultWithRetry("INSERT INTO takedowns (host, contact, reason, created_at) VALUES (?, ?, ?, ?)",
+		host, contact, reason, time.Now().UTC())
+	if err != nil {
+		return Takedown{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Takedown{}, err
+	}
+	return s.takedown(id)
+}
+
+func (s *sqliteStore) takedown(id int64) (Takedown, error) {
+	row := s.queryRow("SELECT id, host, contact, reason, status, created_at, resolved_at FROM takedowns WHERE id = ?", id)
+	return scanTakedown(row)
+}
+
+func (s *sqliteStore) Takedowns(status string) ([]Takedown, error) {
+	query := "SELECT id, host, contact, reason, status, created_at, resolved_at FROM takedowns"
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	rows, err := s.query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var takedowns []Takedown
+	for rows.Next() {
+		t, err := scanTakedown(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		takedowns = append(takedowns, t)
+	}
+	return takedowns, rows.Err()
+}
+
+func scanTakedown(row scanner) (Takedown, error) {
+	var t Takedown
+	var resolved sql.NullTime
+	if err := row.Scan(&t.ID, &t.Host, &t.Contact, &t.Reason, &t.Status, &t.Created, &resolved); err != nil {
+		return Takedown{}, err
+	}
+	t.Resolved = resolved.Time
+	return t, nil
+}
+
+func (s *sqliteStore) ResolveTakedown(id int64, status string) (Takedown, error) {
+	res, err := s.execResultWithRetry("UPDATE takedowns SET status = ?, resolved_at = ? WHERE id = ? AND status = ?",
+		status, time.Now().UTC(), id, TakedownPending)
+	if err != nil {
+		return Takedown{}, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return Takedown{}, fmt.Errorf("no pending takedown with ID %d", id)
+	}
+	return s.takedown(id)
+}
+
+func (s *sqliteStore) Deny(host, reason string) error {
+	return s.executeWithRetry("INSERT INTO denylist (host, reason, added_at) VALUES (?, ?, ?) ON CONFLICT (host) DO NOTHING",
+		host, reason, time.Now().UTC())
+}
+
+func (s *sqliteStore) Denylist() ([]string, error) {
+	rows, err := s.query("SELECT host FROM denylist")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query database: %v", err)
+	}
+	defer rows.Close()
+	var hosts []string
+	for rows.Next() {
+		var host string
+		if err := rows.Scan(&host); err != nil {
+			return nil, fmt.Errorf("failed to scan database row: %v", err)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, rows.Err()
+}
+
+func (s *sqliteStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqliteStore) Backup(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	// VACUUM INTO writes a compacted copy without blocking writers for long
+	if _, err := s.db.ExecContext(ctx, "VACUUM INTO ?", path); err != nil {
+		return fmt.Errorf("failed to back up database: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) Close() error {
+	s.stmtsMu.Lock()
+	for query, st := range s.stmts {
+		st.Close()
+		delete(s.stmts, query)
+	}
+	s.stmtsMu.Unlock()
+	return s.db.Close()
+}
@@ -0,0 +1,104 @@
+package roulette
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const submissionWindow = time.Hour // Period the submission caps count over
+
+// SubmissionConfig caps the requests the public forms can add to the
+// moderation queue, so it can't be flooded.
+type SubmissionConfig struct {
+	// PerIP is how many submissions one client IP can make an hour, 0 for
+	// no cap
+	PerIP int `json:"per_ip"`
+	// Global is how many submissions are accepted an hour from everyone
+	// together, 0 for no cap
+	Global int `json:"global"`
+}
+
+// SubmissionCheck vets a form submission before it is accepted, for
+// example by verifying a captcha response or proof-of-work field. A
+// non-nil error rejects the submission and is shown to the visitor. The
+// form templates can be overridden to add the fields it needs.
+type SubmissionCheck func(r *http.Request) error
+
+// errTooManySubmissions is returned when a submission cap is reached.
+type errTooManySubmissions struct {
+	retryAfter time.Duration
+}
+
+func (e errTooManySubmissions) Error() string {
+	return fmt.Sprintf("too many requests, try again in %s", e.retryAfter.Round(time.Minute))
+}
+
+// submissionLimiter counts recent submissions per client IP and overall.
+type submissionLimiter struct {
+	mu   sync.Mutex
+	byIP map[string][]time.Time
+	all  []time.Time
+}
+
+func newSubmissionLimiter() *submissionLimiter {
+	return &submissionLimiter{byIP: make(map[string][]time.Time)}
+}
+
+// take records a submission from ip unless that would go over a cap.
+func (l *submissionLimiter) take(ip string, c SubmissionConfig, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-submissionWindow)
+	l.all = recentSubmissions(l.all, cutoff)
+	for k, times := range l.byIP {
+		if times = recentSubmissions(times, cutoff); len(times) == 0 {
+			delete(l.byIP, k)
+		} else {
+			l.byIP[k] = times
+		}
+	}
+
+	mine := l.byIP[ip]
+	if c.PerIP > 0 && len(mine) >= c.PerIP {
+		return errTooManySubmissions{mine[len(mine)-c.PerIP].Sub(cutoff)}
+	}
+	if c.Global > 0 && len(l.all) >= c.Global {
+		return errTooManySubmissions{l.all[len(l.all)-c.Global].Sub(cutoff)}
+	}
+	l.byIP[ip] = append(mine, now)
+	l.all = append(l.all, now)
+	return nil
+}
+
+// recentSubmissions drops the times, oldest first, before cutoff.
+func recentSubmissions(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// SetSubmissionCheck installs fn to vet every public form submission.
+// Call it before serving.
+func (rl *Roulette) SetSubmissionCheck(fn SubmissionCheck) {
+	rl.submissionCheck = fn
+}
+
+// admitSubmission runs the submission check and counts r against the caps.
+// The returned status goes with the error.
+func (rl *Roulette) admitSubmission(r *http.Request) (int, error) {
+	if rl.submissionCheck != nil {
+		if err := rl.submissionCheck(r); err != nil {
+			return http.StatusForbidden, err
+		}
+	}
+	c := rl.Config()
+	if err := rl.submissions.take(c.clientKey(r), c.Submissions, time.Now()); err != nil {
+		return http.StatusTooManyRequests, err
+	}
+	return 0, nil
+}
@@ -0,0 +1,373 @@
+package roulette
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// WriteURLsFile replaces the URL list at filePath with urls, one per line.
+// The list is written to a temporary file and renamed into place, so a
+// crash mid-write can't leave a truncated list behind.
+func WriteURLsFile(filePath string, urls []string) error {
+	// Create the temporary file next to the target so the rename is atomic
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	defer tmp.Close()
+
+	// Write each URL on a new line
+	w := bufio.NewWriter(tmp)
+	for _, url := range urls {
+		_, err := w.WriteString(url + "\n")
+		if err != nil {
+			return fmt.Errorf("failed to write to file: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write to file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to flush file to disk: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %v", err)
+	}
+	// CreateTemp makes the file private, keep the list readable like before
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set file permissions: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", filePath, err)
+	}
+	return nil
+}
+
+// ReadURLsFile reads a URL list from filePath.
+func ReadURLsFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadURLs(file)
+}
+
+// ReadURLs reads one URL per line, skipping blanks and normalizing the scheme.
+func ReadURLs(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		url := strings.TrimSpace(scanner.Text())
+		if url != "" {
+			urls = append(urls, normalizeURL(url))
+		}
+	}
+	return urls, scanner.Err()
+}
+
+func ensureURLScheme(url string) string {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "http://" + url
+	}
+	return url
+}
+
+// normalizeURL adds the scheme url may lack and strips any user:pass@
+// credentials, which would otherwise log visitors into someone's server.
+func normalizeURL(url string) string {
+	url = ensureURLScheme(url)
+	u, err := neturl.Parse(url)
+	if err != nil || u.User == nil {
+		return url
+	}
+	u.User = nil
+	syncLog.Info("Stripped credentials from URL", "url", u.String())
+	return u.String()
+}
+
+// Sync brings the pool in line with the URL list file: URLs missing from
+// the file are removed and new ones are added. In demo mode the embedded
+// sample list is used instead.
+func (rl *Roulette) Sync() {
+	rl.sync(context.Background(), SourceFile)
+}
+
+// sync is Sync as part of the work in ctx, such as a refresh, with the list
+// coming from source. Every run is recorded in the refresh history.
+func (rl *Roulette) sync(ctx context.Context, source string) {
+	if rl.Config().Demo {
+		source = SourceDemo
+	}
+	report := RefreshReport{Time: time.Now().UTC(), Source: source}
+	err := rl.timed(syncJob, func(ctx context.Context) error {
+		if rl.Config().Demo {
+			return rl.updateDatabase(ctx, demoReader(), &report)
+		}
+		return rl.updateDatabaseFromLists(ctx, &report)
+	})(ctx)
+	report.Duration = Duration(time.Since(report.Time))
+	if err != nil {
+		syncLog.Error("Sync failed", "err", err)
+		report.Error = err.Error()
+	}
+	rl.recordRefresh(report)
+}
+
+// updateDatabaseFromLists syncs the pool with URLsFile and the URL
+// sources merged, then tags the sites by source.
+func (rl *Roulette) updateDatabaseFromLists(ctx context.Context, report *RefreshReport) error {
+	urls, tags, stamp, err := rl.readLists()
+	if err != nil {
+		return err
+	}
+	rl.urlsWatch.saw(stamp)
+	if err := rl.updateDatabase(ctx, strings.NewReader(strings.Join(urls, "\n")), report); err != nil {
+		return err
+	}
+	rl.replaceTags(TagOriginSource, tags)
+	return nil
+}
+
+// updateDatabase syncs the pool with the URL list read from list, filling
+// in report with what changed.
+func (rl *Roulette) updateDatabase(ctx context.Context, list io.Reader, report *RefreshReport) error {
+	// Read all URLs from the file, in order and without duplicates
+	var fileURLs []string
+	seen := make(map[string]bool)
+	denied := rl.deniedHosts()
+	skipped := 0
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		url := strings.TrimSpace(scanner.Text())
+		if url != "" {
+			// Ensure the URL has the correct scheme and no credentials
+			url = normalizeURL(url)
+			if rl.excluded(url, denied) {
+				skipped++
+				continue
+			}
+			if !seen[url] {
+				seen[url] = true
+				fileURLs = append(fileURLs, url)
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read the URL list: %v", err)
+	}
+
+	// Get all URLs currently in the database
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return fmt.Errorf("failed to query database: %v", err)
+	}
+	dbURLs := make([]string, 0, len(sites))
+	for _, site := range sites {
+		dbURLs = append(dbURLs, site.URL)
+	}
+
+	added, removed := diffURLs(fileURLs, dbURLs)
+	detail := "sync from " + report.Source
+
+	// Remove URLs from the database that are not in the file
+	gone := make(map[string]bool, len(removed))
+	for _, dbURL := range removed {
+		err := rl.store.Remove(dbURL)
+		if err != nil {
+			syncLog.Error("Failed to delete URL", "url", dbURL, "err", err)
+			continue
+		}
+		gone[dbURL] = true
+	}
+	var events []SiteEvent
+	for _, site := range sites {
+		if gone[site.URL] {
+			events = append(events, siteEvent(site, EventRemoved, detail))
+		}
+	}
+
+	// Add new URLs to the database
+	rl.addSites(added)
+	if len(added) > 0 {
+		// The new sites' IDs are only known once they're in
+		if sites, err = rl.store.List(SiteFilter{}); err != nil {
+			syncLog.Error("Failed to list the new sites", "err", err)
+		}
+		isNew := make(map[string]bool, len(added))
+		for _, url := range added {
+			isNew[url] = true
+		}
+		var discovered []Site
+		for _, site := range sites {
+			if isNew[site.URL] {
+				events = append(events, siteEvent(site, EventDiscovered, detail))
+				discovered = append(discovered, site)
+			}
+		}
+		rl.siteDiscovered(discovered)
+	}
+	rl.recordEvents(events...)
+
+	if len(added) > 0 || len(removed) > 0 {
+		rl.sitesChanged()
+	}
+	report.Sites, report.Added, report.Removed, report.Excluded = len(fileURLs), len(added), len(removed), skipped
+	report.SampleAdded, report.SampleRemoved = sample(added), sample(removed)
+	syncLog.Info("Database update complete", "sites", len(fileURLs), "added", len(added), "removed", len(removed), "excluded", skipped)
+	spanFromContext(ctx).set(attrInt("sync.sites", len(fileURLs)), attrInt("sync.added", len(added)), attrInt("sync.removed", len(removed)))
+	return nil
+}
+
+// addSites adds urls to the pool, in batches if the store can.
+func (rl *Roulette) addSites(urls []string) {
+	if batch, ok := rl.store.(BatchStore); ok && len(urls) > 0 {
+		sites := make([]Site, len(urls))
+		for i, url := range urls {
+			sites[i].URL = url
+		}
+		if err := batch.InsertBatch(sites); err != nil {
+			syncLog.Error("Failed to insert URLs", "count", len(urls), "err", err)
+		}
+		return
+	}
+	for _, url := range urls {
+		if err := rl.store.Add(url); err != nil {
+			syncLog.Error("Failed to insert URL", "url", url, "err", err)
+		}
+	}
+}
+
+// diffURLs returns the URLs in want but not in have, and those in have but
+// not in want, each in the order they are listed and once each. It is linear in the
+// size of both lists, which matters once the pool has tens of thousands of
+// URLs.
+func diffURLs(want, have []string) (added, removed []string) {
+	wanted := make(map[string]bool, len(want))
+	for _, url := range want {
+		wanted[url] = true
+	}
+	had := make(map[string]bool, len(have))
+	for _, url := range have {
+		had[url] = true
+		if !wanted[url] {
+			removed = append(removed, url)
+		}
+	}
+	for _, url := range want {
+		if !had[url] {
+			had[url] = true
+			added = append(added, url)
+		}
+	}
+	return added, removed
+}
+
+// Import merges urls into the URL list file and syncs the pool. It returns
+// how many of them were new.
+func (rl *Roulette) Import(urls []string) (int, error) {
+	if rl.Config().Demo {
+		return 0, ErrDemoMode
+	}
+	urlsFile := rl.Config().URLsFile
+
+	// Start from the current list so importing only ever adds URLs
+	existing, err := ReadURLsFile(urlsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	seen := make(map[string]bool)
+	for _, url := range existing {
+		seen[url] = true
+	}
+
+	merged := existing
+	added := 0
+	denied := rl.deniedHosts()
+	for _, url := range urls {
+		url = normalizeURL(strings.TrimSpace(url))
+		if rl.excluded(url, denied) {
+			continue
+		}
+		if !seen[url] {
+			seen[url] = true
+			merged = append(merged, url)
+			added++
+		}
+	}
+
+	if err := WriteURLsFile(urlsFile, merged); err != nil {
+		return 0, err
+	}
+	rl.sync(context.Background(), SourceImport)
+	return added, nil
+}
+
+// errNoSuchSite is returned by RemoveSite for URLs that aren't in the pool,
+// and by SiteStore.Site for IDs that aren't.
+var errNoSuchSite = errors.New("no such site")
+
+// RemoveSite drops url from the URL lists and the pool, and returns
+// the site as it was.
+func (rl *Roulette) RemoveSite(url string) (Site, error) {
+	if rl.Config().Demo {
+		return Site{}, ErrDemoMode
+	}
+	url = ensureURLScheme(strings.TrimSpace(url))
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return Site{}, err
+	}
+	var removed Site
+	for _, site := range sites {
+		if site.URL == url {
+			removed = site
+		}
+	}
+	if removed.URL == "" {
+		return Site{}, errNoSuchSite
+	}
+	// The lists go first so a sync can't bring the site back
+	if err := rl.dropFromLists(func(u string) bool { return u == url }); err != nil {
+		return Site{}, err
+	}
+	if err := rl.store.Remove(url); err != nil {
+		return Site{}, err
+	}
+	rl.sitesChanged()
+	rl.recordEvents(siteEvent(removed, EventRemoved, "deleted by an admin"))
+	syncLog.Info("Removed site", "url", url)
+	return removed, nil
+}
+
+// PruneDown rewrites the URL lists without the sites the last probe found
+// down and returns how many were dropped.
+func (rl *Roulette) PruneDown() (int, error) {
+	if rl.Config().Demo {
+		return 0, ErrDemoMode
+	}
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return 0, err
+	}
+	down := make(map[string]bool)
+	for _, site := range sites {
+		if site.Status == StatusDown {
+			down[site.URL] = true
+		}
+	}
+	if err := rl.dropFromLists(func(url string) bool { return down[url] }); err != nil {
+		return 0, err
+	}
+	return len(down), nil
+}
@@ -0,0 +1,28 @@
+package roulette
+
+import (
+	"fmt"
+	"testing"
+)
+
+// BenchmarkDiffURLs diffs a refreshed URL list against the pool when a
+// tenth of the URLs changed.
+func BenchmarkDiffURLs(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			have := make([]string, n)
+			want := make([]string, n)
+			for i := range n {
+				have[i] = fmt.Sprintf("http://11.%d.%d.%d:8000/", i>>16&0xff, i>>8&0xff, i&0xff)
+				want[i] = have[i]
+				if i%10 == 0 {
+					want[i] = fmt.Sprintf("http://12.%d.%d.%d:8000/", i>>16&0xff, i>>8&0xff, i&0xff)
+				}
+			}
+			b.ResetTimer()
+			for range b.N {
+				diffURLs(want, have)
+			}
+		})
+	}
+}
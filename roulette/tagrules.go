@@ -0,0 +1,252 @@
+package roulette
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const bannerBodyBytes = 4096 // How much of a site's body its banner keeps
+
+// Fields of a site's banner tag rules match against
+const (
+	RuleTitle   = "title"   // The listing's title
+	RuleHeaders = "headers" // The response headers, one "Name: value" per line
+	RuleBody    = "body"    // The start of the body
+)
+
+// TagRule tags every site whose banner field matches Pattern, a regular
+// expression, with Tag. Rules are matched again after every probe, which
+// checks newly added sites first, and whenever they change.
+type TagRule struct {
+	ID      int64     `json:"id"`
+	Field   string    `json:"field"`
+	Pattern string    `json:"pattern"`
+	Tag     string    `json:"tag"`
+	Created time.Time `json:"created"`
+}
+
+// Banner is what a site answered its last successful probe with, kept for
+// matching tag rules again whenever they change.
+type Banner struct {
+	Title   string
+	Headers string
+	Body    string
+}
+
+// TagRuleStore is implemented by stores that keep tag rules and the
+// banners they match.
+type TagRuleStore interface {
+	// AddTagRule stores r and returns it with its ID.
+	AddTagRule(r TagRule) (TagRule, error)
+	// TagRules lists every rule, oldest first.
+	TagRules() ([]TagRule, error)
+	// RemoveTagRule drops the rule with the given ID.
+	RemoveTagRule(id int64) error
+	// SetBanners replaces the banners of the sites in banners.
+	SetBanners(banners map[int64]Banner) error
+	// Banners returns every site's banner by site ID.
+	Banners() (map[int64]Banner, error)
+}
+
+// field returns the banner field a rule matches against.
+func (b Banner) field(name string) string {
+	switch name {
+	case RuleTitle:
+		return b.Title
+	case RuleHeaders:
+		return b.Headers
+	}
+	return b.Body
+}
+
+// newBanner builds a site's banner from a probe's response.
+func newBanner(header http.Header, body []byte) Banner {
+	b := Banner{Body: strings.ToValidUTF8(string(body[:min(len(body), bannerBodyBytes)]), "")}
+	if m := titlePattern.FindSubmatch(body); m != nil {
+		b.Title = strings.TrimSpace(html.UnescapeString(string(m[1])))
+	}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var lines strings.Builder
+	for _, name := range names {
+		for _, v := range header[name] {
+			fmt.Fprintf(&lines, "%s: %s\n", name, v)
+		}
+	}
+	b.Headers = lines.String()
+	return b
+}
+
+func (rl *Roulette) tagRuleStore() (TagRuleStore, error) {
+	rules, ok := rl.store.(TagRuleStore)
+	if !ok {
+		return nil, fmt.Errorf("tag rules aren't supported by this store")
+	}
+	return rules, nil
+}
+
+// AddTagRule adds a rule tagging the sites whose banner field matches the
+// regular expression pattern, and applies the rules again.
+func (rl *Roulette) AddTagRule(field, pattern, tag string) (TagRule, error) {
+	store, err := rl.tagRuleStore()
+	if err != nil {
+		return TagRule{}, err
+	}
+	if field != RuleTitle && field != RuleHeaders && field != RuleBody {
+		return TagRule{}, fmt.Errorf("field must be %q, %q or %q", RuleTitle, RuleHeaders, RuleBody)
+	}
+	if pattern == "" {
+		return TagRule{}, fmt.Errorf("pattern must not be empty")
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return TagRule{}, fmt.Errorf("invalid pattern: %v", err)
+	}
+	if tag = normalizeTag(tag); tag == "" {
+		return TagRule{}, fmt.Errorf("tag must have letters or digits")
+	}
+	rule, err := store.AddTagRule(TagRule{Field: field, Pattern: pattern, Tag: tag, Created: time.Now().UTC()})
+	if err != nil {
+		return TagRule{}, err
+	}
+	appLog.Info("Tag rule added", "rule", rule.ID, "field", field, "pattern", pattern, "tag", tag)
+	rl.applyTagRules()
+	return rule, nil
+}
+
+// RemoveTagRule drops a rule and the tags only it gave.
+func (rl *Roulette) RemoveTagRule(id int64) error {
+	store, err := rl.tagRuleStore()
+	if err != nil {
+		return err
+	}
+	if err := store.RemoveTagRule(id); err != nil {
+		return err
+	}
+	appLog.Info("Tag rule removed", "rule", id)
+	rl.applyTagRules()
+	return nil
+}
+
+// recordBanners stores the banners probes got. Failures are logged.
+func (rl *Roulette) recordBanners(banners map[int64]Banner) {
+	store, ok := rl.store.(TagRuleStore)
+	if !ok || len(banners) == 0 {
+		return
+	}
+	if err := store.SetBanners(banners); err != nil {
+		storeLog.Error("Failed to store banners", "err", err)
+	}
+}
+
+// applyTagRules matches every rule against every stored banner and
+// replaces the tags rules give. Failures are logged.
+func (rl *Roulette) applyTagRules() {
+	store, ok := rl.store.(TagRuleStore)
+	tags, hasTags := rl.store.(TagStore)
+	if !ok || !hasTags {
+		return
+	}
+	rules, err := store.TagRules()
+	if err != nil {
+		storeLog.Error("Failed to read tag rules", "err", err)
+		return
+	}
+	banners, err := store.Banners()
+	if err != nil {
+		storeLog.Error("Failed to read banners", "err", err)
+		return
+	}
+	byID := make(map[int64][]string)
+	for _, rule := range rules {
+		// Checked when added, but the database may have been edited since
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			appLog.Warn("Skipping tag rule that doesn't compile", "rule", rule.ID, "err", err)
+			continue
+		}
+		for id, b := range banners {
+			if pattern.MatchString(b.field(rule.Field)) {
+				byID[id] = addTag(byID[id], rule.Tag)
+			}
+		}
+	}
+	if err := tags.ReplaceTags(TagOriginRules, byID); err != nil {
+		storeLog.Error("Failed to store site tags", "origin", TagOriginRules, "err", err)
+	}
+}
+
+// tagRulesPage is the data the rules template is rendered with.
+type tagRulesPage struct {
+	basePage
+	Rules     []TagRule
+	Fields    []string
+	Error     string
+	Supported bool
+}
+
+// adminTagRulesHandler lists the tag rules on GET /admin/rules, adds one
+// on POST and removes one on POST /admin/rules/{id}/delete.
+func (rl *Roulette) adminTagRulesHandler(w http.ResponseWriter, r *http.Request) {
+	page := tagRulesPage{basePage: rl.pageBase(w, r), Fields: []string{RuleTitle, RuleHeaders, RuleBody}}
+	store, err := rl.tagRuleStore()
+	page.Supported = err == nil
+	if page.Supported && r.Method == http.MethodPost {
+		back := "rules"
+		if idText := r.PathValue("id"); idText != "" {
+			// Back to the list from /admin/rules/{id}/delete
+			back = "../../rules"
+			err = rl.removeTagRuleAudited(r, store, idText)
+		} else {
+			var rule TagRule
+			rule, err = rl.AddTagRule(r.FormValue("field"), r.FormValue("pattern"), r.FormValue("tag"))
+			if err == nil {
+				rl.audit(r, AuditTagRuleAdd, fmt.Sprintf("tag rule #%d", rule.ID), nil, rule)
+			}
+		}
+		if err == nil {
+			redirectRelative(w, back)
+			return
+		}
+		httpLog.Error("Failed to change tag rules", "err", err)
+		page.Error = err.Error()
+	}
+	if page.Supported {
+		rules, err := store.TagRules()
+		if err != nil {
+			httpLog.Error("Failed to list tag rules", "err", err)
+			page.Error = err.Error()
+		}
+		page.Rules = rules
+	}
+	rl.render(w, "rules.html", page)
+}
+
+// removeTagRuleAudited removes the rule with the ID in idText, recording
+// it in the audit log.
+func (rl *Roulette) removeTagRuleAudited(r *http.Request, store TagRuleStore, idText string) error {
+	id, err := strconv.ParseInt(idText, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid rule ID %q", idText)
+	}
+	var before any
+	rules, _ := store.TagRules()
+	for _, rule := range rules {
+		if rule.ID == id {
+			before = rule
+		}
+	}
+	if err := rl.RemoveTagRule(id); err != nil {
+		return err
+	}
+	rl.audit(r, AuditTagRuleRemove, fmt.Sprintf("tag rule #%d", id), before, nil)
+	return nil
+}
@@ -0,0 +1,86 @@
+package roulette
+
+import (
+	"slices"
+	"strings"
+)
+
+// Tag origins: what gave a site a tag. Each origin's tags are replaced as
+// a whole whenever it recomputes them, leaving the others alone.
+const (
+	TagOriginSource     = "source" // The URL list the site came from
+	TagOriginKnownFiles = "known"  // Known files the site hosts
+	TagOriginVerify     = "verify" // What /verify players settled it on
+	TagOriginRules      = "rules"  // Tag rules its banner matches
+)
+
+// TagStore is implemented by stores that keep site tags.
+type TagStore interface {
+	// ReplaceTags sets the tags origin gives each site to those in tags,
+	// dropping every tag it gave before.
+	ReplaceTags(origin string, tags map[int64][]string) error
+	// SiteTags returns the tags of the site with the given ID, from every
+	// origin, sorted.
+	SiteTags(siteID int64) ([]string, error)
+	// AllTags returns the tags of every tagged site, sorted.
+	AllTags() (map[int64][]string, error)
+}
+
+// normalizeTag lowercases tag and keeps only letters, digits, dashes and
+// underscores, so tags compare and query reliably. It returns "" if
+// nothing is left.
+func normalizeTag(tag string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(tag)) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			b.WriteRune(r)
+		case r == ' ' || r == '.':
+			b.WriteRune('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// addTag adds tag to tags unless it's already there.
+func addTag(tags []string, tag string) []string {
+	if tag == "" || slices.Contains(tags, tag) {
+		return tags
+	}
+	return append(tags, tag)
+}
+
+// siteTags returns the site's tags, nil if the store keeps none.
+func (rl *Roulette) siteTags(id int64) []string {
+	store, ok := rl.store.(TagStore)
+	if !ok {
+		return nil
+	}
+	tags, err := store.SiteTags(id)
+	if err != nil {
+		storeLog.Error("Failed to read site tags", "site", id, "err", err)
+	}
+	return tags
+}
+
+// replaceTags sets origin's tags, keyed by site URL. Failures are logged.
+func (rl *Roulette) replaceTags(origin string, byURL map[string][]string) {
+	store, ok := rl.store.(TagStore)
+	if !ok {
+		return
+	}
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		storeLog.Error("Failed to list sites for tagging", "err", err)
+		return
+	}
+	tags := make(map[int64][]string)
+	for _, s := range sites {
+		if t := byURL[s.URL]; len(t) > 0 {
+			tags[s.ID] = t
+		}
+	}
+	if err := store.ReplaceTags(origin, tags); err != nil {
+		storeLog.Error("Failed to store site tags", "origin", origin, "err", err)
+	}
+}
@@ -0,0 +1,248 @@
+package roulette
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxTakedownField = 2000 // Longest contact or reason accepted from the form
+
+// errNoModeration is returned when the store can't keep takedowns.
+var errNoModeration = errors.New("takedowns aren't supported by this store")
+
+// deniedHosts returns the denylist as a set. Errors are logged and mean
+// an empty set, the config blocklist still applies.
+func (rl *Roulette) deniedHosts() map[string]bool {
+	denied := make(map[string]bool)
+	mod, ok := rl.store.(ModerationStore)
+	if !ok {
+		return denied
+	}
+	hosts, err := mod.Denylist()
+	if err != nil {
+		httpLog.Error("Failed to read the denylist", "err", err)
+		return denied
+	}
+	for _, host := range hosts {
+		denied[host] = true
+	}
+	return denied
+}
+
+// excluded reports whether url must stay out of the pool, because of the
+// config blocklist, the network policy, the country policy or the
+// denylist.
+func (rl *Roulette) excluded(url string, denied map[string]bool) bool {
+	c := rl.Config()
+	if c.isBlocked(url) || !c.Network.allowsURL(url) || rl.countryExcluded(url) {
+		return true
+	}
+	host, _ := splitHostPort(url)
+	return denied[host]
+}
+
+// RequestTakedown queues a removal request for the host of target, which
+// may be a URL or a bare host.
+func (rl *Roulette) RequestTakedown(target, contact, reason string) (Takedown, error) {
+	mod, ok := rl.store.(ModerationStore)
+	if !ok {
+		return Takedown{}, errNoModeration
+	}
+	host, _ := splitHostPort(ensureURLScheme(strings.TrimSpace(target)))
+	contact = strings.TrimSpace(contact)
+	reason = strings.TrimSpace(reason)
+	switch {
+	case host == "":
+		return Takedown{}, fmt.Errorf("enter the address of the server to remove")
+	case contact == "":
+		return Takedown{}, fmt.Errorf("enter a way to contact you")
+	case len(contact) > maxTakedownField || len(reason) > maxTakedownField:
+		return Takedown{}, fmt.Errorf("the contact and reason must be under %d characters", maxTakedownField)
+	}
+	if rl.deniedHosts()[host] {
+		return Takedown{}, fmt.Errorf("%s has already been removed", host)
+	}
+	pending, err := mod.Takedowns(TakedownPending)
+	if err != nil {
+		return Takedown{}, err
+	}
+	for _, t := range pending {
+		if t.Host == host {
+			return Takedown{}, fmt.Errorf("a request for %s is already waiting for review", host)
+		}
+	}
+	t, err := mod.AddTakedown(host, contact, reason)
+	if err != nil {
+		return Takedown{}, err
+	}
+	httpLog.Info("Takedown requested", "takedown", t.ID, "host", host)
+	if sites, err := rl.store.List(SiteFilter{}); err == nil {
+		var events []SiteEvent
+		for _, site := range sites {
+			if site.Host == host {
+				events = append(events, siteEvent(site, EventReported, fmt.Sprintf("takedown #%d", t.ID)))
+			}
+		}
+		rl.recordEvents(events...)
+	}
+	return t, nil
+}
+
+// ApproveTakedown denies the request's host for good and removes its
+// sites from the pool. It returns the resolved request and the URLs that
+// were removed.
+func (rl *Roulette) ApproveTakedown(id int64) (Takedown, []string, error) {
+	mod, ok := rl.store.(ModerationStore)
+	if !ok {
+		return Takedown{}, nil, errNoModeration
+	}
+	t, err := mod.ResolveTakedown(id, TakedownApproved)
+	if err != nil {
+		return Takedown{}, nil, err
+	}
+	if err := mod.Deny(t.Host, fmt.Sprintf("takedown #%d", t.ID)); err != nil {
+		return t, nil, err
+	}
+	sites, err := rl.store.List(SiteFilter{})
+	if err != nil {
+		return t, nil, err
+	}
+	var removed []string
+	defer rl.sitesChanged()
+	for _, site := range sites {
+		if site.Host == t.Host {
+			if err := rl.store.Remove(site.URL); err != nil {
+				return t, removed, err
+			}
+			removed = append(removed, site.URL)
+			rl.recordEvents(siteEvent(site, EventRemoved, fmt.Sprintf("takedown #%d approved", t.ID)))
+		}
+	}
+	httpLog.Info("Takedown approved", "takedown", t.ID, "host", t.Host, "removed", len(removed))
+	return t, removed, nil
+}
+
+// RejectTakedown closes the request without changing the pool.
+func (rl *Roulette) RejectTakedown(id int64) (Takedown, error) {
+	mod, ok := rl.store.(ModerationStore)
+	if !ok {
+		return Takedown{}, errNoModeration
+	}
+	t, err := mod.ResolveTakedown(id, TakedownRejected)
+	if err != nil {
+		return Takedown{}, err
+	}
+	httpLog.Info("Takedown rejected", "takedown", t.ID, "host", t.Host)
+	return t, nil
+}
+
+// pendingSnapshot is how a resolved takedown looked before it was resolved.
+func pendingSnapshot(t Takedown) Takedown {
+	t.Status = TakedownPending
+	t.Resolved = time.Time{}
+	return t
+}
+
+// takedownPage is the data the takedown template is rendered with.
+type takedownPage struct {
+	basePage
+	Target  string
+	Contact string
+	Reason  string
+	Error   string
+	Done    bool
+}
+
+// takedownHandler serves the public removal request form.
+func (rl *Roulette) takedownHandler(w http.ResponseWriter, r *http.Request) {
+	page := takedownPage{basePage: rl.pageBase(w, r), Target: r.FormValue("url")}
+	if r.Method == http.MethodPost {
+		page.Contact = r.FormValue("contact")
+		page.Reason = r.FormValue("reason")
+		status, err := rl.admitSubmission(r)
+		if err == nil && shadowed(r) {
+			// Looks accepted, but never reaches the queue
+			rl.render(w, "takedown.html", takedownPage{basePage: page.basePage, Done: true})
+			return
+		}
+		if err == nil {
+			status = http.StatusBadRequest
+			_, err = rl.RequestTakedown(page.Target, page.Contact, page.Reason)
+		}
+		if err != nil {
+			page.Error = err.Error()
+			if e, ok := err.(errTooManySubmissions); ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(e.retryAfter.Seconds())+1))
+			}
+			w.WriteHeader(status)
+		} else {
+			page.Done = true
+		}
+	}
+	rl.render(w, "takedown.html", page)
+}
+
+// takedownQueuePage is the data the admin takedowns template is rendered
+// with.
+type takedownQueuePage struct {
+	basePage
+	Pending   []Takedown
+	Error     string
+	Supported bool
+}
+
+// adminTakedownsHandler lists pending takedowns and resolves them on
+// POST /admin/takedowns/{id}/approve or reject.
+func (rl *Roulette) adminTakedownsHandler(w http.ResponseWriter, r *http.Request) {
+	page := takedownQueuePage{basePage: rl.pageBase(w, r)}
+	if r.Method == http.MethodPost {
+		id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid takedown ID", http.StatusBadRequest)
+			return
+		}
+		target := "takedown #" + r.PathValue("id")
+		switch r.PathValue("action") {
+		case "approve":
+			var t Takedown
+			var removed []string
+			t, removed, err = rl.ApproveTakedown(id)
+			if t.ID != 0 {
+				rl.audit(r, AuditTakedownApprove, target, pendingSnapshot(t), map[string]any{"takedown": t, "denied": t.Host, "removed": removed})
+			}
+		case "reject":
+			var t Takedown
+			t, err = rl.RejectTakedown(id)
+			if err == nil {
+				rl.audit(r, AuditTakedownReject, target, pendingSnapshot(t), t)
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			httpLog.Error("Failed to resolve takedown", "takedown", id, "err", err)
+			page.Error = err.Error()
+		} else {
+			// Back to the queue from /admin/takedowns/{id}/{action}
+			redirectRelative(w, "../../takedowns")
+			return
+		}
+	}
+
+	mod, ok := rl.store.(ModerationStore)
+	page.Supported = ok
+	if ok {
+		pending, err := mod.Takedowns(TakedownPending)
+		if err != nil {
+			httpLog.Error("Failed to list takedowns", "err", err)
+			page.Error = err.Error()
+		}
+		page.Pending = pending
+	}
+	rl.render(w, "takedowns.html", page)
+}
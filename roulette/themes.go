@@ -0,0 +1,130 @@
+package roulette
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+const themeCacheFor = 30 * time.Second // How long a theme's pool is reused, like the picker's
+
+// Theme narrows the default shuffle to a themed pool while its schedule
+// matches, such as old sites only on Thursdays. Sites must pass every
+// filter set.
+type Theme struct {
+	// Name is shown on the index page while the theme is on
+	Name string `json:"name"`
+	// Schedule is a cron expression, in UTC, for the minutes the theme is
+	// on: "* * * * 4" is all of Thursday
+	Schedule string `json:"schedule"`
+	// ModifiedBefore keeps sites whose files last changed before this
+	// date, like "2015-01-01". Ages come from probe.age_samples.
+	ModifiedBefore string `json:"modified_before,omitempty"`
+	// Tags keeps sites with any of these tags
+	Tags []string `json:"tags,omitempty"`
+	// Ports keeps sites on any of these ports
+	Ports []int `json:"ports,omitempty"`
+
+	schedule cronSchedule
+	before   time.Time
+}
+
+// parse checks the theme and fills in its parsed fields.
+func (t *Theme) parse() error {
+	if t.Name == "" {
+		return fmt.Errorf("shuffle themes need a name")
+	}
+	schedule, err := parseCron(t.Schedule)
+	if err != nil {
+		return fmt.Errorf("theme %q: %v", t.Name, err)
+	}
+	t.schedule = schedule
+	if t.ModifiedBefore != "" {
+		if t.before, err = time.Parse(time.DateOnly, t.ModifiedBefore); err != nil {
+			return fmt.Errorf("theme %q: modified_before must be a date like 2015-01-01", t.Name)
+		}
+	}
+	for i, tag := range t.Tags {
+		if t.Tags[i] = normalizeTag(tag); t.Tags[i] == "" {
+			return fmt.Errorf("theme %q: tag %q is empty once normalized", t.Name, tag)
+		}
+	}
+	if t.before.IsZero() && len(t.Tags) == 0 && len(t.Ports) == 0 {
+		return fmt.Errorf("theme %q doesn't narrow the pool, give it a filter", t.Name)
+	}
+	return nil
+}
+
+// activeTheme returns the first theme whose schedule matches now, nil if
+// none does.
+func (c *Config) activeTheme(now time.Time) *Theme {
+	for i := range c.Shuffle.Themes {
+		if t := &c.Shuffle.Themes[i]; t.schedule.matches(now.UTC()) {
+			return t
+		}
+	}
+	return nil
+}
+
+// themeFilters caches the filter of the theme last used.
+type themeFilters struct {
+	mu    sync.Mutex
+	theme string // The filterKey of the theme
+	keep  func(Site) bool
+	built time.Time
+}
+
+// filterKey identifies what the theme keeps, so a theme reloaded with the
+// same name but other filters isn't served from the old one's cache.
+func (t *Theme) filterKey() string {
+	return fmt.Sprintf("%s %s %q %v", t.Name, t.ModifiedBefore, t.Tags, t.Ports)
+}
+
+// themeFilter returns a filter keeping the sites in theme's pool, and a
+// key naming it for pickCached, which changes whenever it's rebuilt.
+func (rl *Roulette) themeFilter(theme *Theme) (keep func(Site) bool, key string) {
+	f := &rl.themes
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.theme == theme.filterKey() && time.Since(f.built) < themeCacheFor {
+		return f.keep, f.key()
+	}
+	var tagged map[int64][]string
+	if len(theme.Tags) > 0 {
+		if store, ok := rl.store.(TagStore); ok {
+			var err error
+			if tagged, err = store.AllTags(); err != nil {
+				storeLog.Error("Failed to read site tags", "err", err)
+			}
+		}
+	}
+	var modified func(Site) bool
+	if !theme.before.IsZero() {
+		rl.ages.once.Do(rl.loadSiteAges)
+		rl.ages.mu.Lock()
+		ages := rl.ages.of // Replaced on reload, never changed
+		rl.ages.mu.Unlock()
+		modified = func(s Site) bool {
+			m, ok := ages[s.ID]
+			return ok && m.Before(theme.before)
+		}
+	}
+	tags, ports := theme.Tags, theme.Ports
+	f.keep = func(s Site) bool {
+		if len(ports) > 0 && !slices.Contains(ports, s.Port) {
+			return false
+		}
+		if len(tags) > 0 && !slices.ContainsFunc(tagged[s.ID], func(t string) bool { return slices.Contains(tags, t) }) {
+			return false
+		}
+		return modified == nil || modified(s)
+	}
+	f.theme, f.built = theme.filterKey(), time.Now()
+	return f.keep, f.key()
+}
+
+// key names the filter last built. The caller holds mu.
+func (f *themeFilters) key() string {
+	return fmt.Sprintf("%s@%d", f.theme, f.built.UnixNano())
+}
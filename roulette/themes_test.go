@@ -0,0 +1,28 @@
+package roulette
+
+import "testing"
+
+// TestThemeFilterReload checks that a theme reloaded under the same name
+// with other filters is shuffled by its new filters at once.
+func TestThemeFilterReload(t *testing.T) {
+	rl := NewWithStore(DefaultConfig(), NewMemoryStore())
+	defer rl.Close()
+	site := Site{ID: 1, Port: 8000}
+
+	before := &Theme{Name: "ports", Ports: []int{8000}}
+	keep, key := rl.themeFilter(before)
+	if !keep(site) {
+		t.Fatal("the theme doesn't keep a site on its port")
+	}
+	after := &Theme{Name: "ports", Ports: []int{8080}}
+	keep, reloaded := rl.themeFilter(after)
+	if keep(site) {
+		t.Error("the reloaded theme still keeps a site on the old port")
+	}
+	if reloaded == key {
+		t.Error("the reloaded theme's filter has the old key, the picker would reuse its sites")
+	}
+	if _, again := rl.themeFilter(after); again != reloaded {
+		t.Error("the filter was rebuilt for an unchanged theme")
+	}
+}
@@ -0,0 +1,313 @@
+package roulette
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const traceQueueSize = 2048                // Finished spans buffered for export before new ones are dropped
+const traceBatchSize = 512                 // Spans sent per export request
+const traceFlushInterval = 5 * time.Second // Longest a finished span waits to be exported
+const traceExportTimeout = 10 * time.Second
+
+// TracingConfig exports OpenTelemetry traces of the refresh, sync and
+// probe jobs and of HTTP requests, over OTLP/HTTP with JSON encoding.
+// Incoming W3C traceparent headers are continued.
+type TracingConfig struct {
+	// Endpoint is the collector's OTLP/HTTP base URL, such as
+	// http://localhost:4318; spans go to its /v1/traces. Empty turns
+	// tracing off.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Headers are sent with every export, for collectors that want an API
+	// key
+	Headers map[string]string `json:"headers,omitempty"`
+	// ServiceName is the service.name resource attribute, by default
+	// simplehttproulette
+	ServiceName string `json:"service_name,omitempty"`
+}
+
+func (t TracingConfig) serviceName() string {
+	if t.ServiceName == "" {
+		return "simplehttproulette"
+	}
+	return t.ServiceName
+}
+
+// OTLP span kinds and status codes
+const (
+	spanInternal = 1
+	spanServer   = 2
+	statusError  = 2
+)
+
+// span is one timed operation of a trace. A nil *span is a valid span
+// that records nothing, which is what startSpan returns with tracing off.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []spanAttr
+	err     string
+}
+
+type spanKey struct{}
+
+// startSpan starts a span called name, a child of the span in ctx if
+// there is one, and returns ctx carrying it. End it with finish.
+func (rl *Roulette) startSpan(ctx context.Context, name string, attrs ...spanAttr) (context.Context, *span) {
+	return rl.startSpanKind(ctx, name, spanInternal, attrs...)
+}
+
+func (rl *Roulette) startSpanKind(ctx context.Context, name string, kind int, attrs ...spanAttr) (context.Context, *span) {
+	if rl.tracer == nil || rl.Config().Tracing.Endpoint == "" {
+		return ctx, nil
+	}
+	s := &span{tracer: rl.tracer, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok && parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanFromContext returns the span ctx carries, nil if none.
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// set adds attributes to s.
+func (s *span) set(attrs ...spanAttr) {
+	if s != nil {
+		s.attrs = append(s.attrs, attrs...)
+	}
+}
+
+// finish ends s, marking it failed if err isn't nil, and queues it for
+// export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	select {
+	case s.tracer.spans <- s:
+	default:
+		// The exporter is behind, losing a span beats blocking the job
+	}
+}
+
+// spanAttr is an OTLP attribute.
+type spanAttr struct {
+	Key   string    `json:"key"`
+	Value attrValue `json:"value"`
+}
+
+type attrValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // OTLP JSON sends 64-bit ints as strings
+}
+
+func attrString(key, value string) spanAttr {
+	return spanAttr{Key: key, Value: attrValue{StringValue: &value}}
+}
+
+func attrInt(key string, value int) spanAttr {
+	v := strconv.Itoa(value)
+	return spanAttr{Key: key, Value: attrValue{IntValue: &v}}
+}
+
+// tracer exports finished spans in batches from the background.
+type tracer struct {
+	rl    *Roulette
+	spans chan *span
+	stop  chan struct{}
+	done  chan struct{}
+	http  *http.Client
+}
+
+func (rl *Roulette) startTracer() {
+	t := &tracer{
+		rl:    rl,
+		spans: make(chan *span, traceQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		http:  &http.Client{Timeout: traceExportTimeout},
+	}
+	rl.tracer = t
+	go t.run()
+}
+
+// close exports the queued spans and stops the exporter.
+func (t *tracer) close() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) == traceBatchSize {
+				t.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = batch[:0]
+		case <-t.stop:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends batch to the collector. Failures are logged and the spans
+// dropped, traces are best effort.
+func (t *tracer) export(batch []*span) {
+	c := t.rl.Config().Tracing
+	if len(batch) == 0 || c.Endpoint == "" {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(c.serviceName(), batch))
+	if err != nil {
+		appLog.Error("Failed to encode spans", "err", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.Endpoint, "/")+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		appLog.Error("Invalid tracing endpoint", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.http.Do(req)
+	if err != nil {
+		appLog.Warn("Failed to export spans", "count", len(batch), "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		appLog.Warn("Failed to export spans", "count", len(batch), "status", resp.Status)
+	}
+}
+
+// otlpRequest is the ExportTraceServiceRequest for spans, in OTLP's JSON
+// mapping.
+func otlpRequest(service string, spans []*span) map[string]any {
+	out := make([]map[string]any, len(spans))
+	for i, s := range spans {
+		o := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        s.attrs,
+		}
+		if s.parent != [8]byte{} {
+			o["parentSpanId"] = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			o["status"] = map[string]any{"code": statusError, "message": s.err}
+		}
+		out[i] = o
+	}
+	return map[string]any{"resourceSpans": []any{map[string]any{
+		"resource":   map[string]any{"attributes": []spanAttr{attrString("service.name", service)}},
+		"scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "simplehttproulette"}, "spans": out}},
+	}}}
+}
+
+// traced wraps h in a server span per request, continuing the trace of an
+// incoming traceparent header.
+func (rl *Roulette) traced(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rl.Config().Tracing.Endpoint == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		ctx, s := rl.startSpanKind(ctx, "HTTP "+r.Method, spanServer,
+			attrString("http.request.method", r.Method), attrString("url.path", r.URL.Path))
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r.WithContext(ctx))
+		s.set(attrInt("http.response.status_code", sw.status))
+		var err error
+		if sw.status >= 500 {
+			err = fmt.Errorf("%s", http.StatusText(sw.status))
+		}
+		s.finish(err)
+	})
+}
+
+// parseTraceparent reads a W3C traceparent header into a remote parent
+// span, which is never exported itself.
+func parseTraceparent(h string) (*span, bool) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, false
+	}
+	var s span
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	if s.traceID == [16]byte{} || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	return &s, true
+}
+
+// statusRecorder remembers the status code a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,82 @@
+package roulette
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const siteDialTimeout = 30 * time.Second // Upper bound on connecting to a site; the client's timeout is usually shorter
+
+// TransportConfig tunes the connections made to listed sites by probes and
+// the proxy. A sweep touches thousands of hosts once each, so few
+// connections are kept open per host and idle ones are closed soon,
+// keeping a big pool from running out of file descriptors.
+type TransportConfig struct {
+	// MaxConnsPerHost caps the connections open to one host, 0 for no cap
+	MaxConnsPerHost int `json:"max_conns_per_host"`
+	// MaxIdleConns caps the idle connections kept across all hosts
+	MaxIdleConns int `json:"max_idle_conns"`
+	// IdleTimeout is how long an idle connection is kept
+	IdleTimeout Duration `json:"idle_timeout"`
+	// HTTP2 lets HTTPS sites negotiate HTTP/2. It's off by default, the
+	// Python servers most listings run speak HTTP/1 only and some TLS
+	// fronts for them break on HTTP/2.
+	HTTP2 bool `json:"http2"`
+}
+
+// siteTransport is the transport shared by every siteClient, rebuilt when
+// its config changes.
+type siteTransport struct {
+	mu        sync.Mutex
+	config    TransportConfig
+	transport *http.Transport
+}
+
+// siteTransport returns the shared transport for connections to sites.
+// The network policy is checked on every dial, so a reloaded policy takes
+// effect without a new transport.
+func (rl *Roulette) siteTransport() *http.Transport {
+	c := rl.Config().Transport
+	st := &rl.transport
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.transport != nil && st.config == c {
+		return st.transport
+	}
+	if st.transport != nil {
+		st.transport.CloseIdleConnections()
+	}
+	dialer := &net.Dialer{
+		Timeout: siteDialTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !rl.Config().Network.allows(ip) {
+				return fmt.Errorf("%w: %s", errAddressNotAllowed, host)
+			}
+			return nil
+		},
+	}
+	t := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: siteDialTimeout,
+		MaxConnsPerHost:     c.MaxConnsPerHost,
+		MaxIdleConns:        c.MaxIdleConns,
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     time.Duration(c.IdleTimeout),
+		ForceAttemptHTTP2:   c.HTTP2,
+	}
+	if !c.HTTP2 {
+		// A non-nil empty map is what turns HTTP/2 off for good
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	st.config, st.transport = c, t
+	return t
+}
@@ -0,0 +1,86 @@
+package roulette
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const urlsWatchInterval = 2 * time.Second // How often the URL lists are checked for edits
+
+// listStamp tells versions of the URL lists apart without reading them.
+type listStamp string
+
+func stampOf(path string, info os.FileInfo) listStamp {
+	return listStamp(fmt.Sprintf("%s:%d:%d;", path, info.ModTime().UnixNano(), info.Size()))
+}
+
+// currentStamp returns the stamp of the URL lists as they are now.
+func (c *Config) currentStamp() listStamp {
+	var stamp listStamp
+	for _, f := range c.listFiles() {
+		if info, err := os.Stat(f.path); err == nil {
+			stamp += stampOf(f.path, info)
+		}
+	}
+	return stamp
+}
+
+// urlsWatch remembers the version of the URL lists last synced, so edits
+// made by hand are noticed and the program's own writes aren't synced
+// twice.
+type urlsWatch struct {
+	mu     sync.Mutex
+	synced listStamp
+}
+
+func (w *urlsWatch) saw(s listStamp) {
+	w.mu.Lock()
+	w.synced = s
+	w.mu.Unlock()
+}
+
+func (w *urlsWatch) changed(s listStamp) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return s != w.synced
+}
+
+// startURLsWatch syncs the pool whenever a URL list changes, while
+// WatchURLsFile is on, until ctx is cancelled. A change is synced once
+// the lists have stopped changing for one check, so editors saving in
+// several writes cause a single sync.
+func (rl *Roulette) startURLsWatch(ctx context.Context) {
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		ticker := time.NewTicker(urlsWatchInterval)
+		defer ticker.Stop()
+		var pending listStamp
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			c := rl.Config()
+			if !c.WatchURLsFile {
+				continue
+			}
+			stamp := c.currentStamp()
+			if !rl.urlsWatch.changed(stamp) {
+				pending = ""
+				continue
+			}
+			if stamp != pending {
+				pending = stamp
+				continue
+			}
+			syncLog.Info("URL list changed, syncing", "path", c.URLsFile)
+			pending = ""
+			rl.sync(ctx, SourceFile)
+		}
+	}()
+}
@@ -0,0 +1,298 @@
+package roulette
+
+import (
+	"fmt"
+	"html"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const verifyEntriesShown = 15 // Listing entries shown with a site to classify
+
+// Classes players sort sites into on /verify
+const (
+	ClassOpenDir   = "open_dir"   // A real directory listing
+	ClassErrorPage = "error_page" // An error or placeholder page
+	ClassHoneypot  = "honeypot"   // A fake listing set up to catch visitors
+	ClassOther     = "other"      // Anything else
+)
+
+// verifyClasses are the classes in the order /verify offers them, with
+// their labels.
+var verifyClasses = []struct{ Class, Label string }{
+	{ClassOpenDir, "Open directory"},
+	{ClassErrorPage, "Error page"},
+	{ClassHoneypot, "Honeypot"},
+	{ClassOther, "Something else"},
+}
+
+// classTags are the tags consensus gives sites, by class.
+var classTags = map[string]string{ClassOpenDir: "verified", ClassErrorPage: "error-page", ClassHoneypot: "honeypot"}
+
+var titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// VerifyConfig runs /verify, where logged in visitors classify the sites
+// nobody has yet. Once enough agree, open directories are tagged verified
+// and anything else is marked down and no longer shuffled to.
+type VerifyConfig struct {
+	// Enabled serves /verify
+	Enabled bool `json:"enabled"`
+	// Votes is how many players must agree on a class to settle a site
+	Votes int `json:"votes"`
+}
+
+// Vote is a player's classification of a site.
+type Vote struct {
+	SiteID int64
+	UserID int64
+	Class  string
+	Time   time.Time
+}
+
+// VoteStore is implemented by stores that keep /verify votes.
+type VoteStore interface {
+	// AddVote records v, replacing the user's earlier vote on the site.
+	AddVote(v Vote) error
+	// Votes returns every vote by site ID.
+	Votes() (map[int64][]Vote, error)
+}
+
+// playerVerdicts caches the classes players settled sites on, since shuffle
+// checks every pick against them. It's worked out again after every vote.
+type playerVerdicts struct {
+	mu      sync.Mutex
+	byClass map[int64]string
+	voted   map[int64]map[int64]bool // Sites by ID, then the users who voted
+	once    sync.Once                // Loads the stored votes before the first lookup
+}
+
+// consensus returns the class votes agree on, "" if there isn't one: it
+// needs need votes and more than any other class.
+func consensus(votes []Vote, need int) string {
+	counts := make(map[string]int)
+	for _, v := range votes {
+		counts[v.Class]++
+	}
+	best, tied := "", false
+	for class, n := range counts {
+		switch {
+		case n > counts[best]:
+			best, tied = class, false
+		case n == counts[best]:
+			tied = true
+		}
+	}
+	if tied || counts[best] < need {
+		return ""
+	}
+	return best
+}
+
+// loadVerdicts works out the settled classes from the stored votes and
+// tags the sites. It returns the consensus reached on sites that had none
+// before.
+func (rl *Roulette) loadVerdicts() map[int64]string {
+	store, ok := rl.store.(VoteStore)
+	if !ok {
+		return nil
+	}
+	all, err := store.Votes()
+	if err != nil {
+		storeLog.Error("Failed to read votes", "err", err)
+		return nil
+	}
+	need := rl.Config().Verify.Votes
+	byClass := make(map[int64]string)
+	voted := make(map[int64]map[int64]bool)
+	for id, votes := range all {
+		voted[id] = make(map[int64]bool)
+		for _, v := range votes {
+			voted[id][v.UserID] = true
+		}
+		if class := consensus(votes, need); class != "" {
+			byClass[id] = class
+		}
+	}
+	v := &rl.verdicts
+	v.mu.Lock()
+	settled := make(map[int64]string)
+	if v.byClass != nil {
+		for id, class := range byClass {
+			if v.byClass[id] != class {
+				settled[id] = class
+			}
+		}
+	}
+	v.byClass, v.voted = byClass, voted
+	v.mu.Unlock()
+	if tags, ok := rl.store.(TagStore); ok {
+		byID := make(map[int64][]string)
+		for id, class := range byClass {
+			if tag := classTags[class]; tag != "" {
+				byID[id] = []string{tag}
+			}
+		}
+		if err := tags.ReplaceTags(TagOriginVerify, byID); err != nil {
+			storeLog.Error("Failed to store site tags", "origin", TagOriginVerify, "err", err)
+		}
+	}
+	return settled
+}
+
+// verdictOf returns the class players settled the site on, if they did.
+func (rl *Roulette) verdictOf(id int64) (string, bool) {
+	v := &rl.verdicts
+	v.once.Do(func() { rl.loadVerdicts() })
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	class, ok := v.byClass[id]
+	return class, ok
+}
+
+// rejected reports whether players settled the site on anything but an
+// open directory, which keeps it out of shuffles.
+func (rl *Roulette) rejected(id int64) bool {
+	class, ok := rl.verdictOf(id)
+	return ok && class != ClassOpenDir
+}
+
+// nextToVerify picks a site that is up, unsettled and not yet classified
+// by the user, ok false if there's none.
+func (rl *Roulette) nextToVerify(userID int64) (Site, bool, error) {
+	sites, err := rl.store.List(SiteFilter{Status: StatusUp})
+	if err != nil {
+		return Site{}, false, err
+	}
+	v := &rl.verdicts
+	v.once.Do(func() { rl.loadVerdicts() })
+	v.mu.Lock()
+	var candidates []Site
+	for _, s := range sites {
+		if _, settled := v.byClass[s.ID]; !settled && !v.voted[s.ID][userID] {
+			candidates = append(candidates, s)
+		}
+	}
+	v.mu.Unlock()
+	if len(candidates) == 0 {
+		return Site{}, false, nil
+	}
+	return candidates[rand.Intn(len(candidates))], true, nil
+}
+
+// verifyPage is the data the verify template is rendered with.
+type verifyPage struct {
+	basePage
+	Providers []string // Names of the OAuth login providers, when logged out
+	LoggedOut bool
+	Error     string
+	Site      Site // Zero when there's nothing left to classify
+	Link      string
+	Title     string
+	Entries   []string
+	Classes   []struct{ Class, Label string }
+}
+
+// verifyHandler shows the logged in player a site to classify and, on
+// POST, records their vote on the site in the site field.
+func (rl *Roulette) verifyHandler(w http.ResponseWriter, r *http.Request) {
+	c := rl.Config()
+	store, ok := rl.store.(VoteStore)
+	if !c.Verify.Enabled || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	page := verifyPage{basePage: rl.pageBase(w, r), Classes: verifyClasses}
+	user := rl.loggedInUser(r)
+	if user == nil {
+		page.LoggedOut = true
+		for _, p := range c.OAuth {
+			page.Providers = append(page.Providers, p.Name)
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		rl.render(w, "verify.html", page)
+		return
+	}
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		// Shadow banned clients' votes look counted, but aren't
+		if !shadowed(r) {
+			status, page.Error = rl.castVote(store, user, r)
+		}
+		if page.Error == "" {
+			redirectRelative(w, "verify")
+			return
+		}
+	}
+	site, ok, err := rl.nextToVerify(user.ID)
+	if err != nil {
+		httpLog.Error("Failed to pick a site to verify", "err", err)
+		http.Error(w, "Failed to pick a site", http.StatusInternalServerError)
+		return
+	}
+	if ok {
+		page.Site, page.Link = site, rl.outPath(site)
+		page.Title, page.Entries = rl.listingPreview(site)
+		page.Entries = page.Entries[:min(len(page.Entries), verifyEntriesShown)]
+	}
+	w.WriteHeader(status)
+	rl.render(w, "verify.html", page)
+}
+
+// castVote records the vote a POST to /verify makes, returning the status
+// and error to show if it can't. A vote that settles a site applies the
+// verdict.
+func (rl *Roulette) castVote(store VoteStore, user *User, r *http.Request) (int, string) {
+	id, err := strconv.ParseInt(r.FormValue("site"), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, "No site given"
+	}
+	class := r.FormValue("class")
+	if _, ok := classTags[class]; !ok && class != ClassOther {
+		return http.StatusBadRequest, "Unknown class"
+	}
+	site, err := rl.store.Site(id)
+	if err == errNoSuchSite {
+		return http.StatusNotFound, "That site is no longer in the pool"
+	}
+	if err != nil {
+		httpLog.Error("Failed to look up site", "site", id, "err", err)
+		return http.StatusInternalServerError, "Failed to record the vote"
+	}
+	if _, settled := rl.verdictOf(id); settled {
+		return 0, ""
+	}
+	if err := store.AddVote(Vote{SiteID: id, UserID: user.ID, Class: class, Time: time.Now().UTC()}); err != nil {
+		httpLog.Error("Failed to record vote", "err", err)
+		return http.StatusInternalServerError, "Failed to record the vote"
+	}
+	if settled, ok := rl.loadVerdicts()[id]; ok {
+		httpLog.Info("Players settled a site", "site", id, "class", settled)
+		if settled != ClassOpenDir {
+			rl.markDown(site, fmt.Sprintf("players classified it as %s", strings.ReplaceAll(settled, "_", " ")))
+		}
+	}
+	return 0, ""
+}
+
+// listingPreview returns the title and entries of the site's listing,
+// from its snapshot. Both are empty without one.
+func (rl *Roulette) listingPreview(site Site) (string, []string) {
+	snap, ok := rl.siteSnapshot(site.ID)
+	if !ok {
+		return "", nil
+	}
+	body, err := snap.html()
+	if err != nil {
+		return "", nil
+	}
+	var title string
+	if m := titlePattern.FindSubmatch(body); m != nil {
+		title = sanitizeText(html.UnescapeString(string(m[1])), 200)
+	}
+	return title, listingEntries(site.URL, body)
+}
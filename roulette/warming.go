@@ -0,0 +1,70 @@
+package roulette
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const warmingRetryAfter = 30 * time.Second // How soon clients are asked to retry while the pool is empty
+const bootstrapEvery = 10 * time.Minute    // Least time between refreshes started because the pool was empty
+
+// bootstrapper starts a refresh in the background when the pool turns out
+// to be empty, at most once per bootstrapEvery.
+type bootstrapper struct {
+	mu      sync.Mutex
+	running bool
+	last    time.Time
+}
+
+// bootstrap refreshes from Shodan in the background, unless that isn't
+// possible or one was started recently.
+func (rl *Roulette) bootstrap() {
+	if rl.Config().Demo || !rl.HasShodanAPIKey() {
+		return
+	}
+	b := &rl.bootstrapper
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running || time.Since(b.last) < bootstrapEvery {
+		return
+	}
+	b.running = true
+	b.last = time.Now()
+	shodanLog.Info("The pool is empty, refreshing from Shodan")
+	rl.jobs.Add(1)
+	go func() {
+		defer rl.jobs.Done()
+		err := rl.Refresh(context.Background())
+		if err != nil && err != ErrNotLeader {
+			shodanLog.Error("Bootstrap refresh failed", "err", err)
+		}
+		b.mu.Lock()
+		b.running = false
+		b.mu.Unlock()
+	}()
+}
+
+// retryAfterWarming tells the client to come back once the pool may have
+// filled.
+func retryAfterWarming(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(warmingRetryAfter.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// warmingPage is the data the warming template is rendered with.
+type warmingPage struct {
+	basePage
+	Retry int // Seconds until the page reloads itself
+}
+
+// renderWarming answers /shuffle while the pool is empty, with a page
+// that retries by itself.
+func (rl *Roulette) renderWarming(w http.ResponseWriter, r *http.Request) {
+	rl.bootstrap()
+	retryAfterWarming(w)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	rl.render(w, "warming.html", warmingPage{basePage: rl.pageBase(w, r), Retry: int(warmingRetryAfter.Seconds())})
+}
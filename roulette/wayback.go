@@ -0,0 +1,131 @@
+package roulette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const waybackAPI = "https://archive.org/wayback/available"
+const liveCheckTimeout = 3 * time.Second // Per site checked before a redirect
+const waybackTimeout = 5 * time.Second
+const waybackCacheFor = time.Hour // Snapshot lookups, found or not, are reused this long
+const waybackCacheSize = 10000    // Lookups cached before the cache is emptied
+
+// waybackCache remembers the latest snapshot of recently looked up URLs.
+type waybackCache struct {
+	mu      sync.Mutex
+	entries map[string]waybackEntry
+}
+
+type waybackEntry struct {
+	snapshot string // Empty if there is none
+	fetched  time.Time
+}
+
+// siteAlive reports whether site answers right now, for the check before a
+// redirect.
+func (rl *Roulette) siteAlive(ctx context.Context, site Site) bool {
+	result := probeSite(ctx, rl.siteClient(liveCheckTimeout), site.URL, rl.Config().Outbound.robotsName())
+	return result.Status == StatusUp
+}
+
+// waybackSnapshot returns the URL of the Wayback Machine's latest good
+// snapshot of url, or "" if it has none or can't be reached.
+func (rl *Roulette) waybackSnapshot(ctx context.Context, url string) string {
+	c := &rl.wayback
+	c.mu.Lock()
+	e, ok := c.entries[url]
+	c.mu.Unlock()
+	if ok && time.Since(e.fetched) < waybackCacheFor {
+		return e.snapshot
+	}
+	snapshot, err := fetchWaybackSnapshot(ctx, url)
+	if err != nil {
+		// Not cached, the next lookup tries again
+		httpLog.Warn("Failed to look up Wayback snapshot", "url", url, "err", err)
+		return ""
+	}
+	c.mu.Lock()
+	if c.entries == nil || len(c.entries) >= waybackCacheSize {
+		c.entries = make(map[string]waybackEntry)
+	}
+	c.entries[url] = waybackEntry{snapshot: snapshot, fetched: time.Now()}
+	c.mu.Unlock()
+	return snapshot
+}
+
+func fetchWaybackSnapshot(ctx context.Context, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, waybackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, waybackAPI+"?url="+neturl.QueryEscape(url), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", resp.Status)
+	}
+	var answer struct {
+		ArchivedSnapshots struct {
+			Closest struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+				Status    string `json:"status"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return "", err
+	}
+	closest := answer.ArchivedSnapshots.Closest
+	if !closest.Available || closest.Status != "200" || !strings.HasPrefix(closest.URL, "http") {
+		return "", nil
+	}
+	return strings.Replace(closest.URL, "http://", "https://", 1), nil
+}
+
+// markDown records that site was found down outside a probe run, so it
+// loses its odds until the next probe finds it up again.
+func (rl *Roulette) markDown(site Site, detail string) {
+	if site.Status == StatusDown {
+		return
+	}
+	if err := rl.store.UpdateStatus(site.ID, StatusDown, time.Now()); err != nil {
+		httpLog.Error("Failed to mark site down", "site", site.ID, "err", err)
+		return
+	}
+	rl.sitesChanged()
+	rl.recordEvents(siteEvent(site, EventQuarantined, detail))
+}
+
+// shuffleLive is shuffle with the optional check that the site answers
+// before a visitor is sent there. Down sites are skipped or, with
+// Shuffle.Wayback, archived is the snapshot to send the visitor to instead.
+func (rl *Roulette) shuffleLive(ctx context.Context, opts shuffleOptions) (site Site, threat, archived string, err error) {
+	c := rl.Config().Shuffle
+	for attempt := 0; attempt < shuffleAttempts; attempt++ {
+		site, threat, err = rl.shuffle(ctx, opts)
+		if err != nil || !c.LiveCheck || rl.siteAlive(ctx, site) {
+			return site, threat, "", err
+		}
+		rl.markDown(site, "failed the check before a redirect")
+		if c.Wayback {
+			if snapshot := rl.waybackSnapshot(ctx, site.URL); snapshot != "" {
+				httpLog.Debug("Site is down, sending its Wayback snapshot", "url", site.URL)
+				return site, threat, snapshot, nil
+			}
+		}
+		httpLog.Debug("Skipping site that is down", "url", site.URL)
+	}
+	return Site{}, "", "", errNoSuitableSite
+}
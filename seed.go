@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runSeed fills the pool with made up sites, for developing the UI, probes
+// and performance work without touching the real internet.
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	fake := fs.Int("fake", 0, "number of fake sites to add")
+	base := fs.String("base", "http://127.0.0.1:8080/fake/", "URL of the /fake/ path of the server that will serve them")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s seed --fake N [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *fake <= 0 {
+		fs.Usage()
+		return fmt.Errorf("--fake must be positive")
+	}
+
+	rl, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	added, err := rl.SeedFake(*base, *fake)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %d fake sites to %s\n", added, rl.Config().URLsFile)
+	if !rl.Config().FakeSites {
+		fmt.Fprintln(os.Stderr, "Set fake_sites in the config so the server answers them")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"simplehttproulette/roulette"
+)
+
+const shutdownTimeout = 10 * time.Second // How long to wait for in-flight requests on shutdown
+
+// jobs tracks the server's own background goroutines (signal handling,
+// watchdog) so shutdown can wait for them
+var jobs sync.WaitGroup
+
+// runServe starts the web server. It is the default command.
+func runServe(args []string) error {
+	// Cancel background work when we are asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serve(ctx, args)
+}
+
+// serve runs the web server until ctx is cancelled.
+func serve(ctx context.Context, args []string) error {
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	fs.StringVar(&storage.TemplatesDir, "templates", storage.TemplatesDir, "directory of templates and static/ files that override the built-in ones")
+	listenAddr := fs.String("listen", "", "address to listen on: host:port, :port, unix:/path/to.sock, or systemd:[NAME] for a socket-activated listener (default the systemd socket, $PORT or "+defaultListenAddr+")")
+	var tlsOpts tlsOptions
+	fs.StringVar(&tlsOpts.CertFile, "tls-cert", "", "serve HTTPS using this PEM certificate file")
+	fs.StringVar(&tlsOpts.KeyFile, "tls-key", "", "PEM private key for --tls-cert")
+	fs.StringVar(&tlsOpts.AutocertHosts, "autocert-hosts", "", "comma-separated hostnames to obtain Let's Encrypt certificates for")
+	fs.StringVar(&tlsOpts.AutocertCache, "autocert-cache", "autocert-cache", "directory for storing Let's Encrypt certificates")
+	fs.StringVar(&tlsOpts.RedirectAddr, "http-redirect", "", "when serving HTTPS, also listen on this address and redirect HTTP to HTTPS (:80 is typical)")
+	debugAddr := fs.String("debug-listen", "", "also serve pprof and /debug/vars to admins on this address, such as localhost:6060")
+	fs.Parse(args)
+	slog.Info("Simple HTTP Roulette", "version", roulette.GetBuildInfo().String())
+
+	// Everything goes through the gate, which holds requests back until the
+	// database is ready and, on a first run, serves the setup wizard
+	gate := newSetupGate(storage.TemplatesDir)
+	var setupToken string
+	if storage.needsSetup() {
+		configPath := storage.ConfigPath
+		if configPath == "" {
+			configPath = defaultSetupConfigPath
+		}
+		setupToken = gate.begin(configPath)
+	}
+
+	// Issued certificates are data too
+	tlsOpts.AutocertCache = storage.dataPath(tlsOpts.AutocertCache)
+
+	// Start the server
+	ln, err := listen(resolveListenAddr(*listenAddr))
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: gate, MaxHeaderBytes: roulette.MaxHeaderBytes}
+	var redirectServer *http.Server
+	if tlsOpts.enabled() {
+		_, httpsPort, _ := net.SplitHostPort(ln.Addr().String())
+		tlsConfig, redirectHandler, err := tlsOpts.build(httpsPort)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = tlsConfig
+		ln = tls.NewListener(ln, tlsConfig)
+
+		if tlsOpts.RedirectAddr != "" {
+			redirectLn, err := listen(tlsOpts.RedirectAddr)
+			if err != nil {
+				return err
+			}
+			redirectServer = &http.Server{Handler: redirectHandler, MaxHeaderBytes: roulette.MaxHeaderBytes}
+			go func() {
+				if err := redirectServer.Serve(redirectLn); err != nil && err != http.ErrServerClosed {
+					slog.Error("HTTP redirect listener stopped", "err", err)
+				}
+			}()
+		}
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(ln)
+	}()
+
+	// On a first run, wait for the wizard before touching any storage
+	fetchNow := false
+	if setupToken != "" {
+		slog.Warn("No configuration found, finish setup in the browser", "url", displayAddr(ln, tlsOpts.enabled())+"/setup?token="+setupToken)
+		select {
+		case result := <-gate.done:
+			storage.ConfigPath = result.configPath
+			fetchNow = result.fetchNow
+		case err := <-serveErr:
+			return fmt.Errorf("server stopped: %v", err)
+		case <-ctx.Done():
+			server.Close()
+			return nil
+		}
+	}
+
+	// Initialize the database and populate it immediately on start
+	rl, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+	// Deferred calls run last-in first-out: stop the background jobs before Close waits for them
+	defer stop()
+	rand.Seed(time.Now().UnixNano())
+
+	rl.Start(ctx)
+	if fetchNow {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			if err := rl.Refresh(ctx); err != nil {
+				slog.Error("Refresh failed", "err", err)
+			}
+		}()
+	}
+	handleReloadSignal(ctx, rl)
+	gate.ready(rl.Handler())
+	var debugServer *http.Server
+	if *debugAddr != "" {
+		if debugServer, err = serveDebug(*debugAddr, rl); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Server started at %s\n", displayAddr(ln, tlsOpts.enabled()))
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Error("Failed to notify systemd", "err", err)
+	}
+	startWatchdog(ctx, rl)
+
+	select {
+	case err := <-serveErr:
+		return fmt.Errorf("server stopped: %v", err)
+	case <-ctx.Done():
+	}
+
+	// Drain in-flight requests before the deferred DB close runs
+	slog.Info("Shutting down")
+	sdNotify("STOPPING=1")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Error during shutdown", "err", err)
+	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+	if debugServer != nil {
+		// Profiles can run for a while, don't wait for them
+		debugServer.Close()
+	}
+	jobs.Wait()
+	return nil
+}
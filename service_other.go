@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "fmt"
+
+func runService(args []string) error {
+	return fmt.Errorf("the service command is only available on Windows, use systemd elsewhere")
+}
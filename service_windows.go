@@ -0,0 +1,154 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"simplehttproulette/roulette"
+)
+
+const serviceName = "SimpleHTTPRoulette"
+const serviceDisplayName = "Simple HTTP Roulette"
+
+// runService installs, removes or runs the roulette as a Windows service.
+// Flags after install are stored with the service and passed to serve.
+func runService(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s service install|uninstall|run [serve flags]", os.Args[0])
+	}
+	switch args[0] {
+	case "install":
+		return installService(args[1:])
+	case "uninstall":
+		return uninstallService()
+	case "run":
+		return runAsService(args[1:])
+	}
+	return fmt.Errorf("unknown service command %q", args[0])
+}
+
+func installService(serveArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %v", err)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDisplayName,
+		Description: "Redirects visitors to random open directory listings",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, serveArgs...)...)
+	if err != nil {
+		return fmt.Errorf("failed to create service: %v", err)
+	}
+	defer s.Close()
+	fmt.Printf("Installed service %s\n", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %v", err)
+	}
+	fmt.Printf("Removed service %s\n", serviceName)
+	return nil
+}
+
+// runAsService serves under the service control manager. Services start in
+// System32, so relative paths are resolved against the executable's
+// directory, and logs go to a file there since there is no console.
+func runAsService(serveArgs []string) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("failed to detect service environment: %v", err)
+	}
+	if !isService {
+		return fmt.Errorf("service run must be started by the service manager, use serve to run interactively")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %v", err)
+	}
+	dir := filepath.Dir(exe)
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("failed to change to %s: %v", dir, err)
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, "roulette-service.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open service log: %v", err)
+	}
+	defer logFile.Close()
+	roulette.SetupLogging(roulette.RedactSecrets(logFile))
+
+	return svc.Run(serviceName, &rouletteService{args: serveArgs})
+}
+
+// rouletteService adapts serve to the svc.Handler interface.
+type rouletteService struct {
+	args []string
+}
+
+func (s *rouletteService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, s.args)
+	}()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				slog.Error("Server stopped", "err", err)
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second) / time.Millisecond)}
+				cancel()
+				if err := <-done; err != nil {
+					slog.Error("Server stopped", "err", err)
+				}
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"simplehttproulette/roulette"
+)
+
+// defaultSetupConfigPath is where the setup wizard writes the config when
+// --config wasn't given.
+const defaultSetupConfigPath = "roulette.json"
+
+// setupGate sits in front of the real routes. While setup is pending it
+// serves only the first-run wizard; after that it gets out of the way.
+type setupGate struct {
+	templatesDir string
+
+	mu         sync.Mutex
+	next       http.Handler
+	pending    bool   // The wizard is active
+	starting   bool   // The wizard is done but the server isn't ready yet
+	token      string // One-time secret printed to the log, required to submit
+	configPath string // Where the wizard writes the config
+	done       chan setupResult
+}
+
+// setupResult is what the wizard hands back to runServe.
+type setupResult struct {
+	configPath string
+	fetchNow   bool
+}
+
+func newSetupGate(templatesDir string) *setupGate {
+	return &setupGate{templatesDir: templatesDir, starting: true}
+}
+
+// begin activates the wizard and returns the token needed to complete it.
+func (g *setupGate) begin(configPath string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate setup token: %v", err)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending = true
+	g.token = hex.EncodeToString(b)
+	g.configPath = configPath
+	g.done = make(chan setupResult, 1)
+	return g.token
+}
+
+// ready switches the gate over to next for good.
+func (g *setupGate) ready(next http.Handler) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.next = next
+	g.pending = false
+	g.starting = false
+}
+
+func (g *setupGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	pending, starting, next := g.pending, g.starting, g.next
+	g.mu.Unlock()
+
+	switch {
+	case pending && r.URL.Path == "/setup":
+		roulette.LimitBodies(http.HandlerFunc(g.serveSetup), roulette.DefaultMaxBodyBytes).ServeHTTP(w, r)
+	case pending:
+		http.Redirect(w, r, "/setup", http.StatusSeeOther)
+	case starting:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Starting up, try again in a moment", http.StatusServiceUnavailable)
+	default:
+		next.ServeHTTP(w, r)
+	}
+}
+
+// setupPage is the data rendered into setup.html.
+type setupPage struct {
+	Token      string
+	Queries    string
+	StorageDir string
+	Error      string
+	Done       bool
+}
+
+func (g *setupGate) serveSetup(w http.ResponseWriter, r *http.Request) {
+	page := setupPage{
+		Token:      r.FormValue("token"),
+		Queries:    roulette.DefaultShodanQuery,
+		StorageDir: ".",
+	}
+
+	if r.Method == http.MethodPost {
+		err := g.completeSetup(r)
+		if err == nil {
+			page.Done = true
+		} else {
+			page.Error = err.Error()
+			page.Queries = r.FormValue("queries")
+			page.StorageDir = r.FormValue("storage_dir")
+		}
+	}
+
+	tmpl, err := template.ParseFS(roulette.Assets(g.templatesDir), "setup.html")
+	if err != nil {
+		http.Error(w, "Failed to load template", http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, page)
+}
+
+// completeSetup validates the wizard form, writes the config file and
+// hands control back to runServe.
+func (g *setupGate) completeSetup(r *http.Request) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.pending {
+		return fmt.Errorf("setup has already been completed")
+	}
+	if subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(g.token)) != 1 {
+		return fmt.Errorf("the setup token is wrong, copy it from the server log")
+	}
+
+	c := roulette.DefaultConfig()
+	c.ShodanAPIKey = strings.TrimSpace(r.FormValue("api_key"))
+	c.ShodanQueries = nil
+	for _, query := range strings.Split(r.FormValue("queries"), "\n") {
+		if query = strings.TrimSpace(query); query != "" {
+			c.ShodanQueries = append(c.ShodanQueries, query)
+		}
+	}
+	if len(c.ShodanQueries) == 0 {
+		return fmt.Errorf("enter at least one Shodan query")
+	}
+	fetchNow := r.FormValue("fetch_now") != ""
+	if fetchNow && c.ShodanKey() == "" {
+		return fmt.Errorf("a Shodan API key is needed to fetch URLs")
+	}
+
+	dir := strings.TrimSpace(r.FormValue("storage_dir"))
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create storage directory: %v", err)
+	}
+	c.DataDir = dir
+	c.DBPath = "roulette.db"
+
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	// The file holds the API key, so keep it private
+	if err := os.WriteFile(g.configPath, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	// Start with an empty list so the next run isn't treated as a first run
+	if urlsFile := c.DataPath(c.URLsFile); !fileExists(urlsFile) {
+		if err := roulette.WriteURLsFile(urlsFile, nil); err != nil {
+			return err
+		}
+	}
+	slog.Info("Setup complete", "config", g.configPath)
+
+	g.pending = false
+	g.done <- setupResult{configPath: g.configPath, fetchNow: fetchNow}
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"simplehttproulette/roulette"
+)
+
+// handleReloadSignal reloads the config file every time the process gets SIGHUP.
+func handleReloadSignal(ctx context.Context, rl *roulette.Roulette) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				if err := rl.Reload(); err != nil {
+					slog.Error("Failed to reload configuration", "err", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// runSpin prints random sites, from a running instance's API or straight
+// from the local database.
+func runSpin(args []string) error {
+	fs := flag.NewFlagSet("spin", flag.ExitOnError)
+	var storage storageOptions
+	storage.register(fs)
+	server := fs.String("server", "", "base URL of a running instance to ask, such as http://localhost:8080 (default read the local database)")
+	key := fs.String("key", os.Getenv("ROULETTE_API_KEY"), "API key for --server, if it requires one (default $ROULETTE_API_KEY)")
+	count := fs.Int("count", 1, "how many sites to spin")
+	asJSON := fs.Bool("json", false, "print the sites as a JSON array")
+	open := fs.Bool("open", false, "open each site in the default browser")
+	fs.Parse(args)
+	if *count <= 0 {
+		return fmt.Errorf("-count must be positive")
+	}
+
+	spin := func() (exportedSite, error) { return spinRemote(*server, *key) }
+	if *server == "" {
+		rl, err := storage.open()
+		if err != nil {
+			return err
+		}
+		defer rl.Close()
+		ctx, stop := commandContext()
+		defer stop()
+		spin = func() (exportedSite, error) {
+			site, err := rl.Spin(ctx)
+			if err != nil {
+				return exportedSite{}, err
+			}
+			spun := exportedSite{URL: site.URL, Status: site.Status}
+			if !site.LastChecked.IsZero() {
+				spun.LastChecked = site.LastChecked.UTC().Format(time.RFC3339)
+			}
+			return spun, nil
+		}
+	}
+
+	sites := []exportedSite{}
+	for i := 0; i < *count; i++ {
+		site, err := spin()
+		if err != nil {
+			return fmt.Errorf("spin failed: %v", err)
+		}
+		sites = append(sites, site)
+		if !*asJSON {
+			fmt.Println(site.URL)
+		}
+		if *open {
+			if err := openBrowser(site.URL); err != nil {
+				return fmt.Errorf("failed to open %s: %v", site.URL, err)
+			}
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(sites)
+	}
+	return nil
+}
+
+// spinRemote asks the instance at server for a random site.
+func spinRemote(server, key string) (exportedSite, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(server, "/")+"/api/v1/random", nil)
+	if err != nil {
+		return exportedSite{}, fmt.Errorf("invalid -server: %v", err)
+	}
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return exportedSite{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return exportedSite{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var site exportedSite
+	if err := json.NewDecoder(resp.Body).Decode(&site); err != nil {
+		return exportedSite{}, fmt.Errorf("failed to decode the answer: %v", err)
+	}
+	return site, nil
+}
+
+// openBrowser opens url with the desktop's default handler.
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"simplehttproulette/roulette"
+)
+
+// sdNotify sends a state update to systemd when running under Type=notify.
+// It is a no-op when NOTIFY_SOCKET isn't set.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ means an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd notify socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("failed to notify systemd: %v", err)
+	}
+	return nil
+}
+
+// startWatchdog pings the systemd watchdog at half the configured interval
+// for as long as the health check passes. Skipping pings lets systemd
+// restart a wedged instance.
+func startWatchdog(ctx context.Context, rl *roulette.Roulette) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	// The watchdog is meant for us only if WATCHDOG_PID is unset or ours
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := rl.HealthCheck(ctx); err != nil {
+					slog.Warn("Health check failed, withholding watchdog ping", "err", err)
+					continue
+				}
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					slog.Error("Failed to notify systemd", "err", err)
+				}
+			}
+		}
+	}()
+}
+
+// listenFdsStart is the first file descriptor systemd passes sockets on.
+const listenFdsStart = 3
+
+// socketActivated reports whether systemd passed this process sockets.
+func socketActivated() bool {
+	return os.Getenv("LISTEN_PID") == strconv.Itoa(os.Getpid()) && os.Getenv("LISTEN_FDS") != ""
+}
+
+// activatedListener returns the inherited socket with the given
+// FileDescriptorName=, or the first one when name is empty.
+func activatedListener(name string) (net.Listener, error) {
+	if !socketActivated() {
+		return nil, fmt.Errorf("no sockets were passed in by systemd (LISTEN_FDS is not set for this process)")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		if name != "" && (i >= len(names) || names[i] != name) {
+			continue
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), "systemd-socket")
+		// FileListener dups the descriptor, so the original can go
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use socket from systemd: %v", err)
+		}
+		return ln, nil
+	}
+	return nil, fmt.Errorf("systemd passed no socket named %q", name)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsOptions describes how (and whether) the server terminates TLS itself.
+type tlsOptions struct {
+	CertFile      string // PEM certificate, used together with KeyFile
+	KeyFile       string // PEM private key
+	AutocertHosts string // Comma-separated hostnames to request Let's Encrypt certificates for
+	AutocertCache string // Directory where autocert stores issued certificates
+	RedirectAddr  string // Plain HTTP address that redirects to HTTPS (and answers ACME challenges)
+}
+
+// enabled reports whether any TLS mode was configured.
+func (o tlsOptions) enabled() bool {
+	return o.CertFile != "" || o.KeyFile != "" || o.AutocertHosts != ""
+}
+
+// build returns the TLS config for the HTTPS server and the handler for the
+// plain HTTP redirect listener. httpsPort is the port visitors get sent to.
+func (o tlsOptions) build(httpsPort string) (*tls.Config, http.Handler, error) {
+	redirect := redirectToHTTPS(httpsPort)
+
+	if o.AutocertHosts != "" {
+		if o.CertFile != "" || o.KeyFile != "" {
+			return nil, nil, fmt.Errorf("--tls-cert/--tls-key and --autocert-hosts are mutually exclusive")
+		}
+		var hosts []string
+		for _, host := range strings.Split(o.AutocertHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(o.AutocertCache),
+		}
+		// The manager answers HTTP-01 challenges and redirects everything else
+		return m.TLSConfig(), m.HTTPHandler(redirect), nil
+	}
+
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, nil, fmt.Errorf("both --tls-cert and --tls-key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, redirect, nil
+}
+
+// redirectToHTTPS sends plain HTTP visitors to the same path over HTTPS,
+// keeping the port in the URL unless it is the default 443.
+func redirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}